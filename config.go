@@ -0,0 +1,70 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// Config is the JSON configuration file.
+type Config struct {
+	Pairs []PairConfig `json:"pairs"`
+}
+
+// PairConfig is the configuration for one (primary, secondary) tracker pair.
+//
+// Primary and Secondary are matched against the Tracker IDs; an empty value matches any tracker.
+type PairConfig struct {
+	Primary   it.TrackerID `json:"primary,omitempty"`
+	Secondary it.TrackerID `json:"secondary,omitempty"`
+	States    StateMapping `json:"states"`
+	// Priorities is the priority mapping; without one the priorities are copied verbatim.
+	Priorities PriorityMapping `json:"priorities,omitempty"`
+	// Users are the explicit user pairs, overriding the matching by email.
+	Users []UserPair `json:"users,omitempty"`
+}
+
+// LoadConfig reads the configuration from the JSON file.
+func LoadConfig(fn string) (Config, error) {
+	var cfg Config
+	if fn == "" {
+		return cfg, nil
+	}
+	fh, err := os.Open(fn)
+	if err != nil {
+		return cfg, err
+	}
+	defer fh.Close()
+	dec := json.NewDecoder(fh)
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&cfg); err != nil {
+		return cfg, fmt.Errorf("parse %q: %w", fn, err)
+	}
+	for i := range cfg.Pairs {
+		if err = cfg.Pairs[i].States.init(); err != nil {
+			return cfg, fmt.Errorf("%q: pair %d: %w", fn, i, err)
+		}
+		if err = cfg.Pairs[i].Priorities.init(); err != nil {
+			return cfg, fmt.Errorf("%q: pair %d: %w", fn, i, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Pair returns the first configuration matching the (primary, secondary) pair.
+func (cfg Config) Pair(primary, secondary it.TrackerID) PairConfig {
+	for _, p := range cfg.Pairs {
+		if (p.Primary == "" || p.Primary == primary) &&
+			(p.Secondary == "" || p.Secondary == secondary) {
+			return p
+		}
+	}
+	return PairConfig{Primary: primary, Secondary: secondary}
+}
@@ -0,0 +1,664 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bugzilla is the Bugzilla tracker, using its REST API.
+package bugzilla
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("bugzilla", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://bugzilla.readthedocs.io/en/latest/api/core/v1/
+type Client struct {
+	id string
+	// URL is the base URL of the REST API.
+	URL        *url.URL
+	key        string
+	HTTPClient *http.Client
+	defaults   defaults
+	// secondaryField is the name of the custom field (cf_...) holding the secondary ID.
+	secondaryField string
+}
+
+// defaults are the values used for the new bugs, when the incoming issue lacks them.
+type defaults struct {
+	Product, Component, Version, Priority, Severity string
+}
+
+// PageSize is the number of bugs requested in one page.
+const PageSize = 100
+
+// New returns a new Bugzilla client.
+//
+// The API key is taken from the "key" query parameter, or the BUGZILLA_API_KEY
+// environment variable. The defaults for the created bugs are the
+// product, component, version (default "unspecified"), priority and severity query parameters,
+// the secondary ID is stored in the custom field named by "secondary_field".
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	key := q.Get("key")
+	if key == "" {
+		key = os.Getenv("BUGZILLA_API_KEY")
+	}
+	URL.Path = strings.TrimSuffix(URL.Path, "/") + "/rest/"
+	return Client{
+		id: baseURL, URL: URL, key: key, HTTPClient: http.DefaultClient,
+		defaults: defaults{
+			Product:   q.Get("product"),
+			Component: q.Get("component"),
+			Version:   firstNonEmpty(q.Get("version"), "unspecified"),
+			Priority:  q.Get("priority"),
+			Severity:  q.Get("severity"),
+		},
+		secondaryField: q.Get("secondary_field"),
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+func bugPath(ID it.IssueID) string {
+	return "bug/" + url.PathEscape(string(ID))
+}
+
+// GetIssue returns the data for the issueID
+//
+// The description is the first comment of the bug.
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	var resp struct {
+		Bugs []bug `json:"bugs"`
+	}
+	if err := c.do(ctx, "GET", bugPath(ID), nil, &resp); err != nil {
+		return it.Issue{}, err
+	}
+	if len(resp.Bugs) == 0 {
+		return it.Issue{}, fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+	}
+	issue := c.readBug(resp.Bugs[0])
+	comments, err := c.listComments(ctx, ID)
+	if err != nil {
+		return issue, err
+	}
+	if len(comments) != 0 && comments[0].Count == 0 {
+		issue.Description = comments[0].Text
+	}
+	return issue, nil
+}
+
+// ListIssues lists all the bugs (of the default product, if set) created/changed since "since".
+//
+// The bugs are returned without their description.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	q := url.Values{"order": {"changeddate"}, "limit": {strconv.Itoa(PageSize)}}
+	if c.defaults.Product != "" {
+		q.Set("product", c.defaults.Product)
+	}
+	if !since.IsZero() {
+		q.Set("last_change_time", since.UTC().Format(time.RFC3339))
+	}
+	var issues []it.Issue
+	for offset := 0; ; offset += PageSize {
+		q.Set("offset", strconv.Itoa(offset))
+		var resp struct {
+			Bugs []bug `json:"bugs"`
+		}
+		if err := c.do(ctx, "GET", "bug?"+q.Encode(), nil, &resp); err != nil {
+			return issues, err
+		}
+		for _, b := range resp.Bugs {
+			issues = append(issues, c.readBug(b))
+		}
+		if len(resp.Bugs) < PageSize {
+			return issues, nil
+		}
+	}
+}
+
+// CreateIssue creates the bug, returning the ID.
+//
+// The bug is created in the default product and component.
+// The reporter cannot be set, so it is written into the description.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	var missing []string
+	if c.defaults.Product == "" {
+		missing = append(missing, "product")
+	}
+	if c.defaults.Component == "" {
+		missing = append(missing, "component")
+	}
+	if issue.Summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	description := issue.Description
+	if author != (it.User{}) {
+		description = it.Attribute(author, issue.CreatedAt, description)
+	}
+	req := map[string]interface{}{
+		"product":     c.defaults.Product,
+		"component":   c.defaults.Component,
+		"version":     firstNonEmpty(issue.Version, c.defaults.Version),
+		"summary":     issue.Summary,
+		"description": description,
+	}
+	if p := firstNonEmpty(issue.Priority, c.defaults.Priority); p != "" {
+		req["priority"] = p
+	}
+	if s := firstNonEmpty(issue.Severity, c.defaults.Severity); s != "" {
+		req["severity"] = s
+	}
+	if issue.Assignee.ID != "" {
+		req["assigned_to"] = string(issue.Assignee.ID)
+	}
+	if len(issue.Labels) != 0 {
+		req["keywords"] = issue.Labels
+	}
+	if !issue.DueDate.IsZero() {
+		req["deadline"] = issue.DueDate.Format(dateFormat)
+	}
+	// A bug cannot be filed as closed, that is set after the creation.
+	status, resolution := splitState(issue.State)
+	if status != "" && resolution == "" {
+		req["status"] = status
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(ctx, "POST", "bug", req, &resp); err != nil {
+		return "", err
+	}
+	ID := it.IssueID(strconv.Itoa(resp.ID))
+	if resolution != "" {
+		if err := c.UpdateIssueState(ctx, ID, issue.State); err != nil {
+			return ID, err
+		}
+	}
+	return ID, nil
+}
+
+// UpdateIssueState updates the bug's status and resolution, given as "STATUS/RESOLUTION".
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the bug selected by the update's mask.
+//
+// The labels are the keywords, which must be defined in Bugzilla.
+// An assignee without ID (not a mapped Bugzilla user) is left as is,
+// an empty assignee resets it to the component's default.
+// The description is the first comment, which cannot be changed.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	req := make(map[string]interface{})
+	if upd.Fields.Has(it.FieldSummary) {
+		req["summary"] = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		req["priority"] = upd.Priority
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			req["assigned_to"] = string(upd.Assignee.ID)
+		} else if upd.Assignee == (it.User{}) {
+			req["reset_assigned_to"] = true
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		labels := upd.Labels
+		if labels == nil {
+			labels = []string{}
+		}
+		req["keywords"] = map[string][]string{"set": labels}
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		status, resolution := splitState(upd.State)
+		req["status"] = status
+		if resolution != "" {
+			req["resolution"] = resolution
+		}
+	}
+	if len(req) == 0 {
+		return nil
+	}
+	if err := c.do(ctx, "PUT", bugPath(ID), req, nil); err != nil {
+		return fmt.Errorf("update %q: %w", ID, err)
+	}
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the bug.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	if err := c.do(ctx, "PUT", bugPath(primary), map[string]string{c.secondaryField: string(secondary)}, nil); err != nil {
+		return fmt.Errorf("set %s of %q: %w", c.secondaryField, primary, err)
+	}
+	return nil
+}
+
+// ListStates lists the states a bug can be in:
+// the open statuses, and the closed ones with each resolution.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	statuses, err := c.fieldValues(ctx, "bug_status")
+	if err != nil {
+		return nil, err
+	}
+	resolutions, err := c.fieldValues(ctx, "resolution")
+	if err != nil {
+		return nil, err
+	}
+	var states []it.State
+	for _, s := range statuses {
+		if s.Name == "" {
+			continue
+		}
+		if s.IsOpen {
+			states = append(states, it.State(s.Name))
+			continue
+		}
+		for _, r := range resolutions {
+			if r.Name != "" {
+				states = append(states, joinState(s.Name, r.Name))
+			}
+		}
+	}
+	return states, nil
+}
+
+type fieldValue struct {
+	Name   string `json:"name"`
+	IsOpen bool   `json:"is_open"`
+}
+
+func (c Client) fieldValues(ctx context.Context, field string) ([]fieldValue, error) {
+	var resp struct {
+		Fields []struct {
+			Values []fieldValue `json:"values"`
+		} `json:"fields"`
+	}
+	if err := c.do(ctx, "GET", "field/bug/"+field, nil, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Fields) == 0 {
+		return nil, fmt.Errorf("field %q: %w", field, it.ErrNotFound)
+	}
+	return resp.Fields[0].Values, nil
+}
+
+// FindUser returns the user with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var resp struct {
+		Users []userDetail `json:"users"`
+	}
+	if err := c.do(ctx, "GET", "user?"+url.Values{"match": {email}}.Encode(), nil, &resp); err != nil {
+		return it.User{}, err
+	}
+	for _, u := range resp.Users {
+		if strings.EqualFold(u.Email, email) || strings.EqualFold(u.Name, email) {
+			v := readUser(u.Name, &u)
+			v.Email = email
+			return v, nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a comment to the bug.
+//
+// The author cannot be set, so it is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := c.do(ctx, "POST", bugPath(ID)+"/comment", map[string]string{"comment": comment.AttributedBody()}, &resp); err != nil {
+		return "", err
+	}
+	return it.CommentID(strconv.Itoa(resp.ID)), nil
+}
+
+// ListComments list the comments of the bug, without the first one, which is the description.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	bcs, err := c.listComments(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, 0, len(bcs))
+	for _, bc := range bcs {
+		if bc.Count == 0 {
+			continue
+		}
+		comments = append(comments, it.Comment{
+			ID:        it.CommentID(strconv.Itoa(bc.ID)),
+			Author:    it.User{ID: it.UserID(bc.Creator), Email: emailOf(bc.Creator)},
+			CreatedAt: bc.CreationTime,
+			Body:      bc.Text,
+		})
+	}
+	return comments, nil
+}
+
+func (c Client) listComments(ctx context.Context, ID it.IssueID) ([]comment, error) {
+	var resp struct {
+		Bugs map[string]struct {
+			Comments []comment `json:"comments"`
+		} `json:"bugs"`
+	}
+	if err := c.do(ctx, "GET", bugPath(ID)+"/comment", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Bugs[string(ID)].Comments, nil
+}
+
+// AddAttachment adds the attachment to the bug, base64-encoded.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	id, err := strconv.Atoi(string(ID))
+	if err != nil {
+		return "", fmt.Errorf("bug ID %q: %w", ID, err)
+	}
+	contentType := a.MIMEType
+	if contentType == "" {
+		contentType = http.DetectContentType(b)
+	}
+	var resp struct {
+		IDs []int `json:"ids"`
+	}
+	if err = c.do(ctx, "POST", bugPath(ID)+"/attachment", map[string]interface{}{
+		"ids":          []int{id},
+		"data":         base64.StdEncoding.EncodeToString(b),
+		"file_name":    a.Name,
+		"summary":      a.Name,
+		"content_type": contentType,
+	}, &resp); err != nil {
+		return "", err
+	}
+	if len(resp.IDs) == 0 {
+		return "", fmt.Errorf("uploaded %q to %q, but got no ID: %w", a.Name, ID, it.ErrNotFound)
+	}
+	return it.AttachmentID(strconv.Itoa(resp.IDs[0])), nil
+}
+
+// ListAttachments lists the (not obsolete) attachments of the bug.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	var resp struct {
+		Bugs map[string][]attachment `json:"bugs"`
+	}
+	if err := c.do(ctx, "GET", bugPath(ID)+"/attachment?exclude_fields=data", nil, &resp); err != nil {
+		return nil, err
+	}
+	bas := resp.Bugs[string(ID)]
+	as := make([]it.Attachment, 0, len(bas))
+	for _, ba := range bas {
+		if ba.IsObsolete {
+			continue
+		}
+		aID := strconv.Itoa(ba.ID)
+		as = append(as, it.Attachment{
+			ID:        it.AttachmentID(aID),
+			Name:      ba.FileName,
+			MIMEType:  ba.ContentType,
+			Author:    it.User{ID: it.UserID(ba.Creator), Email: emailOf(ba.Creator)},
+			CreatedAt: ba.CreationTime,
+			GetBody: func() (io.ReadCloser, error) {
+				var resp struct {
+					Attachments map[string]attachment `json:"attachments"`
+				}
+				if err := c.do(ctx, "GET", "bug/attachment/"+aID+"?include_fields=data", nil, &resp); err != nil {
+					return nil, err
+				}
+				a, ok := resp.Attachments[aID]
+				if !ok {
+					return nil, fmt.Errorf("attachment %q: %w", aID, it.ErrNotFound)
+				}
+				b, err := base64.StdEncoding.DecodeString(a.Data)
+				if err != nil {
+					return nil, err
+				}
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		})
+	}
+	return as, nil
+}
+
+func (c Client) readBug(b bug) it.Issue {
+	issue := it.Issue{
+		ID:            it.IssueID(strconv.Itoa(b.ID)),
+		Summary:       b.Summary,
+		Project:       b.Product,
+		Category:      b.Component,
+		Priority:      b.Priority,
+		Severity:      b.Severity,
+		Author:        readUser(b.Creator, b.CreatorDetail),
+		Reporter:      readUser(b.Creator, b.CreatorDetail),
+		Assignee:      readUser(b.AssignedTo, b.AssignedToDetail),
+		Labels:        b.Keywords,
+		CreatedAt:     b.CreationTime,
+		UpdatedAt:     b.LastChangeTime,
+		State:         joinState(b.Status, b.Resolution),
+		Version:       b.Version,
+		TargetVersion: b.TargetMilestone,
+	}
+	if b.Deadline != "" {
+		issue.DueDate, _ = time.Parse(dateFormat, b.Deadline)
+	}
+	for k, raw := range b.Custom {
+		if !strings.HasPrefix(k, "cf_") {
+			continue
+		}
+		var v string
+		if err := json.Unmarshal(raw, &v); err != nil || v == "" || v == "---" {
+			continue
+		}
+		if c.secondaryField != "" && k == c.secondaryField {
+			issue.SecondaryID = it.IssueID(v)
+		}
+		if issue.Custom == nil {
+			issue.Custom = make(map[string]string)
+		}
+		issue.Custom[k] = v
+	}
+	return issue
+}
+
+// joinState returns the state of the status and the resolution, as "RESOLVED/FIXED".
+func joinState(status, resolution string) it.State {
+	if resolution == "" {
+		return it.State(status)
+	}
+	return it.State(status + "/" + resolution)
+}
+
+func splitState(s it.State) (status, resolution string) {
+	status = string(s)
+	if i := strings.IndexByte(status, '/'); i >= 0 {
+		return status[:i], status[i+1:]
+	}
+	return status, ""
+}
+
+// do calls the API, encoding body and decoding the response into result, if not nil.
+func (c Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	URL, err := c.URL.Parse(path)
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, URL.String(), r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.key != "" {
+		req.Header.Set("X-BUGZILLA-API-KEY", c.key)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s %s: %s: %s", method, URL.Path, resp.Status, b)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", it.ErrNotFound, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s %s: decode: %w", method, URL.Path, err)
+	}
+	return nil
+}
+
+const dateFormat = "2006-01-02"
+
+type userDetail struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Email    string `json:"email"`
+}
+
+// readUser returns the it.User, identified by the login name.
+func readUser(login string, d *userDetail) it.User {
+	if login == "" {
+		return it.User{}
+	}
+	u := it.User{ID: it.UserID(login), Email: emailOf(login)}
+	if d != nil {
+		u.RealName = d.RealName
+		if d.Email != "" {
+			u.Email = d.Email
+		}
+	}
+	return u
+}
+
+// emailOf returns the login name if it is an email address, as usual in Bugzilla.
+func emailOf(login string) string {
+	if strings.Contains(login, "@") {
+		return login
+	}
+	return ""
+}
+
+type comment struct {
+	ID           int       `json:"id"`
+	Text         string    `json:"text"`
+	Creator      string    `json:"creator"`
+	CreationTime time.Time `json:"creation_time"`
+	// Count is the number of the comment on the bug, 0 is the description.
+	Count int `json:"count"`
+}
+
+type attachment struct {
+	ID           int       `json:"id"`
+	FileName     string    `json:"file_name"`
+	ContentType  string    `json:"content_type"`
+	Creator      string    `json:"creator"`
+	CreationTime time.Time `json:"creation_time"`
+	IsObsolete   bool      `json:"is_obsolete"`
+	Data         string    `json:"data,omitempty"`
+}
+
+// bug is a bug as returned by the API.
+type bug struct {
+	ID               int         `json:"id"`
+	Summary          string      `json:"summary"`
+	Status           string      `json:"status"`
+	Resolution       string      `json:"resolution"`
+	Product          string      `json:"product"`
+	Component        string      `json:"component"`
+	Version          string      `json:"version"`
+	TargetMilestone  string      `json:"target_milestone"`
+	Priority         string      `json:"priority"`
+	Severity         string      `json:"severity"`
+	Creator          string      `json:"creator"`
+	CreatorDetail    *userDetail `json:"creator_detail,omitempty"`
+	AssignedTo       string      `json:"assigned_to"`
+	AssignedToDetail *userDetail `json:"assigned_to_detail,omitempty"`
+	Keywords         []string    `json:"keywords"`
+	Deadline         string      `json:"deadline"`
+	CreationTime     time.Time   `json:"creation_time"`
+	LastChangeTime   time.Time   `json:"last_change_time"`
+	// Custom holds all the fields, for the custom (cf_...) ones.
+	Custom map[string]json.RawMessage `json:"-"`
+}
+
+func (b *bug) UnmarshalJSON(p []byte) error {
+	type plain bug
+	if err := json.Unmarshal(p, (*plain)(b)); err != nil {
+		return err
+	}
+	return json.Unmarshal(p, &b.Custom)
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
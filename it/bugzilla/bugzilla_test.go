@@ -0,0 +1,102 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package bugzilla
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/bugzilla/bugzillatest"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+const testParams = "?key=secret&product=TestProduct&component=General&secondary_field=cf_secondary"
+
+func newTestClient(t *testing.T) (Client, *bugzillatest.Server) {
+	t.Helper()
+	srv := bugzillatest.NewServer("TestProduct", []string{"General"}, "secret")
+	srv.CustomFields = []string{"cf_other", "cf_secondary"}
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.AddUser(bugzillatest.User{ID: 2, Name: "jdoe@example.com", RealName: "John Doe", Email: "jdoe@example.com"})
+		srv.AddUser(bugzillatest.User{ID: 3, Name: "jdoe@example.com.au", RealName: "Jane Doe", Email: "jdoe@example.com.au"})
+		return c
+	}, ittest.WithPageSize(PageSize),
+		ittest.WithUser(it.User{ID: "jdoe@example.com", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	BUGZILLA_TEST_URL='https://bugzilla.example.com/?key=...&product=TestProduct&component=General&secondary_field=cf_secondary' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("BUGZILLA_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestStates(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.Statuses = srv.Statuses[1:]
+	srv.Resolutions = []string{"FIXED", "WONTFIX"}
+
+	states, err := c.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []it.State{
+		"CONFIRMED", "IN_PROGRESS",
+		"RESOLVED/FIXED", "RESOLVED/WONTFIX", "VERIFIED/FIXED", "VERIFIED/WONTFIX",
+	}; !reflect.DeepEqual(states, want) {
+		t.Errorf("ListStates: got %q, wanted %q", states, want)
+	}
+
+	// A bug cannot be created as closed, so it is resolved after the creation.
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "resolved", Description: "done", State: "RESOLVED/FIXED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(state it.State) {
+		t.Helper()
+		issue, err := c.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.State != state || issue.Description != "done" {
+			t.Errorf("got state %q, description %q; wanted %q and done", issue.State, issue.Description, state)
+		}
+	}
+	check("RESOLVED/FIXED")
+	// The resolution is kept when only the status changes,
+	if err = c.UpdateIssueState(ctx, ID, "VERIFIED"); err != nil {
+		t.Fatal(err)
+	}
+	check("VERIFIED/FIXED")
+	// and cleared on reopen.
+	if err = c.UpdateIssueState(ctx, ID, "CONFIRMED"); err != nil {
+		t.Fatal(err)
+	}
+	check("CONFIRMED")
+}
@@ -0,0 +1,678 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package bugzillatest provides an in-process Bugzilla REST API (5.x) server, for testing.
+//
+// It implements the endpoints used by the bugzilla package under rest/:
+// bug search (paginated by offset and limit), get, create and update,
+// comments, attachments, the bug_status and resolution field values and user match.
+//
+// The closed statuses require a resolution, the open ones clear it,
+// and the keywords must be defined, as in Bugzilla.
+// The X-BUGZILLA-API-KEY header must hold the Key, if it is not empty.
+package bugzillatest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a Bugzilla server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Key is the accepted API key.
+	Key string
+	// Product and Components are the product and its components the bugs can be filed in.
+	Product    string
+	Components []string
+	// Statuses are the bug statuses, the first is the status of the new bugs.
+	Statuses []Status
+	// Resolutions are the resolutions of the closed bugs.
+	Resolutions []string
+	// Keywords are the defined keywords.
+	Keywords []string
+	// CustomFields are the names of the free text custom fields (cf_...).
+	CustomFields []string
+	// Me is the owner of the key, the creator of the bugs, comments and attachments.
+	Me User
+
+	mu          sync.Mutex
+	users       []User
+	bugs        []*bug
+	comments    []*comment
+	attachments []*attachment
+}
+
+// Status is a bug status.
+type Status struct {
+	Name   string `json:"name"`
+	IsOpen bool   `json:"is_open"`
+}
+
+// User is a Bugzilla account, the login name is usually the email address.
+type User struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	RealName string `json:"real_name"`
+	Email    string `json:"email"`
+}
+
+type comment struct {
+	ID           int       `json:"id"`
+	BugID        int       `json:"bug_id"`
+	Text         string    `json:"text"`
+	Creator      string    `json:"creator"`
+	CreationTime time.Time `json:"creation_time"`
+	Count        int       `json:"count"`
+	IsPrivate    bool      `json:"is_private"`
+}
+
+type attachment struct {
+	ID           int       `json:"id"`
+	BugID        int       `json:"bug_id"`
+	FileName     string    `json:"file_name"`
+	Summary      string    `json:"summary"`
+	ContentType  string    `json:"content_type"`
+	Size         int       `json:"size"`
+	Creator      string    `json:"creator"`
+	CreationTime time.Time `json:"creation_time"`
+	IsObsolete   bool      `json:"is_obsolete"`
+	data         []byte
+}
+
+type bug struct {
+	ID             int
+	Summary        string
+	Status         string
+	Resolution     string
+	DupeOf         int
+	Component      string
+	Version        string
+	Priority       string
+	Severity       string
+	Creator        string
+	AssignedTo     string
+	Keywords       []string
+	Deadline       string
+	Custom         map[string]string
+	CreationTime   time.Time
+	LastChangeTime time.Time
+	comments       int
+}
+
+// DefaultStatuses and DefaultResolutions are the workflow of Bugzilla 5.
+var (
+	DefaultStatuses = []Status{
+		{"UNCONFIRMED", true}, {"CONFIRMED", true}, {"IN_PROGRESS", true},
+		{"RESOLVED", false}, {"VERIFIED", false},
+	}
+	DefaultResolutions = []string{"FIXED", "INVALID", "WONTFIX", "DUPLICATE", "WORKSFORME"}
+)
+
+// NewServer starts and returns a new server with the product and its components, accepting the key.
+// The caller should call Close when finished, to shut it down.
+func NewServer(product string, components []string, key string) *Server {
+	s := &Server{
+		Key: key, Product: product, Components: components,
+		Statuses:    append([]Status(nil), DefaultStatuses...),
+		Resolutions: append([]string(nil), DefaultResolutions...),
+		Me:          User{ID: 1, Name: "admin@example.com", RealName: "Admin", Email: "admin@example.com"},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Status  int    `json:"-"`
+	Error   bool   `json:"error"`
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func errorf(status, code int, format string, args ...interface{}) *apiError {
+	return &apiError{Status: status, Error: true, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func invalid(format string, args ...interface{}) *apiError {
+	return errorf(http.StatusBadRequest, 32000, format, args...)
+}
+
+// now returns the current time with the seconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Key != "" && r.Header.Get("X-BUGZILLA-API-KEY") != s.Key {
+		writeJSON(w, 0, errorf(http.StatusUnauthorized, 306, "The API key you specified is invalid."))
+		return
+	}
+	p := strings.Trim(r.URL.Path, "/")
+	if !strings.HasPrefix(p, "rest/") {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "rest/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var result interface{}
+	err := errorf(http.StatusNotFound, 32614, "A REST API resource was not found for '%s %s'.", r.Method, r.URL.Path)
+	switch {
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "field" && parts[1] == "bug":
+		result, err = s.field(parts[2])
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "user":
+		result, err = s.matchUsers(r.URL.Query().Get("match")), nil
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "bug":
+		result, err = s.search(r)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "bug":
+		result, err = s.create(r)
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "bug" && parts[1] == "attachment":
+		result, err = s.getAttachment(parts[2], r.URL.Query().Get("include_fields"))
+	case len(parts) >= 2 && parts[0] == "bug":
+		b := s.bug(parts[1])
+		if b == nil {
+			err = errorf(http.StatusNotFound, 101, "Bug #%s does not exist.", parts[1])
+			break
+		}
+		switch endpoint := strings.Join(parts[2:], "/"); {
+		case r.Method == "GET" && endpoint == "":
+			result, err = map[string]interface{}{"bugs": []interface{}{s.render(b)}, "faults": []string{}}, nil
+		case r.Method == "PUT" && endpoint == "":
+			result, err = s.update(b, r)
+		case r.Method == "GET" && endpoint == "comment":
+			result, err = s.listComments(b), nil
+		case r.Method == "POST" && endpoint == "comment":
+			result, err = s.addComment(b, r)
+		case r.Method == "GET" && endpoint == "attachment":
+			result, err = s.listAttachments(b, r.URL.Query().Get("exclude_fields")), nil
+		case r.Method == "POST" && endpoint == "attachment":
+			result, err = s.addAttachment(b, r)
+		}
+	}
+	if err != nil {
+		writeJSON(w, err.Status, err)
+		return
+	}
+	writeJSON(w, 0, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// bug returns the bug by ID, or nil. s.mu must be held.
+func (s *Server) bug(ID string) *bug {
+	id, err := strconv.Atoi(ID)
+	if err != nil || id <= 0 || id > len(s.bugs) {
+		return nil
+	}
+	return s.bugs[id-1]
+}
+
+func (s *Server) user(login string) *User {
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.Name == login {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) status(name string) *Status {
+	for _, st := range s.Statuses {
+		if st.Name == name {
+			return &st
+		}
+	}
+	return nil
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) render(b *bug) map[string]interface{} {
+	m := map[string]interface{}{
+		"id":               b.ID,
+		"summary":          b.Summary,
+		"status":           b.Status,
+		"resolution":       b.Resolution,
+		"product":          s.Product,
+		"component":        b.Component,
+		"version":          b.Version,
+		"target_milestone": "---",
+		"priority":         b.Priority,
+		"severity":         b.Severity,
+		"creator":          b.Creator,
+		"creator_detail":   s.user(b.Creator),
+		"assigned_to":      b.AssignedTo,
+		"keywords":         append([]string{}, b.Keywords...),
+		"deadline":         nil,
+		"creation_time":    b.CreationTime,
+		"last_change_time": b.LastChangeTime,
+		"is_open":          s.status(b.Status).IsOpen,
+	}
+	if u := s.user(b.AssignedTo); u != nil {
+		m["assigned_to_detail"] = u
+	}
+	if b.DupeOf != 0 {
+		m["dupe_of"] = b.DupeOf
+	}
+	if b.Deadline != "" {
+		m["deadline"] = b.Deadline
+	}
+	for _, cf := range s.CustomFields {
+		m[cf] = b.Custom[cf]
+	}
+	return m
+}
+
+func (s *Server) field(name string) (interface{}, *apiError) {
+	var values []interface{}
+	switch name {
+	case "bug_status":
+		// The empty status is the initial state of the workflow.
+		values = append(values, Status{})
+		for _, st := range s.Statuses {
+			values = append(values, st)
+		}
+	case "resolution":
+		// The empty resolution is the one of the open bugs.
+		values = append(values, map[string]string{"name": ""})
+		for _, r := range s.Resolutions {
+			values = append(values, map[string]string{"name": r})
+		}
+	default:
+		return nil, errorf(http.StatusBadRequest, 51, "There is no field named '%s'.", name)
+	}
+	return map[string]interface{}{"fields": []interface{}{map[string]interface{}{"name": name, "values": values}}}, nil
+}
+
+func (s *Server) search(r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("last_change_time"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, invalid("last_change_time: %v", err)
+		}
+	}
+	bugs := make([]*bug, 0, len(s.bugs))
+	for _, b := range s.bugs {
+		if (q.Get("product") == "" || q.Get("product") == s.Product) && !b.LastChangeTime.Before(since) {
+			bugs = append(bugs, b)
+		}
+	}
+	if q.Get("order") == "changeddate" {
+		sort.SliceStable(bugs, func(i, j int) bool { return bugs[i].LastChangeTime.Before(bugs[j].LastChangeTime) })
+	}
+	offset, _ := strconv.Atoi(q.Get("offset"))
+	if offset > len(bugs) {
+		offset = len(bugs)
+	}
+	to := len(bugs)
+	if limit, _ := strconv.Atoi(q.Get("limit")); limit > 0 && offset+limit < to {
+		to = offset + limit
+	}
+	rendered := make([]interface{}, 0, to-offset)
+	for _, b := range bugs[offset:to] {
+		rendered = append(rendered, s.render(b))
+	}
+	return map[string]interface{}{"bugs": rendered}, nil
+}
+
+// setState sets the status and resolution, checking that only the closed bugs have a resolution.
+func (s *Server) setState(b *bug, status, resolution string, dupeOf int) *apiError {
+	st := s.status(status)
+	if st == nil {
+		return invalid("There is no status named '%s'.", status)
+	}
+	if st.IsOpen {
+		if resolution != "" {
+			return invalid("You cannot set a resolution for open bugs.")
+		}
+		b.Status, b.Resolution, b.DupeOf = status, "", 0
+		return nil
+	}
+	if resolution == "" {
+		resolution = b.Resolution
+	}
+	switch {
+	case resolution == "":
+		return invalid("A valid resolution is required to mark bugs as %s.", status)
+	case !contains(s.Resolutions, resolution):
+		return invalid("There is no resolution named '%s'.", resolution)
+	case resolution == "DUPLICATE" && dupeOf == 0 && b.DupeOf == 0:
+		return invalid("You must specify a bug ID of which this bug is a duplicate.")
+	}
+	b.Status, b.Resolution = status, resolution
+	if dupeOf != 0 {
+		b.DupeOf = dupeOf
+	}
+	return nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Product     string   `json:"product"`
+		Component   string   `json:"component"`
+		Version     string   `json:"version"`
+		Summary     string   `json:"summary"`
+		Description string   `json:"description"`
+		Priority    string   `json:"priority"`
+		Severity    string   `json:"severity"`
+		AssignedTo  string   `json:"assigned_to"`
+		Keywords    []string `json:"keywords"`
+		Deadline    string   `json:"deadline"`
+		Status      string   `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, invalid("%v", err)
+	}
+	switch {
+	case req.Product != s.Product:
+		return nil, errorf(http.StatusBadRequest, 106, "Product '%s' does not exist or you don't have access to it.", req.Product)
+	case !contains(s.Components, req.Component):
+		return nil, errorf(http.StatusBadRequest, 51, "There is no component named '%s'.", req.Component)
+	case req.Version == "":
+		return nil, errorf(http.StatusBadRequest, 115, "You must select/enter a version.")
+	case req.Summary == "":
+		return nil, errorf(http.StatusBadRequest, 116, "You must enter a summary for this bug.")
+	}
+	t := now()
+	b := &bug{
+		ID: len(s.bugs) + 1, Summary: req.Summary, Component: req.Component, Version: req.Version,
+		Priority: firstNonEmpty(req.Priority, "---"), Severity: firstNonEmpty(req.Severity, "normal"),
+		Creator: s.Me.Name, AssignedTo: firstNonEmpty(req.AssignedTo, "nobody@example.com"),
+		Deadline: req.Deadline, Custom: make(map[string]string),
+		CreationTime: t, LastChangeTime: t,
+	}
+	status := firstNonEmpty(req.Status, s.Statuses[0].Name)
+	if st := s.status(status); st == nil || !st.IsOpen {
+		return nil, invalid("A bug cannot be created as '%s'.", status)
+	}
+	b.Status = status
+	for _, k := range req.Keywords {
+		if !contains(s.Keywords, k) {
+			return nil, errorf(http.StatusBadRequest, 51, "There is no keyword named '%s'.", k)
+		}
+	}
+	b.Keywords = req.Keywords
+	s.bugs = append(s.bugs, b)
+	s.newComment(b, req.Description, t)
+	return map[string]int{"id": b.ID}, nil
+}
+
+func (s *Server) update(b *bug, r *http.Request) (interface{}, *apiError) {
+	var fields map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&fields); err != nil {
+		return nil, invalid("%v", err)
+	}
+	upd := *b
+	upd.Custom = make(map[string]string, len(b.Custom))
+	for k, v := range b.Custom {
+		upd.Custom[k] = v
+	}
+	str := func(k string) (string, *apiError) {
+		var v string
+		if err := json.Unmarshal(fields[k], &v); err != nil {
+			return "", invalid("%s: %v", k, err)
+		}
+		return v, nil
+	}
+	var status, resolution string
+	var dupeOf int
+	for k, raw := range fields {
+		var err *apiError
+		switch k {
+		case "ids", "id":
+		case "summary":
+			if upd.Summary, err = str(k); err == nil && upd.Summary == "" {
+				err = errorf(http.StatusBadRequest, 116, "You must enter a summary for this bug.")
+			}
+		case "priority":
+			upd.Priority, err = str(k)
+		case "severity":
+			upd.Severity, err = str(k)
+		case "assigned_to":
+			if upd.AssignedTo, err = str(k); err == nil && s.user(upd.AssignedTo) == nil {
+				err = errorf(http.StatusBadRequest, 51, "There is no user named '%s'.", upd.AssignedTo)
+			}
+		case "reset_assigned_to":
+			upd.AssignedTo = "nobody@example.com"
+		case "status":
+			status, err = str(k)
+		case "resolution":
+			resolution, err = str(k)
+		case "dupe_of":
+			if e := json.Unmarshal(raw, &dupeOf); e != nil {
+				err = invalid("dupe_of: %v", e)
+			}
+		case "keywords":
+			var kw struct {
+				Set    []string `json:"set"`
+				Add    []string `json:"add"`
+				Remove []string `json:"remove"`
+			}
+			if e := json.Unmarshal(raw, &kw); e != nil {
+				err = invalid("keywords: %v", e)
+				break
+			}
+			if kw.Set != nil {
+				upd.Keywords = nil
+			}
+			for _, k := range append(kw.Set, kw.Add...) {
+				if !contains(s.Keywords, k) {
+					err = errorf(http.StatusBadRequest, 51, "There is no keyword named '%s'.", k)
+					break
+				}
+				if !contains(upd.Keywords, k) {
+					upd.Keywords = append(upd.Keywords, k)
+				}
+			}
+			for _, k := range kw.Remove {
+				for i, x := range upd.Keywords {
+					if x == k {
+						upd.Keywords = append(upd.Keywords[:i:i], upd.Keywords[i+1:]...)
+						break
+					}
+				}
+			}
+		default:
+			if !contains(s.CustomFields, k) {
+				err = invalid("There is no field named '%s'.", k)
+				break
+			}
+			upd.Custom[k], err = str(k)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if status != "" || resolution != "" {
+		if err := s.setState(&upd, firstNonEmpty(status, upd.Status), resolution, dupeOf); err != nil {
+			return nil, err
+		}
+	}
+	upd.LastChangeTime = now()
+	*b = upd
+	return map[string]interface{}{"bugs": []interface{}{map[string]interface{}{
+		"id": b.ID, "last_change_time": b.LastChangeTime, "changes": map[string]interface{}{},
+	}}}, nil
+}
+
+// newComment adds a comment to the bug. s.mu must be held.
+func (s *Server) newComment(b *bug, text string, t time.Time) *comment {
+	c := &comment{
+		ID: len(s.comments) + 1, BugID: b.ID, Text: text,
+		Creator: s.Me.Name, CreationTime: t, Count: b.comments,
+	}
+	b.comments++
+	s.comments = append(s.comments, c)
+	return c
+}
+
+func (s *Server) listComments(b *bug) interface{} {
+	comments := []comment{}
+	for _, c := range s.comments {
+		if c.BugID == b.ID {
+			comments = append(comments, *c)
+		}
+	}
+	return map[string]interface{}{
+		"bugs":     map[string]interface{}{strconv.Itoa(b.ID): map[string]interface{}{"comments": comments}},
+		"comments": map[string]interface{}{},
+	}
+}
+
+func (s *Server) addComment(b *bug, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Comment string `json:"comment"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, invalid("%v", err)
+	}
+	if strings.TrimSpace(req.Comment) == "" {
+		return nil, errorf(http.StatusBadRequest, 54, "You must specify a comment.")
+	}
+	t := now()
+	c := s.newComment(b, req.Comment, t)
+	b.LastChangeTime = t
+	return map[string]int{"id": c.ID}, nil
+}
+
+func (s *Server) renderAttachment(a *attachment, withData bool) map[string]interface{} {
+	m := map[string]interface{}{
+		"id": a.ID, "bug_id": a.BugID, "file_name": a.FileName, "summary": a.Summary,
+		"content_type": a.ContentType, "size": a.Size, "creator": a.Creator,
+		"creation_time": a.CreationTime, "last_change_time": a.CreationTime,
+		"is_obsolete": a.IsObsolete, "is_private": false, "is_patch": false,
+	}
+	if withData {
+		m["data"] = base64.StdEncoding.EncodeToString(a.data)
+	}
+	return m
+}
+
+func (s *Server) listAttachments(b *bug, exclude string) interface{} {
+	attachments := []interface{}{}
+	for _, a := range s.attachments {
+		if a.BugID == b.ID {
+			attachments = append(attachments, s.renderAttachment(a, exclude != "data"))
+		}
+	}
+	return map[string]interface{}{
+		"bugs":        map[string]interface{}{strconv.Itoa(b.ID): attachments},
+		"attachments": map[string]interface{}{},
+	}
+}
+
+func (s *Server) getAttachment(ID, include string) (interface{}, *apiError) {
+	id, _ := strconv.Atoi(ID)
+	if id <= 0 || id > len(s.attachments) {
+		return nil, errorf(http.StatusNotFound, 100, "Attachment #%s does not exist.", ID)
+	}
+	a := s.renderAttachment(s.attachments[id-1], true)
+	if include != "" {
+		fields := make(map[string]interface{})
+		for _, f := range strings.Split(include, ",") {
+			if v, ok := a[f]; ok {
+				fields[f] = v
+			}
+		}
+		a = fields
+	}
+	return map[string]interface{}{"attachments": map[string]interface{}{ID: a}, "bugs": map[string]interface{}{}}, nil
+}
+
+func (s *Server) addAttachment(b *bug, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		IDs         []int  `json:"ids"`
+		Data        string `json:"data"`
+		FileName    string `json:"file_name"`
+		Summary     string `json:"summary"`
+		ContentType string `json:"content_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, invalid("%v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(req.Data)
+	switch {
+	case err != nil:
+		return nil, invalid("data: %v", err)
+	case req.FileName == "":
+		return nil, errorf(http.StatusBadRequest, 602, "You must specify a file name.")
+	case req.Summary == "":
+		return nil, errorf(http.StatusBadRequest, 604, "You must enter a description for the attachment.")
+	case req.ContentType == "":
+		return nil, errorf(http.StatusBadRequest, 601, "You must specify a content type.")
+	}
+	t := now()
+	if len(req.IDs) == 0 {
+		req.IDs = []int{b.ID}
+	}
+	ids := make([]int, 0, len(req.IDs))
+	for _, id := range req.IDs {
+		bb := s.bug(strconv.Itoa(id))
+		if bb == nil {
+			return nil, errorf(http.StatusNotFound, 101, "Bug #%d does not exist.", id)
+		}
+		a := &attachment{
+			ID: len(s.attachments) + 1, BugID: id, FileName: req.FileName, Summary: req.Summary,
+			ContentType: req.ContentType, Size: len(data), Creator: s.Me.Name, CreationTime: t, data: data,
+		}
+		s.attachments = append(s.attachments, a)
+		bb.LastChangeTime = t
+		ids = append(ids, a.ID)
+	}
+	return map[string][]int{"ids": ids}, nil
+}
+
+// matchUsers returns the users whose login name or real name contains match.
+func (s *Server) matchUsers(match string) interface{} {
+	users := []User{}
+	q := strings.ToLower(match)
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if strings.Contains(strings.ToLower(u.Name), q) || strings.Contains(strings.ToLower(u.RealName), q) {
+			users = append(users, u)
+		}
+	}
+	return map[string][]User{"users": users}
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -26,6 +26,9 @@ type DBItem struct {
 func NewFileDB(fn string) (*FileDB, error) {
 	fh, err := os.Open(fn)
 	if err != nil {
+		if os.IsNotExist(err) {
+			return &FileDB{fileName: fn}, nil
+		}
 		return nil, err
 	}
 	fdb := FileDB{fileName: fh.Name()}
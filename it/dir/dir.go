@@ -0,0 +1,551 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package dir is a tracker storing the issues as Markdown files in a directory.
+//
+// Each issue is a directory, named by its ID:
+//
+//	1/issue.md           the fields in YAML front matter, then the description
+//	1/comments/0001.md   the author and time in front matter, then the comment
+//	1/attachments/x.png  the attached files
+//
+// It serves as an export/backup target (the directory can be a git repository),
+// and as a deterministic tracker for tests.
+package dir
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/renameio"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("dir", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+type Client struct {
+	// Root is the directory holding the issues.
+	Root   string
+	states []it.State
+	mu     *sync.Mutex
+}
+
+const (
+	issueFile      = "issue.md"
+	commentsDir    = "comments"
+	attachmentsDir = "attachments"
+)
+
+// New returns a new client storing the issues under the directory,
+// which is created if not exists.
+//
+// The allowed states can be listed in the "states" query parameter (comma separated),
+// for the validation of the state mapping.
+func New(baseURL string) (Client, error) {
+	root, rawQuery := baseURL, ""
+	if i := strings.IndexByte(baseURL, '?'); i >= 0 {
+		root, rawQuery = baseURL[:i], baseURL[i+1:]
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Client{}, err
+	}
+	if root == "" {
+		return Client{}, fmt.Errorf("%q: no directory", baseURL)
+	}
+	root = filepath.Clean(root)
+	if err = os.MkdirAll(root, 0755); err != nil {
+		return Client{}, err
+	}
+	c := Client{Root: root, mu: new(sync.Mutex)}
+	if s := q.Get("states"); s != "" {
+		for _, st := range strings.Split(s, ",") {
+			c.states = append(c.states, it.State(strings.TrimSpace(st)))
+		}
+	}
+	return c, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.Root)
+}
+
+func (c Client) issueDir(ID it.IssueID) (string, error) {
+	if ID == "" || strings.ContainsAny(string(ID), `/\`) || ID == "." || ID == ".." {
+		return "", fmt.Errorf("invalid issue ID %q", ID)
+	}
+	return filepath.Join(c.Root, string(ID)), nil
+}
+
+// GetIssue returns the data for the issueID
+//
+// UpdatedAt is the last modification time of the issue's files.
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	issue, _, err := c.readIssue(ID)
+	return issue, err
+}
+
+func (c Client) readIssue(ID it.IssueID) (it.Issue, string, error) {
+	dir, err := c.issueDir(ID)
+	if err != nil {
+		return it.Issue{}, "", err
+	}
+	fn := filepath.Join(dir, issueFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return it.Issue{}, fn, fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+		}
+		return it.Issue{}, fn, err
+	}
+	fields, body, err := parseFrontMatter(b)
+	if err != nil {
+		return it.Issue{}, fn, fmt.Errorf("%s: %w", fn, err)
+	}
+	issue := it.Issue{
+		ID:             ID,
+		SecondaryID:    it.IssueID(fields["secondary_id"].Scalar),
+		Summary:        fields["summary"].Scalar,
+		Description:    body,
+		Project:        fields["project"].Scalar,
+		Category:       fields["category"].Scalar,
+		Priority:       fields["priority"].Scalar,
+		Severity:       fields["severity"].Scalar,
+		Author:         readUser(fields["author"]),
+		Reporter:       readUser(fields["reporter"]),
+		Assignee:       readUser(fields["assignee"]),
+		Labels:         fields["labels"].List,
+		CreatedAt:      parseTime(fields["created"].Scalar),
+		DueDate:        parseTime(fields["due"].Scalar),
+		State:          it.State(fields["state"].Scalar),
+		Version:        fields["version"].Scalar,
+		FixedInVersion: fields["fixed_in_version"].Scalar,
+		TargetVersion:  fields["target_version"].Scalar,
+		Custom:         fields["custom"].Map,
+	}
+	issue.UpdatedAt, err = lastModified(dir)
+	return issue, fn, err
+}
+
+func (c Client) writeIssue(fn string, issue it.Issue) error {
+	fm := newFrontMatter()
+	fm.Scalar("id", string(issue.ID))
+	fm.Scalar("secondary_id", string(issue.SecondaryID))
+	fm.Scalar("summary", issue.Summary)
+	fm.Scalar("state", string(issue.State))
+	fm.Scalar("project", issue.Project)
+	fm.Scalar("category", issue.Category)
+	fm.Scalar("priority", issue.Priority)
+	fm.Scalar("severity", issue.Severity)
+	writeUser(fm, "author", issue.Author)
+	writeUser(fm, "reporter", issue.Reporter)
+	writeUser(fm, "assignee", issue.Assignee)
+	fm.List("labels", issue.Labels)
+	fm.Scalar("created", formatTime(issue.CreatedAt))
+	fm.Scalar("due", formatTime(issue.DueDate))
+	fm.Scalar("version", issue.Version)
+	fm.Scalar("fixed_in_version", issue.FixedInVersion)
+	fm.Scalar("target_version", issue.TargetVersion)
+	fm.Map("custom", issue.Custom)
+	return renameio.WriteFile(fn, fm.Bytes(issue.Description), 0644)
+}
+
+// lastModified returns the latest modification time of the issue's file and directories.
+func lastModified(dir string) (time.Time, error) {
+	var last time.Time
+	for _, fn := range []string{
+		dir, filepath.Join(dir, issueFile),
+		filepath.Join(dir, commentsDir), filepath.Join(dir, attachmentsDir),
+	} {
+		fi, err := os.Stat(fn)
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue
+			}
+			return last, err
+		}
+		if t := fi.ModTime(); t.After(last) {
+			last = t
+		}
+	}
+	return last, nil
+}
+
+// ListIssues lists all the issues whose files are modified since "since", ordered by ID.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	IDs, err := c.issueIDs()
+	if err != nil {
+		return nil, err
+	}
+	var issues []it.Issue
+	for _, ID := range IDs {
+		if err := ctx.Err(); err != nil {
+			return issues, err
+		}
+		dir := filepath.Join(c.Root, ID)
+		if t, err := lastModified(dir); err != nil {
+			return issues, err
+		} else if t.Before(since) {
+			continue
+		}
+		issue, err := c.GetIssue(ctx, it.IssueID(ID))
+		if err != nil {
+			return issues, err
+		}
+		issues = append(issues, issue)
+	}
+	return issues, nil
+}
+
+// issueIDs returns the IDs of the issues, numerically ordered.
+func (c Client) issueIDs() ([]string, error) {
+	dis, err := ioutil.ReadDir(c.Root)
+	if err != nil {
+		return nil, err
+	}
+	IDs := make([]string, 0, len(dis))
+	for _, fi := range dis {
+		if !fi.IsDir() {
+			continue
+		}
+		if _, err := os.Stat(filepath.Join(c.Root, fi.Name(), issueFile)); err == nil {
+			IDs = append(IDs, fi.Name())
+		}
+	}
+	sort.Slice(IDs, func(i, j int) bool {
+		a, aErr := strconv.Atoi(IDs[i])
+		b, bErr := strconv.Atoi(IDs[j])
+		if aErr == nil && bErr == nil {
+			return a < b
+		}
+		return IDs[i] < IDs[j]
+	})
+	return IDs, nil
+}
+
+// CreateIssue creates the issue, returning the ID, the next number.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	if issue.Summary == "" {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: []string{"summary"}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	IDs, err := c.issueIDs()
+	if err != nil {
+		return "", err
+	}
+	var n int
+	for _, ID := range IDs {
+		if i, err := strconv.Atoi(ID); err == nil && i > n {
+			n = i
+		}
+	}
+	var dir string
+	for {
+		n++
+		dir = filepath.Join(c.Root, strconv.Itoa(n))
+		if err = os.Mkdir(dir, 0755); err == nil {
+			break
+		} else if !os.IsExist(err) {
+			return "", err
+		}
+	}
+	issue.ID, issue.SecondaryID = it.IssueID(strconv.Itoa(n)), ""
+	if issue.CreatedAt.IsZero() {
+		issue.CreatedAt = time.Now()
+	}
+	if err = c.writeIssue(filepath.Join(dir, issueFile), issue); err != nil {
+		os.RemoveAll(dir)
+		return "", err
+	}
+	return issue.ID, nil
+}
+
+// UpdateIssueState updates the issue's state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	issue, fn, err := c.readIssue(ID)
+	if err != nil {
+		return err
+	}
+	if upd.Fields.Has(it.FieldSummary) {
+		issue.Summary = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		issue.Description = upd.Description
+	}
+	if upd.Fields.Has(it.FieldPriority) {
+		issue.Priority = upd.Priority
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		issue.Assignee = upd.Assignee
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		issue.Labels = upd.Labels
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		issue.State = upd.State
+	}
+	return c.writeIssue(fn, issue)
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	issue, fn, err := c.readIssue(primary)
+	if err != nil {
+		return err
+	}
+	issue.SecondaryID = secondary
+	return c.writeIssue(fn, issue)
+}
+
+// ListStates lists the states given in the "states" parameter.
+//
+// Returns ErrNotImplemented if no states are given, as any state is allowed.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	if len(c.states) == 0 {
+		return nil, it.ErrNotImplemented
+	}
+	return append([]it.State(nil), c.states...), nil
+}
+
+// FindUser returns the user with the given email address.
+//
+// There are no accounts, the users are identified by their email.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	if email == "" {
+		return it.User{}, it.ErrNotFound
+	}
+	return it.User{ID: it.UserID(email), Email: email}, nil
+}
+
+// AddComment adds the comment as the next comments/NNNN.md file.
+//
+// The ID of the comment is "issueID/NNNN".
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	dir, err := c.issueDir(ID)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(filepath.Join(dir, issueFile)); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+		}
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir = filepath.Join(dir, commentsDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	names, err := commentNames(dir)
+	if err != nil {
+		return "", err
+	}
+	var n int
+	if len(names) != 0 {
+		n, _ = strconv.Atoi(names[len(names)-1])
+	}
+	name := fmt.Sprintf("%04d", n+1)
+	createdAt := comment.CreatedAt
+	if createdAt.IsZero() {
+		createdAt = time.Now()
+	}
+	fm := newFrontMatter()
+	writeUser(fm, "author", comment.Author)
+	fm.Scalar("created", formatTime(createdAt))
+	if err = renameio.WriteFile(filepath.Join(dir, name+".md"), fm.Bytes(comment.Body), 0644); err != nil {
+		return "", err
+	}
+	return it.CommentID(string(ID) + "/" + name), nil
+}
+
+// commentNames returns the names (without .md) of the comment files, ordered.
+func commentNames(dir string) ([]string, error) {
+	dis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	names := make([]string, 0, len(dis))
+	for _, fi := range dis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".md") {
+			names = append(names, strings.TrimSuffix(fi.Name(), ".md"))
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// ListComments list the comments of the issue.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	dir, err := c.issueDir(ID)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, commentsDir)
+	names, err := commentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, 0, len(names))
+	for _, name := range names {
+		fn := filepath.Join(dir, name+".md")
+		b, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return comments, err
+		}
+		fields, body, err := parseFrontMatter(b)
+		if err != nil {
+			return comments, fmt.Errorf("%s: %w", fn, err)
+		}
+		comments = append(comments, it.Comment{
+			ID:        it.CommentID(string(ID) + "/" + name),
+			Author:    readUser(fields["author"]),
+			CreatedAt: parseTime(fields["created"].Scalar),
+			Body:      body,
+		})
+	}
+	return comments, nil
+}
+
+// AddAttachment writes the file into the attachments directory,
+// its modification time being the attachment's creation time.
+//
+// The ID of the attachment is "issueID/name".
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	dir, err := c.issueDir(ID)
+	if err != nil {
+		return "", err
+	}
+	if _, err = os.Stat(filepath.Join(dir, issueFile)); err != nil {
+		if os.IsNotExist(err) {
+			return "", fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+		}
+		return "", err
+	}
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dir = filepath.Join(dir, attachmentsDir)
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	name := filepath.Base(strings.ReplaceAll(a.Name, `\`, "/"))
+	if name == "." || name == "/" || name == "" {
+		name = "attachment"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 2; ; i++ {
+		if _, err = os.Stat(filepath.Join(dir, name)); os.IsNotExist(err) {
+			break
+		}
+		name = base + " (" + strconv.Itoa(i) + ")" + ext
+	}
+	fn := filepath.Join(dir, name)
+	t, err := renameio.TempFile("", fn)
+	if err != nil {
+		return "", err
+	}
+	defer t.Cleanup()
+	if _, err = io.Copy(t, r); err != nil {
+		return "", err
+	}
+	if err = t.CloseAtomicallyReplace(); err != nil {
+		return "", err
+	}
+	if !a.CreatedAt.IsZero() {
+		if err = os.Chtimes(fn, a.CreatedAt, a.CreatedAt); err != nil {
+			return "", err
+		}
+	}
+	return it.AttachmentID(string(ID) + "/" + name), nil
+}
+
+// ListAttachments lists the files in the attachments directory.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	dir, err := c.issueDir(ID)
+	if err != nil {
+		return nil, err
+	}
+	dir = filepath.Join(dir, attachmentsDir)
+	dis, err := ioutil.ReadDir(dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	as := make([]it.Attachment, 0, len(dis))
+	for _, fi := range dis {
+		if fi.IsDir() {
+			continue
+		}
+		fn := filepath.Join(dir, fi.Name())
+		as = append(as, it.Attachment{
+			ID:        it.AttachmentID(string(ID) + "/" + fi.Name()),
+			Name:      fi.Name(),
+			MIMEType:  mime.TypeByExtension(filepath.Ext(fi.Name())),
+			CreatedAt: fi.ModTime(),
+			GetBody:   func() (io.ReadCloser, error) { return os.Open(fn) },
+		})
+	}
+	return as, nil
+}
+
+func readUser(n node) it.User {
+	return it.User{ID: it.UserID(n.Map["id"]), RealName: n.Map["name"], Email: n.Map["email"]}
+}
+
+func writeUser(fm *frontMatter, key string, u it.User) {
+	fm.Map(key, map[string]string{"id": string(u.ID), "name": u.RealName, "email": u.Email}, "id", "name", "email")
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+func parseTime(s string) time.Time {
+	if s == "" {
+		return time.Time{}
+	}
+	t, _ := time.Parse(time.RFC3339Nano, s)
+	return t
+}
@@ -0,0 +1,23 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dir
+
+import (
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(t.TempDir() + "?states=new,closed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	})
+}
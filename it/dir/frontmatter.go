@@ -0,0 +1,614 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dir
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The front matter is a subset of YAML: scalars (plain, quoted or block),
+// and lists and maps of scalars, one level deep (in block or flow style).
+// That is all the issue fields need, and it is still readable and editable by hand.
+
+const fmDelim = "---"
+
+// node is a front matter value: a scalar, a list or a map.
+type node struct {
+	Scalar string
+	List   []string
+	Map    map[string]string
+}
+
+// frontMatter writes a front matter, field by field.
+type frontMatter struct {
+	buf bytes.Buffer
+}
+
+func newFrontMatter() *frontMatter {
+	var fm frontMatter
+	fm.buf.WriteString(fmDelim + "\n")
+	return &fm
+}
+
+// Scalar writes the key: value pair, if the value is not empty.
+func (fm *frontMatter) Scalar(key, value string) {
+	if value == "" {
+		return
+	}
+	fm.buf.WriteString(key + ": " + strconv.Quote(value) + "\n")
+}
+
+// List writes the non-empty list.
+func (fm *frontMatter) List(key string, values []string) {
+	if len(values) == 0 {
+		return
+	}
+	fm.buf.WriteString(key + ":\n")
+	for _, v := range values {
+		fm.buf.WriteString("  - " + strconv.Quote(v) + "\n")
+	}
+}
+
+// Map writes the non-empty values of the map, in the order of keys (sorted if nil).
+func (fm *frontMatter) Map(key string, m map[string]string, keys ...string) {
+	if len(keys) == 0 {
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+	}
+	var n int
+	for _, k := range keys {
+		if m[k] != "" {
+			n++
+		}
+	}
+	if n == 0 {
+		return
+	}
+	fm.buf.WriteString(key + ":\n")
+	for _, k := range keys {
+		if v := m[k]; v != "" {
+			fm.buf.WriteString("  " + quoteKey(k) + ": " + strconv.Quote(v) + "\n")
+		}
+	}
+}
+
+// Bytes returns the front matter, followed by the body.
+func (fm *frontMatter) Bytes(body string) []byte {
+	fm.buf.WriteString(fmDelim + "\n")
+	if body != "" {
+		// The final newline is always added, and removed by parseFrontMatter.
+		fm.buf.WriteString("\n" + body + "\n")
+	}
+	return fm.buf.Bytes()
+}
+
+var errNoFrontMatter = errors.New("no front matter")
+
+// parseFrontMatter returns the fields of the front matter and the body after it.
+//
+// The YAML constructs not in the subset (anchors, tags, nested collections,
+// multi-line flow collections and quoted scalars) are rejected with an error.
+func parseFrontMatter(b []byte) (map[string]node, string, error) {
+	text := string(b)
+	if strings.HasPrefix(text, fmDelim+"\r\n") {
+		// Edited on Windows. Otherwise the CRs are kept, those may be in the description.
+		text = strings.ReplaceAll(text, "\r\n", "\n")
+	}
+	if !strings.HasPrefix(text, fmDelim+"\n") {
+		return nil, "", errNoFrontMatter
+	}
+	text = text[len(fmDelim)+1:]
+	var head, body string
+	if strings.HasPrefix(text, fmDelim+"\n") {
+		body = text[len(fmDelim)+1:]
+	} else if i := strings.Index(text, "\n"+fmDelim+"\n"); i >= 0 {
+		head, body = text[:i], text[i+len(fmDelim)+2:]
+	} else if strings.HasSuffix(text, "\n"+fmDelim) {
+		head = strings.TrimSuffix(text, "\n"+fmDelim)
+	} else {
+		return nil, "", fmt.Errorf("unterminated front matter: %w", errNoFrontMatter)
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "\n"), "\n")
+
+	p := fmParser{lines: strings.Split(head, "\n"), i: -1}
+	fields := make(map[string]node)
+	for p.next() {
+		line := p.lines[p.i]
+		if indentOf(line) != 0 || line[0] == '\t' {
+			return nil, "", p.errorf("unexpected indentation (multi-line plain scalars are not supported)")
+		}
+		k, v, err := splitKey(line)
+		if err != nil {
+			return nil, "", p.errorf("%w", err)
+		}
+		if _, ok := fields[k]; ok {
+			return nil, "", p.errorf("duplicate key %q", k)
+		}
+		n, err := p.value(v, 0)
+		if err != nil {
+			return nil, "", err
+		}
+		fields[k] = n
+	}
+	return fields, body, nil
+}
+
+// fmParser reads the lines of the front matter.
+type fmParser struct {
+	lines []string
+	// i is the current line, -1 before the first.
+	i int
+}
+
+// next moves to the next line which is not blank or a comment.
+func (p *fmParser) next() bool {
+	for p.i++; p.i < len(p.lines); p.i++ {
+		if !isBlank(p.lines[p.i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// peek returns the index of the next line which is not blank or a comment, -1 at the end.
+func (p *fmParser) peek() int {
+	for i := p.i + 1; i < len(p.lines); i++ {
+		if !isBlank(p.lines[i]) {
+			return i
+		}
+	}
+	return -1
+}
+
+func (p *fmParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: "+format, append([]interface{}{p.i + 1}, args...)...)
+}
+
+// value returns the value of the key at indent, v is the rest of the key's line.
+func (p *fmParser) value(v string, indent int) (node, error) {
+	v = strings.TrimSpace(v)
+	switch {
+	case v == "" || v[0] == '#':
+		if j := p.peek(); j >= 0 {
+			line := p.lines[j]
+			if ind := indentOf(line); ind > indent || ind == indent && isItem(line[ind:]) {
+				return p.collection(indent)
+			}
+		}
+		return node{}, nil
+	case v[0] == '[' || v[0] == '{':
+		n, err := flowCollection(v)
+		if err != nil {
+			return n, p.errorf("%w", err)
+		}
+		return n, nil
+	case v[0] == '|' || v[0] == '>':
+		s, err := p.blockScalar(v, indent)
+		return node{Scalar: s}, err
+	}
+	s, err := plainOrQuoted(v)
+	if err != nil {
+		return node{}, p.errorf("%w", err)
+	}
+	return node{Scalar: s}, nil
+}
+
+// collection reads the block sequence or mapping of scalars after the key at indent.
+func (p *fmParser) collection(indent int) (node, error) {
+	var n node
+	ind := -1
+	for j := p.peek(); j >= 0; j = p.peek() {
+		line := p.lines[j]
+		lineInd := indentOf(line)
+		if lineInd < indent || lineInd == indent && !(isItem(line[lineInd:]) && (ind < 0 || ind == indent)) {
+			break
+		}
+		p.i = j
+		if line[lineInd] == '\t' {
+			return n, p.errorf("tabs are not allowed in the indentation")
+		}
+		if ind < 0 {
+			ind = lineInd
+		} else if lineInd != ind {
+			return n, p.errorf("nested collections are not supported")
+		}
+		if line = line[ind:]; isItem(line) {
+			if n.Map != nil {
+				return n, p.errorf("a list item in a map")
+			}
+			v := strings.TrimSpace(line[1:])
+			if v != "" && (v[0] == '|' || v[0] == '>') {
+				s, err := p.blockScalar(v, ind)
+				if err != nil {
+					return n, err
+				}
+				n.List = append(n.List, s)
+				continue
+			}
+			s, err := p.nestedScalar(v, ind)
+			if err != nil {
+				return n, err
+			}
+			n.List = append(n.List, s)
+			continue
+		}
+		if n.List != nil {
+			return n, p.errorf("a map key in a list")
+		}
+		k, v, err := splitKey(line)
+		if err != nil {
+			return n, p.errorf("%w", err)
+		}
+		if n.Map == nil {
+			n.Map = make(map[string]string)
+		} else if _, ok := n.Map[k]; ok {
+			return n, p.errorf("duplicate key %q", k)
+		}
+		if v = strings.TrimSpace(v); v != "" && (v[0] == '|' || v[0] == '>') {
+			if n.Map[k], err = p.blockScalar(v, ind); err != nil {
+				return n, err
+			}
+			continue
+		}
+		if n.Map[k], err = p.nestedScalar(v, ind); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// nestedScalar returns the scalar value of an item of a collection at indent.
+func (p *fmParser) nestedScalar(v string, indent int) (string, error) {
+	if v = strings.TrimSpace(v); v != "" && (v[0] == '[' || v[0] == '{') {
+		return "", p.errorf("nested collections are not supported")
+	}
+	s, err := plainOrQuoted(v)
+	if err != nil {
+		return "", p.errorf("%w", err)
+	}
+	if j := p.peek(); j >= 0 && indentOf(p.lines[j]) > indent {
+		return "", p.errorf("nested collections and multi-line plain scalars are not supported")
+	}
+	return s, nil
+}
+
+// blockScalar reads the literal (|) or folded (>) block scalar with the header,
+// of the node at indent.
+func (p *fmParser) blockScalar(header string, indent int) (string, error) {
+	folded := header[0] == '>'
+	chomp, ci := byte(0), 0
+	for _, c := range []byte(strings.TrimSpace(strings.SplitN(header[1:], " #", 2)[0])) {
+		switch {
+		case (c == '-' || c == '+') && chomp == 0:
+			chomp = c
+		case '1' <= c && c <= '9' && ci == 0:
+			ci = indent + int(c-'0')
+		default:
+			return "", p.errorf("bad block scalar header %q", header)
+		}
+	}
+	var lines []string
+	for p.i+1 < len(p.lines) {
+		line := p.lines[p.i+1]
+		if strings.TrimSpace(line) == "" {
+			lines = append(lines, "")
+			p.i++
+			continue
+		}
+		ind := indentOf(line)
+		if ind <= indent {
+			break
+		}
+		if ci == 0 {
+			ci = ind
+		}
+		if ind < ci {
+			return "", fmt.Errorf("line %d: less indented than the block scalar", p.i+2)
+		}
+		lines = append(lines, line[ci:])
+		p.i++
+	}
+	// The trailing empty lines are kept only with the "+" chomping.
+	n := len(lines)
+	for n > 0 && lines[n-1] == "" {
+		n--
+	}
+	trailing := len(lines) - n
+	lines = lines[:n]
+
+	var buf strings.Builder
+	var empties int
+	var prevNormal bool
+	for i, line := range lines {
+		if line == "" {
+			empties++
+			continue
+		}
+		more := line[0] == ' ' || line[0] == '\t'
+		switch {
+		case !folded || i == empties:
+			buf.WriteString(strings.Repeat("\n", empties))
+			if i != empties {
+				buf.WriteByte('\n')
+			}
+		case prevNormal && !more && empties == 0:
+			// Folded: the line break between two normal lines is a space,
+			buf.WriteByte(' ')
+		case prevNormal && !more:
+			// or dropped, if followed by empty lines.
+			buf.WriteString(strings.Repeat("\n", empties))
+		default:
+			buf.WriteString(strings.Repeat("\n", empties+1))
+		}
+		empties = 0
+		buf.WriteString(line)
+		prevNormal = !more
+	}
+	switch {
+	case chomp == '-':
+	case chomp == '+':
+		buf.WriteString(strings.Repeat("\n", trailing+1))
+	case buf.Len() != 0:
+		buf.WriteByte('\n')
+	}
+	return buf.String(), nil
+}
+
+// flowCollection returns the one-line flow sequence or mapping of scalars.
+func flowCollection(s string) (node, error) {
+	var n node
+	closing := byte(']')
+	if s[0] == '{' {
+		closing, n.Map = '}', make(map[string]string)
+	} else {
+		n.List = []string{}
+	}
+	s = s[1:]
+	for {
+		s = strings.TrimLeft(s, " ")
+		if s == "" {
+			return n, errors.New("unterminated flow collection (multi-line ones are not supported)")
+		}
+		if s[0] == closing {
+			s = s[1:]
+			break
+		}
+		var k, v string
+		var err error
+		if n.Map != nil {
+			if k, s, err = flowScalar(s, true); err != nil {
+				return n, err
+			}
+			if _, ok := n.Map[k]; ok {
+				return n, fmt.Errorf("duplicate key %q", k)
+			}
+			if s = strings.TrimLeft(s, " "); strings.HasPrefix(s, ":") {
+				if v, s, err = flowScalar(s[1:], false); err != nil {
+					return n, err
+				}
+			}
+			n.Map[k] = v
+		} else {
+			if v, s, err = flowScalar(s, false); err != nil {
+				return n, err
+			}
+			n.List = append(n.List, v)
+		}
+		if s = strings.TrimLeft(s, " "); strings.HasPrefix(s, ",") {
+			s = s[1:]
+		} else if !strings.HasPrefix(s, string(closing)) {
+			return n, fmt.Errorf("expected , or %c in the flow collection, got %q", closing, s)
+		}
+	}
+	if s = strings.TrimSpace(s); s != "" && s[0] != '#' {
+		return n, fmt.Errorf("unexpected %q after the flow collection", s)
+	}
+	return n, nil
+}
+
+// flowScalar returns the scalar at the start of s in a flow collection, and the rest of s.
+func flowScalar(s string, key bool) (string, string, error) {
+	s = strings.TrimLeft(s, " ")
+	if s == "" {
+		return "", s, nil
+	}
+	switch s[0] {
+	case '"':
+		return doubleQuoted(s)
+	case '\'':
+		return singleQuoted(s)
+	case '[', '{':
+		return "", s, errors.New("nested collections are not supported")
+	}
+	end := strings.IndexAny(s, ",[]{}")
+	if end < 0 {
+		end = len(s)
+	}
+	if key {
+		if i := strings.IndexByte(s[:end], ':'); i >= 0 {
+			end = i
+		}
+	}
+	v, err := plain(s[:end])
+	return v, s[end:], err
+}
+
+// plainOrQuoted returns the value of the scalar, followed by an optional comment.
+func plainOrQuoted(s string) (string, error) {
+	if s = strings.TrimSpace(s); s == "" || (s[0] != '"' && s[0] != '\'') {
+		if i := strings.Index(s, " #"); i >= 0 {
+			s = s[:i]
+		} else if strings.HasPrefix(s, "#") {
+			s = ""
+		}
+		return plain(s)
+	}
+	var v string
+	var err error
+	if s[0] == '"' {
+		v, s, err = doubleQuoted(s)
+	} else {
+		v, s, err = singleQuoted(s)
+	}
+	if err != nil {
+		return "", err
+	}
+	if s = strings.TrimSpace(s); s != "" && s[0] != '#' {
+		return "", fmt.Errorf("unexpected %q after the quoted scalar", s)
+	}
+	return v, nil
+}
+
+// plain returns the value of the plain scalar, rejecting the unsupported constructs.
+func plain(s string) (string, error) {
+	s = strings.TrimSpace(s)
+	switch s {
+	case "", "~", "null", "Null", "NULL":
+		return "", nil
+	}
+	if strings.IndexByte("[]{},#&*!|>'\"%@`", s[0]) >= 0 {
+		return "", fmt.Errorf("%q: anchors, tags and the like are not supported", s)
+	}
+	if (s[0] == '-' || s[0] == '?' || s[0] == ':') && (len(s) == 1 || s[1] == ' ') {
+		return "", fmt.Errorf("%q: nested collections are not supported", s)
+	}
+	if strings.Contains(s, ": ") || strings.HasSuffix(s, ":") || strings.Contains(s, " #") {
+		return "", fmt.Errorf("%q: should be quoted", s)
+	}
+	return s, nil
+}
+
+// doubleQuoted returns the value of the double-quoted scalar at the start of s, and the rest of s.
+func doubleQuoted(s string) (string, string, error) {
+	var buf strings.Builder
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		if c == '"' {
+			return buf.String(), s[i+1:], nil
+		}
+		if c != '\\' {
+			buf.WriteByte(c)
+			continue
+		}
+		if i++; i == len(s) {
+			break
+		}
+		if r, ok := yamlEscapes[s[i]]; ok {
+			buf.WriteRune(r)
+			continue
+		}
+		var n int
+		switch s[i] {
+		case 'x':
+			n = 2
+		case 'u':
+			n = 4
+		case 'U':
+			n = 8
+		default:
+			return "", s, fmt.Errorf("invalid escape \\%c", s[i])
+		}
+		if i+n >= len(s) {
+			break
+		}
+		r, err := strconv.ParseUint(s[i+1:i+1+n], 16, 32)
+		if err != nil || !utf8.ValidRune(rune(r)) {
+			return "", s, fmt.Errorf("invalid escape \\%s", s[i:i+1+n])
+		}
+		buf.WriteRune(rune(r))
+		i += n
+	}
+	return "", s, errors.New("unterminated double-quoted scalar (multi-line ones are not supported)")
+}
+
+var yamlEscapes = map[byte]rune{
+	'0': 0, 'a': '\a', 'b': '\b', 't': '\t', '\t': '\t', 'n': '\n', 'v': '\v', 'f': '\f',
+	'r': '\r', 'e': '\x1b', ' ': ' ', '"': '"', '/': '/', '\\': '\\',
+	'N': '\u0085', '_': '\u00a0', 'L': '\u2028', 'P': '\u2029',
+}
+
+// singleQuoted returns the value of the single-quoted scalar at the start of s, and the rest of s.
+func singleQuoted(s string) (string, string, error) {
+	var buf strings.Builder
+	for i := 1; i < len(s); i++ {
+		if s[i] != '\'' {
+			buf.WriteByte(s[i])
+		} else if i+1 < len(s) && s[i+1] == '\'' {
+			buf.WriteByte('\'')
+			i++
+		} else {
+			return buf.String(), s[i+1:], nil
+		}
+	}
+	return "", s, errors.New("unterminated single-quoted scalar (multi-line ones are not supported)")
+}
+
+// splitKey splits the "key: value" line; the key may be quoted.
+func splitKey(s string) (key, value string, err error) {
+	var rest string
+	switch s[0] {
+	case '"':
+		key, rest, err = doubleQuoted(s)
+	case '\'':
+		key, rest, err = singleQuoted(s)
+	default:
+		i := strings.Index(s, ": ")
+		if i < 0 && strings.HasSuffix(s, ":") {
+			i = len(s) - 1
+		}
+		if i < 0 {
+			return "", "", fmt.Errorf("no key in %q", s)
+		}
+		key, rest = strings.TrimSpace(s[:i]), s[i:]
+		if key == "" || strings.IndexByte("[]{},#&*!|>'\"%@`", key[0]) >= 0 || isItem(key) || strings.HasPrefix(key, "? ") {
+			return "", "", fmt.Errorf("unsupported key %q", key)
+		}
+	}
+	if err != nil {
+		return "", "", err
+	}
+	if rest = strings.TrimLeft(rest, " "); !strings.HasPrefix(rest, ":") || len(rest) > 1 && rest[1] != ' ' {
+		return "", "", fmt.Errorf("no key in %q", s)
+	}
+	return key, rest[1:], nil
+}
+
+// indentOf returns the number of the leading spaces.
+func indentOf(line string) int {
+	return len(line) - len(strings.TrimLeft(line, " "))
+}
+
+// isItem reports whether the (unindented) line is a block sequence item.
+func isItem(line string) bool {
+	return line == "-" || strings.HasPrefix(line, "- ")
+}
+
+// isBlank reports whether the line is empty or a comment.
+func isBlank(line string) bool {
+	t := strings.TrimSpace(line)
+	return t == "" || t[0] == '#'
+}
+
+// quoteKey quotes the map key, unless it is a plain word.
+func quoteKey(k string) string {
+	for _, r := range k {
+		if !(r == '_' || r == '-' || r == '.' || '0' <= r && r <= '9' || 'a' <= r && r <= 'z' || 'A' <= r && r <= 'Z') {
+			return strconv.Quote(k)
+		}
+	}
+	if k == "" {
+		return `""`
+	}
+	return k
+}
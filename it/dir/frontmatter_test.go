@@ -0,0 +1,162 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package dir
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+func TestFrontMatterRoundTrip(t *testing.T) {
+	for _, s := range []string{
+		`say "hello"`, `it's`, "key: value", "a #hash", "http://example.com:8080/x",
+		"two\nlines", "trailing newline\n", "  leading space", "tab\there",
+		"árvíztűrő tükörfúrógép", "日本語", "~", "null", "- dash", "[not a list]",
+		"{not a map}", "&anchor", "*alias", "!tag", "|", "> folded", "\x1b[0m", " ",
+	} {
+		fm := newFrontMatter()
+		fm.Scalar("summary", s)
+		fm.List("labels", []string{s, "plain"})
+		fm.Map("custom", map[string]string{s: s, "ключ": "érték"})
+		b := fm.Bytes("body: " + s)
+		fields, body, err := parseFrontMatter(b)
+		if err != nil {
+			t.Errorf("%q: %+v\n%s", s, err, b)
+			continue
+		}
+		if got := fields["summary"].Scalar; got != s {
+			t.Errorf("scalar: got %q, wanted %q", got, s)
+		}
+		if got, want := fields["labels"].List, []string{s, "plain"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("list: got %q, wanted %q", got, want)
+		}
+		if got, want := fields["custom"].Map, map[string]string{s: s, "ключ": "érték"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("map: got %q, wanted %q", got, want)
+		}
+		if want := "body: " + s; body != want {
+			t.Errorf("body: got %q, wanted %q", body, want)
+		}
+	}
+}
+
+func TestParseFrontMatter(t *testing.T) {
+	for i, tc := range []struct {
+		In   string
+		Want map[string]node
+		Body string
+	}{
+		{In: "---\nsummary: plain text # comment\n# comment\nstate: 'it''s'\n---\nbody\n",
+			Want: map[string]node{"summary": {Scalar: "plain text"}, "state": {Scalar: "it's"}}, Body: "body"},
+		{In: "---\r\nsummary: \"a: b\"\r\nlabels:\r\n  - x\r\n---\r\n\r\nline 1\r\nline 2\r\n",
+			Want: map[string]node{"summary": {Scalar: "a: b"}, "labels": {List: []string{"x"}}}, Body: "line 1\nline 2"},
+		{In: "---\na: ~\nb: null\nc:\nd: \"\\u00e1\\x41\\t\\/\"\n---\n",
+			Want: map[string]node{"a": {}, "b": {}, "c": {}, "d": {Scalar: "áA\t/"}}},
+		{In: "---\nárvíz: tűrő\n\"quoted key\": v\n'single': w\n---\n",
+			Want: map[string]node{"árvíz": {Scalar: "tűrő"}, "quoted key": {Scalar: "v"}, "single": {Scalar: "w"}}},
+		{In: "---\nlabels: [a, \"b, c\", 'd']\nempty: []\ncustom: {x: 1, \"y z\": two, n: }\n---\n",
+			Want: map[string]node{
+				"labels": {List: []string{"a", "b, c", "d"}}, "empty": {List: []string{}},
+				"custom": {Map: map[string]string{"x": "1", "y z": "two", "n": ""}},
+			}},
+		{In: "---\nlabels:\n- a\n- b\nstate: new\n---\n",
+			Want: map[string]node{"labels": {List: []string{"a", "b"}}, "state": {Scalar: "new"}}},
+		{In: "---\nassignee:\n  id: 1\n  name: \"John: Doe\"\n  email: ~\nstate: new\n---\n",
+			Want: map[string]node{"assignee": {Map: map[string]string{"id": "1", "name": "John: Doe", "email": ""}}, "state": {Scalar: "new"}}},
+		{In: "---\nsummary: |\n  line 1\n    indented\n\n  line 3\n\nstate: new\n---\n",
+			Want: map[string]node{"summary": {Scalar: "line 1\n  indented\n\nline 3\n"}, "state": {Scalar: "new"}}},
+		{In: "---\nsummary: >-\n  folded\n  line\n\n  next\nstrip: |-\n  x\n\nkeep: |+\n  y\n\n---\n",
+			Want: map[string]node{"summary": {Scalar: "folded line\nnext"}, "strip": {Scalar: "x"}, "keep": {Scalar: "y\n\n"}}},
+		{In: "---\ncustom:\n  a: |\n    multi\n    line\n  b: c\n---\n",
+			Want: map[string]node{"custom": {Map: map[string]string{"a": "multi\nline\n", "b": "c"}}}},
+	} {
+		got, body, err := parseFrontMatter([]byte(tc.In))
+		if err != nil {
+			t.Errorf("%d. %+v", i, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.Want) {
+			t.Errorf("%d. got %#v, wanted %#v", i, got, tc.Want)
+		}
+		if body != tc.Body {
+			t.Errorf("%d. body: got %q, wanted %q", i, body, tc.Body)
+		}
+	}
+}
+
+func TestParseFrontMatterUnsupported(t *testing.T) {
+	for _, in := range []string{
+		"assignee:\n  name: x\n  meta:\n    a: b",
+		"labels:\n  - a: b",
+		"labels:\n  - [a]",
+		"labels: [a, [b]]",
+		"labels: [a,\n  b]",
+		"summary: a: b",
+		"summary: &anchor x",
+		"summary: *alias",
+		"summary: !!str x",
+		"summary: \"unterminated",
+		"summary: \"bad \\q escape\"",
+		"summary: first\n  continued",
+		"summary: x\nsummary: y",
+		"summary: |\n    deep\n  shallow",
+		"\tsummary: tab",
+		"- item",
+		"? complex",
+	} {
+		if fields, _, err := parseFrontMatter([]byte("---\n" + in + "\n---\n")); err == nil {
+			t.Errorf("%q: got %#v, wanted an error", in, fields)
+		}
+	}
+}
+
+func TestIssueRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	c, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := it.Issue{
+		Summary: `"Quoted": with colon # and hash`, Description: "first\r\nsecond\n\n---\nafter a delimiter",
+		State: "new", Priority: "~", Labels: []string{"a, b", "null", "ünnep"},
+		Reporter: it.User{ID: "1", RealName: "Jöns: Jönsson", Email: "jj@example.com"},
+		Custom:   map[string]string{"Kategória: fő": "line\nbreak", "x": "y"},
+	}
+	ID, err := c.CreateIssue(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Summary != want.Summary || got.Description != want.Description || got.State != want.State ||
+		got.Priority != want.Priority || !reflect.DeepEqual(got.Labels, want.Labels) ||
+		got.Reporter != want.Reporter || !reflect.DeepEqual(got.Custom, want.Custom) {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+
+	// A file edited on Windows.
+	fn := filepath.Join(dir, string(ID), issueFile)
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(fn, []byte(strings.ReplaceAll(string(b), "\n", "\r\n")), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = c.GetIssue(ctx, ID); err != nil {
+		t.Fatal(err)
+	} else if got.Summary != want.Summary || !reflect.DeepEqual(got.Custom, want.Custom) {
+		t.Errorf("CRLF: got %+v", got)
+	}
+}
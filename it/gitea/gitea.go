@@ -0,0 +1,423 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gitea is the Gitea (and Forgejo) Issues tracker.
+//
+// The API is mostly compatible with GitHub's, so the model is shared with the github package.
+package gitea
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/github"
+	"github.com/UNO-SOFT/mantisync/it/internal/rest"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("gitea", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://gitea.com/api/swagger
+type Client struct {
+	rest.Client
+	id          string
+	repo        string
+	statePrefix string
+}
+
+// PageSize is the number of items requested in one page.
+const PageSize = 50
+
+// New returns a new Gitea client for the repository in the URL (https://gitea.example.com/owner/repo).
+//
+// The token is taken from the "token" query parameter, or the GITEA_TOKEN
+// environment variable. The labels starting with "state_prefix"
+// (default "state:") are the sub-state of the issue.
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	repo := strings.Trim(URL.Path, "/")
+	if strings.Count(repo, "/") != 1 {
+		return Client{}, fmt.Errorf("%q: repository should be owner/repo", baseURL)
+	}
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("GITEA_TOKEN")
+	}
+	statePrefix := github.DefaultStatePrefix
+	if _, ok := q["state_prefix"]; ok {
+		statePrefix = q.Get("state_prefix")
+	}
+	api := *URL
+	api.Path = "/api/v1/"
+	var header http.Header
+	if token != "" {
+		header = http.Header{"Authorization": {"token " + token}}
+	}
+	return Client{
+		Client: rest.Client{URL: &api, Header: header, HTTPClient: http.DefaultClient},
+		id:     baseURL, repo: repo,
+		statePrefix: statePrefix,
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+func (c Client) issuePath(ID it.IssueID) string {
+	return "repos/" + c.repo + "/issues/" + url.PathEscape(string(ID))
+}
+
+// GetIssue returns the data for the issueID
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return github.ReadIssue(gi, c.statePrefix), nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID) (github.Issue, error) {
+	var gi github.Issue
+	_, err := c.Do(ctx, "GET", c.issuePath(ID), nil, &gi)
+	return gi, err
+}
+
+// ListIssues lists all the issues (not the pull requests) created/changed since "since".
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	q := url.Values{"state": {"all"}, "type": {"issues"}, "limit": {strconv.Itoa(PageSize)}}
+	if !since.IsZero() {
+		q.Set("since", since.UTC().Format(time.RFC3339))
+	}
+	var issues []it.Issue
+	err := c.GetAll(ctx, "repos/"+c.repo+"/issues?"+q.Encode(), func(dec *json.Decoder) error {
+		var page []github.Issue
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		for _, gi := range page {
+			if gi.PullRequest == nil {
+				issues = append(issues, github.ReadIssue(gi, c.statePrefix))
+			}
+		}
+		return nil
+	})
+	return issues, err
+}
+
+// CreateIssue creates the issue, returning the ID.
+//
+// The API cannot set the author, so it is always written into the body.
+// The labels are set after the creation, as those need IDs at creation,
+// and so is a "closed" state.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	if issue.Summary == "" {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: []string{"summary"}}
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	body := issue.Description
+	if author != (it.User{}) {
+		body = it.Attribute(author, issue.CreatedAt, body)
+	}
+	req := github.IssueRequest{Title: &issue.Summary, Body: &body}
+	if issue.Assignee.ID != "" {
+		req.Assignees = &[]string{string(issue.Assignee.ID)}
+	}
+	if !issue.DueDate.IsZero() {
+		req.DueDate = &issue.DueDate
+	}
+	var gi github.Issue
+	if _, err := c.Do(ctx, "POST", "repos/"+c.repo+"/issues", req, &gi); err != nil {
+		return "", err
+	}
+	ID := it.IssueID(strconv.Itoa(gi.Number))
+	state, sub := it.SplitState(issue.State)
+	if labels := it.MergeLabels(issue.Labels, c.statePrefix, sub); len(labels) != 0 {
+		if err := c.setLabels(ctx, ID, labels); err != nil {
+			return ID, err
+		}
+	}
+	if state != "" && state != gi.State {
+		if _, err := c.Do(ctx, "PATCH", c.issuePath(ID), github.IssueRequest{State: &state}, nil); err != nil {
+			return ID, fmt.Errorf("set state of %q to %q: %w", ID, state, err)
+		}
+	}
+	return ID, nil
+}
+
+// UpdateIssueState updates the issue's state, "open" or "closed", optionally followed by "/" and the sub-state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The sub-state label is kept when only the labels change, and the other labels
+// when only the state changes.
+// An assignee without ID (not a mapped Gitea user) is left as is.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	var req github.IssueRequest
+	if upd.Fields.Has(it.FieldSummary) {
+		req.Title = &upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		req.Body = &upd.Description
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			req.Assignees = &[]string{string(upd.Assignee.ID)}
+		} else if upd.Assignee == (it.User{}) {
+			req.Assignees = &[]string{}
+		}
+	}
+	var labels []string
+	setLabels := upd.Fields.Has(it.FieldLabels) || (upd.Fields.Has(it.FieldState) && upd.State != "")
+	if setLabels {
+		gi, err := c.getIssue(ctx, ID)
+		if err != nil {
+			return err
+		}
+		current := github.ReadIssue(gi, c.statePrefix)
+		labels = current.Labels
+		if upd.Fields.Has(it.FieldLabels) {
+			labels = upd.Labels
+		}
+		_, sub := it.SplitState(current.State)
+		if upd.Fields.Has(it.FieldState) && upd.State != "" {
+			var state string
+			state, sub = it.SplitState(upd.State)
+			if state != gi.State {
+				req.State = &state
+			}
+		}
+		labels = it.MergeLabels(labels, c.statePrefix, sub)
+	}
+	if req != (github.IssueRequest{}) {
+		if _, err := c.Do(ctx, "PATCH", c.issuePath(ID), req, nil); err != nil {
+			return fmt.Errorf("update %q: %w", ID, err)
+		}
+	}
+	if setLabels {
+		return c.setLabels(ctx, ID, labels)
+	}
+	return nil
+}
+
+// setLabels replaces the labels of the issue, creating the missing ones in the repository.
+func (c Client) setLabels(ctx context.Context, ID it.IssueID, names []string) error {
+	existing, err := c.listLabels(ctx)
+	if err != nil {
+		return err
+	}
+	ids := make([]int64, 0, len(names))
+	for _, name := range names {
+		l, ok := existing[name]
+		if !ok {
+			if _, err = c.Do(ctx, "POST", "repos/"+c.repo+"/labels",
+				map[string]string{"name": name, "color": "#cccccc"}, &l,
+			); err != nil {
+				return fmt.Errorf("create label %q: %w", name, err)
+			}
+		}
+		ids = append(ids, l.ID)
+	}
+	if _, err = c.Do(ctx, "PUT", c.issuePath(ID)+"/labels", map[string][]int64{"labels": ids}, nil); err != nil {
+		return fmt.Errorf("set labels of %q: %w", ID, err)
+	}
+	return nil
+}
+
+func (c Client) listLabels(ctx context.Context) (map[string]github.Label, error) {
+	labels := make(map[string]github.Label)
+	err := c.GetAll(ctx, "repos/"+c.repo+"/labels?limit="+strconv.Itoa(PageSize), func(dec *json.Decoder) error {
+		var page []github.Label
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		for _, l := range page {
+			labels[l.Name] = l
+		}
+		return nil
+	})
+	return labels, err
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// Gitea issues have no custom fields.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	return it.ErrNotImplemented
+}
+
+// ListStates lists the states an issue can be in:
+// open and closed, and each with the sub-state labels.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	states := []it.State{"open", "closed"}
+	if c.statePrefix == "" {
+		return states, nil
+	}
+	labels, err := c.listLabels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range []string{"open", "closed"} {
+		for name := range labels {
+			if strings.HasPrefix(name, c.statePrefix) {
+				states = append(states, it.JoinState(state, strings.TrimPrefix(name, c.statePrefix)))
+			}
+		}
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var resp struct {
+		Data []github.User `json:"data"`
+	}
+	if _, err := c.Do(ctx, "GET", "users/search?"+url.Values{"q": {email}}.Encode(), nil, &resp); err != nil {
+		return it.User{}, err
+	}
+	for _, u := range resp.Data {
+		if strings.EqualFold(u.Email, email) {
+			return github.ReadUser(&u), nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a comment to the issue.
+//
+// The API cannot set the author, so it is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	var gc github.Comment
+	if _, err := c.Do(ctx, "POST", c.issuePath(ID)+"/comments", map[string]string{"body": comment.AttributedBody()}, &gc); err != nil {
+		return "", err
+	}
+	return it.CommentID(strconv.FormatInt(gc.ID, 10)), nil
+}
+
+// ListComments list the comments of the issue.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	gcs, err := c.listComments(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, len(gcs))
+	for i, gc := range gcs {
+		comments[i] = github.ReadComment(gc)
+	}
+	return comments, nil
+}
+
+func (c Client) listComments(ctx context.Context, ID it.IssueID) ([]github.Comment, error) {
+	var gcs []github.Comment
+	_, err := c.Do(ctx, "GET", c.issuePath(ID)+"/comments", nil, &gcs)
+	return gcs, err
+}
+
+// AddAttachment uploads the file as an asset of the issue.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	w, err := mw.CreateFormFile("attachment", a.Name)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", err
+	}
+	req, err := c.NewRequest(ctx, "POST", c.issuePath(ID)+"/assets?"+url.Values{"name": {a.Name}}.Encode(), &buf)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var asset github.Asset
+	if _, err = c.Send(req, &asset); err != nil {
+		return "", fmt.Errorf("upload %q: %w", a.Name, err)
+	}
+	return it.AttachmentID(strconv.FormatInt(asset.ID, 10)), nil
+}
+
+// ListAttachments lists the assets of the issue and its comments.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	gcs, err := c.listComments(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	var as []it.Attachment
+	add := func(assets []github.Asset, author *github.User) {
+		for _, x := range assets {
+			dl := x.BrowserDownloadURL
+			as = append(as, it.Attachment{
+				ID:        it.AttachmentID(strconv.FormatInt(x.ID, 10)),
+				Name:      x.Name,
+				Author:    github.ReadUser(author),
+				CreatedAt: x.CreatedAt,
+				URL:       dl,
+				GetBody: func() (io.ReadCloser, error) {
+					req, err := c.NewRequest(ctx, "GET", dl, nil)
+					if err != nil {
+						return nil, err
+					}
+					req.Header.Del("Accept")
+					hc := c.HTTPClient
+					if hc == nil {
+						hc = http.DefaultClient
+					}
+					resp, err := hc.Do(req)
+					if err != nil {
+						return nil, err
+					}
+					if resp.StatusCode >= 300 {
+						resp.Body.Close()
+						return nil, fmt.Errorf("GET %s: %s", dl, resp.Status)
+					}
+					return resp.Body, nil
+				},
+			})
+		}
+	}
+	add(gi.Assets, gi.User)
+	for _, gc := range gcs {
+		add(gc.Assets, gc.User)
+	}
+	return as, nil
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gitea
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/gitea/giteatest"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+func newTestClient(t *testing.T) (Client, *giteatest.Server) {
+	t.Helper()
+	srv := giteatest.NewServer("owner/repo", "secret")
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + "/owner/repo?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.MaxResponseItems = 7
+		srv.AddUser(giteatest.User{ID: 2, Login: "jdoe", FullName: "John Doe", Email: "jdoe@example.com"})
+		srv.AddUser(giteatest.User{ID: 3, Login: "jdoe2", FullName: "Jane Doe", Email: "jdoe@example.com.au"})
+		return c
+	}, ittest.WithPageSize(7),
+		ittest.WithUser(it.User{ID: "jdoe", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	GITEA_TEST_URL='https://gitea.example.com/owner/repo?token=...' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("GITEA_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestSubState(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddLabel("state:in progress")
+
+	states, err := c.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []it.State{"open", "closed", "open/in progress", "closed/in progress"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("ListStates: got %q, wanted %q", states, want)
+	}
+
+	// The labels are created as needed.
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "sub-state", State: "closed/in progress", Labels: []string{"bug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(state it.State, labels ...string) {
+		t.Helper()
+		issue, err := c.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.State != state {
+			t.Errorf("state: got %q, wanted %q", issue.State, state)
+		}
+		sort.Strings(issue.Labels)
+		if !reflect.DeepEqual(issue.Labels, labels) {
+			t.Errorf("labels: got %q, wanted %q", issue.Labels, labels)
+		}
+	}
+	check("closed/in progress", "bug")
+
+	if err = c.UpdateIssueState(ctx, ID, "open"); err != nil {
+		t.Fatal(err)
+	}
+	check("open", "bug")
+	if err = c.UpdateIssueState(ctx, ID, "open/in progress"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{Labels: []string{"bug", "ui"}}, Fields: it.FieldLabels}); err != nil {
+		t.Fatal(err)
+	}
+	check("open/in progress", "bug", "ui")
+}
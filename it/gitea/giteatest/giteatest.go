@@ -0,0 +1,574 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package giteatest provides an in-process Gitea REST API (v1) server, for testing.
+//
+// It implements the endpoints used by the gitea package, for one repository:
+// issue list (paginated by page and limit, with the Link header, and filtered by type),
+// get, create and edit, labels (set by ID), comments, issue assets and user search.
+//
+// The Authorization header must hold the Token, if it is not empty.
+package giteatest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a Gitea server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Repo is the served "owner/repo" repository.
+	Repo string
+	// Token is the accepted token.
+	Token string
+	// MaxResponseItems caps the page size, 50 by default.
+	MaxResponseItems int
+	// Me is the owner of the token, the author of the created issues, comments and assets.
+	Me User
+
+	mu          sync.Mutex
+	users       []User
+	labels      []label
+	issues      []*issue
+	lastComment int64
+	assets      []*asset
+}
+
+// User is a Gitea account.
+type User struct {
+	ID       int64  `json:"id"`
+	Login    string `json:"login"`
+	FullName string `json:"full_name"`
+	Email    string `json:"email"`
+}
+
+type label struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+type asset struct {
+	ID                 int64     `json:"id"`
+	Name               string    `json:"name"`
+	Size               int64     `json:"size"`
+	DownloadCount      int64     `json:"download_count"`
+	CreatedAt          time.Time `json:"created_at"`
+	UUID               string    `json:"uuid"`
+	BrowserDownloadURL string    `json:"browser_download_url"`
+	data               []byte
+}
+
+type comment struct {
+	ID        int64     `json:"id"`
+	Body      string    `json:"body"`
+	User      *User     `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	Assets    []*asset  `json:"assets"`
+}
+
+type issue struct {
+	Number      int
+	Title, Body string
+	State       string
+	User        User
+	Assignees   []User
+	Labels      []label
+	DueDate     *time.Time
+	Assets      []*asset
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	PullRequest bool
+	Comments    []*comment
+}
+
+// NewServer starts and returns a new server for the "owner/repo" repository, accepting the token.
+// The caller should call Close when finished, to shut it down.
+func NewServer(repo, token string) *Server {
+	s := &Server{
+		Repo: repo, Token: token,
+		MaxResponseItems: 50,
+		Me:               User{ID: 1, Login: "gitea", FullName: "Gitea Admin", Email: "gitea@example.com"},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// AddLabel adds a label to the repository.
+func (s *Server) AddLabel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.addLabel(name, "#ededed")
+}
+
+// AddPullRequest opens a pull request, returning its number, shared with the issues.
+func (s *Server) AddPullRequest(title string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := now()
+	is := &issue{
+		Number: len(s.issues) + 1, Title: title, State: "open", User: s.Me,
+		CreatedAt: t, UpdatedAt: t, PullRequest: true,
+	}
+	s.issues = append(s.issues, is)
+	return is.Number
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Code    int    `json:"-"`
+	Message string `json:"message"`
+	URL     string `json:"url"`
+}
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...), URL: "https://gitea.com/api/swagger"}
+}
+
+func notFound() *apiError { return errorf(http.StatusNotFound, "The target couldn't be found.") }
+
+// now returns the current time with the seconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(r.URL.Path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(p, "attachments/") {
+		// The downloads need no token.
+		s.download(w, r, strings.TrimPrefix(p, "attachments/"))
+		return
+	}
+	if s.Token != "" && r.Header.Get("Authorization") != "token "+s.Token {
+		writeJSON(w, 0, errorf(http.StatusUnauthorized, "user does not exist [uid: 0, name: ]"))
+		return
+	}
+	var code int
+	var result interface{}
+	err := notFound()
+	if r.Method == "GET" && p == "api/v1/users/search" {
+		result, err = s.searchUsers(r), nil
+		writeResult(w, code, result, err)
+		return
+	}
+	prefix := "api/v1/repos/" + s.Repo + "/"
+	if !strings.HasPrefix(p, prefix) {
+		writeResult(w, code, result, err)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, prefix), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "labels":
+		labels := make([]interface{}, len(s.labels))
+		for i, l := range s.labels {
+			labels[i] = l
+		}
+		result, err = s.page(w, r, labels)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "labels":
+		code = http.StatusCreated
+		result, err = s.createLabel(r)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "issues":
+		result, err = s.list(w, r)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "issues":
+		code = http.StatusCreated
+		result, err = s.create(r)
+	case len(parts) >= 2 && parts[0] == "issues":
+		is := s.issue(parts[1])
+		if is == nil {
+			break
+		}
+		switch endpoint := strings.Join(parts[2:], "/"); {
+		case r.Method == "GET" && endpoint == "":
+			result, err = s.render(is), nil
+		case r.Method == "PATCH" && endpoint == "":
+			code = http.StatusCreated
+			result, err = s.edit(is, r)
+		case r.Method == "PUT" && endpoint == "labels":
+			result, err = s.setLabels(is, r)
+		case r.Method == "GET" && endpoint == "comments":
+			comments := make([]*comment, len(is.Comments))
+			copy(comments, is.Comments)
+			result, err = comments, nil
+		case r.Method == "POST" && endpoint == "comments":
+			code = http.StatusCreated
+			result, err = s.addComment(is, r)
+		case r.Method == "POST" && endpoint == "assets":
+			code = http.StatusCreated
+			result, err = s.addAsset(is, r)
+		}
+	}
+	writeResult(w, code, result, err)
+}
+
+func writeResult(w http.ResponseWriter, code int, result interface{}, err *apiError) {
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json;charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// issue returns the issue (or pull request) by number, or nil. s.mu must be held.
+func (s *Server) issue(number string) *issue {
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 || n > len(s.issues) {
+		return nil
+	}
+	return s.issues[n-1]
+}
+
+// addLabel adds a new label. s.mu must be held.
+func (s *Server) addLabel(name, color string) label {
+	l := label{ID: int64(len(s.labels) + 1), Name: name, Color: strings.TrimPrefix(color, "#")}
+	s.labels = append(s.labels, l)
+	return l
+}
+
+// user returns the user by login, or nil. s.mu must be held.
+func (s *Server) user(login string) *User {
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.Login == login {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) render(is *issue) map[string]interface{} {
+	m := map[string]interface{}{
+		"number":     is.Number,
+		"title":      is.Title,
+		"body":       is.Body,
+		"state":      is.State,
+		"user":       is.User,
+		"labels":     append([]label{}, is.Labels...),
+		"assignees":  nil,
+		"assignee":   nil,
+		"comments":   len(is.Comments),
+		"due_date":   is.DueDate,
+		"assets":     append([]*asset{}, is.Assets...),
+		"created_at": is.CreatedAt,
+		"updated_at": is.UpdatedAt,
+		// Gitea sends it for the issues, too, as null.
+		"pull_request": nil,
+	}
+	if len(is.Assignees) != 0 {
+		m["assignee"], m["assignees"] = is.Assignees[0], is.Assignees
+	}
+	if is.PullRequest {
+		m["pull_request"] = map[string]interface{}{"merged": false, "merged_at": nil}
+	}
+	return m
+}
+
+// page returns the page of items selected by the page and limit parameters,
+// and sets the Link header to the next and last pages, and the X-Total-Count header.
+func (s *Server) page(w http.ResponseWriter, r *http.Request, items []interface{}) ([]interface{}, *apiError) {
+	q := r.URL.Query()
+	limit := s.MaxResponseItems
+	if v := q.Get("limit"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 && n < limit {
+			limit = n
+		}
+	}
+	page := 1
+	if v := q.Get("page"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			page = n
+		}
+	}
+	last := (len(items) + limit - 1) / limit
+	link := func(page int, rel string) string {
+		q.Set("page", strconv.Itoa(page))
+		return "<" + s.URL + r.URL.Path + "?" + q.Encode() + `>; rel="` + rel + `"`
+	}
+	if page < last {
+		w.Header().Set("Link", link(page+1, "next")+","+link(last, "last"))
+	}
+	w.Header().Set("X-Total-Count", strconv.Itoa(len(items)))
+	from, to := (page-1)*limit, page*limit
+	if from > len(items) {
+		from = len(items)
+	}
+	if to > len(items) {
+		to = len(items)
+	}
+	return append([]interface{}{}, items[from:to]...), nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errorf(http.StatusUnprocessableEntity, "since: %v", err)
+		}
+	}
+	state := q.Get("state")
+	if state == "" {
+		state = "open"
+	}
+	typ := q.Get("type")
+	issues := make([]*issue, 0, len(s.issues))
+	for _, is := range s.issues {
+		if (state == "all" || is.State == state) &&
+			(typ == "" || (typ == "pulls") == is.PullRequest) &&
+			!is.UpdatedAt.Before(since) {
+			issues = append(issues, is)
+		}
+	}
+	// The newest first.
+	sort.SliceStable(issues, func(i, j int) bool { return issues[i].Number > issues[j].Number })
+	items := make([]interface{}, len(issues))
+	for i, is := range issues {
+		items[i] = s.render(is)
+	}
+	return s.page(w, r, items)
+}
+
+// issueRequest is the body of the issue create and edit requests.
+type issueRequest struct {
+	Title     *string    `json:"title"`
+	Body      *string    `json:"body"`
+	State     *string    `json:"state"`
+	Assignees *[]string  `json:"assignees"`
+	DueDate   *time.Time `json:"due_date"`
+	// Labels are the label IDs, on creation only.
+	Labels []int64 `json:"labels"`
+}
+
+func readRequest(r *http.Request, v interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errorf(http.StatusUnprocessableEntity, "%v", err)
+	}
+	return nil
+}
+
+// labelsByID returns the labels of the IDs. s.mu must be held.
+func (s *Server) labelsByID(ids []int64) ([]label, *apiError) {
+	labels := make([]label, 0, len(ids))
+Loop:
+	for _, id := range ids {
+		for _, l := range s.labels {
+			if l.ID == id {
+				labels = append(labels, l)
+				continue Loop
+			}
+		}
+		return nil, errorf(http.StatusUnprocessableEntity, "label does not exist [id: %d]", id)
+	}
+	return labels, nil
+}
+
+// apply sets the fields of the request on the issue. s.mu must be held.
+func (s *Server) apply(is *issue, req issueRequest) *apiError {
+	if req.Title != nil {
+		if *req.Title == "" {
+			return errorf(http.StatusUnprocessableEntity, "[Title]: Required")
+		}
+		is.Title = *req.Title
+	}
+	if req.Body != nil {
+		is.Body = *req.Body
+	}
+	if req.State != nil {
+		if *req.State != "open" && *req.State != "closed" {
+			return errorf(http.StatusUnprocessableEntity, "unknown state %q", *req.State)
+		}
+		is.State = *req.State
+	}
+	if req.Assignees != nil {
+		assignees := make([]User, 0, len(*req.Assignees))
+		for _, login := range *req.Assignees {
+			u := s.user(login)
+			if u == nil {
+				return errorf(http.StatusUnprocessableEntity, "user does not exist [name: %s]", login)
+			}
+			assignees = append(assignees, *u)
+		}
+		is.Assignees = assignees
+	}
+	if req.DueDate != nil {
+		d := req.DueDate.UTC()
+		is.DueDate = &d
+	}
+	if req.Labels != nil {
+		labels, err := s.labelsByID(req.Labels)
+		if err != nil {
+			return err
+		}
+		is.Labels = labels
+	}
+	return nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	var req issueRequest
+	if err := readRequest(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Title == nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "[Title]: Required")
+	}
+	t := now()
+	is := &issue{Number: len(s.issues) + 1, State: "open", User: s.Me, CreatedAt: t, UpdatedAt: t}
+	if err := s.apply(is, req); err != nil {
+		return nil, err
+	}
+	s.issues = append(s.issues, is)
+	return s.render(is), nil
+}
+
+func (s *Server) edit(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req issueRequest
+	if err := readRequest(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Labels != nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "the labels are set with the labels endpoint")
+	}
+	upd := *is
+	if err := s.apply(&upd, req); err != nil {
+		return nil, err
+	}
+	upd.UpdatedAt = now()
+	*is = upd
+	return s.render(is), nil
+}
+
+func (s *Server) createLabel(r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Name  string `json:"name"`
+		Color string `json:"color"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Name == "" || req.Color == "" {
+		return nil, errorf(http.StatusUnprocessableEntity, "[Name Color]: Required")
+	}
+	for _, l := range s.labels {
+		if l.Name == req.Name {
+			return nil, errorf(http.StatusUnprocessableEntity, "label already exists [name: %s]", req.Name)
+		}
+	}
+	return s.addLabel(req.Name, req.Color), nil
+}
+
+func (s *Server) setLabels(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Labels []int64 `json:"labels"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return nil, err
+	}
+	labels, err := s.labelsByID(req.Labels)
+	if err != nil {
+		return nil, err
+	}
+	is.Labels = labels
+	is.UpdatedAt = now()
+	return append([]label{}, labels...), nil
+}
+
+func (s *Server) addComment(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Body string `json:"body"`
+	}
+	if err := readRequest(r, &req); err != nil {
+		return nil, err
+	}
+	if req.Body == "" {
+		return nil, errorf(http.StatusUnprocessableEntity, "[Body]: Required")
+	}
+	s.lastComment++
+	me := s.Me
+	c := &comment{ID: s.lastComment, Body: req.Body, User: &me, CreatedAt: now(), Assets: []*asset{}}
+	c.UpdatedAt = c.CreatedAt
+	is.Comments = append(is.Comments, c)
+	is.UpdatedAt = c.CreatedAt
+	return c, nil
+}
+
+func (s *Server) addAsset(is *issue, r *http.Request) (interface{}, *apiError) {
+	f, fh, err := r.FormFile("attachment")
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "attachment: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errorf(http.StatusInternalServerError, "%v", err)
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		name = fh.Filename
+	}
+	a := &asset{
+		ID: int64(len(s.assets) + 1), Name: name, Size: int64(len(data)),
+		CreatedAt: now(), data: data,
+	}
+	a.UUID = fmt.Sprintf("%08x-0000-4000-8000-%012x", a.ID, a.ID)
+	a.BrowserDownloadURL = s.URL + "/attachments/" + a.UUID
+	s.assets = append(s.assets, a)
+	is.Assets = append(is.Assets, a)
+	is.UpdatedAt = a.CreatedAt
+	return a, nil
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, uuid string) {
+	for _, a := range s.assets {
+		if a.UUID == uuid {
+			a.DownloadCount++
+			w.Header().Set("Content-Type", "application/octet-stream")
+			w.Write(a.data)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// searchUsers searches the users by login, full name and email, returning them in the "data" field.
+func (s *Server) searchUsers(r *http.Request) interface{} {
+	q := strings.ToLower(r.URL.Query().Get("q"))
+	data := []User{}
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if strings.Contains(strings.ToLower(u.Login), q) ||
+			strings.Contains(strings.ToLower(u.FullName), q) ||
+			strings.Contains(strings.ToLower(u.Email), q) {
+			data = append(data, u)
+		}
+	}
+	return map[string]interface{}{"ok": true, "data": data}
+}
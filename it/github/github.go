@@ -0,0 +1,421 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package github is the GitHub Issues tracker.
+package github
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/internal/rest"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("github", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://docs.github.com/en/rest/issues
+type Client struct {
+	rest.Client
+	id          string
+	repo        string
+	statePrefix string
+}
+
+// DefaultURL is the URL of the public GitHub API.
+const DefaultURL = "https://api.github.com/"
+
+// New returns a new GitHub client for the "owner/repo" repository.
+//
+// The token is taken from the "token" query parameter, or the GITHUB_TOKEN
+// environment variable. The "api" query parameter overrides the URL of the API
+// (for GitHub Enterprise), the labels starting with "state_prefix"
+// (default "state:") are the sub-state of the issue.
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	repo := strings.Trim(URL.Path, "/")
+	if strings.Count(repo, "/") != 1 {
+		return Client{}, fmt.Errorf("%q: repository should be owner/repo", baseURL)
+	}
+	apiURL := q.Get("api")
+	if apiURL == "" {
+		apiURL = DefaultURL
+	}
+	if !strings.HasSuffix(apiURL, "/") {
+		apiURL += "/"
+	}
+	api, err := url.Parse(apiURL)
+	if err != nil {
+		return Client{}, err
+	}
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("GITHUB_TOKEN")
+	}
+	statePrefix := DefaultStatePrefix
+	if _, ok := q["state_prefix"]; ok {
+		statePrefix = q.Get("state_prefix")
+	}
+	return Client{
+		Client: rest.Client{URL: api, Header: authHeader(token), HTTPClient: http.DefaultClient},
+		id:     apiURL + "repos/" + repo, repo: repo,
+		statePrefix: statePrefix,
+	}, nil
+}
+
+// authHeader returns the header authenticating with the token, if not empty.
+func authHeader(token string) http.Header {
+	if token == "" {
+		return nil
+	}
+	return http.Header{"Authorization": {"token " + token}}
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+func (c Client) issuePath(ID it.IssueID) string {
+	return "repos/" + c.repo + "/issues/" + url.PathEscape(string(ID))
+}
+
+// GetIssue returns the data for the issueID
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return ReadIssue(gi, c.statePrefix), nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID) (Issue, error) {
+	var gi Issue
+	if _, err := c.Do(ctx, "GET", c.issuePath(ID), nil, &gi); err != nil {
+		return gi, err
+	}
+	if gi.PullRequest != nil {
+		return gi, fmt.Errorf("%q is a pull request: %w", ID, it.ErrNotFound)
+	}
+	return gi, nil
+}
+
+// ListIssues lists all the issues created/changed since "since".
+//
+// The pull requests are skipped.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	q := url.Values{"state": {"all"}, "sort": {"updated"}, "direction": {"asc"}, "per_page": {"100"}}
+	if !since.IsZero() {
+		q.Set("since", since.UTC().Format(time.RFC3339))
+	}
+	var issues []it.Issue
+	err := c.GetAll(ctx, "repos/"+c.repo+"/issues?"+q.Encode(), func(dec *json.Decoder) error {
+		var page []Issue
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		for _, gi := range page {
+			if gi.PullRequest == nil {
+				issues = append(issues, ReadIssue(gi, c.statePrefix))
+			}
+		}
+		return nil
+	})
+	return issues, err
+}
+
+// CreateIssue creates the issue, returning the ID.
+//
+// The API cannot set the author, so it is always written into the body.
+// A "closed" state is set after the creation.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	if issue.Summary == "" {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: []string{"summary"}}
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	body := issue.Description
+	if author != (it.User{}) {
+		body = it.Attribute(author, issue.CreatedAt, body)
+	}
+	state, sub := it.SplitState(issue.State)
+	labels := it.MergeLabels(issue.Labels, c.statePrefix, sub)
+	req := IssueRequest{Title: &issue.Summary, Body: &body, Labels: &labels}
+	if issue.Assignee.ID != "" {
+		req.Assignees = &[]string{string(issue.Assignee.ID)}
+	}
+	var gi Issue
+	if _, err := c.Do(ctx, "POST", "repos/"+c.repo+"/issues", req, &gi); err != nil {
+		return "", err
+	}
+	ID := it.IssueID(strconv.Itoa(gi.Number))
+	if state != "" && state != gi.State {
+		if _, err := c.Do(ctx, "PATCH", c.issuePath(ID), IssueRequest{State: &state}, nil); err != nil {
+			return ID, fmt.Errorf("set state of %q to %q: %w", ID, state, err)
+		}
+	}
+	return ID, nil
+}
+
+// UpdateIssueState updates the issue's state, "open" or "closed", optionally followed by "/" and the sub-state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The sub-state label is kept when only the labels change, and the other labels
+// when only the state changes.
+// An assignee without ID (not a mapped GitHub user) is left as is.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	var req IssueRequest
+	if upd.Fields.Has(it.FieldSummary) {
+		req.Title = &upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		req.Body = &upd.Description
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			req.Assignees = &[]string{string(upd.Assignee.ID)}
+		} else if upd.Assignee == (it.User{}) {
+			req.Assignees = &[]string{}
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) || (upd.Fields.Has(it.FieldState) && upd.State != "") {
+		gi, err := c.getIssue(ctx, ID)
+		if err != nil {
+			return err
+		}
+		current := ReadIssue(gi, c.statePrefix)
+		labels := current.Labels
+		if upd.Fields.Has(it.FieldLabels) {
+			labels = upd.Labels
+		}
+		_, sub := it.SplitState(current.State)
+		if upd.Fields.Has(it.FieldState) && upd.State != "" {
+			var state string
+			state, sub = it.SplitState(upd.State)
+			req.State = &state
+		}
+		labels = it.MergeLabels(labels, c.statePrefix, sub)
+		req.Labels = &labels
+	}
+	if req == (IssueRequest{}) {
+		return nil
+	}
+	if _, err := c.Do(ctx, "PATCH", c.issuePath(ID), req, nil); err != nil {
+		return fmt.Errorf("update %q: %w", ID, err)
+	}
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// GitHub issues have no custom fields.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	return it.ErrNotImplemented
+}
+
+// ListStates lists the states an issue can be in:
+// open and closed, and each with the sub-state labels.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	states := []it.State{"open", "closed"}
+	if c.statePrefix == "" {
+		return states, nil
+	}
+	var subs []string
+	err := c.GetAll(ctx, "repos/"+c.repo+"/labels?per_page=100", func(dec *json.Decoder) error {
+		var page []Label
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		for _, l := range page {
+			if strings.HasPrefix(l.Name, c.statePrefix) {
+				subs = append(subs, strings.TrimPrefix(l.Name, c.statePrefix))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	for _, state := range []string{"open", "closed"} {
+		for _, sub := range subs {
+			states = append(states, it.JoinState(state, sub))
+		}
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given (public) email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var resp struct {
+		Items []User `json:"items"`
+	}
+	if _, err := c.Do(ctx, "GET", "search/users?"+url.Values{"q": {email + " in:email"}}.Encode(), nil, &resp); err != nil {
+		return it.User{}, err
+	}
+	if len(resp.Items) == 0 {
+		return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+	}
+	u := ReadUser(&resp.Items[0])
+	u.Email = email
+	return u, nil
+}
+
+// AddComment adds a comment to the issue.
+//
+// The API cannot set the author, so it is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	var gc Comment
+	if _, err := c.Do(ctx, "POST", c.issuePath(ID)+"/comments", Comment{Body: comment.AttributedBody()}, &gc); err != nil {
+		return "", err
+	}
+	return it.CommentID(strconv.FormatInt(gc.ID, 10)), nil
+}
+
+// ListComments list the comments of the issue, without the attachment links.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	gcs, err := c.listComments(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, 0, len(gcs))
+	for _, gc := range gcs {
+		if !strings.HasPrefix(gc.Body, attachmentPrefix) {
+			comments = append(comments, ReadComment(gc))
+		}
+	}
+	return comments, nil
+}
+
+func (c Client) listComments(ctx context.Context, ID it.IssueID) ([]Comment, error) {
+	var gcs []Comment
+	err := c.GetAll(ctx, c.issuePath(ID)+"/comments?per_page=100", func(dec *json.Decoder) error {
+		var page []Comment
+		if err := dec.Decode(&page); err != nil {
+			return err
+		}
+		gcs = append(gcs, page...)
+		return nil
+	})
+	return gcs, err
+}
+
+// attachmentPrefix starts the comments added by AddAttachment.
+const attachmentPrefix = "Attachment: "
+
+// AddAttachment adds the attachment to the issue.
+//
+// The API cannot upload files, so a comment is added with a link to the
+// attachment's URL, which is the ID of the new attachment.
+// Without an URL, only the name is noted.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	body := attachmentPrefix + a.Name + " (not available)"
+	if a.URL != "" {
+		body = attachmentPrefix + "[" + a.Name + "](" + a.URL + ")"
+	}
+	var gc Comment
+	if _, err := c.Do(ctx, "POST", c.issuePath(ID)+"/comments", Comment{Body: body}, &gc); err != nil {
+		return "", err
+	}
+	if a.URL == "" {
+		return it.AttachmentID("comment-" + strconv.FormatInt(gc.ID, 10)), nil
+	}
+	return it.AttachmentID(a.URL), nil
+}
+
+// ListAttachments lists the files uploaded to the issue's body and comments,
+// and the links added by AddAttachment. The ID of an attachment is its URL.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	gcs, err := c.listComments(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	var as []it.Attachment
+	seen := make(map[string]bool)
+	add := func(text string, all bool, author it.User, createdAt time.Time) {
+		for _, l := range Links(text) {
+			if seen[l.URL] || !(all || isUpload(l.URL)) {
+				continue
+			}
+			seen[l.URL] = true
+			name := l.Text
+			if name == "" {
+				name = path.Base(l.URL)
+			}
+			as = append(as, it.Attachment{
+				ID: it.AttachmentID(l.URL), Name: name, URL: l.URL,
+				Author: author, CreatedAt: createdAt,
+				GetBody: c.download(ctx, l.URL),
+			})
+		}
+	}
+	add(gi.Body, false, ReadUser(gi.User), gi.CreatedAt)
+	for _, gc := range gcs {
+		add(gc.Body, strings.HasPrefix(gc.Body, attachmentPrefix), ReadUser(gc.User), gc.CreatedAt)
+	}
+	return as, nil
+}
+
+// isUpload reports whether the URL points to a file uploaded to GitHub.
+func isUpload(s string) bool {
+	u, err := url.Parse(s)
+	if err != nil {
+		return false
+	}
+	switch u.Host {
+	case "user-images.githubusercontent.com", "private-user-images.githubusercontent.com":
+		return true
+	case "github.com":
+		return strings.Contains(u.Path, "/files/") || strings.HasPrefix(u.Path, "/user-attachments/")
+	}
+	return false
+}
+
+func (c Client) download(ctx context.Context, URL string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		req, err := http.NewRequest("GET", URL, nil)
+		if err != nil {
+			return nil, err
+		}
+		hc := c.HTTPClient
+		if hc == nil {
+			hc = http.DefaultClient
+		}
+		resp, err := hc.Do(req.WithContext(ctx))
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode >= 300 {
+			resp.Body.Close()
+			return nil, fmt.Errorf("GET %s: %s", URL, resp.Status)
+		}
+		return resp.Body, nil
+	}
+}
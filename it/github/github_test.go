@@ -0,0 +1,127 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package github
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/github/githubtest"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+func newTestClient(t *testing.T) (Client, *githubtest.Server) {
+	t.Helper()
+	srv := githubtest.NewServer("owner/repo", "secret")
+	t.Cleanup(srv.Close)
+	c, err := New("https://github.com/owner/repo?" + url.Values{"api": {srv.URL}, "token": {"secret"}}.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.MaxPerPage = 7
+		srv.AddUser(githubtest.User{ID: 2, Login: "jdoe", Name: "John Doe", Email: "jdoe@example.com"})
+		return c
+	}, ittest.WithPageSize(7),
+		ittest.WithUser(it.User{ID: "jdoe", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	GITHUB_TEST_URL='https://github.com/owner/repo?token=...' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("GITHUB_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestPullRequests(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "issue"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr := it.IssueID(strconv.Itoa(srv.AddPullRequest("pull request")))
+	issues, err := c.ListIssues(ctx, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].ID != ID {
+		t.Errorf("got %+v, wanted only %q", issues, ID)
+	}
+	if _, err = c.GetIssue(ctx, pr); !errors.Is(err, it.ErrNotFound) {
+		t.Errorf("GetIssue(%q) of a pull request: got %+v, wanted ErrNotFound", pr, err)
+	}
+}
+
+func TestSubState(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddLabel("state:in progress")
+
+	states, err := c.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []it.State{"open", "closed", "open/in progress", "closed/in progress"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("ListStates: got %q, wanted %q", states, want)
+	}
+
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "sub-state", State: "open/in progress", Labels: []string{"bug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(state it.State, labels ...string) {
+		t.Helper()
+		issue, err := c.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.State != state {
+			t.Errorf("state: got %q, wanted %q", issue.State, state)
+		}
+		sort.Strings(issue.Labels)
+		if !reflect.DeepEqual(issue.Labels, labels) {
+			t.Errorf("labels: got %q, wanted %q", issue.Labels, labels)
+		}
+	}
+	check("open/in progress", "bug")
+
+	// The labels are kept when the state changes,
+	if err = c.UpdateIssueState(ctx, ID, "closed"); err != nil {
+		t.Fatal(err)
+	}
+	check("closed", "bug")
+	if err = c.UpdateIssueState(ctx, ID, "open/in progress"); err != nil {
+		t.Fatal(err)
+	}
+	// and the sub-state when the labels change.
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{Labels: []string{"bug", "ui"}}, Fields: it.FieldLabels}); err != nil {
+		t.Fatal(err)
+	}
+	check("open/in progress", "bug", "ui")
+}
@@ -0,0 +1,466 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package githubtest provides an in-process GitHub REST API server, for testing.
+//
+// It implements the endpoints used by the github package, for one repository:
+// issue list (paginated with the Link header, including the pull requests as GitHub does),
+// get, create and edit, comments, labels and user search.
+//
+// The Authorization header must hold the Token, if it is not empty.
+package githubtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a GitHub server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Repo is the served "owner/repo" repository.
+	Repo string
+	// Token is the accepted token.
+	Token string
+	// MaxPerPage caps the page size, 100 by default.
+	MaxPerPage int
+	// Me is the owner of the token, the author of the created issues and comments.
+	Me User
+
+	mu          sync.Mutex
+	users       []User
+	labels      []label
+	issues      []*issue
+	lastComment int64
+}
+
+// User is a GitHub account.
+type User struct {
+	ID    int64  `json:"id"`
+	Login string `json:"login"`
+	Name  string `json:"name,omitempty"`
+	// Email is the public email address.
+	Email string `json:"email,omitempty"`
+}
+
+type label struct {
+	ID    int64  `json:"id"`
+	Name  string `json:"name"`
+	Color string `json:"color"`
+}
+
+type comment struct {
+	ID        int64     `json:"id"`
+	Body      string    `json:"body"`
+	User      *User     `json:"user"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type issue struct {
+	Number      int
+	Title, Body string
+	State       string
+	User        User
+	Assignees   []User
+	Labels      []label
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	PullRequest bool
+	Comments    []comment
+}
+
+// NewServer starts and returns a new server for the "owner/repo" repository, accepting the token.
+// The caller should call Close when finished, to shut it down.
+func NewServer(repo, token string) *Server {
+	s := &Server{
+		Repo: repo, Token: token,
+		MaxPerPage: 100,
+		Me:         User{ID: 1, Login: "octocat", Name: "The Octocat"},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// AddLabel adds a label to the repository.
+func (s *Server) AddLabel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label(name)
+}
+
+// AddPullRequest opens a pull request, returning its number, shared with the issues.
+func (s *Server) AddPullRequest(title string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := now()
+	is := &issue{
+		Number: len(s.issues) + 1, Title: title, State: "open", User: s.Me,
+		CreatedAt: t, UpdatedAt: t, PullRequest: true,
+	}
+	s.issues = append(s.issues, is)
+	return is.Number
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Code    int    `json:"-"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("%d: %s", e.Code, e.Message) }
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound() *apiError { return errorf(http.StatusNotFound, "Not Found") }
+
+// now returns the current time with the seconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("Authorization") != "token "+s.Token {
+		writeJSON(w, 0, errorf(http.StatusUnauthorized, "Bad credentials"))
+		return
+	}
+	p := strings.Trim(r.URL.Path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var code int
+	var result interface{}
+	err := notFound()
+	if r.Method == "GET" && p == "search/users" {
+		result, err = s.searchUsers(r), nil
+		writeResult(w, code, result, err)
+		return
+	}
+	prefix := "repos/" + s.Repo + "/"
+	if !strings.HasPrefix(p, prefix) {
+		writeResult(w, code, result, err)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, prefix), "/")
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "labels":
+		labels := make([]interface{}, len(s.labels))
+		for i, l := range s.labels {
+			labels[i] = l
+		}
+		result, err = s.page(w, r, labels)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "issues":
+		result, err = s.list(w, r)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "issues":
+		code = http.StatusCreated
+		result, err = s.create(r)
+	case len(parts) >= 2 && parts[0] == "issues":
+		is := s.issue(parts[1])
+		if is == nil {
+			break
+		}
+		switch endpoint := strings.Join(parts[2:], "/"); {
+		case r.Method == "GET" && endpoint == "":
+			result, err = s.render(is), nil
+		case r.Method == "PATCH" && endpoint == "":
+			result, err = s.edit(is, r)
+		case r.Method == "GET" && endpoint == "comments":
+			comments := make([]interface{}, len(is.Comments))
+			for i, c := range is.Comments {
+				comments[i] = c
+			}
+			result, err = s.page(w, r, comments)
+		case r.Method == "POST" && endpoint == "comments":
+			code = http.StatusCreated
+			result, err = s.addComment(is, r)
+		}
+	}
+	writeResult(w, code, result, err)
+}
+
+func writeResult(w http.ResponseWriter, code int, result interface{}, err *apiError) {
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// issue returns the issue (or pull request) by number, or nil. s.mu must be held.
+func (s *Server) issue(number string) *issue {
+	n, err := strconv.Atoi(number)
+	if err != nil || n <= 0 || n > len(s.issues) {
+		return nil
+	}
+	return s.issues[n-1]
+}
+
+// label returns the label by name, creating it if it does not exist. s.mu must be held.
+func (s *Server) label(name string) label {
+	for _, l := range s.labels {
+		if l.Name == name {
+			return l
+		}
+	}
+	l := label{ID: int64(len(s.labels) + 1), Name: name, Color: "ededed"}
+	s.labels = append(s.labels, l)
+	return l
+}
+
+// user returns the user by login, or nil. s.mu must be held.
+func (s *Server) user(login string) *User {
+	if login == s.Me.Login {
+		u := s.Me
+		return &u
+	}
+	for _, u := range s.users {
+		if u.Login == login {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) render(is *issue) map[string]interface{} {
+	m := map[string]interface{}{
+		"number":     is.Number,
+		"title":      is.Title,
+		"body":       is.Body,
+		"state":      is.State,
+		"user":       is.User,
+		"labels":     append([]label{}, is.Labels...),
+		"assignees":  append([]User{}, is.Assignees...),
+		"assignee":   nil,
+		"comments":   len(is.Comments),
+		"created_at": is.CreatedAt,
+		"updated_at": is.UpdatedAt,
+	}
+	if len(is.Assignees) != 0 {
+		m["assignee"] = is.Assignees[0]
+	}
+	if is.PullRequest {
+		m["pull_request"] = map[string]string{"url": s.URL + "/repos/" + s.Repo + "/pulls/" + strconv.Itoa(is.Number)}
+	}
+	return m
+}
+
+// page returns the page of items selected by the page and per_page parameters,
+// and sets the Link header to the next and last pages.
+func (s *Server) page(w http.ResponseWriter, r *http.Request, items []interface{}) ([]interface{}, *apiError) {
+	q := r.URL.Query()
+	perPage := 30
+	if v := q.Get("per_page"); v != "" {
+		var err error
+		if perPage, err = strconv.Atoi(v); err != nil || perPage <= 0 {
+			return nil, errorf(http.StatusUnprocessableEntity, "per_page: %q", v)
+		}
+	}
+	if perPage > s.MaxPerPage {
+		perPage = s.MaxPerPage
+	}
+	page := 1
+	if v := q.Get("page"); v != "" {
+		var err error
+		if page, err = strconv.Atoi(v); err != nil || page <= 0 {
+			return nil, errorf(http.StatusUnprocessableEntity, "page: %q", v)
+		}
+	}
+	last := (len(items) + perPage - 1) / perPage
+	link := func(page int, rel string) string {
+		q.Set("page", strconv.Itoa(page))
+		return "<" + s.URL + r.URL.Path + "?" + q.Encode() + `>; rel="` + rel + `"`
+	}
+	if page < last {
+		w.Header().Set("Link", link(page+1, "next")+", "+link(last, "last"))
+	}
+	from, to := (page-1)*perPage, page*perPage
+	if from > len(items) {
+		from = len(items)
+	}
+	if to > len(items) {
+		to = len(items)
+	}
+	return append([]interface{}{}, items[from:to]...), nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	var since time.Time
+	if v := q.Get("since"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errorf(http.StatusUnprocessableEntity, "since: %v", err)
+		}
+	}
+	state := q.Get("state")
+	if state == "" {
+		state = "open"
+	}
+	issues := make([]*issue, 0, len(s.issues))
+	for _, is := range s.issues {
+		if (state == "all" || is.State == state) && !is.UpdatedAt.Before(since) {
+			issues = append(issues, is)
+		}
+	}
+	key := func(is *issue) time.Time { return is.CreatedAt }
+	if q.Get("sort") == "updated" {
+		key = func(is *issue) time.Time { return is.UpdatedAt }
+	}
+	asc := q.Get("direction") == "asc"
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := key(issues[i]), key(issues[j])
+		if a.Equal(b) {
+			return (issues[i].Number < issues[j].Number) == asc
+		}
+		return a.Before(b) == asc
+	})
+	items := make([]interface{}, len(issues))
+	for i, is := range issues {
+		items[i] = s.render(is)
+	}
+	return s.page(w, r, items)
+}
+
+// issueRequest is the body of the issue create and edit requests.
+type issueRequest struct {
+	Title     *string   `json:"title"`
+	Body      *string   `json:"body"`
+	State     *string   `json:"state"`
+	Labels    *[]string `json:"labels"`
+	Assignees *[]string `json:"assignees"`
+}
+
+func readRequest(r *http.Request) (issueRequest, *apiError) {
+	var req issueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return req, errorf(http.StatusBadRequest, "Problems parsing JSON")
+	}
+	return req, nil
+}
+
+// apply sets the fields of the request on the issue. s.mu must be held.
+func (s *Server) apply(is *issue, req issueRequest) *apiError {
+	if req.Title != nil {
+		if *req.Title == "" {
+			return errorf(http.StatusUnprocessableEntity, "Validation Failed: title is missing")
+		}
+		is.Title = *req.Title
+	}
+	if req.Body != nil {
+		is.Body = *req.Body
+	}
+	if req.State != nil {
+		if *req.State != "open" && *req.State != "closed" {
+			return errorf(http.StatusUnprocessableEntity, "Validation Failed: state %q", *req.State)
+		}
+		is.State = *req.State
+	}
+	if req.Assignees != nil {
+		assignees := make([]User, 0, len(*req.Assignees))
+		for _, login := range *req.Assignees {
+			u := s.user(login)
+			if u == nil {
+				return errorf(http.StatusUnprocessableEntity, "Validation Failed: assignee %q", login)
+			}
+			assignees = append(assignees, *u)
+		}
+		is.Assignees = assignees
+	}
+	if req.Labels != nil {
+		labels := make([]label, 0, len(*req.Labels))
+		for _, name := range *req.Labels {
+			labels = append(labels, s.label(name))
+		}
+		is.Labels = labels
+	}
+	return nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	if req.Title == nil {
+		return nil, errorf(http.StatusUnprocessableEntity, "Validation Failed: title is missing")
+	}
+	t := now()
+	is := &issue{Number: len(s.issues) + 1, State: "open", User: s.Me, CreatedAt: t, UpdatedAt: t}
+	if err = s.apply(is, req); err != nil {
+		return nil, err
+	}
+	s.issues = append(s.issues, is)
+	return s.render(is), nil
+}
+
+func (s *Server) edit(is *issue, r *http.Request) (interface{}, *apiError) {
+	req, err := readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	upd := *is
+	if err = s.apply(&upd, req); err != nil {
+		return nil, err
+	}
+	upd.UpdatedAt = now()
+	*is = upd
+	return s.render(is), nil
+}
+
+func (s *Server) addComment(is *issue, r *http.Request) (interface{}, *apiError) {
+	var c comment
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		return nil, errorf(http.StatusBadRequest, "Problems parsing JSON")
+	}
+	if c.Body == "" {
+		return nil, errorf(http.StatusUnprocessableEntity, "Validation Failed: body is missing")
+	}
+	s.lastComment++
+	me := s.Me
+	c.ID, c.User = s.lastComment, &me
+	c.CreatedAt = now()
+	c.UpdatedAt = c.CreatedAt
+	is.Comments = append(is.Comments, c)
+	is.UpdatedAt = c.CreatedAt
+	return c, nil
+}
+
+// searchUsers searches the users by their public email, with the "ADDRESS in:email" query.
+func (s *Server) searchUsers(r *http.Request) interface{} {
+	q := r.URL.Query().Get("q")
+	email := strings.TrimSpace(strings.TrimSuffix(q, " in:email"))
+	items := []map[string]interface{}{}
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			// The search results have no email.
+			items = append(items, map[string]interface{}{"id": u.ID, "login": u.Login})
+		}
+	}
+	return map[string]interface{}{"total_count": len(items), "incomplete_results": false, "items": items}
+}
@@ -0,0 +1,165 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package github
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// The model of the GitHub issues API, shared with the compatible Gitea API.
+
+// Issue is an issue as returned by the API.
+type Issue struct {
+	Number    int        `json:"number"`
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	State     string     `json:"state"`
+	User      *User      `json:"user,omitempty"`
+	Assignee  *User      `json:"assignee,omitempty"`
+	Labels    []Label    `json:"labels,omitempty"`
+	Milestone *Milestone `json:"milestone,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	UpdatedAt time.Time  `json:"updated_at"`
+	// DueDate and Assets are Gitea only.
+	DueDate *time.Time `json:"due_date,omitempty"`
+	Assets  []Asset    `json:"assets,omitempty"`
+	// PullRequest is not nil for the pull requests, as those are listed with the issues.
+	PullRequest *json.RawMessage `json:"pull_request,omitempty"`
+}
+
+// User is a user account.
+type User struct {
+	ID    int64  `json:"id,omitempty"`
+	Login string `json:"login"`
+	// Name is the real name on GitHub, FullName on Gitea.
+	Name     string `json:"name,omitempty"`
+	FullName string `json:"full_name,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// Label is an issue label.
+type Label struct {
+	ID   int64  `json:"id,omitempty"`
+	Name string `json:"name"`
+}
+
+// Milestone is an issue milestone.
+type Milestone struct {
+	ID    int64  `json:"id,omitempty"`
+	Title string `json:"title"`
+}
+
+// Comment is an issue comment.
+type Comment struct {
+	ID        int64     `json:"id"`
+	Body      string    `json:"body"`
+	User      *User     `json:"user,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Assets are Gitea only.
+	Assets []Asset `json:"assets,omitempty"`
+}
+
+// Asset is a file attached to an issue or a comment (Gitea only).
+type Asset struct {
+	ID                 int64     `json:"id"`
+	Name               string    `json:"name"`
+	Size               int64     `json:"size"`
+	CreatedAt          time.Time `json:"created_at"`
+	BrowserDownloadURL string    `json:"browser_download_url"`
+}
+
+// IssueRequest is the body of the issue create and edit requests, only the non-nil fields are sent.
+type IssueRequest struct {
+	Title     *string   `json:"title,omitempty"`
+	Body      *string   `json:"body,omitempty"`
+	State     *string   `json:"state,omitempty"`
+	Labels    *[]string `json:"labels,omitempty"`
+	Assignees *[]string `json:"assignees,omitempty"`
+	// DueDate is Gitea only.
+	DueDate *time.Time `json:"due_date,omitempty"`
+}
+
+// DefaultStatePrefix is the prefix of the labels holding the sub-state.
+const DefaultStatePrefix = "state:"
+
+// ReadIssue returns the it.Issue of the API issue.
+//
+// The labels starting with statePrefix are the sub-state, not labels.
+func ReadIssue(gi Issue, statePrefix string) it.Issue {
+	issue := it.Issue{
+		ID:          it.IssueID(strconv.Itoa(gi.Number)),
+		Summary:     gi.Title,
+		Description: gi.Body,
+		Author:      ReadUser(gi.User),
+		Reporter:    ReadUser(gi.User),
+		Assignee:    ReadUser(gi.Assignee),
+		CreatedAt:   gi.CreatedAt,
+		UpdatedAt:   gi.UpdatedAt,
+	}
+	if gi.Milestone != nil {
+		issue.TargetVersion = gi.Milestone.Title
+	}
+	if gi.DueDate != nil {
+		issue.DueDate = *gi.DueDate
+	}
+	var sub string
+	for _, l := range gi.Labels {
+		if statePrefix != "" && strings.HasPrefix(l.Name, statePrefix) {
+			if sub == "" {
+				sub = strings.TrimPrefix(l.Name, statePrefix)
+			}
+			continue
+		}
+		issue.Labels = append(issue.Labels, l.Name)
+	}
+	issue.State = it.JoinState(gi.State, sub)
+	return issue
+}
+
+// ReadUser returns the it.User of the account, identified by its login name.
+func ReadUser(u *User) it.User {
+	if u == nil || u.Login == "" {
+		return it.User{}
+	}
+	name := u.Name
+	if name == "" {
+		name = u.FullName
+	}
+	return it.User{ID: it.UserID(u.Login), RealName: name, Email: u.Email}
+}
+
+// ReadComment returns the it.Comment of the API comment.
+func ReadComment(gc Comment) it.Comment {
+	return it.Comment{
+		ID:        it.CommentID(strconv.FormatInt(gc.ID, 10)),
+		Author:    ReadUser(gc.User),
+		CreatedAt: gc.CreatedAt,
+		Body:      gc.Body,
+	}
+}
+
+// Link is a markdown link found in a text.
+type Link struct {
+	Text, URL string
+}
+
+var rLink = regexp.MustCompile(`!?\[([^\]]*)\]\((https?://[^)\s]+)\)`)
+
+// Links returns the markdown links (and images) of the text.
+func Links(text string) []Link {
+	var links []Link
+	for _, m := range rLink.FindAllStringSubmatch(text, -1) {
+		links = append(links, Link{Text: m[1], URL: m[2]})
+	}
+	return links
+}
@@ -0,0 +1,527 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gitlab is the GitLab Issues tracker.
+package gitlab
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/internal/rest"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("gitlab", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://docs.gitlab.com/ee/api/issues.html
+type Client struct {
+	rest.Client
+	id string
+	// Web is the URL of the project's web pages, the base of the uploads.
+	Web *url.URL
+	// project is the escaped ID or path of the project.
+	project string
+	// stateScope is the scope of the labels holding the sub-state.
+	stateScope string
+}
+
+// PageSize is the number of issues requested in one page.
+const PageSize = 100
+
+// DefaultStateScope is the scope of the labels holding the sub-state ("status::in progress").
+const DefaultStateScope = "status"
+
+// New returns a new GitLab client for the project in the URL
+// (https://gitlab.example.com/group/project, or https://gitlab.example.com/1234 by ID).
+//
+// The token is taken from the "token" query parameter, or the GITLAB_TOKEN
+// environment variable. The scoped labels of "state_scope" (default "status")
+// are the sub-state of the issue.
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	project := strings.Trim(URL.Path, "/")
+	if project == "" {
+		return Client{}, fmt.Errorf("%q: no project in the URL", baseURL)
+	}
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("GITLAB_TOKEN")
+	}
+	stateScope := DefaultStateScope
+	if _, ok := q["state_scope"]; ok {
+		stateScope = q.Get("state_scope")
+	}
+	web := *URL
+	web.Path = "/" + project + "/"
+	api := *URL
+	api.Path, api.RawPath = "/api/v4/", ""
+	var header http.Header
+	if token != "" {
+		header = http.Header{"Private-Token": {token}}
+	}
+	return Client{
+		Client: rest.Client{URL: &api, Header: header, HTTPClient: http.DefaultClient},
+		id:     baseURL, Web: &web,
+		project:    url.PathEscape(project),
+		stateScope: stateScope,
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+func (c Client) issuePath(ID it.IssueID) string {
+	return "projects/" + c.project + "/issues/" + url.PathEscape(string(ID))
+}
+
+// GetIssue returns the data for the issueID (the project-level iid).
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return c.readIssue(gi), nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID) (apiIssue, error) {
+	var gi apiIssue
+	_, err := c.Do(ctx, "GET", c.issuePath(ID), nil, &gi)
+	return gi, err
+}
+
+// ListIssues lists all the issues created/changed since "since".
+//
+// The pages are followed by the Link header, with keyset pagination,
+// so the listing is not limited by the offset pagination's cap.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	q := url.Values{
+		"scope": {"all"}, "pagination": {"keyset"},
+		"order_by": {"updated_at"}, "sort": {"asc"},
+		"per_page": {strconv.Itoa(PageSize)},
+	}
+	if !since.IsZero() {
+		q.Set("updated_after", since.UTC().Format(time.RFC3339))
+	}
+	var issues []it.Issue
+	for next := "projects/" + c.project + "/issues?" + q.Encode(); next != ""; {
+		var page []apiIssue
+		var err error
+		if next, err = c.Do(ctx, "GET", next, nil, &page); err != nil {
+			return issues, err
+		}
+		for _, gi := range page {
+			issues = append(issues, c.readIssue(gi))
+		}
+	}
+	return issues, nil
+}
+
+// CreateIssue creates the issue, returning the ID.
+//
+// Only administrators could set the author, so it is always written into the description.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	if issue.Summary == "" {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: []string{"summary"}}
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	description := issue.Description
+	if author != (it.User{}) {
+		description = it.Attribute(author, issue.CreatedAt, description)
+	}
+	state, sub := it.SplitState(issue.State)
+	req := map[string]interface{}{
+		"title":       issue.Summary,
+		"description": description,
+		"labels":      strings.Join(it.MergeLabels(issue.Labels, c.statePrefix(), sub), ","),
+	}
+	if issue.Assignee.ID != "" {
+		id, err := strconv.Atoi(string(issue.Assignee.ID))
+		if err != nil {
+			return "", fmt.Errorf("user ID %q: %w", issue.Assignee.ID, err)
+		}
+		req["assignee_ids"] = []int{id}
+	}
+	if !issue.DueDate.IsZero() {
+		req["due_date"] = issue.DueDate.Format(dateFormat)
+	}
+	var gi apiIssue
+	if _, err := c.Do(ctx, "POST", "projects/"+c.project+"/issues", req, &gi); err != nil {
+		return "", err
+	}
+	ID := it.IssueID(strconv.Itoa(gi.IID))
+	if state == "closed" {
+		if _, err := c.Do(ctx, "PUT", c.issuePath(ID), map[string]string{"state_event": "close"}, nil); err != nil {
+			return ID, fmt.Errorf("close %q: %w", ID, err)
+		}
+	}
+	return ID, nil
+}
+
+// UpdateIssueState updates the issue's state, "open" or "closed", optionally followed by "/" and the sub-state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The sub-state label is kept when only the labels change, and the other labels
+// when only the state changes.
+// An assignee without ID (not a mapped GitLab user) is left as is.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	req := make(map[string]interface{})
+	if upd.Fields.Has(it.FieldSummary) {
+		req["title"] = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		req["description"] = upd.Description
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			id, err := strconv.Atoi(string(upd.Assignee.ID))
+			if err != nil {
+				return fmt.Errorf("user ID %q: %w", upd.Assignee.ID, err)
+			}
+			req["assignee_ids"] = []int{id}
+		} else if upd.Assignee == (it.User{}) {
+			req["assignee_ids"] = []int{}
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) || (upd.Fields.Has(it.FieldState) && upd.State != "") {
+		gi, err := c.getIssue(ctx, ID)
+		if err != nil {
+			return err
+		}
+		current := c.readIssue(gi)
+		labels := current.Labels
+		if upd.Fields.Has(it.FieldLabels) {
+			labels = upd.Labels
+		}
+		_, sub := it.SplitState(current.State)
+		if upd.Fields.Has(it.FieldState) && upd.State != "" {
+			var state string
+			state, sub = it.SplitState(upd.State)
+			if state == "closed" && gi.State != "closed" {
+				req["state_event"] = "close"
+			} else if state != "closed" && gi.State == "closed" {
+				req["state_event"] = "reopen"
+			}
+		}
+		req["labels"] = strings.Join(it.MergeLabels(labels, c.statePrefix(), sub), ",")
+	}
+	if len(req) == 0 {
+		return nil
+	}
+	if _, err := c.Do(ctx, "PUT", c.issuePath(ID), req, nil); err != nil {
+		return fmt.Errorf("update %q: %w", ID, err)
+	}
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// GitLab issues have no custom fields.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	return it.ErrNotImplemented
+}
+
+// ListStates lists the states an issue can be in:
+// open and closed, and each with the sub-state labels.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	states := []it.State{"open", "closed"}
+	if c.stateScope == "" {
+		return states, nil
+	}
+	var subs []string
+	for next := "projects/" + c.project + "/labels?per_page=" + strconv.Itoa(PageSize); next != ""; {
+		var page []struct {
+			Name string `json:"name"`
+		}
+		var err error
+		if next, err = c.Do(ctx, "GET", next, nil, &page); err != nil {
+			return nil, err
+		}
+		for _, l := range page {
+			if strings.HasPrefix(l.Name, c.statePrefix()) {
+				subs = append(subs, strings.TrimPrefix(l.Name, c.statePrefix()))
+			}
+		}
+	}
+	for _, state := range []string{"open", "closed"} {
+		for _, sub := range subs {
+			states = append(states, it.JoinState(state, sub))
+		}
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address.
+//
+// The email is visible only to the administrators (or if it is public),
+// the users without a visible email are not found: those have to be
+// paired in the "users" of the config.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var users []user
+	if _, err := c.Do(ctx, "GET", "users?"+url.Values{"search": {email}}.Encode(), nil, &users); err != nil {
+		return it.User{}, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return readUser(&u), nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a note to the issue.
+//
+// Only administrators could set the author, so it is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	var n note
+	if _, err := c.Do(ctx, "POST", c.issuePath(ID)+"/notes", map[string]string{"body": comment.AttributedBody()}, &n); err != nil {
+		return "", err
+	}
+	return it.CommentID(strconv.Itoa(n.ID)), nil
+}
+
+// ListComments list the notes of the issue, without the system notes and the attachment notes.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	notes, err := c.listNotes(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, 0, len(notes))
+	for _, n := range notes {
+		if n.System || strings.HasPrefix(n.Body, attachmentPrefix) {
+			continue
+		}
+		comments = append(comments, it.Comment{
+			ID:        it.CommentID(strconv.Itoa(n.ID)),
+			Author:    readUser(n.Author),
+			CreatedAt: n.CreatedAt,
+			Body:      n.Body,
+		})
+	}
+	return comments, nil
+}
+
+func (c Client) listNotes(ctx context.Context, ID it.IssueID) ([]note, error) {
+	var notes []note
+	for next := c.issuePath(ID) + "/notes?sort=asc&order_by=created_at&per_page=" + strconv.Itoa(PageSize); next != ""; {
+		var page []note
+		var err error
+		if next, err = c.Do(ctx, "GET", next, nil, &page); err != nil {
+			return notes, err
+		}
+		notes = append(notes, page...)
+	}
+	return notes, nil
+}
+
+// attachmentPrefix starts the notes added by AddAttachment.
+const attachmentPrefix = "Attachment: "
+
+// AddAttachment uploads the file to the project, and links it from a new note.
+// The ID of the attachment is its upload path ("/uploads/secret/name").
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	w, err := mw.CreateFormFile("file", a.Name)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", err
+	}
+	req, err := c.NewRequest(ctx, "POST", "projects/"+c.project+"/uploads", &buf)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var up struct {
+		URL      string `json:"url"`
+		Markdown string `json:"markdown"`
+	}
+	if _, err = c.Send(req, &up); err != nil {
+		return "", fmt.Errorf("upload %q: %w", a.Name, err)
+	}
+	if _, err = c.Do(ctx, "POST", c.issuePath(ID)+"/notes", map[string]string{"body": attachmentPrefix + up.Markdown}, nil); err != nil {
+		return "", err
+	}
+	return it.AttachmentID(up.URL), nil
+}
+
+var rUpload = regexp.MustCompile(`!?\[([^\]]*)\]\((/uploads/[^)\s]+)\)`)
+
+// ListAttachments lists the files uploaded to the issue's description and notes.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	gi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	notes, err := c.listNotes(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	var as []it.Attachment
+	seen := make(map[string]bool)
+	add := func(text string, author it.User, createdAt time.Time) {
+		for _, m := range rUpload.FindAllStringSubmatch(text, -1) {
+			if seen[m[2]] {
+				continue
+			}
+			seen[m[2]] = true
+			URL, err := c.Web.Parse(strings.TrimPrefix(m[2], "/"))
+			if err != nil {
+				continue
+			}
+			dl := URL.String()
+			as = append(as, it.Attachment{
+				ID: it.AttachmentID(m[2]), Name: path.Base(m[2]), URL: dl,
+				Author: author, CreatedAt: createdAt,
+				GetBody: func() (io.ReadCloser, error) {
+					req, err := c.NewRequest(ctx, "GET", dl, nil)
+					if err != nil {
+						return nil, err
+					}
+					resp, err := c.HTTPClient.Do(req)
+					if err != nil {
+						return nil, err
+					}
+					if resp.StatusCode >= 300 {
+						resp.Body.Close()
+						return nil, fmt.Errorf("GET %s: %s", dl, resp.Status)
+					}
+					return resp.Body, nil
+				},
+			})
+		}
+	}
+	add(gi.Description, readUser(gi.Author), gi.CreatedAt)
+	for _, n := range notes {
+		if !n.System {
+			add(n.Body, readUser(n.Author), n.CreatedAt)
+		}
+	}
+	return as, nil
+}
+
+func (c Client) readIssue(gi apiIssue) it.Issue {
+	issue := it.Issue{
+		ID:          it.IssueID(strconv.Itoa(gi.IID)),
+		Summary:     gi.Title,
+		Description: gi.Description,
+		Author:      readUser(gi.Author),
+		Reporter:    readUser(gi.Author),
+		Assignee:    readUser(gi.Assignee),
+		CreatedAt:   gi.CreatedAt,
+		UpdatedAt:   gi.UpdatedAt,
+	}
+	if gi.Milestone != nil {
+		issue.TargetVersion = gi.Milestone.Title
+	}
+	if gi.DueDate != "" {
+		issue.DueDate, _ = time.Parse(dateFormat, gi.DueDate)
+	}
+	var sub string
+	prefix := c.statePrefix()
+	for _, l := range gi.Labels {
+		if prefix != "" && strings.HasPrefix(l, prefix) {
+			sub = strings.TrimPrefix(l, prefix)
+			continue
+		}
+		issue.Labels = append(issue.Labels, l)
+	}
+	state := gi.State
+	if state == "opened" {
+		state = "open"
+	}
+	issue.State = it.JoinState(state, sub)
+	return issue
+}
+
+// statePrefix returns the prefix of the sub-state labels, empty without a state scope.
+func (c Client) statePrefix() string {
+	if c.stateScope == "" {
+		return ""
+	}
+	return c.stateScope + "::"
+}
+
+const dateFormat = "2006-01-02"
+
+type user struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	Email    string `json:"email,omitempty"`
+}
+
+// readUser returns the it.User of the account, identified by its numeric ID.
+func readUser(u *user) it.User {
+	if u == nil || u.ID == 0 {
+		return it.User{}
+	}
+	return it.User{ID: it.UserID(strconv.Itoa(u.ID)), RealName: u.Name, Email: u.Email}
+}
+
+type note struct {
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	Author    *user     `json:"author,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	System    bool      `json:"system"`
+}
+
+// apiIssue is an issue as returned by the API.
+type apiIssue struct {
+	ID          int      `json:"id"`
+	IID         int      `json:"iid"`
+	Title       string   `json:"title"`
+	Description string   `json:"description"`
+	State       string   `json:"state"`
+	Labels      []string `json:"labels"`
+	Author      *user    `json:"author,omitempty"`
+	Assignee    *user    `json:"assignee,omitempty"`
+	Milestone   *struct {
+		Title string `json:"title"`
+	} `json:"milestone,omitempty"`
+	DueDate   string    `json:"due_date,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
@@ -0,0 +1,112 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package gitlab
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/gitlab/gitlabtest"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+func newTestClient(t *testing.T) (Client, *gitlabtest.Server) {
+	t.Helper()
+	srv := gitlabtest.NewServer("group/project", "secret")
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + "/group/project?token=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.MaxPerPage = 7
+		srv.AddUser(gitlabtest.User{ID: 2, Username: "jdoe", Name: "John Doe", Email: "jdoe@example.com"})
+		return c
+	}, ittest.WithPageSize(7),
+		ittest.WithUser(it.User{ID: "2", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	GITLAB_TEST_URL='https://gitlab.example.com/group/project?token=...' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("GITLAB_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestSubState(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddLabel("status::in progress")
+
+	states, err := c.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []it.State{"open", "closed", "open/in progress", "closed/in progress"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("ListStates: got %q, wanted %q", states, want)
+	}
+
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "sub-state", State: "open/in progress", Labels: []string{"bug"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(state it.State, labels ...string) {
+		t.Helper()
+		issue, err := c.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.State != state {
+			t.Errorf("state: got %q, wanted %q", issue.State, state)
+		}
+		sort.Strings(issue.Labels)
+		if !reflect.DeepEqual(issue.Labels, labels) {
+			t.Errorf("labels: got %q, wanted %q", issue.Labels, labels)
+		}
+	}
+	check("open/in progress", "bug")
+
+	if err = c.UpdateIssueState(ctx, ID, "closed"); err != nil {
+		t.Fatal(err)
+	}
+	check("closed", "bug")
+	if err = c.UpdateIssueState(ctx, ID, "open/in progress"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{Labels: []string{"bug", "ui"}}, Fields: it.FieldLabels}); err != nil {
+		t.Fatal(err)
+	}
+	check("open/in progress", "bug", "ui")
+}
+
+func TestFindUserHidden(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddUser(gitlabtest.User{ID: 3, Username: "hidden", Name: "Hidden Email"})
+	// The hidden emails are not guessed from the username.
+	if u, err := c.FindUser(ctx, "hidden@example.com"); !errors.Is(err, it.ErrNotFound) {
+		t.Errorf("got %+v, %+v, wanted ErrNotFound", u, err)
+	}
+}
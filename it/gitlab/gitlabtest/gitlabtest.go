@@ -0,0 +1,476 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package gitlabtest provides an in-process GitLab REST API (v4) server, for testing.
+//
+// It implements the endpoints used by the gitlab package, for one project:
+// issue list (with keyset pagination by the Link header), get, create and edit,
+// notes, labels, uploads (served under the project's web path) and user search.
+//
+// The PRIVATE-TOKEN header must hold the Token, if it is not empty.
+package gitlabtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a GitLab server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Project is the path of the served project, as "group/project".
+	Project string
+	// Token is the accepted private token.
+	Token string
+	// MaxPerPage caps the page size, 100 by default.
+	MaxPerPage int
+	// Me is the owner of the token, the author of the created issues and notes.
+	Me User
+
+	mu       sync.Mutex
+	users    []User
+	labels   []string
+	issues   []*issue
+	lastNote int
+	uploads  map[string][]byte
+}
+
+// User is a GitLab account.
+type User struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+	Name     string `json:"name"`
+	// Email is the email visible to the token's owner (all for an administrator), empty if it is hidden.
+	Email string `json:"email,omitempty"`
+}
+
+type note struct {
+	ID        int       `json:"id"`
+	Body      string    `json:"body"`
+	Author    User      `json:"author"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	System    bool      `json:"system"`
+}
+
+type issue struct {
+	IID         int
+	Title       string
+	Description string
+	State       string
+	Labels      []string
+	Author      User
+	Assignees   []User
+	DueDate     string
+	CreatedAt   time.Time
+	UpdatedAt   time.Time
+	Notes       []note
+}
+
+// NewServer starts and returns a new server for the "group/project" project, accepting the token.
+// The caller should call Close when finished, to shut it down.
+func NewServer(project, token string) *Server {
+	s := &Server{
+		Project: project, Token: token,
+		MaxPerPage: 100,
+		Me:         User{ID: 1, Username: "root", Name: "Administrator"},
+		uploads:    make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// AddLabel adds a label to the project.
+func (s *Server) AddLabel(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.label(name)
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Code    int    `json:"-"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("%d: %s", e.Code, e.Message) }
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+func notFound() *apiError { return errorf(http.StatusNotFound, "404 Not found") }
+
+// now returns the current time with the milliseconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Millisecond) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Token != "" && r.Header.Get("PRIVATE-TOKEN") != s.Token {
+		writeJSON(w, 0, errorf(http.StatusUnauthorized, "401 Unauthorized"))
+		return
+	}
+	// The project's path is escaped in the API's paths.
+	p := strings.Trim(r.URL.EscapedPath(), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if prefix := s.Project + "/uploads/"; r.Method == "GET" && strings.HasPrefix(p, prefix) {
+		b, ok := s.uploads[strings.TrimPrefix(p, prefix)]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(b)
+		return
+	}
+	var code int
+	var result interface{}
+	err := notFound()
+	prefix := "api/v4/projects/" + url.PathEscape(s.Project) + "/"
+	switch {
+	case r.Method == "GET" && p == "api/v4/users":
+		result, err = s.searchUsers(r.URL.Query().Get("search")), nil
+	case !strings.HasPrefix(p, prefix):
+	default:
+		parts := strings.Split(strings.TrimPrefix(p, prefix), "/")
+		switch {
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "labels":
+			labels := make([]interface{}, len(s.labels))
+			for i, l := range s.labels {
+				labels[i] = map[string]interface{}{"id": i + 1, "name": l, "color": "#428BCA"}
+			}
+			result, err = s.page(w, r, labels)
+		case r.Method == "GET" && len(parts) == 1 && parts[0] == "issues":
+			result, err = s.list(w, r)
+		case r.Method == "POST" && len(parts) == 1 && parts[0] == "issues":
+			code = http.StatusCreated
+			result, err = s.create(r)
+		case r.Method == "POST" && len(parts) == 1 && parts[0] == "uploads":
+			code = http.StatusCreated
+			result, err = s.upload(r)
+		case len(parts) >= 2 && parts[0] == "issues":
+			iid, _ := strconv.Atoi(parts[1])
+			if iid <= 0 || iid > len(s.issues) {
+				break
+			}
+			is := s.issues[iid-1]
+			switch endpoint := strings.Join(parts[2:], "/"); {
+			case r.Method == "GET" && endpoint == "":
+				result, err = s.render(is), nil
+			case r.Method == "PUT" && endpoint == "":
+				result, err = s.edit(is, r)
+			case r.Method == "GET" && endpoint == "notes":
+				notes := make([]interface{}, len(is.Notes))
+				for i, n := range is.Notes {
+					notes[i] = n
+				}
+				result, err = s.page(w, r, notes)
+			case r.Method == "POST" && endpoint == "notes":
+				code = http.StatusCreated
+				result, err = s.addNote(is, r)
+			}
+		}
+	}
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// label adds the label to the project, if it does not exist. s.mu must be held.
+func (s *Server) label(name string) {
+	for _, l := range s.labels {
+		if l == name {
+			return
+		}
+	}
+	s.labels = append(s.labels, name)
+}
+
+// user returns the user by ID, or nil. s.mu must be held.
+func (s *Server) user(id int) *User {
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.ID == id {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) render(is *issue) map[string]interface{} {
+	m := map[string]interface{}{
+		"id":          1000 + is.IID,
+		"iid":         is.IID,
+		"project_id":  1,
+		"title":       is.Title,
+		"description": is.Description,
+		"state":       is.State,
+		"labels":      append([]string{}, is.Labels...),
+		"author":      is.Author,
+		"assignees":   append([]User{}, is.Assignees...),
+		"assignee":    nil,
+		"milestone":   nil,
+		"due_date":    nil,
+		"created_at":  is.CreatedAt,
+		"updated_at":  is.UpdatedAt,
+	}
+	if len(is.Assignees) != 0 {
+		m["assignee"] = is.Assignees[0]
+	}
+	if is.DueDate != "" {
+		m["due_date"] = is.DueDate
+	}
+	return m
+}
+
+// page returns the page of items selected by the page and per_page parameters,
+// and sets the Link header to the next page.
+//
+// With pagination=keyset, the next page is selected by an opaque cursor.
+func (s *Server) page(w http.ResponseWriter, r *http.Request, items []interface{}) ([]interface{}, *apiError) {
+	q := r.URL.Query()
+	perPage := 20
+	if v := q.Get("per_page"); v != "" {
+		var err error
+		if perPage, err = strconv.Atoi(v); err != nil || perPage <= 0 {
+			return nil, errorf(http.StatusBadRequest, "per_page is invalid")
+		}
+	}
+	if perPage > s.MaxPerPage {
+		perPage = s.MaxPerPage
+	}
+	from := 0
+	if q.Get("pagination") == "keyset" {
+		if v := q.Get("cursor"); v != "" {
+			var err error
+			if from, err = strconv.Atoi(strings.TrimPrefix(v, "offset:")); err != nil {
+				return nil, errorf(http.StatusBadRequest, "cursor is invalid")
+			}
+		}
+	} else if v := q.Get("page"); v != "" {
+		page, err := strconv.Atoi(v)
+		if err != nil || page <= 0 {
+			return nil, errorf(http.StatusBadRequest, "page is invalid")
+		}
+		from = (page - 1) * perPage
+	}
+	if from > len(items) {
+		from = len(items)
+	}
+	to := from + perPage
+	if to > len(items) {
+		to = len(items)
+	}
+	if to < len(items) {
+		if q.Get("pagination") == "keyset" {
+			q.Set("cursor", "offset:"+strconv.Itoa(to))
+		} else {
+			q.Set("page", strconv.Itoa(to/perPage+1))
+		}
+		w.Header().Set("Link", "<"+s.URL+r.URL.EscapedPath()+"?"+q.Encode()+`>; rel="next"`)
+	}
+	return append([]interface{}{}, items[from:to]...), nil
+}
+
+func (s *Server) list(w http.ResponseWriter, r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	var after time.Time
+	if v := q.Get("updated_after"); v != "" {
+		var err error
+		if after, err = time.Parse(time.RFC3339, v); err != nil {
+			return nil, errorf(http.StatusBadRequest, "updated_after is invalid")
+		}
+	}
+	issues := make([]*issue, 0, len(s.issues))
+	for _, is := range s.issues {
+		if !is.UpdatedAt.Before(after) {
+			issues = append(issues, is)
+		}
+	}
+	key := func(is *issue) time.Time { return is.CreatedAt }
+	if q.Get("order_by") == "updated_at" {
+		key = func(is *issue) time.Time { return is.UpdatedAt }
+	}
+	asc := q.Get("sort") == "asc"
+	sort.SliceStable(issues, func(i, j int) bool {
+		a, b := key(issues[i]), key(issues[j])
+		if a.Equal(b) {
+			return (issues[i].IID < issues[j].IID) == asc
+		}
+		return a.Before(b) == asc
+	})
+	items := make([]interface{}, len(issues))
+	for i, is := range issues {
+		items[i] = s.render(is)
+	}
+	return s.page(w, r, items)
+}
+
+// issueRequest is the body of the issue create and edit requests.
+type issueRequest struct {
+	Title       *string `json:"title"`
+	Description *string `json:"description"`
+	Labels      *string `json:"labels"`
+	AssigneeIDs *[]int  `json:"assignee_ids"`
+	DueDate     *string `json:"due_date"`
+	StateEvent  *string `json:"state_event"`
+}
+
+// apply sets the fields of the request on the issue. s.mu must be held.
+func (s *Server) apply(is *issue, r *http.Request) *apiError {
+	var req issueRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return errorf(http.StatusBadRequest, "%v", err)
+	}
+	if req.Title != nil {
+		if *req.Title == "" {
+			return errorf(http.StatusBadRequest, "title is empty")
+		}
+		is.Title = *req.Title
+	}
+	if req.Description != nil {
+		is.Description = *req.Description
+	}
+	if req.Labels != nil {
+		is.Labels = nil
+		for _, l := range strings.Split(*req.Labels, ",") {
+			if l = strings.TrimSpace(l); l != "" {
+				s.label(l)
+				is.Labels = append(is.Labels, l)
+			}
+		}
+	}
+	if req.AssigneeIDs != nil {
+		is.Assignees = nil
+		for _, id := range *req.AssigneeIDs {
+			u := s.user(id)
+			if u == nil {
+				return errorf(http.StatusNotFound, "404 User Not Found")
+			}
+			is.Assignees = append(is.Assignees, *u)
+		}
+	}
+	if req.DueDate != nil {
+		if _, err := time.Parse("2006-01-02", *req.DueDate); err != nil {
+			return errorf(http.StatusBadRequest, "due_date is invalid")
+		}
+		is.DueDate = *req.DueDate
+	}
+	if req.StateEvent != nil {
+		switch *req.StateEvent {
+		case "close":
+			is.State = "closed"
+		case "reopen":
+			is.State = "opened"
+		default:
+			return errorf(http.StatusBadRequest, "state_event does not have a valid value")
+		}
+	}
+	return nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	t := now()
+	is := &issue{IID: len(s.issues) + 1, State: "opened", Author: s.Me, CreatedAt: t, UpdatedAt: t}
+	if err := s.apply(is, r); err != nil {
+		return nil, err
+	}
+	if is.Title == "" {
+		return nil, errorf(http.StatusBadRequest, "title is missing")
+	}
+	s.issues = append(s.issues, is)
+	return s.render(is), nil
+}
+
+func (s *Server) edit(is *issue, r *http.Request) (interface{}, *apiError) {
+	upd := *is
+	if err := s.apply(&upd, r); err != nil {
+		return nil, err
+	}
+	upd.UpdatedAt = now()
+	*is = upd
+	return s.render(is), nil
+}
+
+func (s *Server) addNote(is *issue, r *http.Request) (interface{}, *apiError) {
+	var n note
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	if n.Body == "" {
+		return nil, errorf(http.StatusBadRequest, "body is missing")
+	}
+	s.lastNote++
+	t := now()
+	n = note{ID: s.lastNote, Body: n.Body, Author: s.Me, CreatedAt: t, UpdatedAt: t}
+	is.Notes = append(is.Notes, n)
+	is.UpdatedAt = t
+	return n, nil
+}
+
+func (s *Server) upload(r *http.Request) (interface{}, *apiError) {
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "file is missing")
+	}
+	defer f.Close()
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	secret := fmt.Sprintf("%032x", len(s.uploads)+1)
+	s.uploads[secret+"/"+fh.Filename] = b
+	URL := "/uploads/" + secret + "/" + fh.Filename
+	markdown := "[" + fh.Filename + "](" + URL + ")"
+	if strings.HasPrefix(http.DetectContentType(b), "image/") {
+		markdown = "!" + markdown
+	}
+	return map[string]string{
+		"alt": fh.Filename, "url": URL, "full_path": "/" + s.Project + URL,
+		"markdown": markdown,
+	}, nil
+}
+
+// searchUsers returns the users whose username or name contains q,
+// or whose visible email is q.
+func (s *Server) searchUsers(q string) []User {
+	users := []User{}
+	lq := strings.ToLower(q)
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if strings.Contains(strings.ToLower(u.Username), lq) ||
+			strings.Contains(strings.ToLower(u.Name), lq) ||
+			u.Email != "" && strings.EqualFold(u.Email, q) {
+			users = append(users, u)
+		}
+	}
+	return users
+}
@@ -0,0 +1,136 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package rest is a minimal client of the JSON REST APIs paging with the Link header,
+// as the GitHub, Gitea and GitLab APIs.
+package rest
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// Client calls the API at URL.
+type Client struct {
+	// URL is the base URL of the API.
+	URL *url.URL
+	// Header is set on each request, for the authentication.
+	Header     http.Header
+	HTTPClient *http.Client
+}
+
+// Do calls the API, encoding body and decoding the response into result, if not nil.
+//
+// Returns the next page's URL, from the Link header.
+func (c Client) Do(ctx context.Context, method, path string, body, result interface{}) (next string, err error) {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.NewRequest(ctx, method, path, r)
+	if err != nil {
+		return "", err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.Send(req, result)
+}
+
+// NewRequest returns an authenticated request for the path, relative to the API's URL.
+func (c Client) NewRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	URL, err := c.URL.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	for k, vv := range c.Header {
+		req.Header[k] = vv
+	}
+	return req, nil
+}
+
+// Send sends the request, decoding the response into result, if not nil.
+// A 404 Not Found response is returned as it.ErrNotFound.
+//
+// Returns the next page's URL, from the Link header.
+func (c Client) Send(req *http.Request, result interface{}) (next string, err error) {
+	hc := c.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, b)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", it.ErrNotFound, err)
+		}
+		return "", err
+	}
+	next = nextLink(resp.Header.Get("Link"))
+	if result == nil {
+		return next, nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return next, fmt.Errorf("%s %s: decode: %w", req.Method, req.URL.Path, err)
+	}
+	return next, nil
+}
+
+// GetAll GETs path and all the following pages, calling page with each's decoder.
+func (c Client) GetAll(ctx context.Context, path string, page func(*json.Decoder) error) error {
+	for path != "" {
+		var raw json.RawMessage
+		next, err := c.Do(ctx, "GET", path, nil, &raw)
+		if err != nil {
+			return err
+		}
+		if err = page(json.NewDecoder(bytes.NewReader(raw))); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		path = next
+	}
+	return nil
+}
+
+// nextLink returns the rel="next" URL of the Link header.
+func nextLink(header string) string {
+	for _, part := range strings.Split(header, ",") {
+		segs := strings.Split(part, ";")
+		if len(segs) < 2 {
+			continue
+		}
+		for _, s := range segs[1:] {
+			if strings.TrimSpace(s) == `rel="next"` {
+				return strings.Trim(strings.TrimSpace(segs[0]), "<>")
+			}
+		}
+	}
+	return ""
+}
@@ -30,8 +30,17 @@ type Tracker interface {
 	CreateIssue(context.Context, Issue) (IssueID, error)
 	// UpdateIssue updates the issue's state.
 	UpdateIssueState(context.Context, IssueID, State) error
+	// UpdateIssue updates the fields of the issue selected by the update's mask.
+	// May return ErrNotImplemented.
+	UpdateIssue(context.Context, IssueID, IssueUpdate) error
 	// SetSecondaryID updates the secondary ID to the issue.
 	SetSecondaryID(ctx context.Context, primary, secondary IssueID) error
+	// ListStates lists the states an issue can be in.
+	// May return ErrNotImplemented.
+	ListStates(context.Context) ([]State, error)
+	// FindUser returns the user with the given email address.
+	// May return ErrNotImplemented.
+	FindUser(ctx context.Context, email string) (User, error)
 
 	// AddComment adds a comment to the issue.
 	AddComment(context.Context, IssueID, Comment) (CommentID, error)
@@ -46,9 +55,10 @@ type Tracker interface {
 
 var (
 	ErrNotImplemented = errors.New("not implemented")
+	ErrNotFound       = errors.New("not found")
 
 	registryMu sync.RWMutex
-	registry   map[string]func(string) (Tracker, error)
+	registry   = make(map[string]func(string) (Tracker, error))
 )
 
 func Register(name string, factory func(baseURL string) (Tracker, error)) {
@@ -78,13 +88,34 @@ func New(baseURL string) (Tracker, error) {
 
 var ErrAlreadyRegistered = errors.New("already registered")
 
+// ValidationError is returned when an issue lacks fields required by the tracker.
+type ValidationError struct {
+	Tracker TrackerID
+	Missing []string
+}
+
+func (e *ValidationError) Error() string {
+	return fmt.Sprintf("%s: missing required fields: %s", e.Tracker, strings.Join(e.Missing, ", "))
+}
+
 // Issue holds the data of the issue.
 type Issue struct {
-	ID, SecondaryID IssueID
-	Summary         string
-	Author          User
-	CreatedAt       time.Time
-	State           State
+	ID, SecondaryID      IssueID
+	Summary, Description string
+	// Project is the key/name of the project, Category the component/category within it.
+	Project, Category  string
+	Priority, Severity string
+	// Author is the creator of the issue, Reporter the one it is reported for (mostly the same).
+	Author, Reporter, Assignee User
+	Labels                     []string
+	CreatedAt, UpdatedAt       time.Time
+	DueDate                    time.Time
+	State                      State
+	// Version is the affected version, FixedInVersion the one containing the fix,
+	// TargetVersion the one the fix is planned for.
+	Version, FixedInVersion, TargetVersion string
+	// Custom holds the custom fields, by name.
+	Custom map[string]string
 }
 
 // IssueID is the ID of the issue.
@@ -106,17 +137,44 @@ type Comment struct {
 	Body      string
 }
 
+// AttributedBody returns the Body prefixed with the original author and date,
+// for trackers that cannot post in the name of the Author.
+func (c Comment) AttributedBody() string { return Attribute(c.Author, c.CreatedAt, c.Body) }
+
+// Attribute returns the text prefixed with "Originally by author on date".
+func Attribute(author User, at time.Time, text string) string {
+	name := author.String()
+	if name == "" {
+		return text
+	}
+	return "Originally by " + name + " on " + at.Format("2006-01-02 15:04 MST") + "\n\n" + text
+}
+
 type User struct {
 	ID              UserID
 	RealName, Email string
 }
 
+func (u User) String() string {
+	switch {
+	case u.RealName != "" && u.Email != "":
+		return u.RealName + " <" + u.Email + ">"
+	case u.RealName != "":
+		return u.RealName
+	case u.Email != "":
+		return u.Email
+	}
+	return string(u.ID)
+}
+
 // Attachment is an attachment (file).
 type Attachment struct {
 	ID             AttachmentID
 	Name, MIMEType string
 	Author         User
 	CreatedAt      time.Time
+	// URL is where the file can be downloaded from, if the tracker has such a link.
+	URL string
 	// GetBody returns the data.
 	GetBody func() (io.ReadCloser, error)
 }
@@ -0,0 +1,358 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ittest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+)
+
+var recordFlag = flag.Bool("record", false, "record the HTTP exchanges with the trackers into the cassettes")
+
+// Recording reports whether the tests run with -record.
+func Recording() bool { return *recordFlag }
+
+// secretParams are the query parameters holding credentials.
+var secretParams = []string{"token", "key", "password", "api_key"}
+
+// redactedHost replaces the scheme and host of the recorded tracker.
+const redactedHost = "https://tracker.example.invalid"
+
+// Cassette is an http.RoundTripper recording the HTTP exchanges with a tracker
+// into a file (with -record), or replaying them from that file.
+//
+// The credentials (the Authorization and cookie headers, the user info of the URL,
+// the token, key and password query parameters, and the passwords in the request bodies)
+// are not recorded, and the tracker's host is replaced with tracker.example.invalid.
+//
+// The requests are replayed in order, each must match the recorded one's method,
+// URL (with the query) and body. The timestamps are not compared, as those depend
+// on the time of the test, and neither are the multipart boundaries.
+type Cassette struct {
+	t        *testing.T
+	fileName string
+
+	mu           sync.Mutex
+	cassette     cassette
+	next         int
+	replacements []string
+}
+
+type cassette struct {
+	// URL is the URL of the tracker, redacted.
+	URL          string
+	Interactions []interaction
+}
+
+type interaction struct {
+	Method, URL string
+	Request     body `json:",omitempty"`
+	Status      int
+	Header      http.Header `json:",omitempty"`
+	Response    body        `json:",omitempty"`
+}
+
+// body is a string in JSON, base64 encoded if it is not valid UTF-8.
+type body []byte
+
+func (b body) MarshalJSON() ([]byte, error) {
+	s := string(b)
+	if !utf8.Valid(b) {
+		s = "base64:" + base64.StdEncoding.EncodeToString(b)
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	err := enc.Encode(s)
+	return bytes.TrimSuffix(buf.Bytes(), []byte{'\n'}), err
+}
+
+func (b *body) UnmarshalJSON(p []byte) error {
+	var s string
+	if err := json.Unmarshal(p, &s); err != nil {
+		return err
+	}
+	if strings.HasPrefix(s, "base64:") {
+		var err error
+		*b, err = base64.StdEncoding.DecodeString(s[7:])
+		return err
+	}
+	*b = body(s)
+	return nil
+}
+
+// NewCassette returns a Cassette for the named file under testdata.
+//
+// Without -record the file is read, and the test is skipped if it does not exist.
+// With -record the exchanges are written to the file at the end of the test, if it passes.
+func NewCassette(t *testing.T, name string) *Cassette {
+	t.Helper()
+	return newCassette(t, filepath.Join("testdata", name+".json"))
+}
+
+func newCassette(t *testing.T, fileName string) *Cassette {
+	t.Helper()
+	c := &Cassette{t: t, fileName: fileName}
+	if *recordFlag {
+		t.Cleanup(c.save)
+		return c
+	}
+	b, err := ioutil.ReadFile(c.fileName)
+	if err != nil {
+		if os.IsNotExist(err) {
+			t.Skipf("%s does not exist, run the test with -record against a tracker", c.fileName)
+		}
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal(b, &c.cassette); err != nil {
+		t.Fatalf("%s: %+v", c.fileName, err)
+	}
+	t.Cleanup(func() {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if n := len(c.cassette.Interactions) - c.next; n != 0 && !t.Failed() && !t.Skipped() {
+			t.Errorf("%s: %d recorded exchanges were not replayed", c.fileName, n)
+		}
+	})
+	return c
+}
+
+// URL returns the URL of the tracker to test.
+//
+// When recording, this is rawURL, and its scheme, host and credentials are
+// redacted in the recorded exchanges; otherwise the URL recorded with the exchanges.
+func (c *Cassette) URL(rawURL string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !*recordFlag {
+		return c.cassette.URL
+	}
+	URL, err := url.Parse(rawURL)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	if u := URL.User; u != nil {
+		if p, ok := u.Password(); ok && p != "" {
+			c.replacements = append(c.replacements, p, "REDACTED")
+		}
+		if n := u.Username(); n != "" {
+			c.replacements = append(c.replacements, n, "user")
+		}
+		URL.User = url.UserPassword("user", "REDACTED")
+	}
+	q := URL.Query()
+	for _, k := range secretParams {
+		if v := q.Get(k); v != "" {
+			c.replacements = append(c.replacements, v, "REDACTED")
+			q.Set(k, "REDACTED")
+		}
+	}
+	URL.RawQuery = q.Encode()
+	c.replacements = append(c.replacements, URL.Scheme+"://"+URL.Host, redactedHost)
+	URL.Scheme, URL.Host = "https", strings.TrimPrefix(redactedHost, "https://")
+	c.cassette.URL = URL.String()
+	return rawURL
+}
+
+// EnvURL is like URL, with the URL of the tracker taken from the env environment variable.
+//
+// The test is skipped when recording without it: the cassettes are recorded
+// against real trackers, the fake servers are tested directly.
+func (c *Cassette) EnvURL(env string) string {
+	if !*recordFlag {
+		return c.URL("")
+	}
+	rawURL := os.Getenv(env)
+	if rawURL == "" {
+		c.t.Skipf("%s is not set, there is no tracker to record", env)
+	}
+	return c.URL(rawURL)
+}
+
+// Client returns an http.Client using the Cassette.
+func (c *Cassette) Client() *http.Client { return &http.Client{Transport: c} }
+
+// HookDefaultClient makes http.DefaultClient use the Cassette till the end of the test,
+// for the libraries without a way to set their http.Client.
+func (c *Cassette) HookDefaultClient() {
+	old := http.DefaultClient.Transport
+	http.DefaultClient.Transport = c
+	c.t.Cleanup(func() { http.DefaultClient.Transport = old })
+}
+
+// RoundTrip records or replays the exchange.
+func (c *Cassette) RoundTrip(req *http.Request) (*http.Response, error) {
+	if *recordFlag {
+		return c.recordTrip(req)
+	}
+	resp, err := c.replay(req)
+	if err != nil {
+		c.t.Error(err)
+	}
+	return resp, err
+}
+
+// replay returns the next recorded response, if the request matches the recorded one.
+func (c *Cassette) replay(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	URL := c.redact(requestURL(req))
+	if c.next >= len(c.cassette.Interactions) {
+		return nil, fmt.Errorf("%s %s: no more recorded exchanges in %s", req.Method, URL, c.fileName)
+	}
+	ia := c.cassette.Interactions[c.next]
+	if ia.Method != req.Method || normalize(ia.URL) != normalize(URL) {
+		return nil, fmt.Errorf("%s %s: the recorded exchange #%d in %s is %s %s", req.Method, URL, c.next, c.fileName, ia.Method, ia.URL)
+	}
+	if got := normalize(c.redactBody(req, reqBody)); got != normalize(string(ia.Request)) {
+		return nil, fmt.Errorf("%s %s: the body differs from the recorded exchange #%d in %s:\n%s\nrecorded:\n%s",
+			req.Method, URL, c.next, c.fileName, got, normalize(string(ia.Request)))
+	}
+	c.next++
+	return &http.Response{
+		Status:     fmt.Sprintf("%d %s", ia.Status, http.StatusText(ia.Status)),
+		StatusCode: ia.Status,
+		Proto:      "HTTP/1.1", ProtoMajor: 1, ProtoMinor: 1,
+		Header:        ia.Header.Clone(),
+		Body:          ioutil.NopCloser(bytes.NewReader(ia.Response)),
+		ContentLength: int64(len(ia.Response)),
+		Request:       req,
+	}, nil
+}
+
+// readRequestBody reads and closes the body of the request, replacing it with a copy.
+func readRequestBody(req *http.Request) ([]byte, error) {
+	if req.Body == nil {
+		return nil, nil
+	}
+	b, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	req.Body = ioutil.NopCloser(bytes.NewReader(b))
+	return b, err
+}
+
+// requestURL returns the URL of the request without the user info and the fragment.
+func requestURL(req *http.Request) string {
+	URL := *req.URL
+	URL.User, URL.Fragment = nil, ""
+	return URL.String()
+}
+
+func (c *Cassette) recordTrip(req *http.Request) (*http.Response, error) {
+	reqBody, err := readRequestBody(req)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(respBody))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	header := resp.Header.Clone()
+	for _, k := range []string{"Set-Cookie", "Content-Length", "Www-Authenticate"} {
+		header.Del(k)
+	}
+	c.cassette.Interactions = append(c.cassette.Interactions, interaction{
+		Method:   req.Method,
+		URL:      c.redact(requestURL(req)),
+		Request:  body(c.redactBody(req, reqBody)),
+		Status:   resp.StatusCode,
+		Header:   c.redactHeader(header),
+		Response: body(c.redact(string(respBody))),
+	})
+	return resp, nil
+}
+
+// rePassword matches the password values in XML (SOAP) and JSON bodies.
+var rePassword = regexp.MustCompile(`(<(?:\w+:)?password[^>]*>)[^<]*(</)|("password"\s*:\s*")[^"]*(")`)
+
+// redactBody returns the request body without the passwords,
+// and with "BOUNDARY" as the multipart boundary.
+func (c *Cassette) redactBody(req *http.Request, b []byte) string {
+	s := c.redact(string(rePassword.ReplaceAll(b, []byte("${1}${3}REDACTED${2}${4}"))))
+	if _, params, err := mime.ParseMediaType(req.Header.Get("Content-Type")); err == nil && params["boundary"] != "" {
+		s = strings.Replace(s, params["boundary"], "BOUNDARY", -1)
+	}
+	return s
+}
+
+// reTimestamp matches the dates and times, optionally URL encoded.
+var reTimestamp = regexp.MustCompile(`\d{4}(?:-|/|%2F)\d\d(?:-|/|%2F)\d\d(?:(?:T|\s|\+|%20)\d\d(?::|%3A)\d\d(?:(?::|%3A)\d\d(?:\.\d+)?)?(?:Z|(?:[+-]|%2B)\d\d(?::|%3A)?\d\d)?)?`)
+
+// normalize replaces the timestamps of the URL or body, for comparison.
+func normalize(s string) string {
+	return reTimestamp.ReplaceAllString(s, "TIMESTAMP")
+}
+
+func (c *Cassette) redact(s string) string {
+	if len(c.replacements) == 0 {
+		return s
+	}
+	return strings.NewReplacer(c.replacements...).Replace(s)
+}
+
+func (c *Cassette) redactHeader(h http.Header) http.Header {
+	for k, vv := range h {
+		for i, v := range vv {
+			vv[i] = c.redact(v)
+		}
+		h[k] = vv
+	}
+	return h
+}
+
+func (c *Cassette) save() {
+	if c.t.Failed() || c.t.Skipped() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cassette.URL == "" {
+		c.t.Error("the tracker's URL is not set, call Cassette.URL")
+		return
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(c.cassette); err != nil {
+		c.t.Error(err)
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(c.fileName), 0755); err != nil {
+		c.t.Error(err)
+		return
+	}
+	if err := ioutil.WriteFile(c.fileName, buf.Bytes(), 0644); err != nil {
+		c.t.Error(err)
+	}
+}
@@ -0,0 +1,141 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package ittest
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCassette(t *testing.T) {
+	var hits int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&hits, 1)
+		b, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte(r.Method + " " + r.URL.Path + " " + strconv.Itoa(len(b)) + " " + strconv.Itoa(int(n))))
+	}))
+	defer srv.Close()
+	fileName := filepath.Join(t.TempDir(), "cassette.json")
+
+	// exchange sends the requests, with the timestamps of the time, returning the responses.
+	exchange := func(t *testing.T, c *Cassette, rawURL string, at time.Time) []string {
+		t.Helper()
+		base, err := url.Parse(rawURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token := base.Query().Get("token")
+		ts := at.UTC().Format(time.RFC3339)
+		URL := func(path string, q url.Values) string {
+			q.Set("token", token)
+			u, _ := base.Parse(path + "?" + q.Encode())
+			return u.String()
+		}
+		var mp bytes.Buffer
+		mw := multipart.NewWriter(&mp)
+		w, _ := mw.CreateFormFile("file", "a.txt")
+		w.Write([]byte("attached"))
+		mw.Close()
+		js, _ := json.Marshal(map[string]string{"summary": "created", "updated": ts, "password": "hunter2"})
+
+		var reqs []*http.Request
+		req, _ := http.NewRequest("GET", URL("issues", url.Values{"since": {ts}}), nil)
+		reqs = append(reqs, req)
+		req, _ = http.NewRequest("POST", URL("issues", url.Values{}), bytes.NewReader(js))
+		req.Header.Set("Content-Type", "application/json")
+		reqs = append(reqs, req)
+		req, _ = http.NewRequest("POST", URL("issues/1/attachments", url.Values{}), bytes.NewReader(mp.Bytes()))
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		reqs = append(reqs, req)
+
+		var responses []string
+		for _, req := range reqs {
+			resp, err := c.Client().Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, err := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, resp.Status+" "+string(b))
+		}
+		return responses
+	}
+
+	var recorded []string
+	t.Run("record", func(t *testing.T) {
+		*recordFlag = true
+		defer func() { *recordFlag = false }()
+		c := newCassette(t, fileName)
+		recorded = exchange(t, c, c.URL(srv.URL+"/api/?token=secret"), time.Now())
+	})
+	if t.Failed() {
+		return
+	}
+	b, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"secret", "hunter2", strings.TrimPrefix(srv.URL, "http://")} {
+		if bytes.Contains(b, []byte(s)) {
+			t.Errorf("the cassette contains %q:\n%s", s, b)
+		}
+	}
+
+	t.Run("replay", func(t *testing.T) {
+		c := newCassette(t, fileName)
+		before := atomic.LoadInt32(&hits)
+		// The timestamps and the multipart boundaries differ.
+		replayed := exchange(t, c, c.URL(""), time.Now().Add(time.Hour))
+		if !reflect.DeepEqual(replayed, recorded) {
+			t.Errorf("got %q, recorded %q", replayed, recorded)
+		}
+		if n := atomic.LoadInt32(&hits); n != before {
+			t.Errorf("the replay called the server %d times", n-before)
+		}
+	})
+
+	t.Run("mismatch", func(t *testing.T) {
+		c := newCassette(t, fileName)
+		base := c.URL("")
+		for _, tc := range []struct {
+			Method, URL, Body string
+		}{
+			{"POST", "issues?since=2020-01-01T00:00:00Z&token=REDACTED", ""},
+			{"GET", "issues?since=2020-01-01T00:00:00Z&token=REDACTED&state=all", ""},
+			{"GET", "issues?since=2020-01-01T00:00:00Z&token=REDACTED", "unexpected"},
+		} {
+			u, _ := url.Parse(base)
+			u, _ = u.Parse(tc.URL)
+			var body io.Reader
+			if tc.Body != "" {
+				body = strings.NewReader(tc.Body)
+			}
+			req, _ := http.NewRequest(tc.Method, u.String(), body)
+			if resp, err := c.replay(req); err == nil {
+				t.Errorf("%s %s %q replayed %+v", tc.Method, u, tc.Body, resp)
+			}
+		}
+		// The exchanges are still replayed from the first.
+		exchange(t, c, base, time.Now())
+	})
+}
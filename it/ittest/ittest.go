@@ -0,0 +1,424 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package ittest provides a conformance test suite for the it.Tracker implementations.
+//
+// A backend runs it against a local (fake) server, as
+//
+//	func TestConformance(t *testing.T) {
+//		ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+//			srv := newFakeServer(t)
+//			c, err := New(srv.URL)
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return c
+//		}, ittest.WithPageSize(PageSize))
+//	}
+package ittest
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// Factory returns a new, empty tracker for each test.
+//
+// The tracker is expected to use the wall clock, the "since" tests are based on time.Now.
+type Factory func(t *testing.T) it.Tracker
+
+// Option configures the optional parts of RunConformance.
+type Option func(*options)
+
+type options struct {
+	PageSize int
+	User     it.User
+}
+
+// WithPageSize runs the ListPages test, listing more issues than
+// fit on two pages of the given size.
+func WithPageSize(n int) Option { return func(o *options) { o.PageSize = n } }
+
+// WithUser checks that FindUser finds the user by its email, case insensitively,
+// and does not by a part of it.
+// The factory must return trackers knowing the user.
+func WithUser(u it.User) Option { return func(o *options) { o.User = u } }
+
+// RunConformance runs the conformance tests as subtests of t.
+//
+// The methods documented as "May return ErrNotImplemented" may do so
+// (the tests depending on them are skipped then), but must not return
+// any other error for valid input.
+func RunConformance(t *testing.T, factory Factory, opts ...Option) {
+	var o options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	for _, tc := range []struct {
+		Name string
+		Test func(*testing.T, it.Tracker, options)
+	}{
+		{"CreateGet", testCreateGet},
+		{"GetMissing", testGetMissing},
+		{"ListSince", testListSince},
+		{"ListPages", testListPages},
+		{"UpdateIssue", testUpdateIssue},
+		{"State", testState},
+		{"SecondaryID", testSecondaryID},
+		{"FindUser", testFindUser},
+		{"Comments", testComments},
+		{"Attachments", testAttachments},
+	} {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) { tc.Test(t, factory(t), o) })
+	}
+}
+
+// Context returns a context for a test, with a timeout.
+func Context(t *testing.T) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	t.Cleanup(cancel)
+	return ctx
+}
+
+// create creates a new issue, skipping the test if the tracker cannot create issues.
+func create(ctx context.Context, t *testing.T, tr it.Tracker, issue it.Issue) it.IssueID {
+	t.Helper()
+	ID, err := tr.CreateIssue(ctx, issue)
+	if err != nil {
+		if errors.Is(err, it.ErrNotImplemented) {
+			t.Skip("CreateIssue is not implemented")
+		}
+		t.Fatalf("CreateIssue(%+v): %+v", issue, err)
+	}
+	if ID == "" {
+		t.Fatal("CreateIssue returned an empty ID")
+	}
+	return ID
+}
+
+// sameText reports whether got is want, ignoring the attribution and the surrounding space.
+func sameText(got, want string) bool {
+	return strings.TrimSpace(it.StripAttribution(got)) == strings.TrimSpace(want)
+}
+
+func testCreateGet(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	want := it.Issue{Summary: "conformance: create", Description: "The description.\n\nSecond paragraph."}
+	ID := create(ctx, t, tr, want)
+	ID2 := create(ctx, t, tr, it.Issue{Summary: "conformance: create 2", Description: "other"})
+	if ID2 == ID {
+		t.Errorf("two issues got the same ID %q", ID)
+	}
+	for i := 0; i < 2; i++ {
+		got, err := tr.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatalf("GetIssue(%q): %+v", ID, err)
+		}
+		if got.ID != ID {
+			t.Errorf("GetIssue(%q) returned ID %q", ID, got.ID)
+		}
+		if got.Summary != want.Summary {
+			t.Errorf("Summary: got %q, wanted %q", got.Summary, want.Summary)
+		}
+		if !sameText(got.Description, want.Description) {
+			t.Errorf("Description: got %q, wanted %q", got.Description, want.Description)
+		}
+	}
+}
+
+func testGetMissing(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: missing"})
+	missing := it.IssueID(string(ID) + "999")
+	if _, err := tr.GetIssue(ctx, missing); err == nil {
+		t.Errorf("GetIssue(%q) of a missing issue succeeded", missing)
+	} else if errors.Is(err, it.ErrNotImplemented) {
+		t.Errorf("GetIssue(%q): %+v, wanted not found", missing, err)
+	}
+}
+
+func testListSince(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	// Some trackers query with minute, Mantis with day precision.
+	before := time.Now().Add(-time.Minute)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: list"})
+
+	listed := func(since time.Time) bool {
+		t.Helper()
+		issues, err := tr.ListIssues(ctx, since)
+		if err != nil {
+			t.Fatalf("ListIssues(%s): %+v", since, err)
+		}
+		var found bool
+		for _, issue := range issues {
+			if issue.ID == "" {
+				t.Errorf("ListIssues(%s) returned an issue without ID: %+v", since, issue)
+			}
+			found = found || issue.ID == ID
+		}
+		return found
+	}
+	if !listed(time.Time{}) {
+		t.Errorf("ListIssues(zero) does not list %q", ID)
+	}
+	if !listed(before) {
+		t.Errorf("ListIssues(%s) does not list %q, created later", before, ID)
+	}
+	if after := time.Now().Add(48 * time.Hour); listed(after) {
+		t.Errorf("ListIssues(%s) lists %q, created earlier", after, ID)
+	}
+}
+
+func testListPages(t *testing.T, tr it.Tracker, o options) {
+	if o.PageSize <= 0 {
+		t.Skip("no page size")
+	}
+	ctx := Context(t)
+	want := make(map[it.IssueID]bool)
+	for i := 0; i < 2*o.PageSize+1; i++ {
+		want[create(ctx, t, tr, it.Issue{Summary: "conformance: paged"})] = true
+	}
+	issues, err := tr.ListIssues(ctx, time.Time{})
+	if err != nil {
+		t.Fatalf("ListIssues: %+v", err)
+	}
+	for _, issue := range issues {
+		if !want[issue.ID] {
+			t.Errorf("ListIssues returned an unexpected or repeated issue %q", issue.ID)
+		}
+		delete(want, issue.ID)
+	}
+	if len(want) != 0 {
+		t.Errorf("ListIssues misses %d issues", len(want))
+	}
+}
+
+func testUpdateIssue(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: update", Description: "kept"})
+	err := tr.UpdateIssue(ctx, ID, it.IssueUpdate{
+		Issue:  it.Issue{Summary: "conformance: updated", Description: "must not be set"},
+		Fields: it.FieldSummary,
+	})
+	if errors.Is(err, it.ErrNotImplemented) {
+		t.Skip("UpdateIssue is not implemented")
+	} else if err != nil {
+		t.Fatalf("UpdateIssue(%q): %+v", ID, err)
+	}
+	got, err := tr.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatalf("GetIssue(%q): %+v", ID, err)
+	}
+	if got.Summary != "conformance: updated" {
+		t.Errorf("Summary: got %q, wanted the updated", got.Summary)
+	}
+	if !sameText(got.Description, "kept") {
+		t.Errorf("Description: got %q, but it is not in the update's mask", got.Description)
+	}
+}
+
+func testState(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	states, err := tr.ListStates(ctx)
+	if errors.Is(err, it.ErrNotImplemented) {
+		t.Skip("ListStates is not implemented")
+	} else if err != nil {
+		t.Fatalf("ListStates: %+v", err)
+	}
+	if len(states) == 0 {
+		t.Fatal("ListStates returned no states")
+	}
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: state"})
+	issue, err := tr.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatalf("GetIssue(%q): %+v", ID, err)
+	}
+	var target it.State
+	for _, s := range states {
+		if s != issue.State {
+			target = s
+			break
+		}
+	}
+	if target == "" {
+		t.Skipf("no other state than %q", issue.State)
+	}
+	if err = tr.UpdateIssueState(ctx, ID, target); err != nil {
+		t.Fatalf("UpdateIssueState(%q, %q): %+v", ID, target, err)
+	}
+	if issue, err = tr.GetIssue(ctx, ID); err != nil {
+		t.Fatalf("GetIssue(%q): %+v", ID, err)
+	}
+	if issue.State != target {
+		t.Errorf("State: got %q, wanted %q", issue.State, target)
+	}
+}
+
+func testSecondaryID(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: secondary"})
+	err := tr.SetSecondaryID(ctx, ID, "OTHER-1")
+	if errors.Is(err, it.ErrNotImplemented) {
+		t.Skip("SetSecondaryID is not implemented")
+	} else if err != nil {
+		t.Fatalf("SetSecondaryID(%q): %+v", ID, err)
+	}
+	if issue, err := tr.GetIssue(ctx, ID); err != nil {
+		t.Fatalf("GetIssue(%q): %+v", ID, err)
+	} else if issue.SecondaryID != "OTHER-1" {
+		t.Errorf("SecondaryID: got %q, wanted OTHER-1", issue.SecondaryID)
+	}
+}
+
+func testFindUser(t *testing.T, tr it.Tracker, o options) {
+	ctx := Context(t)
+	const email = "nobody@example.invalid"
+	// Trackers without accounts may return a user for any address, but with an ID.
+	u, err := tr.FindUser(ctx, email)
+	switch {
+	case errors.Is(err, it.ErrNotImplemented):
+		t.Skip("FindUser is not implemented")
+	case errors.Is(err, it.ErrNotFound):
+	case err != nil:
+		t.Errorf("FindUser(%q): %+v, wanted ErrNotFound", email, err)
+	case u.ID == "":
+		t.Errorf("FindUser(%q) returned a user without ID: %+v", email, u)
+	}
+	if o.User.Email == "" {
+		return
+	}
+
+	for _, email := range []string{o.User.Email, strings.ToUpper(o.User.Email)} {
+		u, err := tr.FindUser(ctx, email)
+		if err != nil {
+			t.Errorf("FindUser(%q): %+v", email, err)
+		} else if u.ID != o.User.ID {
+			t.Errorf("FindUser(%q) returned %+v, wanted %q", email, u, o.User.ID)
+		}
+	}
+	// Searching for a part must not match.
+	partial := o.User.Email[1:]
+	if u, err := tr.FindUser(ctx, partial); !errors.Is(err, it.ErrNotFound) {
+		t.Errorf("FindUser(%q): got %+v, %+v, wanted ErrNotFound", partial, u, err)
+	}
+}
+
+func testComments(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: comments"})
+	bodies := []string{"first comment", "second comment"}
+	cIDs := make([]it.CommentID, len(bodies))
+	for i, body := range bodies {
+		cID, err := tr.AddComment(ctx, ID, it.Comment{Body: body})
+		if err != nil {
+			t.Fatalf("AddComment(%q): %+v", ID, err)
+		}
+		if cID == "" {
+			t.Fatalf("AddComment(%q) returned an empty ID", ID)
+		}
+		cIDs[i] = cID
+	}
+	if cIDs[0] == cIDs[1] {
+		t.Errorf("two comments got the same ID %q", cIDs[0])
+	}
+	for i := 0; i < 2; i++ {
+		comments, err := tr.ListComments(ctx, ID)
+		if err != nil {
+			t.Fatalf("ListComments(%q): %+v", ID, err)
+		}
+		for j, cID := range cIDs {
+			var found bool
+			for _, c := range comments {
+				if c.ID == cID {
+					found = true
+					if !sameText(c.Body, bodies[j]) {
+						t.Errorf("comment %q: got %q, wanted %q", cID, c.Body, bodies[j])
+					}
+				}
+			}
+			if !found {
+				t.Errorf("ListComments(%q) misses %q: %+v", ID, cID, comments)
+			}
+		}
+	}
+
+	// The comments of other issues are not listed.
+	other := create(ctx, t, tr, it.Issue{Summary: "conformance: no comments"})
+	if comments, err := tr.ListComments(ctx, other); err != nil {
+		t.Fatalf("ListComments(%q): %+v", other, err)
+	} else if len(comments) != 0 {
+		t.Errorf("ListComments(%q): got %+v, wanted none", other, comments)
+	}
+}
+
+func testAttachments(t *testing.T, tr it.Tracker, _ options) {
+	ctx := Context(t)
+	ID := create(ctx, t, tr, it.Issue{Summary: "conformance: attachments"})
+	data := []byte("attached data\n")
+	// The attachment has an URL too, as the ones listed by the trackers,
+	// for the trackers which cannot upload, only link the files.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write(data)
+	}))
+	t.Cleanup(srv.Close)
+	aID, err := tr.AddAttachment(ctx, ID, it.Attachment{
+		Name: "conformance.txt", MIMEType: "text/plain", URL: srv.URL + "/conformance.txt",
+		GetBody: func() (io.ReadCloser, error) { return ioutil.NopCloser(bytes.NewReader(data)), nil },
+	})
+	if err != nil {
+		t.Fatalf("AddAttachment(%q): %+v", ID, err)
+	}
+	if aID == "" {
+		t.Fatalf("AddAttachment(%q) returned an empty ID", ID)
+	}
+	for i := 0; i < 2; i++ {
+		attachments, err := tr.ListAttachments(ctx, ID)
+		if err != nil {
+			t.Fatalf("ListAttachments(%q): %+v", ID, err)
+		}
+		var found bool
+		for _, a := range attachments {
+			if a.ID != aID {
+				continue
+			}
+			found = true
+			if a.Name != "conformance.txt" {
+				t.Errorf("attachment %q: name is %q", aID, a.Name)
+			}
+			if got, err := readBody(a); err != nil {
+				t.Errorf("attachment %q: %+v", aID, err)
+			} else if !bytes.Equal(got, data) {
+				t.Errorf("attachment %q: got %q, wanted %q", aID, got, data)
+			}
+		}
+		if !found {
+			t.Errorf("ListAttachments(%q) misses %q: %+v", ID, aID, attachments)
+		}
+	}
+}
+
+func readBody(a it.Attachment) ([]byte, error) {
+	if a.GetBody == nil {
+		return nil, errors.New("no GetBody")
+	}
+	r, err := a.GetBody()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -7,8 +7,11 @@ package jira
 
 import (
 	"context"
+	"fmt"
 	"io"
-	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -26,11 +29,68 @@ func init() {
 type Client struct {
 	id string
 	*jira.Client
+	defaults defaults
+	workflow workflow
+	// secondaryField is the ID of the custom field holding the secondary ID.
+	secondaryField string
 }
 
-func New(baseURL string) (Client, error) {
-	c, err := jira.NewClient(nil, baseURL)
-	return Client{id: baseURL, Client: c}, err
+// defaults are the values used for the new issues, when the incoming issue lacks them.
+type defaults struct {
+	Project, IssueType, Priority string
+}
+
+// workflow configures the state changes.
+type workflow struct {
+	// Paths are sequences of states to follow when there is no direct transition to the target state.
+	Paths [][]string
+	// Resolution is set when the transition requires it.
+	Resolution string
+}
+
+// New returns a new Jira client.
+//
+// The defaults for the created issues can be given as query parameters:
+// project (key), issuetype and priority.
+//
+// The workflow can be configured with the "path" parameter (may be repeated),
+// a ">"-separated sequence of states, such as "Open>In Progress>Resolved>Closed",
+// and the "resolution" parameter, the resolution to set on transitions requiring it.
+//
+// The secondary ID is stored in the custom field named by the "secondary_field"
+// parameter (such as "customfield_10010").
+func New(baseURL string) (Client, error) { return NewWithClient(baseURL, nil) }
+
+// NewWithClient is like New, but uses hc for the HTTP requests (http.DefaultClient if nil).
+func NewWithClient(baseURL string, hc *http.Client) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	wf := workflow{Resolution: q.Get("resolution")}
+	for _, p := range q["path"] {
+		states := strings.Split(p, ">")
+		for i, s := range states {
+			states[i] = strings.TrimSpace(s)
+		}
+		wf.Paths = append(wf.Paths, states)
+	}
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c, err := jira.NewClient(hc, baseURL)
+	return Client{id: baseURL, Client: c,
+		defaults: defaults{
+			Project:   q.Get("project"),
+			IssueType: q.Get("issuetype"),
+			Priority:  q.Get("priority"),
+		},
+		workflow:       wf,
+		secondaryField: q.Get("secondary_field"),
+	}, err
 }
 
 func (c Client) ID() it.TrackerID {
@@ -40,12 +100,50 @@ func (c Client) ID() it.TrackerID {
 // GetIssue returns the data for the issueID
 func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
 	ji, _, err := c.Client.Issue.Get(string(ID), nil)
-	return it.Issue{
-		ID: it.IssueID(ji.ID), Summary: ji.Fields.Summary,
-		Author:    readJU(ji.Fields.Reporter, ji.Fields.Creator),
-		CreatedAt: time.Time(ji.Fields.Created),
-		State:     it.State(ji.Fields.Status.Name),
-	}, err
+	if err != nil {
+		return it.Issue{}, err
+	}
+	f := ji.Fields
+	issue := it.Issue{
+		ID: it.IssueID(ji.ID), Summary: f.Summary, Description: f.Description,
+		Project:   f.Project.Key,
+		Author:    readJU(f.Creator, f.Reporter),
+		Reporter:  readJU(f.Reporter),
+		Assignee:  readJU(f.Assignee),
+		Labels:    f.Labels,
+		CreatedAt: time.Time(f.Created), UpdatedAt: time.Time(f.Updated),
+		DueDate: time.Time(f.Duedate),
+	}
+	if f.Status != nil {
+		issue.State = it.State(f.Status.Name)
+	}
+	if f.Priority != nil {
+		issue.Priority = f.Priority.Name
+	}
+	if len(f.Components) != 0 && f.Components[0] != nil {
+		issue.Category = f.Components[0].Name
+	}
+	if len(f.AffectsVersions) != 0 && f.AffectsVersions[0] != nil {
+		issue.Version = f.AffectsVersions[0].Name
+	}
+	if len(f.FixVersions) != 0 && f.FixVersions[0] != nil {
+		issue.FixedInVersion = f.FixVersions[0].Name
+	}
+	if c.secondaryField != "" {
+		issue.SecondaryID = it.IssueID(customValue(f.Unknowns[c.secondaryField]))
+	}
+	for k, v := range f.Unknowns {
+		if !strings.HasPrefix(k, "customfield_") {
+			continue
+		}
+		if s := customValue(v); s != "" {
+			if issue.Custom == nil {
+				issue.Custom = make(map[string]string)
+			}
+			issue.Custom[k] = s
+		}
+	}
+	return issue, nil
 }
 
 // ListIssues lists all the issues created/changed since "since".
@@ -53,12 +151,20 @@ func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, er
 	// https://developer.atlassian.com/server/jira/platform/jira-rest-api-examples/#searching-for-issues-examples
 	issues := make([]it.Issue, 0, 1024)
 	sinceS := since.Format("2006-01-02")
+	fields := []string{"id", "key"}
+	if c.secondaryField != "" {
+		fields = append(fields, c.secondaryField)
+	}
 	err := c.Client.Issue.SearchPages("updated >= "+sinceS+" OR created >= "+sinceS,
 		&jira.SearchOptions{
-			StartAt: 0, MaxResults: 1000, Fields: []string{"id", "key"},
+			StartAt: 0, MaxResults: 1000, Fields: fields,
 		},
 		func(ji jira.Issue) error {
-			issues = append(issues, it.Issue{ID: it.IssueID(ji.ID)})
+			issue := it.Issue{ID: it.IssueID(ji.ID)}
+			if c.secondaryField != "" && ji.Fields != nil {
+				issue.SecondaryID = it.IssueID(customValue(ji.Fields.Unknowns[c.secondaryField]))
+			}
+			issues = append(issues, issue)
 			return nil
 		},
 	)
@@ -66,26 +172,251 @@ func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, er
 }
 
 // CreateIssue creates the issue, returning the ID.
-// May return ErrNotImplemented.
-func (c Client) CreateIssue(context.Context, it.Issue) (it.IssueID, error) {
-	ji, _, err := c.Client.Issue.Create(&jira.Issue{})
-	return it.IssueID(ji.ID), err
+//
+// The issue is created in the default project, with the default issue type.
+// The reporter is set if it is a mapped Jira user, otherwise the original
+// author is written into the description.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	f := jira.IssueFields{
+		Project:     jira.Project{Key: c.defaults.Project},
+		Type:        jira.IssueType{Name: c.defaults.IssueType},
+		Summary:     issue.Summary,
+		Description: issue.Description,
+		Labels:      issue.Labels,
+	}
+	var missing []string
+	if f.Project.Key == "" {
+		missing = append(missing, "project")
+	}
+	if f.Type.Name == "" {
+		missing = append(missing, "issuetype")
+	}
+	if f.Summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+
+	if p := firstNonEmpty(issue.Priority, c.defaults.Priority); p != "" {
+		f.Priority = &jira.Priority{Name: p}
+	}
+	if issue.Reporter.ID != "" {
+		f.Reporter = &jira.User{AccountID: string(issue.Reporter.ID)}
+	} else {
+		f.Description = it.Attribute(firstUser(issue.Reporter, issue.Author), issue.CreatedAt, f.Description)
+	}
+	if issue.Assignee.ID != "" {
+		f.Assignee = &jira.User{AccountID: string(issue.Assignee.ID)}
+	}
+	if !issue.DueDate.IsZero() {
+		f.Duedate = jira.Date(issue.DueDate)
+	}
+	ji, _, err := c.Client.Issue.Create(&jira.Issue{Fields: &f})
+	if err != nil {
+		return "", err
+	}
+	return it.IssueID(ji.ID), nil
 }
 
 // UpdateIssue updates the issue's state.
-func (c Client) UpdateIssueState(context.Context, it.IssueID, it.State) error {
-	return it.ErrNotImplemented
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The state is changed with a workflow transition, after the other fields.
+// An assignee without ID (not a mapped Jira user) is left as is.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	fields := make(map[string]interface{})
+	if upd.Fields.Has(it.FieldSummary) {
+		fields["summary"] = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		fields["description"] = upd.Description
+	}
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		fields["priority"] = map[string]string{"name": upd.Priority}
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			fields["assignee"] = map[string]string{"accountId": string(upd.Assignee.ID)}
+		} else if upd.Assignee == (it.User{}) {
+			fields["assignee"] = nil
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		labels := upd.Labels
+		if labels == nil {
+			labels = []string{}
+		}
+		fields["labels"] = labels
+	}
+	if len(fields) != 0 {
+		if _, err := c.Client.Issue.UpdateIssue(string(ID), map[string]interface{}{"fields": fields}); err != nil {
+			return fmt.Errorf("update %q: %w", ID, err)
+		}
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		return c.transition(ID, upd.State)
+	}
+	return nil
+}
+
+// maxTransitionSteps limits the length of the walk along the configured paths.
+const maxTransitionSteps = 16
+
+// transition moves the issue to the state with the workflow transition leading there.
+//
+// If there is no direct transition, the configured paths are followed,
+// always taking the transition that leads the farthest along a path towards the state.
+func (c Client) transition(ID it.IssueID, state it.State) error {
+	for step := 0; step < maxTransitionSteps; step++ {
+		ji, _, err := c.Client.Issue.Get(string(ID), &jira.GetQueryOptions{Fields: "status"})
+		if err != nil {
+			return fmt.Errorf("get status of %q: %w", ID, err)
+		}
+		var current string
+		if ji.Fields != nil && ji.Fields.Status != nil {
+			current = ji.Fields.Status.Name
+		}
+		if strings.EqualFold(current, string(state)) {
+			return nil
+		}
+		ts, _, err := c.Client.Issue.GetTransitions(string(ID))
+		if err != nil {
+			return fmt.Errorf("get transitions of %q: %w", ID, err)
+		}
+		t, ok := c.workflow.next(current, string(state), ts)
+		if !ok {
+			available := make([]string, len(ts))
+			for i, t := range ts {
+				available[i] = fmt.Sprintf("%q (to %q)", t.Name, t.To.Name)
+			}
+			return fmt.Errorf("%q: no transition path from %q to %q (available transitions: %s)",
+				ID, current, state, strings.Join(available, ", "))
+		}
+		if err = c.doTransition(ID, t); err != nil {
+			return fmt.Errorf("transition %q from %q to %q with %q: %w", ID, current, t.To.Name, t.Name, err)
+		}
+	}
+	return fmt.Errorf("%q: cannot reach %q in %d transitions", ID, state, maxTransitionSteps)
+}
+
+// next returns the transition to take from the current state towards the target state.
+func (wf workflow) next(current, target string, ts []jira.Transition) (jira.Transition, bool) {
+	for _, t := range ts {
+		if strings.EqualFold(t.To.Name, target) {
+			return t, true
+		}
+	}
+	var best jira.Transition
+	bestDist := -1
+	for _, path := range wf.Paths {
+		to := indexFold(path, target)
+		if to < 0 {
+			continue
+		}
+		from := indexFold(path, current)
+		for _, t := range ts {
+			// Take the step that leaves the least states to go on the path.
+			if i := indexFold(path, t.To.Name); from < i && i < to {
+				if dist := to - i; bestDist < 0 || dist < bestDist {
+					best, bestDist = t, dist
+				}
+			}
+		}
+	}
+	return best, bestDist >= 0
+}
+
+func indexFold(ss []string, s string) int {
+	for i, x := range ss {
+		if strings.EqualFold(x, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// doTransition executes the transition, filling the required fields it knows of.
+func (c Client) doTransition(ID it.IssueID, t jira.Transition) error {
+	fields := make(map[string]interface{})
+	var missing []string
+	for k, f := range t.Fields {
+		if !f.Required {
+			continue
+		}
+		switch k {
+		case "resolution":
+			if c.workflow.Resolution != "" {
+				fields[k] = map[string]string{"name": c.workflow.Resolution}
+				continue
+			}
+		}
+		missing = append(missing, k)
+	}
+	if len(missing) != 0 {
+		sort.Strings(missing)
+		return &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+	payload := map[string]interface{}{"transition": map[string]string{"id": t.ID}}
+	if len(fields) != 0 {
+		payload["fields"] = fields
+	}
+	_, err := c.Client.Issue.DoTransitionWithPayload(string(ID), payload)
+	return err
 }
 
 // SetSecondaryID updates the secondary ID to the issue.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
 func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
-	return it.ErrNotImplemented
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	if _, err := c.Client.Issue.UpdateIssue(string(primary), map[string]interface{}{
+		"fields": map[string]interface{}{c.secondaryField: string(secondary)},
+	}); err != nil {
+		return fmt.Errorf("set %s of %q: %w", c.secondaryField, primary, err)
+	}
+	return nil
+}
+
+// ListStates lists the states an issue can be in.
+func (c Client) ListStates(context.Context) ([]it.State, error) {
+	js, _, err := c.Client.Status.GetAllStatuses()
+	if err != nil {
+		return nil, err
+	}
+	states := make([]it.State, len(js))
+	for i, s := range js {
+		states[i] = it.State(s.Name)
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	jus, _, err := c.Client.User.Find(email)
+	if err != nil {
+		return it.User{}, err
+	}
+	for _, ju := range jus {
+		if strings.EqualFold(ju.EmailAddress, email) {
+			return it.User{ID: it.UserID(ju.AccountID), RealName: ju.DisplayName, Email: ju.EmailAddress}, nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
 }
 
 // AddComment adds a comment to the issue.
+//
+// Jira always posts as the authenticated user, so the original author is written into the body.
 func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
 	jc, _, err := c.Issue.AddComment(string(ID), &jira.Comment{
-		Body: comment.Body, Created: comment.CreatedAt.Format(time.RFC3339),
+		Body: comment.AttributedBody(), Created: comment.CreatedAt.Format(time.RFC3339),
 	})
 	return it.CommentID(jc.ID), err
 }
@@ -93,11 +424,14 @@ func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Commen
 // ListComments list the comments of the issue.
 func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
 	jc, _, err := c.Client.Issue.Get(string(ID), &jira.GetQueryOptions{
-		Fields: "comments",
+		Fields: "comment",
 	})
 	if err != nil {
 		return nil, err
 	}
+	if jc.Fields == nil || jc.Fields.Comments == nil {
+		return nil, nil
+	}
 	comments := make([]it.Comment, len(jc.Fields.Comments.Comments))
 	for i, c := range jc.Fields.Comments.Comments {
 		comments[i] = it.Comment{
@@ -118,7 +452,13 @@ func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachmen
 	}
 	defer r.Close()
 	as, _, err := c.Client.Issue.PostAttachment(string(ID), r, a.Name)
-	return it.AttachmentID((*as)[0].ID), err
+	if err != nil {
+		return "", err
+	}
+	if as == nil || len(*as) == 0 {
+		return "", fmt.Errorf("attach %q to %q: no attachment returned", a.Name, ID)
+	}
+	return it.AttachmentID((*as)[0].ID), nil
 }
 
 // ListAttachments lists the attachments of the issue.
@@ -133,29 +473,59 @@ func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attach
 	for i, ja := range jc.Fields.Attachments {
 		as[i] = it.Attachment{
 			ID: it.AttachmentID(ja.ID), Name: ja.Filename, MIMEType: ja.MimeType,
-			CreatedAt: s2t(ja.Created),
-		}
-		if ja.Content != "" {
-			as[i].GetBody = func() (io.ReadCloser, error) {
-				return struct {
-					io.Reader
-					io.Closer
-				}{strings.NewReader(ja.Content), ioutil.NopCloser(nil)}, nil
-			}
-		} else {
-			aID := ja.ID
-			as[i].GetBody = func() (io.ReadCloser, error) {
-				resp, err := c.Client.Issue.DownloadAttachment(aID)
-				if err != nil {
-					return nil, err
-				}
-				return resp.Body, nil
+			CreatedAt: s2t(ja.Created), URL: ja.Content,
+		}
+		// Content is the URL of the data, not the data itself.
+		aID := ja.ID
+		as[i].GetBody = func() (io.ReadCloser, error) {
+			resp, err := c.Client.Issue.DownloadAttachment(aID)
+			if err != nil {
+				return nil, err
 			}
+			return resp.Body, nil
 		}
 	}
 	return as, nil
 }
 
+// customValue returns the string representation of a custom field's value:
+// simple values as is, options by their value or name.
+func customValue(v interface{}) string {
+	switch x := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return x
+	case float64, bool:
+		return fmt.Sprintf("%v", x)
+	case map[string]interface{}:
+		for _, k := range []string{"value", "name"} {
+			if s, ok := x[k].(string); ok {
+				return s
+			}
+		}
+	}
+	return ""
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func firstUser(us ...it.User) it.User {
+	for _, u := range us {
+		if u != (it.User{}) {
+			return u
+		}
+	}
+	return it.User{}
+}
+
 func s2t(s string) time.Time {
 	t, _ := time.Parse(time.RFC3339, s)
 	return t
@@ -0,0 +1,716 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package jiratest provides an in-process Jira REST API server, for testing.
+//
+// It implements the endpoints used by the jira package (through go-jira):
+// issue get, create and edit, search (with a small JQL subset, paginated by
+// startAt and maxResults), comments, attachment upload and download,
+// transitions, statuses and user search.
+//
+// Authentication is not checked.
+package jiratest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a Jira server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+
+	// MaxResults caps the page size of the search, 50 by default.
+	MaxResults int
+	// Statuses are the states of the workflow, the first is the initial state.
+	Statuses []string
+	// Transitions are the workflow's transitions.
+	Transitions []Transition
+	// Me is the authenticated user, the author of the created issues and comments.
+	Me User
+
+	mu             sync.Mutex
+	users          []User
+	issues         []*issue
+	lastComment    int
+	lastAttachment int
+	files          map[string][]byte
+}
+
+// User is a Jira user account.
+type User struct {
+	AccountID    string `json:"accountId"`
+	EmailAddress string `json:"emailAddress,omitempty"`
+	DisplayName  string `json:"displayName,omitempty"`
+}
+
+// Transition is a workflow transition.
+type Transition struct {
+	ID, Name string
+	// From are the states the transition is available in, all if empty.
+	From []string
+	To   string
+	// Required are the fields the transition requires, as "resolution".
+	Required []string
+}
+
+// DefaultStatuses and DefaultTransitions are the simplified default Jira workflow,
+// where Closed can be reached only from Resolved, which requires a resolution.
+var (
+	DefaultStatuses    = []string{"Open", "In Progress", "Resolved", "Closed", "Reopened"}
+	DefaultTransitions = []Transition{
+		{ID: "4", Name: "Start Progress", From: []string{"Open", "Reopened"}, To: "In Progress"},
+		{ID: "301", Name: "Stop Progress", From: []string{"In Progress"}, To: "Open"},
+		{ID: "5", Name: "Resolve Issue", From: []string{"Open", "In Progress", "Reopened"}, To: "Resolved", Required: []string{"resolution"}},
+		{ID: "701", Name: "Close Issue", From: []string{"Resolved"}, To: "Closed"},
+		{ID: "3", Name: "Reopen Issue", From: []string{"Resolved", "Closed"}, To: "Reopened"},
+	}
+)
+
+type issue struct {
+	ID, Key              string
+	Project, Type        string
+	Summary, Description string
+	Priority, Status     string
+	Resolution           string
+	Reporter, Creator    *User
+	Assignee             *User
+	Labels               []string
+	DueDate              string
+	Created, Updated     time.Time
+	Custom               map[string]interface{}
+	Comments             []comment
+	Attachments          []attachment
+}
+
+type comment struct {
+	ID      string
+	Author  User
+	Body    string
+	Created time.Time
+}
+
+type attachment struct {
+	ID, Filename, MIMEType string
+	Author                 User
+	Created                time.Time
+	Size                   int
+}
+
+// timeFormat is the format of the timestamps in the Jira API.
+const timeFormat = "2006-01-02T15:04:05.000-0700"
+
+// NewServer starts and returns a new server, with the default workflow.
+// The caller should call Close when finished, to shut it down.
+func NewServer() *Server {
+	s := &Server{
+		MaxResults:  50,
+		Statuses:    append([]string(nil), DefaultStatuses...),
+		Transitions: append([]Transition(nil), DefaultTransitions...),
+		Me:          User{AccountID: "tester", EmailAddress: "tester@example.com", DisplayName: "Tester"},
+		files:       make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user, to be found by the user search.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	s.users = append(s.users, u)
+	s.mu.Unlock()
+}
+
+// Resolution returns the resolution of the issue (by ID or key).
+func (s *Server) Resolution(ID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if is := s.issue(ID); is != nil {
+		return is.Resolution
+	}
+	return ""
+}
+
+// apiError is the error response of the Jira API.
+type apiError struct {
+	Code          int               `json:"-"`
+	ErrorMessages []string          `json:"errorMessages"`
+	Errors        map[string]string `json:"errors"`
+}
+
+func (e *apiError) Error() string {
+	msgs := append([]string(nil), e.ErrorMessages...)
+	for k, v := range e.Errors {
+		msgs = append(msgs, k+": "+v)
+	}
+	return fmt.Sprintf("%d: %s", e.Code, strings.Join(msgs, "; "))
+}
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, ErrorMessages: []string{fmt.Sprintf(format, args...)}, Errors: map[string]string{}}
+}
+
+func fieldError(field, msg string) *apiError {
+	return &apiError{Code: http.StatusBadRequest, ErrorMessages: []string{}, Errors: map[string]string{field: msg}}
+}
+
+func notFound() *apiError {
+	return errorf(http.StatusNotFound, "Issue Does Not Exist")
+}
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(r.URL.Path, "/")
+	if strings.HasPrefix(p, "secure/attachment/") && r.Method == "GET" {
+		s.download(w, r, strings.SplitN(strings.TrimPrefix(p, "secure/attachment/"), "/", 2)[0])
+		return
+	}
+	if !strings.HasPrefix(p, "rest/api/2/") {
+		writeJSON(w, 0, errorf(http.StatusNotFound, "%s: no such endpoint", r.URL.Path))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "rest/api/2/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var code int
+	var result interface{}
+	err := errorf(http.StatusNotFound, "%s %s: no such endpoint", r.Method, r.URL.Path)
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "search":
+		result, err = s.search(r)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "status":
+		result, err = s.statuses(), nil
+	case r.Method == "GET" && len(parts) == 2 && parts[0] == "user" && parts[1] == "search":
+		result, err = s.findUsers(r), nil
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "issue":
+		code = http.StatusCreated
+		result, err = s.create(r)
+	case len(parts) >= 2 && parts[0] == "issue":
+		is := s.issue(parts[1])
+		if is == nil {
+			err = notFound()
+			break
+		}
+		switch endpoint := strings.Join(parts[2:], "/"); {
+		case r.Method == "GET" && endpoint == "":
+			result, err = s.render(is, fieldsParam(r.URL.Query().Get("fields"))), nil
+		case r.Method == "PUT" && endpoint == "":
+			code, err = http.StatusNoContent, s.edit(is, r)
+		case r.Method == "POST" && endpoint == "comment":
+			code = http.StatusCreated
+			result, err = s.addComment(is, r)
+		case r.Method == "POST" && endpoint == "attachments":
+			result, err = s.addAttachment(is, r)
+		case r.Method == "GET" && endpoint == "transitions":
+			result, err = map[string]interface{}{"expand": "transitions", "transitions": s.transitions(is)}, nil
+		case r.Method == "POST" && endpoint == "transitions":
+			code, err = http.StatusNoContent, s.transition(is, r)
+		}
+	}
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if e, ok := v.(*apiError); ok {
+		code = e.Code
+	}
+	if code == http.StatusNoContent {
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// issue returns the issue by ID or key, or nil. s.mu must be held.
+func (s *Server) issue(idOrKey string) *issue {
+	for _, is := range s.issues {
+		if is.ID == idOrKey || strings.EqualFold(is.Key, idOrKey) {
+			return is
+		}
+	}
+	return nil
+}
+
+func (s *Server) user(accountID string) *User {
+	if accountID == s.Me.AccountID {
+		u := s.Me
+		return &u
+	}
+	for _, u := range s.users {
+		if u.AccountID == accountID {
+			u := u
+			return &u
+		}
+	}
+	return nil
+}
+
+// fieldsParam returns the set of requested fields, nil for all.
+func fieldsParam(s string) map[string]bool {
+	if s == "" || s == "*all" || s == "*navigable" {
+		return nil
+	}
+	m := make(map[string]bool)
+	for _, f := range strings.Split(s, ",") {
+		m[strings.TrimSpace(f)] = true
+	}
+	return m
+}
+
+// render returns the JSON representation of the issue, with only the requested fields (all if nil).
+func (s *Server) render(is *issue, fields map[string]bool) map[string]interface{} {
+	f := map[string]interface{}{
+		"summary":     is.Summary,
+		"description": nilIfEmpty(is.Description),
+		"project":     map[string]string{"key": is.Project, "name": is.Project},
+		"issuetype":   map[string]string{"name": is.Type},
+		"status":      map[string]string{"id": strconv.Itoa(indexOf(s.Statuses, is.Status) + 1), "name": is.Status},
+		"priority":    nil,
+		"resolution":  nil,
+		"reporter":    is.Reporter,
+		"creator":     is.Creator,
+		"assignee":    is.Assignee,
+		"labels":      append([]string{}, is.Labels...),
+		"created":     is.Created.Format(timeFormat),
+		"updated":     is.Updated.Format(timeFormat),
+		"duedate":     nilIfEmpty(is.DueDate),
+	}
+	if is.Assignee == nil {
+		f["assignee"] = nil
+	}
+	if is.Priority != "" {
+		f["priority"] = map[string]string{"name": is.Priority}
+	}
+	if is.Resolution != "" {
+		f["resolution"] = map[string]string{"name": is.Resolution}
+	}
+	comments := make([]map[string]interface{}, len(is.Comments))
+	for i, c := range is.Comments {
+		comments[i] = s.renderComment(is, c)
+	}
+	f["comment"] = map[string]interface{}{"comments": comments, "startAt": 0, "maxResults": len(comments), "total": len(comments)}
+	attachments := make([]map[string]interface{}, len(is.Attachments))
+	for i, a := range is.Attachments {
+		attachments[i] = s.renderAttachment(a)
+	}
+	f["attachment"] = attachments
+	for k, v := range is.Custom {
+		f[k] = v
+	}
+	if fields != nil {
+		for k := range f {
+			if !fields[k] {
+				delete(f, k)
+			}
+		}
+	}
+	return map[string]interface{}{
+		"id": is.ID, "key": is.Key, "self": s.URL + "/rest/api/2/issue/" + is.ID,
+		"fields": f,
+	}
+}
+
+func (s *Server) renderComment(is *issue, c comment) map[string]interface{} {
+	return map[string]interface{}{
+		"id": c.ID, "self": s.URL + "/rest/api/2/issue/" + is.ID + "/comment/" + c.ID,
+		"author": c.Author, "updateAuthor": c.Author, "body": c.Body,
+		"created": c.Created.Format(timeFormat), "updated": c.Created.Format(timeFormat),
+	}
+}
+
+func (s *Server) renderAttachment(a attachment) map[string]interface{} {
+	return map[string]interface{}{
+		"id": a.ID, "self": s.URL + "/rest/api/2/attachment/" + a.ID,
+		"filename": a.Filename, "author": a.Author, "created": a.Created.Format(timeFormat),
+		"size": a.Size, "mimeType": a.MIMEType,
+		"content": s.URL + "/secure/attachment/" + a.ID + "/" + a.Filename,
+	}
+}
+
+func nilIfEmpty(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+func indexOf(ss []string, s string) int {
+	for i, x := range ss {
+		if strings.EqualFold(x, s) {
+			return i
+		}
+	}
+	return -1
+}
+
+// readFields decodes the "fields" of the request body.
+func readFields(r *http.Request) (map[string]json.RawMessage, *apiError) {
+	var body struct {
+		Fields map[string]json.RawMessage `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errorf(http.StatusBadRequest, "decode: %v", err)
+	}
+	return body.Fields, nil
+}
+
+// ref is an object referenced by name, key or ID.
+type ref struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	Name      string `json:"name"`
+	AccountID string `json:"accountId"`
+}
+
+// setFields sets the issue's fields. The project and the issue type are set only on creation.
+func (s *Server) setFields(is *issue, fields map[string]json.RawMessage, create bool) *apiError {
+	for k, raw := range fields {
+		null := string(raw) == "null"
+		var err error
+		switch k {
+		case "summary":
+			err = json.Unmarshal(raw, &is.Summary)
+		case "description":
+			is.Description = ""
+			err = json.Unmarshal(raw, &is.Description)
+		case "labels":
+			is.Labels = nil
+			err = json.Unmarshal(raw, &is.Labels)
+		case "duedate":
+			is.DueDate = ""
+			err = json.Unmarshal(raw, &is.DueDate)
+			if len(is.DueDate) > 10 {
+				is.DueDate = is.DueDate[:10]
+			}
+		case "priority", "project", "issuetype":
+			var r ref
+			if err = json.Unmarshal(raw, &r); err != nil {
+				break
+			}
+			name := firstNonEmpty(r.Name, r.Key, r.ID)
+			switch k {
+			case "priority":
+				is.Priority = name
+			case "project":
+				if !create {
+					return fieldError(k, "Field 'project' cannot be set.")
+				}
+				is.Project = name
+			case "issuetype":
+				if !create {
+					return fieldError(k, "Field 'issuetype' cannot be set.")
+				}
+				is.Type = name
+			}
+		case "assignee", "reporter":
+			var u *User
+			if !null {
+				var r ref
+				if err = json.Unmarshal(raw, &r); err != nil {
+					break
+				}
+				if u = s.user(firstNonEmpty(r.AccountID, r.Name)); u == nil {
+					return fieldError(k, fmt.Sprintf("User '%s' does not exist.", firstNonEmpty(r.AccountID, r.Name)))
+				}
+			}
+			if k == "assignee" {
+				is.Assignee = u
+			} else if u != nil {
+				is.Reporter = u
+			}
+		case "status", "resolution":
+			return fieldError(k, fmt.Sprintf("Field '%s' cannot be set. Use a transition.", k))
+		default:
+			if !strings.HasPrefix(k, "customfield_") {
+				// Such as the zero timestamps and the empty objects go-jira may send.
+				continue
+			}
+			if null {
+				delete(is.Custom, k)
+				continue
+			}
+			var v interface{}
+			if err = json.Unmarshal(raw, &v); err == nil {
+				if is.Custom == nil {
+					is.Custom = make(map[string]interface{})
+				}
+				is.Custom[k] = v
+			}
+		}
+		if err != nil {
+			return fieldError(k, err.Error())
+		}
+	}
+	return nil
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	fields, err := readFields(r)
+	if err != nil {
+		return nil, err
+	}
+	me := s.Me
+	now := time.Now()
+	is := issue{Reporter: &me, Creator: &me, Created: now, Updated: now}
+	if len(s.Statuses) != 0 {
+		is.Status = s.Statuses[0]
+	}
+	if err = s.setFields(&is, fields, true); err != nil {
+		return nil, err
+	}
+	switch {
+	case is.Project == "":
+		return nil, fieldError("project", "project is required")
+	case is.Type == "":
+		return nil, fieldError("issuetype", "issue type is required")
+	case is.Summary == "":
+		return nil, fieldError("summary", "You must specify a summary of the issue.")
+	}
+	var n int
+	for _, other := range s.issues {
+		if other.Project == is.Project {
+			n++
+		}
+	}
+	is.ID = strconv.Itoa(10001 + len(s.issues))
+	is.Key = strings.ToUpper(is.Project) + "-" + strconv.Itoa(n+1)
+	s.issues = append(s.issues, &is)
+	return map[string]string{"id": is.ID, "key": is.Key, "self": s.URL + "/rest/api/2/issue/" + is.ID}, nil
+}
+
+func (s *Server) edit(is *issue, r *http.Request) *apiError {
+	fields, err := readFields(r)
+	if err != nil {
+		return err
+	}
+	data := *is
+	if err = s.setFields(&data, fields, false); err != nil {
+		return err
+	}
+	if data.Summary == "" {
+		return fieldError("summary", "You must specify a summary of the issue.")
+	}
+	data.Updated = time.Now()
+	*is = data
+	return nil
+}
+
+func (s *Server) addComment(is *issue, r *http.Request) (interface{}, *apiError) {
+	var body struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return nil, errorf(http.StatusBadRequest, "decode: %v", err)
+	}
+	if strings.TrimSpace(body.Body) == "" {
+		return nil, fieldError("comment", "Comment body can not be empty!")
+	}
+	s.lastComment++
+	now := time.Now()
+	c := comment{ID: strconv.Itoa(10000 + s.lastComment), Author: s.Me, Body: body.Body, Created: now}
+	is.Comments = append(is.Comments, c)
+	is.Updated = now
+	return s.renderComment(is, c), nil
+}
+
+func (s *Server) addAttachment(is *issue, r *http.Request) (interface{}, *apiError) {
+	// Jira accepts both spellings.
+	if tok := r.Header.Get("X-Atlassian-Token"); tok != "no-check" && tok != "nocheck" {
+		return nil, errorf(http.StatusForbidden, "XSRF check failed")
+	}
+	f, fh, err := r.FormFile("file")
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "file: %v", err)
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "file: %v", err)
+	}
+	s.lastAttachment++
+	now := time.Now()
+	a := attachment{
+		ID: strconv.Itoa(10000 + s.lastAttachment), Filename: fh.Filename,
+		Author: s.Me, Created: now, Size: len(data),
+		MIMEType: fh.Header.Get("Content-Type"),
+	}
+	if ct := mime.TypeByExtension(path.Ext(a.Filename)); ct != "" {
+		a.MIMEType = ct
+	}
+	s.files[a.ID] = data
+	is.Attachments = append(is.Attachments, a)
+	is.Updated = now
+	return []map[string]interface{}{s.renderAttachment(a)}, nil
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, ID string) {
+	s.mu.Lock()
+	data, ok := s.files[ID]
+	var mimeType string
+	for _, is := range s.issues {
+		for _, a := range is.Attachments {
+			if a.ID == ID {
+				mimeType = a.MIMEType
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if mimeType != "" {
+		w.Header().Set("Content-Type", mimeType)
+	}
+	w.Write(data)
+}
+
+func (s *Server) statuses() []map[string]string {
+	statuses := make([]map[string]string, len(s.Statuses))
+	for i, name := range s.Statuses {
+		statuses[i] = map[string]string{"id": strconv.Itoa(i + 1), "name": name}
+	}
+	return statuses
+}
+
+// findUsers returns the users whose email or name contains the query.
+func (s *Server) findUsers(r *http.Request) []User {
+	q := r.URL.Query()
+	query := strings.ToLower(firstNonEmpty(q.Get("query"), q.Get("username")))
+	users := []User{}
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if query != "" && (strings.Contains(strings.ToLower(u.EmailAddress), query) ||
+			strings.Contains(strings.ToLower(u.DisplayName), query)) {
+			users = append(users, u)
+		}
+	}
+	return users
+}
+
+// transitions returns the transitions available for the issue.
+func (s *Server) transitions(is *issue) []map[string]interface{} {
+	ts := []map[string]interface{}{}
+	for _, t := range s.Transitions {
+		if len(t.From) != 0 && indexOf(t.From, is.Status) < 0 {
+			continue
+		}
+		fields := make(map[string]interface{}, len(t.Required))
+		for _, f := range t.Required {
+			fields[f] = map[string]interface{}{"required": true, "name": strings.Title(f)}
+		}
+		ts = append(ts, map[string]interface{}{
+			"id": t.ID, "name": t.Name, "fields": fields,
+			"to": map[string]string{"id": strconv.Itoa(indexOf(s.Statuses, t.To) + 1), "name": t.To},
+		})
+	}
+	return ts
+}
+
+func (s *Server) transition(is *issue, r *http.Request) *apiError {
+	var body struct {
+		Transition ref                        `json:"transition"`
+		Fields     map[string]json.RawMessage `json:"fields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		return errorf(http.StatusBadRequest, "decode: %v", err)
+	}
+	for _, t := range s.Transitions {
+		if t.ID != body.Transition.ID || len(t.From) != 0 && indexOf(t.From, is.Status) < 0 {
+			continue
+		}
+		var resolution string
+		for _, f := range t.Required {
+			raw, ok := body.Fields[f]
+			if !ok {
+				return fieldError(f, strings.Title(f)+" is required.")
+			}
+			if f == "resolution" {
+				var r ref
+				if err := json.Unmarshal(raw, &r); err != nil || r.Name == "" && r.ID == "" {
+					return fieldError(f, "Resolution is required.")
+				}
+				resolution = firstNonEmpty(r.Name, r.ID)
+			}
+		}
+		if resolution != "" {
+			is.Resolution = resolution
+		}
+		is.Status, is.Updated = t.To, time.Now()
+		return nil
+	}
+	return errorf(http.StatusBadRequest, "It seems that you have tried to perform a workflow operation (%s) that is not valid for the current state of this issue (%s).", body.Transition.ID, is.Key)
+}
+
+// search returns the page of the issues matching the JQL, as requested by startAt and maxResults.
+func (s *Server) search(r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	query, err := parseJQL(q.Get("jql"))
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "Error in the JQL Query: %v", err)
+	}
+	var matching []*issue
+	for _, is := range s.issues {
+		if query.match(is) {
+			matching = append(matching, is)
+		}
+	}
+	sort.SliceStable(matching, query.less(matching))
+
+	startAt, _ := strconv.Atoi(q.Get("startAt"))
+	maxResults, _ := strconv.Atoi(q.Get("maxResults"))
+	if maxResults <= 0 || maxResults > s.MaxResults {
+		maxResults = s.MaxResults
+	}
+	if startAt < 0 {
+		startAt = 0
+	}
+	page := matching
+	if startAt < len(page) {
+		page = page[startAt:]
+	} else {
+		page = nil
+	}
+	if len(page) > maxResults {
+		page = page[:maxResults]
+	}
+	fields := fieldsParam(q.Get("fields"))
+	issues := make([]map[string]interface{}, len(page))
+	for i, is := range page {
+		issues[i] = s.render(is, fields)
+	}
+	return map[string]interface{}{
+		"startAt": startAt, "maxResults": maxResults, "total": len(matching),
+		"issues": issues,
+	}, nil
+}
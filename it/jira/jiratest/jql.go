@@ -0,0 +1,224 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package jiratest
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JQL subset: conditions joined by AND and OR (without parentheses),
+// optionally followed by ORDER BY field [ASC|DESC].
+//
+// The fields are created and updated (compared with =, !=, <, <=, >, >= to a date,
+// a date and time with minute precision, or a relative time such as "-1d"),
+// and project, key, id and status (compared with = and !=).
+
+// query is a parsed JQL query: a disjunction of conjunctions.
+type query struct {
+	or      [][]condition
+	orderBy string
+	desc    bool
+}
+
+type condition struct {
+	field, op, value string
+	t                time.Time
+}
+
+var jqlDateFormats = []string{"2006-01-02 15:04", "2006/01/02 15:04", "2006-01-02", "2006/01/02"}
+
+func parseJQL(jql string) (query, error) {
+	var q query
+	toks, err := tokenize(jql)
+	if err != nil {
+		return q, err
+	}
+	var and []condition
+	for i := 0; i < len(toks); {
+		if strings.EqualFold(toks[i], "ORDER") {
+			if i+2 >= len(toks) || !strings.EqualFold(toks[i+1], "BY") {
+				return q, fmt.Errorf("expected ORDER BY field")
+			}
+			q.orderBy = strings.ToLower(toks[i+2])
+			if i+3 < len(toks) {
+				q.desc = strings.EqualFold(toks[i+3], "DESC")
+			}
+			break
+		}
+		if i+2 >= len(toks) {
+			return q, fmt.Errorf("incomplete condition at %q", strings.Join(toks[i:], " "))
+		}
+		c := condition{field: strings.ToLower(toks[i]), op: toks[i+1], value: toks[i+2]}
+		switch c.field {
+		case "created", "updated", "createddate", "updateddate":
+			c.field = strings.TrimSuffix(c.field, "date")
+			if c.t, err = parseJQLTime(c.value); err != nil {
+				return q, err
+			}
+		case "project", "key", "issuekey", "id", "status":
+			if c.op != "=" && c.op != "!=" {
+				return q, fmt.Errorf("operator %q is not supported for field %q", c.op, c.field)
+			}
+		default:
+			return q, fmt.Errorf("field %q does not exist or you do not have permission to view it", toks[i])
+		}
+		switch c.op {
+		case "=", "!=", "<", "<=", ">", ">=":
+		default:
+			return q, fmt.Errorf("unknown operator %q", c.op)
+		}
+		and = append(and, c)
+		i += 3
+		if i < len(toks) {
+			switch strings.ToUpper(toks[i]) {
+			case "AND":
+				i++
+			case "OR":
+				q.or, and = append(q.or, and), nil
+				i++
+			case "ORDER":
+			default:
+				return q, fmt.Errorf("expected AND, OR or ORDER BY at %q", toks[i])
+			}
+		}
+	}
+	if len(and) != 0 {
+		q.or = append(q.or, and)
+	}
+	return q, nil
+}
+
+// tokenize splits the JQL into words, quoted strings and operators.
+func tokenize(jql string) ([]string, error) {
+	var toks []string
+	for i := 0; i < len(jql); {
+		switch c := jql[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '"' || c == '\'':
+			j := strings.IndexByte(jql[i+1:], c)
+			if j < 0 {
+				return nil, fmt.Errorf("unterminated string at %d", i)
+			}
+			toks = append(toks, jql[i+1:i+1+j])
+			i += j + 2
+		case strings.IndexByte("=!<>", c) >= 0:
+			j := i + 1
+			if j < len(jql) && jql[j] == '=' {
+				j++
+			}
+			toks = append(toks, jql[i:j])
+			i = j
+		default:
+			j := i
+			for j < len(jql) && strings.IndexByte(" \t\n=!<>\"'", jql[j]) < 0 {
+				j++
+			}
+			toks = append(toks, jql[i:j])
+			i = j
+		}
+	}
+	return toks, nil
+}
+
+// parseJQLTime parses a date, a date with time or a relative time as "-1d" (units: m, h, d, w).
+func parseJQLTime(s string) (time.Time, error) {
+	for _, f := range jqlDateFormats {
+		if t, err := time.ParseInLocation(f, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	if len(s) >= 2 && (s[0] == '-' || s[0] == '+') {
+		if n, err := strconv.Atoi(s[1 : len(s)-1]); err == nil {
+			unit := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour, 'w': 7 * 24 * time.Hour}[s[len(s)-1]]
+			if unit != 0 {
+				d := time.Duration(n) * unit
+				if s[0] == '-' {
+					d = -d
+				}
+				return time.Now().Add(d), nil
+			}
+		}
+	}
+	return time.Time{}, fmt.Errorf("date value %q is invalid", s)
+}
+
+func (q query) match(is *issue) bool {
+	if len(q.or) == 0 {
+		return true
+	}
+	for _, and := range q.or {
+		ok := true
+		for _, c := range and {
+			if !c.match(is) {
+				ok = false
+				break
+			}
+		}
+		if ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (c condition) match(is *issue) bool {
+	var cmp int
+	switch c.field {
+	case "created", "updated":
+		t := is.Created
+		if c.field == "updated" {
+			t = is.Updated
+		}
+		switch {
+		case t.Before(c.t):
+			cmp = -1
+		case t.After(c.t):
+			cmp = 1
+		}
+	default:
+		v := map[string]string{"project": is.Project, "key": is.Key, "issuekey": is.Key, "id": is.ID, "status": is.Status}[c.field]
+		if !strings.EqualFold(v, c.value) {
+			cmp = 1
+		}
+	}
+	switch c.op {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// less returns the ordering function of the issues, by ID if there is no ORDER BY.
+func (q query) less(issues []*issue) func(i, j int) bool {
+	return func(i, j int) bool {
+		a, b := issues[i], issues[j]
+		if q.desc {
+			a, b = b, a
+		}
+		switch q.orderBy {
+		case "created":
+			return a.Created.Before(b.Created)
+		case "updated":
+			return a.Updated.Before(b.Updated)
+		}
+		x, _ := strconv.Atoi(a.ID)
+		y, _ := strconv.Atoi(b.ID)
+		return x < y
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package it
+
+import "strings"
+
+// The trackers with only open and closed issues (GitHub, Gitea, GitLab)
+// keep the finer state in a label, as "state:in progress".
+
+// JoinState returns the State of the open/closed state and the sub-state, as "open/in progress".
+func JoinState(state, sub string) State {
+	if sub == "" {
+		return State(state)
+	}
+	return State(state + "/" + sub)
+}
+
+// SplitState is the inverse of JoinState.
+func SplitState(s State) (state, sub string) {
+	state = string(s)
+	if i := strings.IndexByte(state, '/'); i >= 0 {
+		return state[:i], state[i+1:]
+	}
+	return state, ""
+}
+
+// MergeLabels returns the labels to set: the plain labels and the sub-state label
+// (if sub is not empty), dropping any other label with statePrefix.
+func MergeLabels(labels []string, statePrefix, sub string) []string {
+	merged := make([]string, 0, len(labels)+1)
+	for _, l := range labels {
+		if statePrefix != "" && strings.HasPrefix(l, statePrefix) {
+			continue
+		}
+		merged = append(merged, l)
+	}
+	if sub != "" {
+		merged = append(merged, statePrefix+sub)
+	}
+	return merged
+}
@@ -7,10 +7,12 @@ package mantisbt
 
 import (
 	"context"
+	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/UNO-SOFT/mantisync/it"
@@ -26,8 +28,24 @@ func init() {
 type Client struct {
 	id string
 	mantis.Client
+	defaults defaults
+	// secondaryField is the name of the custom field holding the secondary ID.
+	secondaryField string
 }
 
+// defaults are the values used for the new issues, when the incoming issue lacks them.
+type defaults struct {
+	Project, Category, Priority, Severity string
+}
+
+// New returns a new MantisBT client.
+//
+// The credentials are taken from the URL's user info, the defaults for the
+// created issues from the query parameters: project (name), category, priority and severity.
+//
+// The secondary ID is stored in the custom field named by the "secondary_field" parameter.
+//
+// The SOAP calls and the attachment downloads use http.DefaultClient.
 func New(baseURL string) (Client, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
 	defer cancel()
@@ -40,10 +58,20 @@ func New(baseURL string) (Client, error) {
 		username = u.Username()
 		password, _ = u.Password()
 		URL.User = nil
-		baseURL = URL.String()
 	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
 	c, err := mantis.New(ctx, baseURL, username, password)
-	return Client{id: baseURL, Client: c}, err
+	return Client{id: baseURL, Client: c,
+		defaults: defaults{
+			Project:  q.Get("project"),
+			Category: q.Get("category"),
+			Priority: q.Get("priority"),
+			Severity: q.Get("severity"),
+		},
+		secondaryField: q.Get("secondary_field"),
+	}, err
 }
 
 func (c Client) ID() it.TrackerID {
@@ -56,16 +84,51 @@ func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
 	if err != nil {
 		return it.Issue{}, err
 	}
-	return it.Issue{
-		ID:        it.IssueID(strconv.Itoa(*mi.ID)),
-		Summary:   *mi.Summary,
-		Author:    readMU(mi.Handler),
-		CreatedAt: time.Time(*mi.DateSubmitted),
-		State:     it.State(mi.Status.Name),
-	}, nil
+	issue := it.Issue{
+		ID:          it.IssueID(strconv.Itoa(*mi.ID)),
+		Summary:     *mi.Summary,
+		Description: mi.Description,
+		Project:     refName(mi.Project),
+		Category:    mi.Category,
+		Priority:    refName(mi.Priority),
+		Severity:    refName(mi.Severity),
+		Author:      readMU(mi.Reporter),
+		Reporter:    readMU(mi.Reporter),
+		Assignee:    readMU(mi.Handler),
+		CreatedAt:   time.Time(*mi.DateSubmitted),
+		State:       it.State(refName(mi.Status)),
+
+		Version:        mi.Version,
+		FixedInVersion: mi.FixedInVersion,
+		TargetVersion:  mi.TargetVersion,
+	}
+	if mi.LastUpdated != nil {
+		issue.UpdatedAt = time.Time(*mi.LastUpdated)
+	}
+	if mi.DueDate != nil {
+		issue.DueDate = time.Time(*mi.DueDate)
+	}
+	for _, t := range mi.Tags {
+		issue.Labels = append(issue.Labels, t.Name)
+	}
+	for _, cf := range mi.CustomFields {
+		if cf.Value == "" {
+			continue
+		}
+		if c.secondaryField != "" && cf.Field.Name == c.secondaryField {
+			issue.SecondaryID = it.IssueID(cf.Value)
+		}
+		if issue.Custom == nil {
+			issue.Custom = make(map[string]string, len(mi.CustomFields))
+		}
+		issue.Custom[cf.Field.Name] = cf.Value
+	}
+	return issue, nil
 }
 
 // ListIssues lists all the issues created/changed since "since".
+//
+// The filter search returns only the IDs, the SecondaryID is read by GetIssue.
 func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
 	y, m, d := since.Year(), since.Month(), since.Day()
 	ids, err := c.Client.FilterSearchIssueIDs(ctx, mantis.FilterSearchData{
@@ -84,33 +147,205 @@ func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, er
 }
 
 // CreateIssue creates the issue, returning the ID.
-// May return ErrNotImplemented.
+//
+// The issue is created in the default project and category.
+// The reporter is set if it is a mapped Mantis user, otherwise the original
+// author is written into the description, which defaults to the summary
+// as Mantis requires it.
 func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
-	id, err := c.Client.IssueAdd(ctx, mantis.IssueData{})
-	return it.IssueID(strconv.Itoa(id)), err
+	summary := issue.Summary
+	mi := mantis.IssueData{
+		Project:     &mantis.ObjectRef{Name: c.defaults.Project},
+		Category:    c.defaults.Category,
+		Summary:     &summary,
+		Description: issue.Description,
+	}
+	var missing []string
+	if mi.Project.Name == "" {
+		missing = append(missing, "project")
+	}
+	if mi.Category == "" {
+		missing = append(missing, "category")
+	}
+	if summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+
+	if mi.Description == "" {
+		mi.Description = summary
+	}
+	if p := firstNonEmpty(issue.Priority, c.defaults.Priority); p != "" {
+		mi.Priority = &mantis.ObjectRef{Name: p}
+	}
+	if s := firstNonEmpty(issue.Severity, c.defaults.Severity); s != "" {
+		mi.Severity = &mantis.ObjectRef{Name: s}
+	}
+	var err error
+	if mi.Reporter, err = accountRef(issue.Reporter); err != nil {
+		return "", err
+	}
+	if mi.Reporter == nil {
+		author := issue.Reporter
+		if author == (it.User{}) {
+			author = issue.Author
+		}
+		mi.Description = it.Attribute(author, issue.CreatedAt, mi.Description)
+	}
+	if mi.Handler, err = accountRef(issue.Assignee); err != nil {
+		return "", err
+	}
+	if !issue.DueDate.IsZero() {
+		t := mantis.Time(issue.DueDate)
+		mi.DueDate = &t
+	}
+	mi.Version, mi.FixedInVersion, mi.TargetVersion = issue.Version, issue.FixedInVersion, issue.TargetVersion
+	id, err := c.Client.IssueAdd(ctx, mi)
+	if err != nil {
+		return "", err
+	}
+	return it.IssueID(strconv.Itoa(id)), nil
 }
 
 // UpdateIssue updates the issue's state.
-func (c Client) UpdateIssueState(context.Context, it.IssueID, it.State) error {
-	return it.ErrNotImplemented
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// mc_issue_update replaces the whole issue, so the current data is read first.
+// An assignee without ID (not a mapped Mantis user) is left as is.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return err
+	}
+	// Notes would be re-sent, attachments are ignored anyway.
+	mi.Notes, mi.Attachments = nil, nil
+	if upd.Fields.Has(it.FieldSummary) {
+		summary := upd.Summary
+		mi.Summary = &summary
+	}
+	if upd.Fields.Has(it.FieldDescription) && upd.Description != "" {
+		mi.Description = upd.Description
+	}
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		mi.Priority = &mantis.ObjectRef{Name: upd.Priority}
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			if mi.Handler, err = accountRef(upd.Assignee); err != nil {
+				return err
+			}
+		} else if upd.Assignee == (it.User{}) {
+			mi.Handler = nil
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		mi.Tags = make([]mantis.ObjectRef, len(upd.Labels))
+		for i, l := range upd.Labels {
+			mi.Tags[i] = mantis.ObjectRef{Name: l}
+		}
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		mi.Status = &mantis.ObjectRef{Name: string(upd.State)}
+	}
+	if _, err = c.Client.IssueUpdate(ctx, *mi.ID, mi); err != nil {
+		return fmt.Errorf("update %q: %w", ID, err)
+	}
+	return nil
 }
 
 // SetSecondaryID updates the secondary ID to the issue.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
 func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
-	return it.ErrNotImplemented
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	mi, err := c.getIssue(ctx, primary)
+	if err != nil {
+		return err
+	}
+	mi.Notes, mi.Attachments = nil, nil
+	found := false
+	for i, cf := range mi.CustomFields {
+		if cf.Field.Name == c.secondaryField {
+			mi.CustomFields[i].Value, found = string(secondary), true
+		}
+	}
+	if !found {
+		mi.CustomFields = append(mi.CustomFields, mantis.CustomFieldValueForIssueData{
+			Field: mantis.ObjectRef{Name: c.secondaryField}, Value: string(secondary),
+		})
+	}
+	if _, err = c.Client.IssueUpdate(ctx, *mi.ID, mi); err != nil {
+		return fmt.Errorf("set %s of %q: %w", c.secondaryField, primary, err)
+	}
+	return nil
+}
+
+// ListStates lists the states an issue can be in.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	refs, err := c.Client.EnumStatus(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("enum status: %w", err)
+	}
+	states := make([]it.State, len(refs))
+	for i, r := range refs {
+		states[i] = it.State(r.Name)
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address, from the users of the
+// default project (of all projects if there is no default).
+//
+// The users whose email address is hidden from us are not found,
+// those have to be paired explicitly in the "users" of the config.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var projectID int
+	if c.defaults.Project != "" {
+		var err error
+		if projectID, err = c.Client.ProjectGetIDFromName(ctx, c.defaults.Project); err != nil {
+			return it.User{}, fmt.Errorf("get ID of project %q: %w", c.defaults.Project, err)
+		}
+	}
+	users, err := c.Client.ProjectGetUsers(ctx, projectID, 0)
+	if err != nil {
+		return it.User{}, fmt.Errorf("get users of project %d: %w", projectID, err)
+	}
+	for i, u := range users {
+		if u.Email != "" && strings.EqualFold(u.Email, email) {
+			return readMU(&users[i]), nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
 }
 
 // AddComment adds a comment to the issue.
+//
+// The note is posted as the Author if it has an ID (it is a mapped Mantis user),
+// otherwise the original author is written into the body.
 func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
 	issueID, err := strconv.Atoi(string(ID))
 	if err != nil {
 		return it.CommentID(""), err
 	}
-	id, err := c.Client.IssueNoteAdd(ctx, issueID, mantis.IssueNoteData{
-		//Reporter:
+	note := mantis.IssueNoteData{
 		DateSubmitted: mantis.Time(comment.CreatedAt),
-		Text:          comment.Body,
-	})
+		Text:          comment.AttributedBody(),
+	}
+	if comment.Author.ID != "" {
+		if note.Reporter.ID, err = strconv.Atoi(string(comment.Author.ID)); err != nil {
+			return it.CommentID(""), fmt.Errorf("author ID %q: %w", comment.Author.ID, err)
+		}
+		note.Text = comment.Body
+	}
+	id, err := c.Client.IssueNoteAdd(ctx, issueID, note)
 	return it.CommentID(strconv.Itoa(id)), err
 }
 
@@ -160,6 +395,7 @@ func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attach
 			ID:       it.AttachmentID(strconv.Itoa(a.ID)),
 			Name:     a.FileName,
 			MIMEType: a.ContentType,
+			URL:      dl,
 			GetBody: func() (io.ReadCloser, error) {
 				req, err := http.NewRequest("GET", dl, nil)
 				if err != nil {
@@ -184,6 +420,34 @@ func (c Client) getIssue(ctx context.Context, ID it.IssueID) (mantis.IssueData,
 	return c.Client.IssueGet(ctx, id)
 }
 
+// accountRef returns the reference to the mapped Mantis user, or nil for unmapped users.
+func accountRef(u it.User) (*mantis.AccountData, error) {
+	if u.ID == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(string(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("user ID %q: %w", u.ID, err)
+	}
+	return &mantis.AccountData{ID: id}, nil
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
+
+func refName(r *mantis.ObjectRef) string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
 func readMU(us ...*mantis.AccountData) it.User {
 	for _, u := range us {
 		if u == nil || u.ID == 0 || u.Email == "" {
@@ -0,0 +1,563 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mantistest provides an in-process MantisConnect (SOAP) server, for testing.
+//
+// It implements the subset of the API used by the mantisbt package:
+// mc_login, mc_version, mc_enum_status, mc_project_get_id_from_name, mc_project_get_users,
+// mc_issue_get, mc_issue_add, mc_issue_update, mc_issue_note_add,
+// mc_issue_attachment_add and mc_filter_search_issue_ids,
+// and serves the attachments on file_download.php.
+// Every POST is handled as a SOAP call, regardless of the path.
+package mantistest
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a MantisConnect server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Username and Password are the accepted credentials.
+	Username, Password string
+	// Statuses are the names of the issue statuses, with the IDs 10, 20, ...
+	Statuses []string
+
+	mu             sync.Mutex
+	issues         map[int]*issueData
+	users          []accountData
+	files          map[int][]byte
+	lastIssue      int
+	lastNote       int
+	lastAttachment int
+}
+
+// NewServer starts and returns a new server, accepting the given credentials.
+// The caller should call Close when finished, to shut it down.
+func NewServer(username, password string) *Server {
+	s := &Server{
+		Username: username, Password: password,
+		Statuses: append([]string(nil), DefaultStatuses...),
+		issues:   make(map[int]*issueData),
+		files:    make(map[int][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user to the project, returning its ID.
+// An empty email stands for an address hidden from the API user.
+func (s *Server) AddUser(name, realName, email string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.users) + 2 // 1 is the logged in user
+	s.users = append(s.users, accountData{ID: id, Name: name, RealName: realName, Email: email})
+	return id
+}
+
+// DefaultStatuses are the statuses of a default Mantis installation.
+var DefaultStatuses = []string{"new", "feedback", "acknowledged", "confirmed", "assigned", "resolved", "closed"}
+
+// BaseURL returns the server's URL with the credentials and the query, as mantisbt.New accepts it.
+func (s *Server) BaseURL(query string) string {
+	URL, err := url.Parse(s.URL)
+	if err != nil {
+		panic(err)
+	}
+	URL.User = url.UserPassword(s.Username, s.Password)
+	URL.RawQuery = query
+	return URL.String()
+}
+
+// The types follow the MantisConnect WSDL.
+
+type objectRef struct {
+	ID   int    `xml:"id,omitempty"`
+	Name string `xml:"name,omitempty"`
+}
+
+type accountData struct {
+	ID       int    `xml:"id,omitempty"`
+	Name     string `xml:"name,omitempty"`
+	RealName string `xml:"real_name,omitempty"`
+	Email    string `xml:"email,omitempty"`
+}
+
+type noteData struct {
+	ID            int          `xml:"id,omitempty"`
+	Reporter      *accountData `xml:"reporter,omitempty"`
+	Text          string       `xml:"text"`
+	DateSubmitted *dateTime    `xml:"date_submitted,omitempty"`
+	LastModified  *dateTime    `xml:"last_modified,omitempty"`
+}
+
+type attachmentData struct {
+	ID            int       `xml:"id"`
+	FileName      string    `xml:"filename"`
+	Size          int       `xml:"size"`
+	ContentType   string    `xml:"content_type"`
+	DateSubmitted *dateTime `xml:"date_submitted,omitempty"`
+	DownloadURL   string    `xml:"download_url"`
+	UserID        int       `xml:"user_id,omitempty"`
+}
+
+type customFieldValue struct {
+	Field objectRef `xml:"field"`
+	Value string    `xml:"value"`
+}
+
+type issueData struct {
+	ID             int                `xml:"id,omitempty"`
+	LastUpdated    *dateTime          `xml:"last_updated,omitempty"`
+	Project        *objectRef         `xml:"project,omitempty"`
+	Category       string             `xml:"category,omitempty"`
+	Priority       *objectRef         `xml:"priority,omitempty"`
+	Severity       *objectRef         `xml:"severity,omitempty"`
+	Status         *objectRef         `xml:"status,omitempty"`
+	Reporter       *accountData       `xml:"reporter,omitempty"`
+	Summary        string             `xml:"summary"`
+	Version        string             `xml:"version,omitempty"`
+	DateSubmitted  *dateTime          `xml:"date_submitted,omitempty"`
+	Handler        *accountData       `xml:"handler,omitempty"`
+	FixedInVersion string             `xml:"fixed_in_version,omitempty"`
+	TargetVersion  string             `xml:"target_version,omitempty"`
+	Description    string             `xml:"description"`
+	Attachments    []attachmentData   `xml:"attachments>item,omitempty"`
+	Notes          []noteData         `xml:"notes>item,omitempty"`
+	CustomFields   []customFieldValue `xml:"custom_fields>item,omitempty"`
+	DueDate        *dateTime          `xml:"due_date,omitempty"`
+	Tags           []objectRef        `xml:"tags>item,omitempty"`
+}
+
+type filterSearchData struct {
+	ProjectID            []int `xml:"project_id>item"`
+	LastUpdateStartYear  int   `xml:"last_update_start_year"`
+	LastUpdateStartMonth int   `xml:"last_update_start_month"`
+	LastUpdateStartDay   int   `xml:"last_update_start_day"`
+}
+
+// request holds the parameters of all the implemented calls.
+type request struct {
+	Username    string           `xml:"username"`
+	Password    string           `xml:"password"`
+	IssueID     int              `xml:"issue_id"`
+	UpdateID    int              `xml:"issueId"` // mc_issue_update names it so
+	Issue       issueData        `xml:"issue"`
+	Note        noteData         `xml:"note"`
+	Name        string           `xml:"name"`
+	FileType    string           `xml:"file_type"`
+	Content     string           `xml:"content"`
+	Filter      filterSearchData `xml:"filter"`
+	ProjectName string           `xml:"project_name"`
+	ProjectID   int              `xml:"project_id"`
+	PageNumber  int              `xml:"page_number"`
+	PerPage     int              `xml:"per_page"`
+}
+
+// dateTime is an xsd:dateTime, empty or nil for the zero time.
+type dateTime time.Time
+
+func newDateTime(t time.Time) *dateTime { d := dateTime(t); return &d }
+
+func (d dateTime) MarshalText() ([]byte, error) {
+	return []byte(time.Time(d).Format(time.RFC3339)), nil
+}
+func (d *dateTime) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		*d = dateTime{}
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	*d = dateTime(t)
+	return err
+}
+
+// isZero reports whether d is nil or the zero time (some clients send "0001-01-01T00:00:00Z").
+func (d *dateTime) isZero() bool { return d == nil || time.Time(*d).IsZero() }
+
+// fault is a SOAP fault.
+type fault struct {
+	Code, String string
+}
+
+func (f *fault) Error() string { return f.String }
+
+func clientFault(format string, args ...interface{}) *fault {
+	return &fault{Code: "SOAP-ENV:Client", String: fmt.Sprintf(format, args...)}
+}
+
+// ServeHTTP serves the SOAP calls (POST) and the attachment downloads (GET).
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case "GET":
+		if !strings.HasSuffix(r.URL.Path, "file_download.php") {
+			http.NotFound(w, r)
+			return
+		}
+		s.serveFile(w, r)
+	case "POST":
+		op, result, err := s.call(r.Body)
+		if err != nil {
+			f, ok := err.(*fault)
+			if !ok {
+				f = &fault{Code: "SOAP-ENV:Server", String: err.Error()}
+			}
+			writeEnvelope(w, http.StatusInternalServerError, func(enc *xml.Encoder) error {
+				return enc.EncodeElement(struct {
+					Code   string `xml:"faultcode"`
+					String string `xml:"faultstring"`
+				}{f.Code, f.String}, xml.StartElement{Name: xml.Name{Local: "SOAP-ENV:Fault"}})
+			})
+			return
+		}
+		writeEnvelope(w, http.StatusOK, func(enc *xml.Encoder) error {
+			resp := xml.StartElement{Name: xml.Name{Local: "ns1:" + op + "Response"}}
+			if err := enc.EncodeToken(resp); err != nil {
+				return err
+			}
+			if err := enc.EncodeElement(result, xml.StartElement{Name: xml.Name{Local: "return"}}); err != nil {
+				return err
+			}
+			return enc.EncodeToken(resp.End())
+		})
+	default:
+		http.Error(w, r.Method, http.StatusMethodNotAllowed)
+	}
+}
+
+func writeEnvelope(w http.ResponseWriter, code int, body func(*xml.Encoder) error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	buf.WriteString(`<SOAP-ENV:Envelope xmlns:SOAP-ENV="http://schemas.xmlsoap.org/soap/envelope/" xmlns:ns1="http://futureware.biz/mantisconnect"><SOAP-ENV:Body>`)
+	enc := xml.NewEncoder(&buf)
+	if err := body(enc); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := enc.Flush(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	buf.WriteString(`</SOAP-ENV:Body></SOAP-ENV:Envelope>`)
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// call decodes the SOAP envelope and calls the operation, returning its name and result.
+func (s *Server) call(r io.Reader) (string, interface{}, error) {
+	var env struct {
+		Body struct {
+			Content []byte `xml:",innerxml"`
+		} `xml:"Body"`
+	}
+	if err := xml.NewDecoder(r).Decode(&env); err != nil {
+		return "", nil, clientFault("parse envelope: %v", err)
+	}
+	dec := xml.NewDecoder(bytes.NewReader(env.Body.Content))
+	var start xml.StartElement
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return "", nil, clientFault("no operation in the body: %v", err)
+		}
+		if se, ok := tok.(xml.StartElement); ok {
+			start = se
+			break
+		}
+	}
+	op := start.Name.Local
+	var req request
+	if err := dec.DecodeElement(&req, &start); err != nil {
+		return op, nil, clientFault("%s: %v", op, err)
+	}
+	if op == "mc_version" {
+		return op, "2.25.0", nil
+	}
+	if req.Username != s.Username || req.Password != s.Password {
+		return op, nil, clientFault("Access denied")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	switch op {
+	case "mc_login":
+		return op, struct {
+			Account     accountData `xml:"account_data"`
+			AccessLevel int         `xml:"access_level"`
+			Timezone    string      `xml:"timezone"`
+		}{s.account(), 90, "UTC"}, nil
+	case "mc_enum_status":
+		refs := make([]objectRef, len(s.Statuses))
+		for i, name := range s.Statuses {
+			refs[i] = objectRef{ID: 10 * (i + 1), Name: name}
+		}
+		return op, struct {
+			Items []objectRef `xml:"item"`
+		}{refs}, nil
+	case "mc_project_get_id_from_name":
+		// Every project exists, with the ID 1.
+		if req.ProjectName == "" {
+			return op, 0, nil
+		}
+		return op, 1, nil
+	case "mc_project_get_users":
+		return op, struct {
+			Items []accountData `xml:"item"`
+		}{append([]accountData{s.account()}, s.users...)}, nil
+	case "mc_issue_get":
+		issue, err := s.issue(req.IssueID)
+		if err != nil {
+			return op, nil, err
+		}
+		return op, *issue, nil
+	case "mc_issue_add":
+		id, err := s.addIssue(req.Issue)
+		return op, id, err
+	case "mc_issue_update":
+		return op, true, s.updateIssue(req.UpdateID, req.Issue)
+	case "mc_issue_note_add":
+		id, err := s.addNote(req.IssueID, req.Note)
+		return op, id, err
+	case "mc_issue_attachment_add":
+		id, err := s.addAttachment(req.IssueID, req.Name, req.FileType, req.Content)
+		return op, id, err
+	case "mc_filter_search_issue_ids":
+		return op, struct {
+			Items []int `xml:"item"`
+		}{s.search(req.Filter, req.PageNumber, req.PerPage)}, nil
+	}
+	return op, nil, clientFault("unsupported operation %q", op)
+}
+
+// account returns the logged in user's account. s.mu must be held.
+func (s *Server) account() accountData {
+	return accountData{ID: 1, Name: s.Username, RealName: s.Username, Email: s.Username + "@example.com"}
+}
+
+func (s *Server) issue(id int) (*issueData, error) {
+	if issue := s.issues[id]; issue != nil {
+		return issue, nil
+	}
+	return nil, clientFault("Issue #%d not found.", id)
+}
+
+func (s *Server) addIssue(issue issueData) (int, error) {
+	switch {
+	case issue.Project == nil || issue.Project.ID == 0 && issue.Project.Name == "":
+		return 0, clientFault("Project '' does not exist.")
+	case issue.Category == "":
+		return 0, clientFault("Category field must be supplied.")
+	case issue.Summary == "":
+		return 0, clientFault("Mandatory field 'summary' is missing.")
+	case issue.Description == "":
+		return 0, clientFault("Mandatory field 'description' is missing.")
+	}
+	s.lastIssue++
+	now := time.Now().Truncate(time.Second)
+	issue.ID = s.lastIssue
+	issue.DateSubmitted, issue.LastUpdated = newDateTime(now), newDateTime(now)
+	if issue.Project.ID == 0 {
+		issue.Project.ID = 1
+	}
+	if issue.Status == nil {
+		issue.Status = &objectRef{Name: s.Statuses[0]}
+	}
+	if err := s.status(issue.Status); err != nil {
+		return 0, err
+	}
+	if issue.Reporter == nil || issue.Reporter.ID == 0 {
+		a := s.account()
+		issue.Reporter = &a
+	}
+	issue.Notes, issue.Attachments = nil, nil
+	s.issues[issue.ID] = &issue
+	return issue.ID, nil
+}
+
+// updateIssue replaces the issue's data, except the notes and attachments.
+func (s *Server) updateIssue(id int, data issueData) error {
+	issue, err := s.issue(id)
+	if err != nil {
+		return err
+	}
+	if data.Summary == "" {
+		return clientFault("Mandatory field 'summary' is missing.")
+	}
+	data.ID, data.DateSubmitted = issue.ID, issue.DateSubmitted
+	data.Notes, data.Attachments = issue.Notes, issue.Attachments
+	if data.Project == nil {
+		data.Project = issue.Project
+	}
+	if data.Reporter == nil {
+		data.Reporter = issue.Reporter
+	}
+	if data.Status == nil {
+		data.Status = issue.Status
+	}
+	if err := s.status(data.Status); err != nil {
+		return err
+	}
+	data.LastUpdated = newDateTime(time.Now().Truncate(time.Second))
+	*issue = data
+	return nil
+}
+
+// status fills the ID or the name of the status. s.mu must be held.
+func (s *Server) status(ref *objectRef) error {
+	for i, name := range s.Statuses {
+		if ref.ID == 10*(i+1) || ref.ID == 0 && ref.Name == name {
+			ref.ID, ref.Name = 10*(i+1), name
+			return nil
+		}
+	}
+	return clientFault("Status '%s' not found.", ref.Name)
+}
+
+func (s *Server) addNote(id int, note noteData) (int, error) {
+	issue, err := s.issue(id)
+	if err != nil {
+		return 0, err
+	}
+	if note.Text == "" {
+		return 0, clientFault("Issue note text must not be blank.")
+	}
+	s.lastNote++
+	now := time.Now().Truncate(time.Second)
+	note.ID = s.lastNote
+	if note.Reporter == nil || note.Reporter.ID == 0 {
+		a := s.account()
+		note.Reporter = &a
+	}
+	if note.DateSubmitted.isZero() {
+		note.DateSubmitted = newDateTime(now)
+	}
+	note.LastModified = newDateTime(now)
+	issue.Notes = append(issue.Notes, note)
+	issue.LastUpdated = newDateTime(now)
+	return note.ID, nil
+}
+
+func (s *Server) addAttachment(id int, name, fileType, content string) (int, error) {
+	issue, err := s.issue(id)
+	if err != nil {
+		return 0, err
+	}
+	data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
+	if err != nil {
+		return 0, clientFault("content: %v", err)
+	}
+	if name == "" {
+		return 0, clientFault("File name must not be empty.")
+	}
+	s.lastAttachment++
+	now := time.Now().Truncate(time.Second)
+	aID := s.lastAttachment
+	s.files[aID] = data
+	issue.Attachments = append(issue.Attachments, attachmentData{
+		ID: aID, FileName: name, Size: len(data), ContentType: fileType,
+		DateSubmitted: newDateTime(now),
+		DownloadURL:   s.URL + "/file_download.php?file_id=" + strconv.Itoa(aID) + "&type=bug",
+		UserID:        s.account().ID,
+	})
+	issue.LastUpdated = newDateTime(now)
+	return aID, nil
+}
+
+// search returns the IDs of the issues updated since the filter's day,
+// the most recently updated first, as Mantis does.
+//
+// The page number starts from 1; a non-positive perPage returns all.
+func (s *Server) search(filter filterSearchData, page, perPage int) []int {
+	var since time.Time
+	if filter.LastUpdateStartYear != 0 {
+		since = time.Date(filter.LastUpdateStartYear, time.Month(filter.LastUpdateStartMonth), filter.LastUpdateStartDay, 0, 0, 0, 0, time.Local)
+	}
+	issues := make([]*issueData, 0, len(s.issues))
+	for _, issue := range s.issues {
+		if time.Time(*issue.LastUpdated).Before(since) {
+			continue
+		}
+		if len(filter.ProjectID) != 0 && !containsInt(filter.ProjectID, issue.Project.ID) {
+			continue
+		}
+		issues = append(issues, issue)
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		ti, tj := time.Time(*issues[i].LastUpdated), time.Time(*issues[j].LastUpdated)
+		if ti.Equal(tj) {
+			return issues[i].ID > issues[j].ID
+		}
+		return ti.After(tj)
+	})
+	if perPage > 0 {
+		if page < 1 {
+			page = 1
+		}
+		from := (page - 1) * perPage
+		if from > len(issues) {
+			from = len(issues)
+		}
+		if to := from + perPage; to < len(issues) {
+			issues = issues[from:to]
+		} else {
+			issues = issues[from:]
+		}
+	}
+	ids := make([]int, len(issues))
+	for i, issue := range issues {
+		ids[i] = issue.ID
+	}
+	return ids
+}
+
+func containsInt(is []int, i int) bool {
+	for _, j := range is {
+		if i == j {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) serveFile(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.URL.Query().Get("file_id"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.mu.Lock()
+	data, ok := s.files[id]
+	var contentType string
+	for _, issue := range s.issues {
+		for _, a := range issue.Attachments {
+			if a.ID == id {
+				contentType = a.ContentType
+			}
+		}
+	}
+	s.mu.Unlock()
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.Write(data)
+}
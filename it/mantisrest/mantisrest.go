@@ -0,0 +1,684 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mantisrest is the MantisBT tracker using the REST API (MantisBT 2.x).
+package mantisrest
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("mantisrest", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://documenter.getpostman.com/view/29959/mantis-bug-tracker-rest-api/7Lt6zkP
+type Client struct {
+	id string
+	// URL is the base URL of the REST API.
+	URL        *url.URL
+	token      string
+	HTTPClient *http.Client
+	defaults   defaults
+	// secondaryField is the name of the custom field holding the secondary ID.
+	secondaryField string
+}
+
+// defaults are the values used for the new issues, when the incoming issue lacks them.
+type defaults struct {
+	Project, Category, Priority, Severity string
+}
+
+// PageSize is the number of issues requested in one page.
+const PageSize = 100
+
+// New returns a new MantisBT REST client.
+//
+// The API token is taken from the "token" query parameter, or the MANTIS_API_TOKEN
+// environment variable. The defaults for the created issues are the
+// project (name), category, priority and severity query parameters,
+// the secondary ID is stored in the custom field named by "secondary_field".
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("MANTIS_API_TOKEN")
+	}
+	URL.Path = strings.TrimSuffix(URL.Path, "/") + "/api/rest/"
+	return Client{
+		id: baseURL, URL: URL, token: token, HTTPClient: http.DefaultClient,
+		defaults: defaults{
+			Project:  q.Get("project"),
+			Category: q.Get("category"),
+			Priority: q.Get("priority"),
+			Severity: q.Get("severity"),
+		},
+		secondaryField: q.Get("secondary_field"),
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+// GetIssue returns the data for the issueID
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return c.readIssue(mi), nil
+}
+
+// ListIssues lists all the issues created/changed since "since".
+//
+// The issues are requested by the last update time, descending,
+// so the paging stops at the first issue older than since.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	var issues []it.Issue
+	for page := 1; ; page++ {
+		var resp struct {
+			Issues []apiIssue `json:"issues"`
+		}
+		if err := c.do(ctx, "GET", "issues?sort=last_updated&dir=DESC&page_size="+strconv.Itoa(PageSize)+"&page="+strconv.Itoa(page), nil, &resp); err != nil {
+			return issues, err
+		}
+		for _, mi := range resp.Issues {
+			if mi.UpdatedAt.Before(since) {
+				return issues, nil
+			}
+			issues = append(issues, c.readIssue(mi))
+		}
+		if len(resp.Issues) < PageSize {
+			return issues, nil
+		}
+	}
+}
+
+// CreateIssue creates the issue, returning the ID.
+//
+// The issue is created in the default project and category.
+// The reporter is set if it is a mapped Mantis user, otherwise the original
+// author is written into the description, which defaults to the summary
+// as Mantis requires it.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	mi := issueFields{
+		Summary:     issue.Summary,
+		Description: issue.Description,
+		Project:     &ref{Name: c.defaults.Project},
+		Category:    &ref{Name: c.defaults.Category},
+	}
+	var missing []string
+	if mi.Project.Name == "" {
+		missing = append(missing, "project")
+	}
+	if mi.Category.Name == "" {
+		missing = append(missing, "category")
+	}
+	if mi.Summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+
+	if mi.Description == "" {
+		mi.Description = mi.Summary
+	}
+	if p := firstNonEmpty(issue.Priority, c.defaults.Priority); p != "" {
+		mi.Priority = &ref{Name: p}
+	}
+	if s := firstNonEmpty(issue.Severity, c.defaults.Severity); s != "" {
+		mi.Severity = &ref{Name: s}
+	}
+	var err error
+	if mi.Reporter, err = userRef(issue.Reporter); err != nil {
+		return "", err
+	}
+	if mi.Reporter == nil {
+		author := issue.Reporter
+		if author == (it.User{}) {
+			author = issue.Author
+		}
+		mi.Description = it.Attribute(author, issue.CreatedAt, mi.Description)
+	}
+	if mi.Handler, err = userRef(issue.Assignee); err != nil {
+		return "", err
+	}
+	if !issue.DueDate.IsZero() {
+		t := issue.DueDate
+		mi.DueDate = &t
+	}
+	mi.Version, mi.FixedInVersion, mi.TargetVersion = nameRef(issue.Version), nameRef(issue.FixedInVersion), nameRef(issue.TargetVersion)
+	if issue.State != "" {
+		mi.Status = &ref{Name: string(issue.State)}
+	}
+	for _, l := range issue.Labels {
+		mi.Tags = append(mi.Tags, ref{Name: l})
+	}
+	var resp struct {
+		Issue apiIssue `json:"issue"`
+	}
+	if err = c.do(ctx, "POST", "issues", mi, &resp); err != nil {
+		return "", err
+	}
+	return it.IssueID(strconv.Itoa(resp.Issue.ID)), nil
+}
+
+// UpdateIssue updates the issue's state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// An assignee without ID (not a mapped Mantis user) is left as is.
+// The labels are set by attaching/detaching the tags.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	patch := make(map[string]interface{})
+	if upd.Fields.Has(it.FieldSummary) {
+		patch["summary"] = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) && upd.Description != "" {
+		patch["description"] = upd.Description
+	}
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		patch["priority"] = ref{Name: upd.Priority}
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			u, err := userRef(upd.Assignee)
+			if err != nil {
+				return err
+			}
+			patch["handler"] = u
+		} else if upd.Assignee == (it.User{}) {
+			patch["handler"] = map[string]int{"id": 0}
+		}
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		patch["status"] = ref{Name: string(upd.State)}
+	}
+	if len(patch) != 0 {
+		if err := c.do(ctx, "PATCH", "issues/"+url.PathEscape(string(ID)), patch, nil); err != nil {
+			return fmt.Errorf("update %q: %w", ID, err)
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		return c.setTags(ctx, ID, upd.Labels)
+	}
+	return nil
+}
+
+func (c Client) setTags(ctx context.Context, ID it.IssueID, labels []string) error {
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return err
+	}
+	want := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		want[l] = true
+	}
+	for _, t := range mi.Tags {
+		if want[t.Name] {
+			delete(want, t.Name)
+			continue
+		}
+		if err = c.do(ctx, "DELETE", "issues/"+url.PathEscape(string(ID))+"/tags/"+strconv.Itoa(t.ID), nil, nil); err != nil {
+			return fmt.Errorf("detach tag %q from %q: %w", t.Name, ID, err)
+		}
+	}
+	if len(want) == 0 {
+		return nil
+	}
+	var attach struct {
+		Tags []ref `json:"tags"`
+	}
+	for _, l := range labels {
+		if want[l] {
+			attach.Tags = append(attach.Tags, ref{Name: l})
+		}
+	}
+	if err = c.do(ctx, "POST", "issues/"+url.PathEscape(string(ID))+"/tags", attach, nil); err != nil {
+		return fmt.Errorf("attach tags to %q: %w", ID, err)
+	}
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	patch := issueFields{CustomFields: []customField{{Field: ref{Name: c.secondaryField}, Value: string(secondary)}}}
+	if err := c.do(ctx, "PATCH", "issues/"+url.PathEscape(string(primary)), patch, nil); err != nil {
+		return fmt.Errorf("set %s of %q: %w", c.secondaryField, primary, err)
+	}
+	return nil
+}
+
+// ListStates lists the states an issue can be in.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	var resp struct {
+		Configs []struct {
+			Option string `json:"option"`
+			Value  []ref  `json:"value"`
+		} `json:"configs"`
+	}
+	if err := c.do(ctx, "GET", "config?option=status_enum_string", nil, &resp); err != nil {
+		return nil, err
+	}
+	var states []it.State
+	for _, cfg := range resp.Configs {
+		if cfg.Option != "status_enum_string" {
+			continue
+		}
+		for _, v := range cfg.Value {
+			states = append(states, it.State(v.Name))
+		}
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address,
+// among the users of the default project (of all projects if none is set).
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var projectID int
+	if c.defaults.Project != "" {
+		var err error
+		if projectID, err = c.projectID(ctx, c.defaults.Project); err != nil {
+			return it.User{}, fmt.Errorf("get ID of project %q: %w", c.defaults.Project, err)
+		}
+	}
+	for page := 1; ; page++ {
+		var resp struct {
+			Users []user `json:"users"`
+		}
+		if err := c.do(ctx, "GET", "projects/"+strconv.Itoa(projectID)+"/users?page_size="+strconv.Itoa(PageSize)+"&page="+strconv.Itoa(page), nil, &resp); err != nil {
+			return it.User{}, fmt.Errorf("get users of project %d: %w", projectID, err)
+		}
+		for i, u := range resp.Users {
+			if u.Email != "" && strings.EqualFold(u.Email, email) {
+				return readUser(&resp.Users[i]), nil
+			}
+		}
+		if len(resp.Users) < PageSize {
+			return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+		}
+	}
+}
+
+func (c Client) projectID(ctx context.Context, name string) (int, error) {
+	var resp struct {
+		Projects []ref `json:"projects"`
+	}
+	if err := c.do(ctx, "GET", "projects", nil, &resp); err != nil {
+		return 0, err
+	}
+	for _, p := range resp.Projects {
+		if p.Name == name {
+			return p.ID, nil
+		}
+	}
+	return 0, fmt.Errorf("%q: %w", name, it.ErrNotFound)
+}
+
+// AddComment adds a comment to the issue.
+//
+// The note is posted as the Author if it has an ID (it is a mapped Mantis user),
+// otherwise the original author is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	n := struct {
+		Reporter  *user  `json:"reporter,omitempty"`
+		Text      string `json:"text"`
+		ViewState ref    `json:"view_state"`
+	}{Text: comment.AttributedBody(), ViewState: ref{Name: "public"}}
+	if comment.Author.ID != "" {
+		var err error
+		if n.Reporter, err = userRef(comment.Author); err != nil {
+			return "", err
+		}
+		n.Text = comment.Body
+	}
+	var resp struct {
+		Note note `json:"note"`
+	}
+	if err := c.do(ctx, "POST", "issues/"+url.PathEscape(string(ID))+"/notes", n, &resp); err != nil {
+		return "", err
+	}
+	return it.CommentID(strconv.Itoa(resp.Note.ID)), nil
+}
+
+// ListComments list the comments of the issue.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, len(mi.Notes))
+	for i, n := range mi.Notes {
+		comments[i] = it.Comment{
+			ID:        it.CommentID(strconv.Itoa(n.ID)),
+			Author:    readUser(n.Reporter),
+			CreatedAt: n.CreatedAt,
+			Body:      n.Text,
+		}
+	}
+	return comments, nil
+}
+
+// AddAttachment adds the attachment to the issue.
+//
+// The API does not return the ID of the uploaded file,
+// so it is the latest attachment with the same name.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	b, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	type upload struct {
+		Name    string `json:"name"`
+		Content string `json:"content"`
+	}
+	if err = c.do(ctx, "POST", "issues/"+url.PathEscape(string(ID))+"/files",
+		struct {
+			Files []upload `json:"files"`
+		}{Files: []upload{{Name: a.Name, Content: base64.StdEncoding.EncodeToString(b)}}},
+		nil,
+	); err != nil {
+		return "", err
+	}
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return "", err
+	}
+	var aID int
+	for _, f := range mi.Attachments {
+		if f.Filename == a.Name && f.ID > aID {
+			aID = f.ID
+		}
+	}
+	if aID == 0 {
+		return "", fmt.Errorf("uploaded %q to %q, but cannot find it: %w", a.Name, ID, it.ErrNotFound)
+	}
+	return it.AttachmentID(strconv.Itoa(aID)), nil
+}
+
+// ListAttachments lists the attachments of the issue.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	mi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return nil, err
+	}
+	as := make([]it.Attachment, len(mi.Attachments))
+	for i, f := range mi.Attachments {
+		path := "issues/" + url.PathEscape(string(ID)) + "/files/" + strconv.Itoa(f.ID)
+		as[i] = it.Attachment{
+			ID:        it.AttachmentID(strconv.Itoa(f.ID)),
+			Name:      f.Filename,
+			MIMEType:  f.ContentType,
+			Author:    readUser(f.Reporter),
+			CreatedAt: f.CreatedAt,
+			GetBody: func() (io.ReadCloser, error) {
+				var resp struct {
+					Files []struct {
+						Content string `json:"content"`
+					} `json:"files"`
+				}
+				if err := c.do(ctx, "GET", path, nil, &resp); err != nil {
+					return nil, err
+				}
+				if len(resp.Files) == 0 {
+					return nil, fmt.Errorf("%s: %w", path, it.ErrNotFound)
+				}
+				b, err := base64.StdEncoding.DecodeString(resp.Files[0].Content)
+				if err != nil {
+					return nil, err
+				}
+				return ioutil.NopCloser(bytes.NewReader(b)), nil
+			},
+		}
+	}
+	return as, nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID) (apiIssue, error) {
+	var resp struct {
+		Issues []apiIssue `json:"issues"`
+	}
+	if err := c.do(ctx, "GET", "issues/"+url.PathEscape(string(ID)), nil, &resp); err != nil {
+		return apiIssue{}, err
+	}
+	if len(resp.Issues) == 0 {
+		return apiIssue{}, fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+	}
+	return resp.Issues[0], nil
+}
+
+func (c Client) readIssue(mi apiIssue) it.Issue {
+	issue := it.Issue{
+		ID:          it.IssueID(strconv.Itoa(mi.ID)),
+		Summary:     mi.Summary,
+		Description: mi.Description,
+		Project:     mi.Project.name(),
+		Category:    mi.Category.name(),
+		Priority:    mi.Priority.name(),
+		Severity:    mi.Severity.name(),
+		Author:      readUser(mi.Reporter),
+		Reporter:    readUser(mi.Reporter),
+		Assignee:    readUser(mi.Handler),
+		CreatedAt:   mi.CreatedAt,
+		UpdatedAt:   mi.UpdatedAt,
+		State:       it.State(mi.Status.name()),
+
+		Version:        mi.Version.name(),
+		FixedInVersion: mi.FixedInVersion.name(),
+		TargetVersion:  mi.TargetVersion.name(),
+	}
+	if mi.DueDate != nil {
+		issue.DueDate = *mi.DueDate
+	}
+	for _, t := range mi.Tags {
+		issue.Labels = append(issue.Labels, t.Name)
+	}
+	for _, cf := range mi.CustomFields {
+		if cf.Value == "" {
+			continue
+		}
+		if c.secondaryField != "" && cf.Field.Name == c.secondaryField {
+			issue.SecondaryID = it.IssueID(cf.Value)
+		}
+		if issue.Custom == nil {
+			issue.Custom = make(map[string]string, len(mi.CustomFields))
+		}
+		issue.Custom[cf.Field.Name] = cf.Value
+	}
+	return issue
+}
+
+// do calls the API, encoding body and decoding the response into result, if not nil.
+func (c Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	URL, err := c.URL.Parse(path)
+	if err != nil {
+		return err
+	}
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, URL.String(), r)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", c.token)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s %s: %s: %s", method, URL.Path, resp.Status, b)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", it.ErrNotFound, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s %s: decode: %w", method, URL.Path, err)
+	}
+	return nil
+}
+
+type ref struct {
+	ID    int    `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+func (r *ref) name() string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// nameRef returns the reference to the named object, nil for the empty name.
+func nameRef(name string) *ref {
+	if name == "" {
+		return nil
+	}
+	return &ref{Name: name}
+}
+
+type user struct {
+	ID       int    `json:"id,omitempty"`
+	Name     string `json:"name,omitempty"`
+	RealName string `json:"real_name,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// readUser returns the it.User for u, skipping the users without ID and email, as readMU does.
+func readUser(u *user) it.User {
+	if u == nil || u.ID == 0 || u.Email == "" {
+		return it.User{}
+	}
+	return it.User{ID: it.UserID(strconv.Itoa(u.ID)), RealName: u.RealName, Email: u.Email}
+}
+
+// userRef returns the reference to the mapped Mantis user, or nil for unmapped users.
+func userRef(u it.User) (*user, error) {
+	if u.ID == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(string(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("user ID %q: %w", u.ID, err)
+	}
+	return &user{ID: id}, nil
+}
+
+type customField struct {
+	Field ref    `json:"field"`
+	Value string `json:"value"`
+}
+
+type note struct {
+	ID        int       `json:"id"`
+	Reporter  *user     `json:"reporter,omitempty"`
+	Text      string    `json:"text"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type file struct {
+	ID          int       `json:"id"`
+	Reporter    *user     `json:"reporter,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Filename    string    `json:"filename"`
+	Size        int       `json:"size"`
+	ContentType string    `json:"content_type"`
+}
+
+// apiIssue is an issue as returned by the API.
+type apiIssue struct {
+	ID int `json:"id"`
+	issueFields
+	Notes       []note    `json:"notes,omitempty"`
+	Attachments []file    `json:"attachments,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// issueFields holds the writable fields of an issue.
+type issueFields struct {
+	Summary        string        `json:"summary,omitempty"`
+	Description    string        `json:"description,omitempty"`
+	Project        *ref          `json:"project,omitempty"`
+	Category       *ref          `json:"category,omitempty"`
+	Priority       *ref          `json:"priority,omitempty"`
+	Severity       *ref          `json:"severity,omitempty"`
+	Status         *ref          `json:"status,omitempty"`
+	Reporter       *user         `json:"reporter,omitempty"`
+	Handler        *user         `json:"handler,omitempty"`
+	Version        *ref          `json:"version,omitempty"`
+	FixedInVersion *ref          `json:"fixed_in_version,omitempty"`
+	TargetVersion  *ref          `json:"target_version,omitempty"`
+	DueDate        *time.Time    `json:"due_date,omitempty"`
+	Tags           []ref         `json:"tags,omitempty"`
+	CustomFields   []customField `json:"custom_fields,omitempty"`
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,123 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package mantisrest
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+	"github.com/UNO-SOFT/mantisync/it/mantisrest/mantisresttest"
+)
+
+const testParams = "?token=secret&project=Test&category=General&secondary_field=Secondary"
+
+func newTestClient(t *testing.T) (Client, *mantisresttest.Server) {
+	t.Helper()
+	srv := mantisresttest.NewServer("secret")
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.AddUser("jdoe", "John Doe", "jdoe@example.com")
+		return c
+	}, ittest.WithPageSize(PageSize),
+		ittest.WithUser(it.User{ID: "2", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	MANTISREST_TEST_URL='https://mantis.example.com/?token=...&project=Test&category=General&secondary_field=Secondary' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("MANTISREST_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestLabels(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestClient(t)
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "tagged", Labels: []string{"a", "b"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{Labels: []string{"b", "c"}}, Fields: it.FieldLabels}); err != nil {
+		t.Fatal(err)
+	}
+	issue, err := c.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(issue.Labels, ","); got != "b,c" {
+		t.Errorf("labels: got %q, wanted b,c", got)
+	}
+}
+
+func TestCreateIssueFields(t *testing.T) {
+	ctx := context.Background()
+	c, _ := newTestClient(t)
+	want := it.Issue{
+		Summary: "versioned", DueDate: time.Date(2020, 6, 30, 0, 0, 0, 0, time.UTC),
+		Version: "1.0", FixedInVersion: "1.1", TargetVersion: "1.2",
+	}
+	ID, err := c.CreateIssue(ctx, want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := c.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.DueDate.Equal(want.DueDate) || got.Version != want.Version ||
+		got.FixedInVersion != want.FixedInVersion || got.TargetVersion != want.TargetVersion {
+		t.Errorf("got %+v, wanted %+v", got, want)
+	}
+}
+
+func TestFindUser(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddUser("ann", "Ann", "")
+	// The hidden emails are not guessed from the name.
+	if u, err := c.FindUser(ctx, "ann@example.com"); !errors.Is(err, it.ErrNotFound) {
+		t.Errorf("got %+v, %+v, wanted ErrNotFound", u, err)
+	}
+	if u, err := c.FindUser(ctx, "ROOT@localhost"); err != nil {
+		t.Error(err)
+	} else if u.ID != "1" {
+		t.Errorf("got %+v, wanted the user 1", u)
+	}
+}
+
+func TestUnauthorized(t *testing.T) {
+	_, srv := newTestClient(t)
+	c, err := New(srv.URL + "?token=wrong&project=Test&category=General")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = c.ListStates(context.Background()); err == nil {
+		t.Error("ListStates with a wrong token succeeded")
+	}
+}
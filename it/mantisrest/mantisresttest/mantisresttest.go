@@ -0,0 +1,532 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package mantisresttest provides an in-process MantisBT REST API server, for testing.
+//
+// It implements the endpoints used by the mantisrest package under api/rest/:
+// issue list (paginated, by the last update), get, create and patch,
+// tag attach and detach, notes, file upload and download, the
+// status_enum_string config option, and the projects with their users.
+//
+// The Authorization header must hold the Token.
+package mantisresttest
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a MantisBT REST server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Token is the accepted API token.
+	Token string
+	// Statuses are the names of the issue statuses, with the IDs 10, 20, ...
+	// The first is the status of the new issues.
+	Statuses []string
+	// Me is the owner of the token, the reporter of the created issues and notes.
+	Me User
+	// Projects are the names of the projects, with the IDs 1, 2, ...
+	Projects []string
+
+	mu       sync.Mutex
+	issues   map[int]*issue
+	files    map[int][]byte
+	tags     []ref
+	users    []User
+	lastID   int
+	lastNote int
+	lastFile int
+}
+
+// User is a MantisBT user account.
+type User struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name,omitempty"`
+	RealName string `json:"real_name,omitempty"`
+	Email    string `json:"email,omitempty"`
+}
+
+// DefaultStatuses are the statuses of a default Mantis installation.
+var DefaultStatuses = []string{"new", "feedback", "acknowledged", "confirmed", "assigned", "resolved", "closed"}
+
+// NewServer starts and returns a new server, accepting the given token.
+// The caller should call Close when finished, to shut it down.
+func NewServer(token string) *Server {
+	s := &Server{
+		Token:    token,
+		Statuses: append([]string(nil), DefaultStatuses...),
+		Me:       User{ID: 1, Name: "administrator", RealName: "Administrator", Email: "root@localhost"},
+		Projects: []string{"Test"},
+		issues:   make(map[int]*issue),
+		files:    make(map[int][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user to every project, returning its ID.
+// An empty email stands for an address hidden from the API user.
+func (s *Server) AddUser(name, realName, email string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := len(s.users) + 2 // 1 is Me
+	s.users = append(s.users, User{ID: id, Name: name, RealName: realName, Email: email})
+	return id
+}
+
+// The types follow the JSON of the REST API.
+
+type ref struct {
+	ID    int    `json:"id,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Label string `json:"label,omitempty"`
+}
+
+type customField struct {
+	Field ref    `json:"field"`
+	Value string `json:"value"`
+}
+
+type note struct {
+	ID        int       `json:"id"`
+	Reporter  *User     `json:"reporter,omitempty"`
+	Text      string    `json:"text"`
+	ViewState *ref      `json:"view_state,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type file struct {
+	ID          int       `json:"id"`
+	Reporter    *User     `json:"reporter,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	Filename    string    `json:"filename"`
+	Size        int       `json:"size"`
+	ContentType string    `json:"content_type"`
+}
+
+type issue struct {
+	ID             int           `json:"id"`
+	Summary        string        `json:"summary"`
+	Description    string        `json:"description"`
+	Project        *ref          `json:"project,omitempty"`
+	Category       *ref          `json:"category,omitempty"`
+	Priority       *ref          `json:"priority,omitempty"`
+	Severity       *ref          `json:"severity,omitempty"`
+	Status         *ref          `json:"status,omitempty"`
+	Reporter       *User         `json:"reporter,omitempty"`
+	Handler        *User         `json:"handler,omitempty"`
+	Version        *ref          `json:"version,omitempty"`
+	FixedInVersion *ref          `json:"fixed_in_version,omitempty"`
+	TargetVersion  *ref          `json:"target_version,omitempty"`
+	DueDate        *time.Time    `json:"due_date,omitempty"`
+	Tags           []ref         `json:"tags,omitempty"`
+	CustomFields   []customField `json:"custom_fields,omitempty"`
+	Notes          []note        `json:"notes,omitempty"`
+	Attachments    []file        `json:"attachments,omitempty"`
+	CreatedAt      time.Time     `json:"created_at"`
+	UpdatedAt      time.Time     `json:"updated_at"`
+}
+
+// apiError is the error response of the REST API.
+type apiError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("%d: %s", e.Code, e.Message) }
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// now returns the current time with the seconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != s.Token {
+		writeJSON(w, 0, errorf(http.StatusUnauthorized, "API token not found"))
+		return
+	}
+	p := strings.Trim(r.URL.Path, "/")
+	if !strings.HasPrefix(p, "api/rest/") {
+		writeJSON(w, 0, errorf(http.StatusNotFound, "%s: no such endpoint", r.URL.Path))
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "api/rest/"), "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var code int
+	var result interface{}
+	err := errorf(http.StatusNotFound, "%s %s: no such endpoint", r.Method, r.URL.Path)
+	switch {
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "config":
+		result, err = s.config(r.URL.Query()["option"]), nil
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "issues":
+		result, err = s.list(r)
+	case r.Method == "GET" && len(parts) == 1 && parts[0] == "projects":
+		result, err = s.projects(), nil
+	case r.Method == "GET" && len(parts) == 3 && parts[0] == "projects" && parts[2] == "users":
+		result, err = s.projectUsers(parts[1], r)
+	case r.Method == "POST" && len(parts) == 1 && parts[0] == "issues":
+		code = http.StatusCreated
+		result, err = s.create(r)
+	case len(parts) >= 2 && parts[0] == "issues":
+		id, _ := strconv.Atoi(parts[1])
+		is := s.issues[id]
+		if is == nil {
+			err = errorf(http.StatusNotFound, "Issue #%s not found", parts[1])
+			break
+		}
+		switch {
+		case r.Method == "GET" && len(parts) == 2:
+			result, err = map[string][]issue{"issues": {*is}}, nil
+		case r.Method == "PATCH" && len(parts) == 2:
+			result, err = s.patch(is, r)
+		case r.Method == "POST" && len(parts) == 3 && parts[2] == "tags":
+			result, err = s.attachTags(is, r)
+		case r.Method == "DELETE" && len(parts) == 4 && parts[2] == "tags":
+			result, err = s.detachTag(is, parts[3])
+		case r.Method == "POST" && len(parts) == 3 && parts[2] == "notes":
+			code = http.StatusCreated
+			result, err = s.addNote(is, r)
+		case r.Method == "POST" && len(parts) == 3 && parts[2] == "files":
+			code, err = http.StatusCreated, s.addFiles(is, r)
+		case r.Method == "GET" && len(parts) == 4 && parts[2] == "files":
+			result, err = s.getFile(is, parts[3])
+		}
+	}
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if e, ok := v.(*apiError); ok {
+		code = e.Code
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if v != nil {
+		json.NewEncoder(w).Encode(v)
+	}
+}
+
+func readJSON(r *http.Request, v interface{}) *apiError {
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return errorf(http.StatusBadRequest, "decode: %v", err)
+	}
+	return nil
+}
+
+func (s *Server) config(options []string) interface{} {
+	type config struct {
+		Option string      `json:"option"`
+		Value  interface{} `json:"value"`
+	}
+	var configs []config
+	for _, o := range options {
+		if o != "status_enum_string" {
+			continue
+		}
+		values := make([]ref, len(s.Statuses))
+		for i, st := range s.Statuses {
+			values[i] = ref{ID: 10 * (i + 1), Name: st, Label: st}
+		}
+		configs = append(configs, config{Option: o, Value: values})
+	}
+	return map[string][]config{"configs": configs}
+}
+
+func (s *Server) projects() interface{} {
+	projects := make([]ref, len(s.Projects))
+	for i, name := range s.Projects {
+		projects[i] = ref{ID: i + 1, Name: name}
+	}
+	return map[string][]ref{"projects": projects}
+}
+
+// projectUsers returns Me and the added users; the project ID 0 stands for all projects.
+func (s *Server) projectUsers(projectID string, r *http.Request) (interface{}, *apiError) {
+	if id, err := strconv.Atoi(projectID); err != nil || id < 0 || id > len(s.Projects) {
+		return nil, errorf(http.StatusNotFound, "Project #%s not found", projectID)
+	}
+	users := append([]User{s.Me}, s.users...)
+	from, to := page(r, len(users))
+	return map[string][]User{"users": users[from:to]}, nil
+}
+
+// page returns the bounds of the page requested by the page_size and page
+// query parameters, within n items.
+func page(r *http.Request, n int) (from, to int) {
+	q := r.URL.Query()
+	pageSize, err := strconv.Atoi(q.Get("page_size"))
+	if err != nil || pageSize <= 0 {
+		pageSize = 50
+	}
+	page, err := strconv.Atoi(q.Get("page"))
+	if err != nil || page <= 0 {
+		page = 1
+	}
+	from, to = (page-1)*pageSize, page*pageSize
+	if from > n {
+		from = n
+	}
+	if to > n {
+		to = n
+	}
+	return from, to
+}
+
+// list returns the issues by the last update, descending unless dir is ASC.
+func (s *Server) list(r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	if o := q.Get("sort"); o != "" && o != "last_updated" {
+		return nil, errorf(http.StatusBadRequest, "Invalid sort %q", o)
+	}
+	asc := strings.EqualFold(q.Get("dir"), "ASC")
+	issues := make([]issue, 0, len(s.issues))
+	for _, is := range s.issues {
+		issues = append(issues, *is)
+	}
+	sort.Slice(issues, func(i, j int) bool {
+		if !issues[i].UpdatedAt.Equal(issues[j].UpdatedAt) {
+			return issues[i].UpdatedAt.After(issues[j].UpdatedAt) != asc
+		}
+		return issues[i].ID > issues[j].ID != asc
+	})
+	from, to := page(r, len(issues))
+	return map[string][]issue{"issues": issues[from:to]}, nil
+}
+
+// status returns the status named by r, or an error.
+func (s *Server) status(r *ref) (*ref, *apiError) {
+	for i, st := range s.Statuses {
+		if st == r.Name || r.ID == 10*(i+1) {
+			return &ref{ID: 10 * (i + 1), Name: st, Label: st}, nil
+		}
+	}
+	return nil, errorf(http.StatusBadRequest, "Invalid status %q", r.Name)
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	var is issue
+	if err := readJSON(r, &is); err != nil {
+		return nil, err
+	}
+	switch {
+	case is.Summary == "":
+		return nil, errorf(http.StatusBadRequest, "Summary not specified")
+	case is.Description == "":
+		return nil, errorf(http.StatusBadRequest, "Description not specified")
+	case is.Project == nil || is.Project.Name == "" && is.Project.ID == 0:
+		return nil, errorf(http.StatusBadRequest, "Project not specified")
+	case is.Category == nil || is.Category.Name == "" && is.Category.ID == 0:
+		return nil, errorf(http.StatusBadRequest, "Category not specified")
+	}
+	if is.Status == nil {
+		is.Status = &ref{Name: s.Statuses[0]}
+	}
+	var err *apiError
+	if is.Status, err = s.status(is.Status); err != nil {
+		return nil, err
+	}
+	if is.Reporter == nil {
+		me := s.Me
+		is.Reporter = &me
+	}
+	s.lastID++
+	is.ID = s.lastID
+	is.Notes, is.Attachments = nil, nil
+	tags := is.Tags
+	is.Tags = nil
+	s.tag(&is, tags)
+	is.CreatedAt = now()
+	is.UpdatedAt = is.CreatedAt
+	s.issues[is.ID] = &is
+	return map[string]issue{"issue": is}, nil
+}
+
+func (s *Server) patch(is *issue, r *http.Request) (interface{}, *apiError) {
+	var fields map[string]json.RawMessage
+	if err := readJSON(r, &fields); err != nil {
+		return nil, err
+	}
+	upd := *is
+	for k, v := range fields {
+		var err error
+		switch k {
+		case "summary":
+			err = json.Unmarshal(v, &upd.Summary)
+		case "description":
+			err = json.Unmarshal(v, &upd.Description)
+		case "priority":
+			err = json.Unmarshal(v, &upd.Priority)
+		case "severity":
+			err = json.Unmarshal(v, &upd.Severity)
+		case "handler":
+			upd.Handler = nil
+			if err = json.Unmarshal(v, &upd.Handler); err == nil && upd.Handler != nil && upd.Handler.ID == 0 {
+				upd.Handler = nil
+			}
+		case "status":
+			var st ref
+			if err = json.Unmarshal(v, &st); err == nil {
+				var aerr *apiError
+				if upd.Status, aerr = s.status(&st); aerr != nil {
+					return nil, aerr
+				}
+			}
+		case "custom_fields":
+			var cfs []customField
+			if err = json.Unmarshal(v, &cfs); err != nil {
+				break
+			}
+			upd.CustomFields = append([]customField(nil), upd.CustomFields...)
+		Loop:
+			for _, cf := range cfs {
+				for i, old := range upd.CustomFields {
+					if old.Field.Name == cf.Field.Name {
+						upd.CustomFields[i].Value = cf.Value
+						continue Loop
+					}
+				}
+				upd.CustomFields = append(upd.CustomFields, cf)
+			}
+		default:
+			return nil, errorf(http.StatusBadRequest, "field %q cannot be patched", k)
+		}
+		if err != nil {
+			return nil, errorf(http.StatusBadRequest, "%s: %v", k, err)
+		}
+	}
+	upd.UpdatedAt = now()
+	*is = upd
+	return map[string][]issue{"issues": {*is}}, nil
+}
+
+// tag attaches the tags to the issue, creating the unknown ones.
+func (s *Server) tag(is *issue, tags []ref) {
+Loop:
+	for _, t := range tags {
+		for _, old := range is.Tags {
+			if old.Name == t.Name {
+				continue Loop
+			}
+		}
+		var found bool
+		for _, known := range s.tags {
+			if known.Name == t.Name {
+				t, found = known, true
+				break
+			}
+		}
+		if !found {
+			t = ref{ID: len(s.tags) + 1, Name: t.Name}
+			s.tags = append(s.tags, t)
+		}
+		is.Tags = append(is.Tags, t)
+	}
+}
+
+func (s *Server) attachTags(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Tags []ref `json:"tags"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return nil, err
+	}
+	s.tag(is, req.Tags)
+	is.UpdatedAt = now()
+	return map[string][]issue{"issues": {*is}}, nil
+}
+
+func (s *Server) detachTag(is *issue, tagID string) (interface{}, *apiError) {
+	id, _ := strconv.Atoi(tagID)
+	for i, t := range is.Tags {
+		if t.ID == id {
+			is.Tags = append(is.Tags[:i:i], is.Tags[i+1:]...)
+			is.UpdatedAt = now()
+			return map[string][]issue{"issues": {*is}}, nil
+		}
+	}
+	return nil, errorf(http.StatusNotFound, "Tag %s is not attached to issue %d", tagID, is.ID)
+}
+
+func (s *Server) addNote(is *issue, r *http.Request) (interface{}, *apiError) {
+	var n note
+	if err := readJSON(r, &n); err != nil {
+		return nil, err
+	}
+	if n.Text == "" {
+		return nil, errorf(http.StatusBadRequest, "Issue note not specified")
+	}
+	if n.Reporter == nil {
+		me := s.Me
+		n.Reporter = &me
+	}
+	s.lastNote++
+	n.ID = s.lastNote
+	n.CreatedAt = now()
+	is.Notes = append(is.Notes, n)
+	is.UpdatedAt = n.CreatedAt
+	return map[string]note{"note": n}, nil
+}
+
+func (s *Server) addFiles(is *issue, r *http.Request) *apiError {
+	var req struct {
+		Files []struct {
+			Name    string `json:"name"`
+			Content string `json:"content"`
+		} `json:"files"`
+	}
+	if err := readJSON(r, &req); err != nil {
+		return err
+	}
+	for _, f := range req.Files {
+		b, err := base64.StdEncoding.DecodeString(f.Content)
+		if err != nil {
+			return errorf(http.StatusBadRequest, "%s: %v", f.Name, err)
+		}
+		s.lastFile++
+		s.files[s.lastFile] = b
+		me := s.Me
+		is.Attachments = append(is.Attachments, file{
+			ID: s.lastFile, Reporter: &me, CreatedAt: now(),
+			Filename: f.Name, Size: len(b), ContentType: http.DetectContentType(b),
+		})
+	}
+	is.UpdatedAt = now()
+	return nil
+}
+
+func (s *Server) getFile(is *issue, fileID string) (interface{}, *apiError) {
+	id, _ := strconv.Atoi(fileID)
+	for _, f := range is.Attachments {
+		if f.ID != id {
+			continue
+		}
+		return map[string][]map[string]interface{}{"files": {{
+			"id": f.ID, "filename": f.Filename, "content_type": f.ContentType,
+			"content": base64.StdEncoding.EncodeToString(s.files[id]),
+		}}}, nil
+	}
+	return nil, errorf(http.StatusNotFound, "File %s not found in issue %d", fileID, is.ID)
+}
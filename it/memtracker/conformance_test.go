@@ -0,0 +1,36 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package memtracker
+
+import (
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+)
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New("conformance?states=new,closed")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.AddUser(it.User{ID: "bob", Email: "bob@example.com"})
+		return c
+	}, ittest.WithUser(it.User{ID: "bob", Email: "bob@example.com"}))
+}
+
+// TestConformanceNotImplemented checks that the suite accepts the optional methods missing.
+func TestConformanceNotImplemented(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New("conformance")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.NotImplemented("UpdateIssue", "SetSecondaryID", "ListStates", "FindUser")
+		return c
+	})
+}
@@ -0,0 +1,491 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package memtracker is an in-memory tracker, for tests and demos.
+//
+// The IDs are deterministic: the issues are numbered as "name-1", "name-2",
+// the comments as "name-c1", the attachments as "name-a1", so two trackers
+// with different names never share an ID.
+//
+// Faults can be injected (failing or delaying the Nth call of a method,
+// or making a method return ErrNotImplemented), and every call is logged.
+package memtracker
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("mem", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// Client is an in-memory tracker. The copies of a Client share the same store.
+type Client struct {
+	*store
+}
+
+type store struct {
+	name string
+	now  func() time.Time
+
+	mu          sync.Mutex
+	issues      map[it.IssueID]*issue
+	order       []it.IssueID
+	users       []it.User
+	states      []it.State
+	faults      []Fault
+	counts      map[string]int
+	calls       []Call
+	lastComment int
+	lastAttach  int
+}
+
+type issue struct {
+	it.Issue
+	comments    []it.Comment
+	attachments []attachment
+}
+
+type attachment struct {
+	it.Attachment
+	data []byte
+}
+
+// New returns a new, empty tracker. The name is the prefix of the IDs.
+//
+// The allowed states can be listed in the "states" query parameter (comma separated),
+// as with "mem:test?states=new,closed".
+func New(baseURL string) (Client, error) {
+	name, rawQuery := baseURL, ""
+	if i := strings.IndexByte(baseURL, '?'); i >= 0 {
+		name, rawQuery = baseURL[:i], baseURL[i+1:]
+	}
+	q, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return Client{}, err
+	}
+	if name == "" {
+		return Client{}, fmt.Errorf("%q: no name", baseURL)
+	}
+	c := Client{store: &store{
+		name:   name,
+		now:    time.Now,
+		issues: make(map[it.IssueID]*issue),
+		counts: make(map[string]int),
+	}}
+	if s := q.Get("states"); s != "" {
+		for _, s := range strings.Split(s, ",") {
+			if s != "" {
+				c.states = append(c.states, it.State(s))
+			}
+		}
+	}
+	return c, nil
+}
+
+// SetClock sets the function returning the current time, used for CreatedAt and UpdatedAt.
+func (c Client) SetClock(now func() time.Time) {
+	c.mu.Lock()
+	c.now = now
+	c.mu.Unlock()
+}
+
+// SetStates sets the states returned by ListStates.
+func (c Client) SetStates(states ...it.State) {
+	c.mu.Lock()
+	c.states = append([]it.State(nil), states...)
+	c.mu.Unlock()
+}
+
+// AddUser adds a user, to be found by FindUser.
+func (c Client) AddUser(u it.User) {
+	c.mu.Lock()
+	c.users = append(c.users, u)
+	c.mu.Unlock()
+}
+
+// Fault is an injected failure or delay of a method call.
+type Fault struct {
+	// Method is the name of the it.Tracker method, as "CreateIssue"; empty for all methods.
+	Method string
+	// Nth is the call (counted per method, from 1) to fail; 0 for every call.
+	Nth int
+	// Delay is waited before the call (or until the context is canceled).
+	Delay time.Duration
+	// Err is returned by the call, if not nil.
+	Err error
+}
+
+// Inject adds the fault.
+func (c Client) Inject(f Fault) {
+	c.mu.Lock()
+	c.faults = append(c.faults, f)
+	c.mu.Unlock()
+}
+
+// NotImplemented makes the methods return it.ErrNotImplemented.
+func (c Client) NotImplemented(methods ...string) {
+	for _, m := range methods {
+		c.Inject(Fault{Method: m, Err: it.ErrNotImplemented})
+	}
+}
+
+// ClearFaults removes all the injected faults.
+func (c Client) ClearFaults() {
+	c.mu.Lock()
+	c.faults = nil
+	c.mu.Unlock()
+}
+
+// Call is a logged method call.
+type Call struct {
+	// Method is the name of the it.Tracker method.
+	Method string
+	// Issue is the issue the call is about, if any.
+	Issue it.IssueID
+	// Err is the injected error, if any.
+	Err error
+}
+
+func (c Call) String() string {
+	s := c.Method
+	if c.Issue != "" {
+		s += "(" + string(c.Issue) + ")"
+	}
+	if c.Err != nil {
+		s += ": " + c.Err.Error()
+	}
+	return s
+}
+
+// Calls returns the logged calls, in order. ID is not logged.
+func (c Client) Calls() []Call {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Call(nil), c.calls...)
+}
+
+// Count returns the number of the method's calls.
+func (c Client) Count(method string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.counts[method]
+}
+
+// ResetCalls clears the call log and the counters (so Fault.Nth counts from the next call).
+func (c Client) ResetCalls() {
+	c.mu.Lock()
+	c.calls, c.counts = nil, make(map[string]int)
+	c.mu.Unlock()
+}
+
+// call logs the call and applies the matching faults.
+func (c Client) call(ctx context.Context, method string, ID it.IssueID) error {
+	c.mu.Lock()
+	c.counts[method]++
+	n := c.counts[method]
+	var delay time.Duration
+	var err error
+	for _, f := range c.faults {
+		if (f.Method == "" || f.Method == method) && (f.Nth == 0 || f.Nth == n) {
+			delay += f.Delay
+			if err == nil {
+				err = f.Err
+			}
+		}
+	}
+	c.calls = append(c.calls, Call{Method: method, Issue: ID, Err: err})
+	c.mu.Unlock()
+
+	if delay > 0 {
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", method, err)
+	}
+	return ctx.Err()
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID("mem:" + c.name)
+}
+
+// get returns the issue, or ErrNotFound. c.mu must be held.
+func (c Client) get(ID it.IssueID) (*issue, error) {
+	if is := c.issues[ID]; is != nil {
+		return is, nil
+	}
+	return nil, fmt.Errorf("%q: %w", ID, it.ErrNotFound)
+}
+
+// GetIssue returns the data for the issueID
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	if err := c.call(ctx, "GetIssue", ID); err != nil {
+		return it.Issue{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return copyIssue(is.Issue), nil
+}
+
+// ListIssues lists all the issues updated since "since", ordered by ID.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	if err := c.call(ctx, "ListIssues", ""); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var issues []it.Issue
+	for _, ID := range c.order {
+		if is := c.issues[ID]; !is.UpdatedAt.Before(since) {
+			issues = append(issues, copyIssue(is.Issue))
+		}
+	}
+	return issues, nil
+}
+
+// CreateIssue creates the issue, returning the ID, the next number.
+func (c Client) CreateIssue(ctx context.Context, data it.Issue) (it.IssueID, error) {
+	if err := c.call(ctx, "CreateIssue", ""); err != nil {
+		return "", err
+	}
+	if data.Summary == "" {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: []string{"summary"}}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	data = copyIssue(data)
+	data.ID = it.IssueID(fmt.Sprintf("%s-%d", c.name, len(c.order)+1))
+	data.SecondaryID = ""
+	data.UpdatedAt = c.now()
+	if data.CreatedAt.IsZero() {
+		data.CreatedAt = data.UpdatedAt
+	}
+	c.issues[data.ID] = &issue{Issue: data}
+	c.order = append(c.order, data.ID)
+	return data.ID, nil
+}
+
+// UpdateIssueState updates the issue's state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	if err := c.call(ctx, "UpdateIssueState", ID); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return err
+	}
+	is.State, is.UpdatedAt = state, c.now()
+	return nil
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	if err := c.call(ctx, "UpdateIssue", ID); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return err
+	}
+	if upd.Fields.Has(it.FieldSummary) {
+		is.Summary = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		is.Description = upd.Description
+	}
+	if upd.Fields.Has(it.FieldPriority) {
+		is.Priority = upd.Priority
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		is.Assignee = upd.Assignee
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		is.Labels = append([]string(nil), upd.Labels...)
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		is.State = upd.State
+	}
+	is.UpdatedAt = c.now()
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	if err := c.call(ctx, "SetSecondaryID", primary); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(primary)
+	if err != nil {
+		return err
+	}
+	is.SecondaryID = secondary
+	return nil
+}
+
+// ListStates lists the states set by SetStates.
+//
+// Returns ErrNotImplemented if no states are set, as any state is allowed.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	if err := c.call(ctx, "ListStates", ""); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.states) == 0 {
+		return nil, it.ErrNotImplemented
+	}
+	return append([]it.State(nil), c.states...), nil
+}
+
+// FindUser returns the user added by AddUser with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	if err := c.call(ctx, "FindUser", ""); err != nil {
+		return it.User{}, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, u := range c.users {
+		if email != "" && strings.EqualFold(u.Email, email) {
+			return u, nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a comment to the issue.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	if err := c.call(ctx, "AddComment", ID); err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return "", err
+	}
+	c.lastComment++
+	comment.ID = it.CommentID(fmt.Sprintf("%s-c%d", c.name, c.lastComment))
+	if comment.CreatedAt.IsZero() {
+		comment.CreatedAt = c.now()
+	}
+	is.comments = append(is.comments, comment)
+	is.UpdatedAt = c.now()
+	return comment.ID, nil
+}
+
+// ListComments list the comments of the issue, in the order of addition.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	if err := c.call(ctx, "ListComments", ID); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return nil, err
+	}
+	return append([]it.Comment(nil), is.comments...), nil
+}
+
+// AddAttachment reads the attachment's body and stores it with the issue.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	if err := c.call(ctx, "AddAttachment", ID); err != nil {
+		return "", err
+	}
+	if a.GetBody == nil {
+		return "", errors.New("attachment without body")
+	}
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return "", err
+	}
+	c.lastAttach++
+	a.ID = it.AttachmentID(fmt.Sprintf("%s-a%d", c.name, c.lastAttach))
+	a.URL, a.GetBody = "", nil
+	if a.CreatedAt.IsZero() {
+		a.CreatedAt = c.now()
+	}
+	is.attachments = append(is.attachments, attachment{Attachment: a, data: data})
+	is.UpdatedAt = c.now()
+	return a.ID, nil
+}
+
+// ListAttachments lists the attachments of the issue, in the order of addition.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	if err := c.call(ctx, "ListAttachments", ID); err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	is, err := c.get(ID)
+	if err != nil {
+		return nil, err
+	}
+	attachments := make([]it.Attachment, len(is.attachments))
+	for i, a := range is.attachments {
+		data := a.data
+		attachments[i] = a.Attachment
+		attachments[i].GetBody = func() (io.ReadCloser, error) {
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+	}
+	return attachments, nil
+}
+
+// copyIssue returns a copy of the issue, not sharing the labels and custom fields.
+func copyIssue(issue it.Issue) it.Issue {
+	if issue.Labels != nil {
+		issue.Labels = append([]string(nil), issue.Labels...)
+	}
+	if issue.Custom != nil {
+		m := make(map[string]string, len(issue.Custom))
+		for k, v := range issue.Custom {
+			m[k] = v
+		}
+		issue.Custom = m
+	}
+	return issue
+}
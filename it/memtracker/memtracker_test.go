@@ -0,0 +1,139 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package memtracker
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+func TestIDs(t *testing.T) {
+	ctx := context.Background()
+	c, err := New("x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := c.ID(); got != "mem:x" {
+		t.Errorf("ID: got %q", got)
+	}
+	for _, want := range []it.IssueID{"x-1", "x-2"} {
+		ID, err := c.CreateIssue(ctx, it.Issue{Summary: "s", SecondaryID: "y"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ID != want {
+			t.Errorf("CreateIssue: got %q, wanted %q", ID, want)
+		}
+	}
+	if cID, err := c.AddComment(ctx, "x-2", it.Comment{Body: "b"}); err != nil {
+		t.Fatal(err)
+	} else if cID != "x-c1" {
+		t.Errorf("AddComment: got %q", cID)
+	}
+	aID, err := c.AddAttachment(ctx, "x-1", it.Attachment{Name: "a.txt",
+		GetBody: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader("data")), nil }})
+	if err != nil {
+		t.Fatal(err)
+	} else if aID != "x-a1" {
+		t.Errorf("AddAttachment: got %q", aID)
+	}
+	as, err := c.ListAttachments(ctx, "x-1")
+	if err != nil || len(as) != 1 {
+		t.Fatalf("ListAttachments: %+v, %+v", as, err)
+	}
+	r, err := as[0].GetBody()
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := ioutil.ReadAll(r)
+	if string(b) != "data" {
+		t.Errorf("attachment body: got %q", b)
+	}
+
+	issue, err := c.GetIssue(ctx, "x-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.SecondaryID != "" {
+		t.Errorf("SecondaryID is kept: %q", issue.SecondaryID)
+	}
+	if _, err = c.GetIssue(ctx, "x-3"); !errors.Is(err, it.ErrNotFound) {
+		t.Errorf("GetIssue(x-3): got %+v, wanted ErrNotFound", err)
+	}
+	if _, err = c.CreateIssue(ctx, it.Issue{}); err == nil {
+		t.Error("CreateIssue without summary succeeded")
+	}
+}
+
+func TestListIssuesSince(t *testing.T) {
+	ctx := context.Background()
+	c, _ := New("x")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	c.SetClock(func() time.Time { return now })
+	c.CreateIssue(ctx, it.Issue{Summary: "1"})
+	now = now.Add(time.Hour)
+	c.CreateIssue(ctx, it.Issue{Summary: "2"})
+	issues, err := c.ListIssues(ctx, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 || issues[0].ID != "x-2" {
+		t.Errorf("got %+v, wanted x-2", issues)
+	}
+	now = now.Add(time.Hour)
+	c.UpdateIssueState(ctx, "x-1", "closed")
+	if issues, _ = c.ListIssues(ctx, now); len(issues) != 1 || issues[0].ID != "x-1" {
+		t.Errorf("got %+v, wanted x-1", issues)
+	}
+}
+
+func TestFaults(t *testing.T) {
+	ctx := context.Background()
+	c, _ := New("x")
+	errBoom := errors.New("boom")
+	c.Inject(Fault{Method: "CreateIssue", Nth: 2, Err: errBoom})
+	c.NotImplemented("UpdateIssue")
+	if _, err := c.CreateIssue(ctx, it.Issue{Summary: "1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.CreateIssue(ctx, it.Issue{Summary: "2"}); !errors.Is(err, errBoom) {
+		t.Errorf("2nd CreateIssue: got %+v, wanted %v", err, errBoom)
+	}
+	if ID, err := c.CreateIssue(ctx, it.Issue{Summary: "3"}); err != nil {
+		t.Fatal(err)
+	} else if ID != "x-2" {
+		t.Errorf("failed call consumed an ID: got %q", ID)
+	}
+	if err := c.UpdateIssue(ctx, "x-1", it.IssueUpdate{}); !errors.Is(err, it.ErrNotImplemented) {
+		t.Errorf("UpdateIssue: got %+v, wanted ErrNotImplemented", err)
+	}
+	if got := c.Count("CreateIssue"); got != 3 {
+		t.Errorf("Count: got %d, wanted 3", got)
+	}
+	var methods []string
+	for _, call := range c.Calls() {
+		methods = append(methods, call.String())
+	}
+	if got, want := strings.Join(methods, " "), "CreateIssue CreateIssue: boom CreateIssue UpdateIssue(x-1): not implemented"; got != want {
+		t.Errorf("Calls: got %q, wanted %q", got, want)
+	}
+
+	c.ClearFaults()
+	c.ResetCalls()
+	c.Inject(Fault{Method: "GetIssue", Delay: time.Minute})
+	ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetIssue(ctx, "x-1"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("delayed GetIssue: got %+v, wanted DeadlineExceeded", err)
+	}
+}
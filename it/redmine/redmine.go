@@ -0,0 +1,674 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package redmine is the Redmine tracker, using its REST API.
+package redmine
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("redmine", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://www.redmine.org/projects/redmine/wiki/Rest_api
+type Client struct {
+	id string
+	// URL is the base URL of Redmine.
+	URL        *url.URL
+	key        string
+	HTTPClient *http.Client
+	defaults   defaults
+	// secondaryField is the name of the custom field holding the secondary ID.
+	secondaryField string
+}
+
+// defaults are the values used for the new issues, when the incoming issue lacks them.
+type defaults struct {
+	Project, Tracker, Priority string
+}
+
+// PageSize is the number of issues requested in one page.
+const PageSize = 100
+
+// New returns a new Redmine client.
+//
+// The API key is taken from the "key" query parameter, or the REDMINE_API_KEY
+// environment variable. The defaults for the created issues are the
+// project (identifier), tracker and priority (names) query parameters,
+// the secondary ID is stored in the custom field named by "secondary_field".
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	if !strings.HasSuffix(URL.Path, "/") {
+		URL.Path += "/"
+	}
+	key := q.Get("key")
+	if key == "" {
+		key = os.Getenv("REDMINE_API_KEY")
+	}
+	return Client{
+		id: baseURL, URL: URL, key: key, HTTPClient: http.DefaultClient,
+		defaults: defaults{
+			Project:  q.Get("project"),
+			Tracker:  q.Get("tracker"),
+			Priority: q.Get("priority"),
+		},
+		secondaryField: q.Get("secondary_field"),
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+func issuePath(ID it.IssueID) string {
+	return "issues/" + url.PathEscape(string(ID)) + ".json"
+}
+
+// GetIssue returns the data for the issueID
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	ri, err := c.getIssue(ctx, ID, "")
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return c.readIssue(ri), nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID, include string) (apiIssue, error) {
+	path := issuePath(ID)
+	if include != "" {
+		path += "?include=" + include
+	}
+	var resp struct {
+		Issue apiIssue `json:"issue"`
+	}
+	err := c.do(ctx, "GET", path, nil, &resp)
+	return resp.Issue, err
+}
+
+// ListIssues lists all the issues (in the default project, if set) created/changed since "since".
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	q := url.Values{"status_id": {"*"}, "sort": {"updated_on"}, "limit": {strconv.Itoa(PageSize)}}
+	if c.defaults.Project != "" {
+		q.Set("project_id", c.defaults.Project)
+	}
+	if !since.IsZero() {
+		q.Set("updated_on", ">="+since.UTC().Format(time.RFC3339))
+	}
+	var issues []it.Issue
+	for offset := 0; ; {
+		q.Set("offset", strconv.Itoa(offset))
+		var resp struct {
+			Issues     []apiIssue `json:"issues"`
+			TotalCount int        `json:"total_count"`
+		}
+		if err := c.do(ctx, "GET", "issues.json?"+q.Encode(), nil, &resp); err != nil {
+			return issues, err
+		}
+		for _, ri := range resp.Issues {
+			issues = append(issues, c.readIssue(ri))
+		}
+		offset += len(resp.Issues)
+		if len(resp.Issues) == 0 || offset >= resp.TotalCount {
+			return issues, nil
+		}
+	}
+}
+
+// CreateIssue creates the issue, returning the ID.
+//
+// The issue is created in the default project, with the default tracker.
+// The author cannot be set, so it is written into the description.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	var missing []string
+	if c.defaults.Project == "" {
+		missing = append(missing, "project")
+	}
+	if issue.Summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	ri := issueFields{
+		ProjectID:   c.defaults.Project,
+		Subject:     &issue.Summary,
+		Description: &issue.Description,
+	}
+	if author != (it.User{}) {
+		description := it.Attribute(author, issue.CreatedAt, issue.Description)
+		ri.Description = &description
+	}
+	var err error
+	if c.defaults.Tracker != "" {
+		if ri.TrackerID, err = c.lookup(ctx, "trackers", c.defaults.Tracker); err != nil {
+			return "", err
+		}
+	}
+	if p := firstNonEmpty(issue.Priority, c.defaults.Priority); p != "" {
+		if ri.PriorityID, err = c.lookup(ctx, "enumerations/issue_priorities", p); err != nil {
+			return "", err
+		}
+	}
+	if issue.State != "" {
+		if ri.StatusID, err = c.lookup(ctx, "issue_statuses", string(issue.State)); err != nil {
+			return "", err
+		}
+	}
+	if id, err := userID(issue.Assignee); err != nil {
+		return "", err
+	} else if id != nil {
+		ri.AssignedToID = *id
+	}
+	if !issue.DueDate.IsZero() {
+		d := issue.DueDate.Format(dateFormat)
+		ri.DueDate = &d
+	}
+	var resp struct {
+		Issue apiIssue `json:"issue"`
+	}
+	if err = c.do(ctx, "POST", "issues.json", map[string]issueFields{"issue": ri}, &resp); err != nil {
+		return "", err
+	}
+	return it.IssueID(strconv.Itoa(resp.Issue.ID)), nil
+}
+
+// UpdateIssueState updates the issue's state.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The states and priorities are set by name.
+// An assignee without ID (not a mapped Redmine user) is left as is.
+// Redmine has no labels.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	var ri issueFields
+	if upd.Fields.Has(it.FieldSummary) {
+		ri.Subject = &upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		ri.Description = &upd.Description
+	}
+	var err error
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		if ri.PriorityID, err = c.lookup(ctx, "enumerations/issue_priorities", upd.Priority); err != nil {
+			return err
+		}
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		if ri.StatusID, err = c.lookup(ctx, "issue_statuses", string(upd.State)); err != nil {
+			return err
+		}
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			id, err := userID(upd.Assignee)
+			if err != nil {
+				return err
+			}
+			ri.AssignedToID = *id
+		} else if upd.Assignee == (it.User{}) {
+			ri.AssignedToID = ""
+		}
+	}
+	if ri.Subject == nil && ri.Description == nil && ri.PriorityID == nil &&
+		ri.StatusID == nil && ri.AssignedToID == nil {
+		return nil
+	}
+	if err = c.putIssue(ctx, ID, ri); err != nil {
+		return fmt.Errorf("update %q: %w", ID, err)
+	}
+	return nil
+}
+
+func (c Client) putIssue(ctx context.Context, ID it.IssueID, ri issueFields) error {
+	return c.do(ctx, "PUT", issuePath(ID), map[string]issueFields{"issue": ri}, nil)
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	ri, err := c.getIssue(ctx, primary, "")
+	if err != nil {
+		return err
+	}
+	for _, cf := range ri.CustomFields {
+		if cf.Name == c.secondaryField {
+			return c.putIssue(ctx, primary, issueFields{CustomFields: []customField{{ID: cf.ID, Value: string(secondary)}}})
+		}
+	}
+	return fmt.Errorf("%q has no custom field %q: %w", primary, c.secondaryField, it.ErrNotFound)
+}
+
+// ListStates lists the states an issue can be in.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	names, err := c.enumeration(ctx, "issue_statuses")
+	if err != nil {
+		return nil, err
+	}
+	states := make([]it.State, len(names))
+	for i, n := range names {
+		states[i] = it.State(n.Name)
+	}
+	return states, nil
+}
+
+// FindUser returns the user with the given email address.
+//
+// Listing the users needs administrator rights.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var resp struct {
+		Users []struct {
+			ID        int    `json:"id"`
+			Firstname string `json:"firstname"`
+			Lastname  string `json:"lastname"`
+			Mail      string `json:"mail"`
+		} `json:"users"`
+	}
+	if err := c.do(ctx, "GET", "users.json?"+url.Values{"name": {email}}.Encode(), nil, &resp); err != nil {
+		return it.User{}, err
+	}
+	for _, u := range resp.Users {
+		if strings.EqualFold(u.Mail, email) {
+			return it.User{
+				ID:       it.UserID(strconv.Itoa(u.ID)),
+				RealName: strings.TrimSpace(u.Firstname + " " + u.Lastname),
+				Email:    u.Mail,
+			}, nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a journal entry with the comment as notes.
+//
+// The author cannot be set, so it is written into the body.
+// The API does not return the ID of the new journal entry,
+// so it is the latest with the same notes.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	body := comment.AttributedBody()
+	if err := c.putIssue(ctx, ID, issueFields{Notes: &body}); err != nil {
+		return "", err
+	}
+	ri, err := c.getIssue(ctx, ID, "journals")
+	if err != nil {
+		return "", err
+	}
+	var jID int
+	for _, j := range ri.Journals {
+		if j.Notes == body && j.ID > jID {
+			jID = j.ID
+		}
+	}
+	if jID == 0 {
+		return "", fmt.Errorf("added comment to %q, but cannot find it: %w", ID, it.ErrNotFound)
+	}
+	return it.CommentID(strconv.Itoa(jID)), nil
+}
+
+// ListComments list the journal entries of the issue with notes.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	ri, err := c.getIssue(ctx, ID, "journals")
+	if err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, 0, len(ri.Journals))
+	for _, j := range ri.Journals {
+		if j.Notes == "" {
+			continue
+		}
+		comments = append(comments, it.Comment{
+			ID:        it.CommentID(strconv.Itoa(j.ID)),
+			Author:    readUser(j.User),
+			CreatedAt: j.CreatedOn,
+			Body:      j.Notes,
+		})
+	}
+	return comments, nil
+}
+
+// AddAttachment uploads the file, and attaches it to the issue with the returned token.
+//
+// The API does not return the ID of the attachment,
+// so it is the latest attachment with the same name.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	req, err := c.newRequest(ctx, "POST", "uploads.json?"+url.Values{"filename": {a.Name}}.Encode(), r)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	var resp struct {
+		Upload struct {
+			Token string `json:"token"`
+		} `json:"upload"`
+	}
+	if err = c.send(req, &resp); err != nil {
+		return "", fmt.Errorf("upload %q: %w", a.Name, err)
+	}
+	if err = c.putIssue(ctx, ID, issueFields{Uploads: []upload{{
+		Token: resp.Upload.Token, Filename: a.Name, ContentType: a.MIMEType,
+	}}}); err != nil {
+		return "", err
+	}
+	ri, err := c.getIssue(ctx, ID, "attachments")
+	if err != nil {
+		return "", err
+	}
+	var aID int
+	for _, f := range ri.Attachments {
+		if f.Filename == a.Name && f.ID > aID {
+			aID = f.ID
+		}
+	}
+	if aID == 0 {
+		return "", fmt.Errorf("uploaded %q to %q, but cannot find it: %w", a.Name, ID, it.ErrNotFound)
+	}
+	return it.AttachmentID(strconv.Itoa(aID)), nil
+}
+
+// ListAttachments lists the attachments of the issue.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	ri, err := c.getIssue(ctx, ID, "attachments")
+	if err != nil {
+		return nil, err
+	}
+	as := make([]it.Attachment, len(ri.Attachments))
+	for i, f := range ri.Attachments {
+		dl := f.ContentURL
+		as[i] = it.Attachment{
+			ID:        it.AttachmentID(strconv.Itoa(f.ID)),
+			Name:      f.Filename,
+			MIMEType:  f.ContentType,
+			Author:    readUser(f.Author),
+			CreatedAt: f.CreatedOn,
+			URL:       dl,
+			GetBody: func() (io.ReadCloser, error) {
+				req, err := c.newRequest(ctx, "GET", dl, nil)
+				if err != nil {
+					return nil, err
+				}
+				resp, err := c.HTTPClient.Do(req)
+				if err != nil {
+					return nil, err
+				}
+				if resp.StatusCode >= 300 {
+					resp.Body.Close()
+					return nil, fmt.Errorf("GET %s: %s", dl, resp.Status)
+				}
+				return resp.Body, nil
+			},
+		}
+	}
+	return as, nil
+}
+
+func (c Client) readIssue(ri apiIssue) it.Issue {
+	issue := it.Issue{
+		ID:            it.IssueID(strconv.Itoa(ri.ID)),
+		Summary:       ri.Subject,
+		Description:   ri.Description,
+		Project:       ri.Project.name(),
+		Category:      ri.Category.name(),
+		Priority:      ri.Priority.name(),
+		Author:        readUser(ri.Author),
+		Reporter:      readUser(ri.Author),
+		Assignee:      readUser(ri.AssignedTo),
+		CreatedAt:     ri.CreatedOn,
+		UpdatedAt:     ri.UpdatedOn,
+		State:         it.State(ri.Status.name()),
+		TargetVersion: ri.FixedVersion.name(),
+	}
+	if ri.DueDate != "" {
+		issue.DueDate, _ = time.Parse(dateFormat, ri.DueDate)
+	}
+	for _, cf := range ri.CustomFields {
+		v, ok := cf.Value.(string)
+		if !ok || v == "" {
+			continue
+		}
+		if c.secondaryField != "" && cf.Name == c.secondaryField {
+			issue.SecondaryID = it.IssueID(v)
+		}
+		if issue.Custom == nil {
+			issue.Custom = make(map[string]string, len(ri.CustomFields))
+		}
+		issue.Custom[cf.Name] = v
+	}
+	return issue
+}
+
+// lookup returns the ID of the named item of the enumeration (issue_statuses, trackers...).
+func (c Client) lookup(ctx context.Context, path, name string) (*int, error) {
+	names, err := c.enumeration(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range names {
+		if strings.EqualFold(n.Name, name) {
+			id := n.ID
+			return &id, nil
+		}
+	}
+	return nil, fmt.Errorf("%s: %q: %w", path, name, it.ErrNotFound)
+}
+
+// enumeration returns the items of the enumeration, the only key of the response object.
+func (c Client) enumeration(ctx context.Context, path string) ([]ref, error) {
+	var resp map[string][]ref
+	if err := c.do(ctx, "GET", path+".json", nil, &resp); err != nil {
+		return nil, err
+	}
+	for _, v := range resp {
+		return v, nil
+	}
+	return nil, nil
+}
+
+// do calls the API, encoding body and decoding the response into result, if not nil.
+func (c Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, result)
+}
+
+func (c Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	URL, err := c.URL.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.key != "" {
+		req.Header.Set("X-Redmine-API-Key", c.key)
+	}
+	return req, nil
+}
+
+func (c Client) send(req *http.Request, result interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, b)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", it.ErrNotFound, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s %s: decode: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+const dateFormat = "2006-01-02"
+
+type ref struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+func (r *ref) name() string {
+	if r == nil {
+		return ""
+	}
+	return r.Name
+}
+
+// readUser returns the it.User of the reference; Redmine does not return the email.
+func readUser(u *ref) it.User {
+	if u == nil || u.ID == 0 {
+		return it.User{}
+	}
+	return it.User{ID: it.UserID(strconv.Itoa(u.ID)), RealName: u.Name}
+}
+
+// userID returns the ID of the mapped Redmine user, or nil for unmapped users.
+func userID(u it.User) (*int, error) {
+	if u.ID == "" {
+		return nil, nil
+	}
+	id, err := strconv.Atoi(string(u.ID))
+	if err != nil {
+		return nil, fmt.Errorf("user ID %q: %w", u.ID, err)
+	}
+	return &id, nil
+}
+
+type customField struct {
+	ID   int    `json:"id"`
+	Name string `json:"name,omitempty"`
+	// Value is a string, or a list of strings for the multi-valued fields.
+	Value interface{} `json:"value"`
+}
+
+type journal struct {
+	ID        int       `json:"id"`
+	User      *ref      `json:"user,omitempty"`
+	Notes     string    `json:"notes"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+type attachment struct {
+	ID          int       `json:"id"`
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"content_type"`
+	ContentURL  string    `json:"content_url"`
+	Author      *ref      `json:"author,omitempty"`
+	CreatedOn   time.Time `json:"created_on"`
+}
+
+type upload struct {
+	Token       string `json:"token"`
+	Filename    string `json:"filename"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// apiIssue is an issue as returned by the API.
+type apiIssue struct {
+	ID           int           `json:"id"`
+	Project      *ref          `json:"project,omitempty"`
+	Tracker      *ref          `json:"tracker,omitempty"`
+	Status       *ref          `json:"status,omitempty"`
+	Priority     *ref          `json:"priority,omitempty"`
+	Author       *ref          `json:"author,omitempty"`
+	AssignedTo   *ref          `json:"assigned_to,omitempty"`
+	Category     *ref          `json:"category,omitempty"`
+	FixedVersion *ref          `json:"fixed_version,omitempty"`
+	Subject      string        `json:"subject"`
+	Description  string        `json:"description"`
+	DueDate      string        `json:"due_date,omitempty"`
+	CreatedOn    time.Time     `json:"created_on"`
+	UpdatedOn    time.Time     `json:"updated_on"`
+	CustomFields []customField `json:"custom_fields,omitempty"`
+	Journals     []journal     `json:"journals,omitempty"`
+	Attachments  []attachment  `json:"attachments,omitempty"`
+}
+
+// issueFields are the writable fields of an issue, only the non-nil ones are sent.
+type issueFields struct {
+	ProjectID  string `json:"project_id,omitempty"`
+	TrackerID  *int   `json:"tracker_id,omitempty"`
+	StatusID   *int   `json:"status_id,omitempty"`
+	PriorityID *int   `json:"priority_id,omitempty"`
+	// AssignedToID is the user's ID, or "" to unassign.
+	AssignedToID interface{}   `json:"assigned_to_id,omitempty"`
+	Subject      *string       `json:"subject,omitempty"`
+	Description  *string       `json:"description,omitempty"`
+	DueDate      *string       `json:"due_date,omitempty"`
+	Notes        *string       `json:"notes,omitempty"`
+	CustomFields []customField `json:"custom_fields,omitempty"`
+	Uploads      []upload      `json:"uploads,omitempty"`
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package redmine
+
+import (
+	"context"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+	"github.com/UNO-SOFT/mantisync/it/redmine/redminetest"
+)
+
+const testParams = "?key=secret&project=test&tracker=Bug&secondary_field=Secondary"
+
+func newTestClient(t *testing.T) (Client, *redminetest.Server) {
+	t.Helper()
+	srv := redminetest.NewServer("test", "secret")
+	srv.CustomFields = []string{"Other", "Secondary"}
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.AddUser(redminetest.User{ID: 2, Login: "jdoe", Firstname: "John", Lastname: "Doe", Mail: "jdoe@example.com"})
+		return c
+	}, ittest.WithPageSize(PageSize),
+		ittest.WithUser(it.User{ID: "2", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	REDMINE_TEST_URL='https://redmine.example.com/?key=...&project=test&tracker=Bug&secondary_field=Secondary' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("REDMINE_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestUpdateIssue(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddUser(redminetest.User{ID: 2, Login: "jdoe", Firstname: "John", Lastname: "Doe", Mail: "jdoe@example.com"})
+	ID, err := c.CreateIssue(ctx, it.Issue{Summary: "update", Priority: "High", Assignee: it.User{ID: "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	issue, err := c.GetIssue(ctx, ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if issue.Priority != "High" || issue.Assignee.ID != "2" {
+		t.Errorf("got priority %q, assignee %+v; wanted High and 2", issue.Priority, issue.Assignee)
+	}
+
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{
+		Issue:  it.Issue{Priority: "Urgent"},
+		Fields: it.FieldPriority | it.FieldAssignee,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if issue, err = c.GetIssue(ctx, ID); err != nil {
+		t.Fatal(err)
+	}
+	if issue.Priority != "Urgent" || issue.Assignee != (it.User{}) {
+		t.Errorf("got priority %q, assignee %+v; wanted Urgent and none", issue.Priority, issue.Assignee)
+	}
+
+	// The journal entries of the changes without notes are not comments.
+	if comments, err := c.ListComments(ctx, ID); err != nil {
+		t.Fatal(err)
+	} else if len(comments) != 0 {
+		t.Errorf("got comments %+v, wanted none", comments)
+	}
+}
@@ -0,0 +1,534 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package redminetest provides an in-process Redmine REST API server, for testing.
+//
+// It implements the JSON endpoints used by the redmine package, for one project:
+// issue list (paginated by offset and limit), get (with the journals and attachments),
+// create and update (with notes, custom fields and uploads), the statuses, trackers
+// and priorities, user search, file upload and the attachment downloads.
+//
+// The X-Redmine-API-Key header must hold the Key, if it is not empty.
+package redminetest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a Redmine server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Key is the accepted API key.
+	Key string
+	// Project is the identifier of the served project.
+	Project string
+	// Statuses, Trackers and Priorities are the names of the enumerations, with the IDs 1, 2, ...
+	// The first is the default.
+	Statuses, Trackers, Priorities []string
+	// CustomFields are the names of the issue custom fields, with the IDs 1, 2, ...
+	CustomFields []string
+	// Me is the owner of the key, the author of the created issues and journals.
+	Me User
+
+	mu          sync.Mutex
+	users       []User
+	issues      []*issue
+	lastJournal int
+	uploads     map[string][]byte
+	files       []file
+}
+
+// User is a Redmine user account.
+type User struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	Firstname string `json:"firstname"`
+	Lastname  string `json:"lastname"`
+	Mail      string `json:"mail"`
+}
+
+func (u User) ref() *ref { return &ref{ID: u.ID, Name: u.Firstname + " " + u.Lastname} }
+
+type ref struct {
+	ID   int    `json:"id"`
+	Name string `json:"name"`
+}
+
+type customField struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name,omitempty"`
+	Value string `json:"value"`
+}
+
+type journal struct {
+	ID        int       `json:"id"`
+	User      *ref      `json:"user"`
+	Notes     string    `json:"notes"`
+	CreatedOn time.Time `json:"created_on"`
+}
+
+type file struct {
+	ID          int       `json:"id"`
+	Filename    string    `json:"filename"`
+	Filesize    int       `json:"filesize"`
+	ContentType string    `json:"content_type"`
+	ContentURL  string    `json:"content_url"`
+	Author      *ref      `json:"author"`
+	CreatedOn   time.Time `json:"created_on"`
+	content     []byte
+}
+
+type issue struct {
+	ID           int
+	Tracker      int
+	Status       int
+	Priority     int
+	Author       *ref
+	AssignedTo   *ref
+	Subject      string
+	Description  string
+	DueDate      string
+	CreatedOn    time.Time
+	UpdatedOn    time.Time
+	CustomFields []customField
+	Journals     []journal
+	Attachments  []int
+}
+
+// DefaultStatuses, DefaultTrackers and DefaultPriorities are the enumerations
+// of a Redmine loaded with the default configuration.
+var (
+	DefaultStatuses   = []string{"New", "In Progress", "Resolved", "Feedback", "Closed", "Rejected"}
+	DefaultTrackers   = []string{"Bug", "Feature", "Support"}
+	DefaultPriorities = []string{"Normal", "Low", "High", "Urgent", "Immediate"}
+)
+
+// NewServer starts and returns a new server for the project, accepting the key.
+// The caller should call Close when finished, to shut it down.
+func NewServer(project, key string) *Server {
+	s := &Server{
+		Key: key, Project: project,
+		Statuses:   append([]string(nil), DefaultStatuses...),
+		Trackers:   append([]string(nil), DefaultTrackers...),
+		Priorities: append([]string(nil), DefaultPriorities...),
+		Me:         User{ID: 1, Login: "admin", Firstname: "Redmine", Lastname: "Admin", Mail: "admin@example.net"},
+		uploads:    make(map[string][]byte),
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Code   int      `json:"-"`
+	Errors []string `json:"errors"`
+}
+
+func (e *apiError) Error() string { return fmt.Sprintf("%d: %s", e.Code, strings.Join(e.Errors, "; ")) }
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	return &apiError{Code: code, Errors: []string{fmt.Sprintf(format, args...)}}
+}
+
+func invalid(format string, args ...interface{}) *apiError {
+	return errorf(http.StatusUnprocessableEntity, format, args...)
+}
+
+// now returns the current time with the seconds precision of the API.
+func now() time.Time { return time.Now().UTC().Truncate(time.Second) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.Key != "" && r.Header.Get("X-Redmine-API-Key") != s.Key {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	p := strings.Trim(r.URL.Path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if r.Method == "GET" && strings.HasPrefix(p, "attachments/download/") {
+		s.download(w, r, strings.TrimPrefix(p, "attachments/download/"))
+		return
+	}
+	var code int
+	var result interface{}
+	var err *apiError
+	switch {
+	case r.Method == "GET" && p == "issue_statuses.json":
+		result = map[string][]map[string]interface{}{"issue_statuses": s.enumeration(s.Statuses)}
+	case r.Method == "GET" && p == "trackers.json":
+		result = map[string][]map[string]interface{}{"trackers": s.enumeration(s.Trackers)}
+	case r.Method == "GET" && p == "enumerations/issue_priorities.json":
+		result = map[string][]map[string]interface{}{"issue_priorities": s.enumeration(s.Priorities)}
+	case r.Method == "GET" && p == "users.json":
+		result = s.searchUsers(r.URL.Query().Get("name"))
+	case r.Method == "POST" && p == "uploads.json":
+		code = http.StatusCreated
+		result, err = s.upload(r)
+	case r.Method == "GET" && p == "issues.json":
+		result, err = s.list(r)
+	case r.Method == "POST" && p == "issues.json":
+		code = http.StatusCreated
+		result, err = s.create(r)
+	case strings.HasPrefix(p, "issues/") && strings.HasSuffix(p, ".json"):
+		id, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(p, "issues/"), ".json"))
+		if id <= 0 || id > len(s.issues) {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		is := s.issues[id-1]
+		switch r.Method {
+		case "GET":
+			result = map[string]interface{}{"issue": s.render(is, strings.Split(r.URL.Query().Get("include"), ","))}
+		case "PUT":
+			code, err = http.StatusNoContent, s.update(is, r)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, code, result)
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	if code == http.StatusNoContent {
+		w.WriteHeader(code)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (s *Server) enumeration(names []string) []map[string]interface{} {
+	items := make([]map[string]interface{}, len(names))
+	for i, n := range names {
+		items[i] = map[string]interface{}{"id": i + 1, "name": n, "is_default": i == 0}
+	}
+	return items
+}
+
+func nameOf(names []string, id int) *ref {
+	if id <= 0 || id > len(names) {
+		return nil
+	}
+	return &ref{ID: id, Name: names[id-1]}
+}
+
+func (s *Server) user(id int) *User {
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.ID == id {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) render(is *issue, include []string) map[string]interface{} {
+	m := map[string]interface{}{
+		"id":            is.ID,
+		"project":       ref{ID: 1, Name: s.Project},
+		"tracker":       nameOf(s.Trackers, is.Tracker),
+		"status":        nameOf(s.Statuses, is.Status),
+		"priority":      nameOf(s.Priorities, is.Priority),
+		"author":        is.Author,
+		"subject":       is.Subject,
+		"description":   is.Description,
+		"created_on":    is.CreatedOn,
+		"updated_on":    is.UpdatedOn,
+		"custom_fields": is.CustomFields,
+	}
+	if is.AssignedTo != nil {
+		m["assigned_to"] = is.AssignedTo
+	}
+	if is.DueDate != "" {
+		m["due_date"] = is.DueDate
+	}
+	for _, inc := range include {
+		switch inc {
+		case "journals":
+			m["journals"] = append([]journal{}, is.Journals...)
+		case "attachments":
+			files := make([]file, len(is.Attachments))
+			for i, id := range is.Attachments {
+				files[i] = s.files[id-1]
+			}
+			m["attachments"] = files
+		}
+	}
+	return m
+}
+
+func (s *Server) list(r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	if p := q.Get("project_id"); p != "" && p != s.Project {
+		return nil, errorf(http.StatusNotFound, "project %q not found", p)
+	}
+	limit, offset := 25, 0
+	if v := q.Get("limit"); v != "" {
+		limit, _ = strconv.Atoi(v)
+		if limit <= 0 || limit > 100 {
+			limit = 100
+		}
+	}
+	if v := q.Get("offset"); v != "" {
+		offset, _ = strconv.Atoi(v)
+	}
+	var since time.Time
+	if v := q.Get("updated_on"); v != "" {
+		var err error
+		if since, err = time.Parse(time.RFC3339, strings.TrimPrefix(v, ">=")); err != nil || !strings.HasPrefix(v, ">=") {
+			return nil, invalid("updated_on: %q is invalid", v)
+		}
+	}
+	issues := make([]*issue, 0, len(s.issues))
+	for _, is := range s.issues {
+		// Without status_id, only the open issues are listed.
+		if !is.UpdatedOn.Before(since) && (q.Get("status_id") == "*" || s.Statuses[is.Status-1] != "Closed") {
+			issues = append(issues, is)
+		}
+	}
+	sortKey, desc := q.Get("sort"), false
+	if strings.HasSuffix(sortKey, ":desc") {
+		sortKey, desc = strings.TrimSuffix(sortKey, ":desc"), true
+	}
+	if sortKey == "updated_on" {
+		sort.SliceStable(issues, func(i, j int) bool {
+			return issues[i].UpdatedOn.Before(issues[j].UpdatedOn) != desc
+		})
+	}
+	total := len(issues)
+	if offset > total {
+		offset = total
+	}
+	to := offset + limit
+	if to > total {
+		to = total
+	}
+	rendered := make([]map[string]interface{}, 0, to-offset)
+	for _, is := range issues[offset:to] {
+		rendered = append(rendered, s.render(is, nil))
+	}
+	return map[string]interface{}{"issues": rendered, "total_count": total, "offset": offset, "limit": limit}, nil
+}
+
+// issueFields are the writable fields of an issue.
+type issueFields struct {
+	ProjectID    *string          `json:"project_id"`
+	TrackerID    *int             `json:"tracker_id"`
+	StatusID     *int             `json:"status_id"`
+	PriorityID   *int             `json:"priority_id"`
+	AssignedToID *json.RawMessage `json:"assigned_to_id"`
+	Subject      *string          `json:"subject"`
+	Description  *string          `json:"description"`
+	DueDate      *string          `json:"due_date"`
+	Notes        *string          `json:"notes"`
+	CustomFields []customField    `json:"custom_fields"`
+	Uploads      []struct {
+		Token       string `json:"token"`
+		Filename    string `json:"filename"`
+		ContentType string `json:"content_type"`
+	} `json:"uploads"`
+}
+
+func readFields(r *http.Request) (issueFields, *apiError) {
+	var req struct {
+		Issue *issueFields `json:"issue"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Issue == nil {
+		return issueFields{}, errorf(http.StatusBadRequest, "invalid body: %v", err)
+	}
+	return *req.Issue, nil
+}
+
+// apply sets the fields on the issue, returning the notes. s.mu must be held.
+func (s *Server) apply(is *issue, f issueFields) (string, *apiError) {
+	check := func(name string, names []string, id *int, dst *int) *apiError {
+		if id == nil {
+			return nil
+		}
+		if *id <= 0 || *id > len(names) {
+			return invalid("%s is not included in the list", name)
+		}
+		*dst = *id
+		return nil
+	}
+	if err := check("Tracker", s.Trackers, f.TrackerID, &is.Tracker); err != nil {
+		return "", err
+	}
+	if err := check("Status", s.Statuses, f.StatusID, &is.Status); err != nil {
+		return "", err
+	}
+	if err := check("Priority", s.Priorities, f.PriorityID, &is.Priority); err != nil {
+		return "", err
+	}
+	if f.Subject != nil {
+		if *f.Subject == "" {
+			return "", invalid("Subject cannot be blank")
+		}
+		is.Subject = *f.Subject
+	}
+	if f.Description != nil {
+		is.Description = *f.Description
+	}
+	if f.DueDate != nil {
+		if _, err := time.Parse("2006-01-02", *f.DueDate); err != nil {
+			return "", invalid("Due date is not a valid date")
+		}
+		is.DueDate = *f.DueDate
+	}
+	if f.AssignedToID != nil {
+		// The ID is a number, or "" to unassign.
+		var id int
+		var empty string
+		if err := json.Unmarshal(*f.AssignedToID, &empty); err == nil && empty == "" {
+			is.AssignedTo = nil
+		} else if err = json.Unmarshal(*f.AssignedToID, &id); err != nil || s.user(id) == nil {
+			return "", invalid("Assignee is invalid")
+		} else {
+			is.AssignedTo = s.user(id).ref()
+		}
+	}
+	for _, cf := range f.CustomFields {
+		if cf.ID <= 0 || cf.ID > len(is.CustomFields) {
+			return "", invalid("custom field %d is invalid", cf.ID)
+		}
+		is.CustomFields[cf.ID-1].Value = cf.Value
+	}
+	for _, u := range f.Uploads {
+		b, ok := s.uploads[u.Token]
+		if !ok {
+			return "", invalid("upload token %q is invalid", u.Token)
+		}
+		delete(s.uploads, u.Token)
+		id := len(s.files) + 1
+		ct := u.ContentType
+		if ct == "" {
+			ct = http.DetectContentType(b)
+		}
+		s.files = append(s.files, file{
+			ID: id, Filename: u.Filename, Filesize: len(b), ContentType: ct,
+			ContentURL: s.URL + "/attachments/download/" + strconv.Itoa(id) + "/" + u.Filename,
+			Author:     s.Me.ref(), CreatedOn: now(), content: b,
+		})
+		is.Attachments = append(is.Attachments, id)
+	}
+	if f.Notes != nil {
+		return *f.Notes, nil
+	}
+	return "", nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	f, err := readFields(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.ProjectID == nil || *f.ProjectID != s.Project {
+		return nil, invalid("Project cannot be blank")
+	}
+	t := now()
+	is := &issue{
+		ID: len(s.issues) + 1, Tracker: 1, Status: 1, Priority: 1,
+		Author: s.Me.ref(), CreatedOn: t, UpdatedOn: t,
+	}
+	for i, name := range s.CustomFields {
+		is.CustomFields = append(is.CustomFields, customField{ID: i + 1, Name: name})
+	}
+	if _, err = s.apply(is, f); err != nil {
+		return nil, err
+	}
+	if is.Subject == "" {
+		return nil, invalid("Subject cannot be blank")
+	}
+	s.issues = append(s.issues, is)
+	return map[string]interface{}{"issue": s.render(is, nil)}, nil
+}
+
+// update updates the issue, and adds a journal entry with the notes.
+func (s *Server) update(is *issue, r *http.Request) *apiError {
+	f, err := readFields(r)
+	if err != nil {
+		return err
+	}
+	upd := *is
+	upd.CustomFields = append([]customField(nil), is.CustomFields...)
+	notes, err := s.apply(&upd, f)
+	if err != nil {
+		return err
+	}
+	s.lastJournal++
+	upd.UpdatedOn = now()
+	upd.Journals = append(upd.Journals, journal{ID: s.lastJournal, User: s.Me.ref(), Notes: notes, CreatedOn: upd.UpdatedOn})
+	*is = upd
+	return nil
+}
+
+func (s *Server) upload(r *http.Request) (interface{}, *apiError) {
+	if r.Header.Get("Content-Type") != "application/octet-stream" {
+		return nil, errorf(http.StatusNotAcceptable, "the Content-Type must be application/octet-stream")
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	id := len(s.files) + len(s.uploads) + 1
+	token := fmt.Sprintf("%d.%08x", id, len(b))
+	s.uploads[token] = b
+	return map[string]map[string]interface{}{"upload": {"id": id, "token": token}}, nil
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, rest string) {
+	id, _ := strconv.Atoi(strings.SplitN(rest, "/", 2)[0])
+	if id <= 0 || id > len(s.files) {
+		http.NotFound(w, r)
+		return
+	}
+	f := s.files[id-1]
+	w.Header().Set("Content-Type", f.ContentType)
+	w.Write(f.content)
+}
+
+// searchUsers returns the users whose login, name or mail contains name.
+func (s *Server) searchUsers(name string) interface{} {
+	users := []User{}
+	q := strings.ToLower(name)
+	for _, u := range append([]User{s.Me}, s.users...) {
+		for _, v := range []string{u.Login, u.Firstname, u.Lastname, u.Mail} {
+			if strings.Contains(strings.ToLower(v), q) {
+				users = append(users, u)
+				break
+			}
+		}
+	}
+	return map[string]interface{}{"users": users, "total_count": len(users), "offset": 0, "limit": 25}
+}
@@ -51,11 +51,26 @@ func (c Client) UpdateIssueState(context.Context, it.IssueID, it.State) error {
 	return it.ErrNotImplemented
 }
 
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+func (c Client) UpdateIssue(context.Context, it.IssueID, it.IssueUpdate) error {
+	return it.ErrNotImplemented
+}
+
 // SetSecondaryID updates the secondary ID to the issue.
 func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
 	return it.ErrNotImplemented
 }
 
+// ListStates lists the states an issue can be in.
+func (c Client) ListStates(context.Context) ([]it.State, error) {
+	return nil, it.ErrNotImplemented
+}
+
+// FindUser returns the user with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	return it.User{}, it.ErrNotImplemented
+}
+
 // AddComment adds a comment to the issue.
 func (c Client) AddComment(context.Context, it.IssueID, it.Comment) (it.CommentID, error) {
 	return it.CommentID(""), it.ErrNotImplemented
@@ -0,0 +1,100 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package it
+
+import (
+	"sort"
+	"strings"
+)
+
+// IssueUpdate is a partial update of an issue: only the Fields are changed.
+type IssueUpdate struct {
+	Issue
+	Fields FieldMask
+}
+
+// FieldMask selects the updatable fields of an issue.
+type FieldMask uint32
+
+const (
+	FieldSummary = FieldMask(1 << iota)
+	FieldDescription
+	FieldPriority
+	FieldAssignee
+	FieldLabels
+	FieldState
+
+	FieldAll = FieldSummary | FieldDescription | FieldPriority | FieldAssignee | FieldLabels | FieldState
+)
+
+var fieldNames = []string{"summary", "description", "priority", "assignee", "labels", "state"}
+
+// Has reports whether all the fields of f are in m.
+func (m FieldMask) Has(f FieldMask) bool { return m&f == f }
+
+func (m FieldMask) String() string {
+	names := make([]string, 0, len(fieldNames))
+	for i, nm := range fieldNames {
+		if m.Has(FieldMask(1 << i)) {
+			names = append(names, nm)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// Diff returns the fields that differ between a and b.
+//
+// Descriptions are compared without the attribution prefix, labels as sets,
+// assignees by ID.
+func Diff(a, b Issue) FieldMask {
+	var m FieldMask
+	if a.Summary != b.Summary {
+		m |= FieldSummary
+	}
+	if StripAttribution(a.Description) != StripAttribution(b.Description) {
+		m |= FieldDescription
+	}
+	if a.Priority != b.Priority {
+		m |= FieldPriority
+	}
+	if a.Assignee.ID != b.Assignee.ID {
+		m |= FieldAssignee
+	}
+	if !sameSet(a.Labels, b.Labels) {
+		m |= FieldLabels
+	}
+	if a.State != b.State {
+		m |= FieldState
+	}
+	return m
+}
+
+// StripAttribution removes the "Originally by X on DATE" prefix added by Attribute.
+func StripAttribution(text string) string {
+	if !strings.HasPrefix(text, "Originally by ") {
+		return text
+	}
+	if i := strings.Index(text, "\n\n"); i >= 0 {
+		return text[i+2:]
+	}
+	return text
+}
+
+func sameSet(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append(make([]string, 0, len(a)), a...)
+	b = append(make([]string, 0, len(b)), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
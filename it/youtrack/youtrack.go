@@ -0,0 +1,715 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package youtrack is the YouTrack tracker, using its REST API.
+package youtrack
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+var _ = it.Tracker(Client{})
+
+func init() {
+	it.Register("youtrack", func(baseURL string) (it.Tracker, error) { return New(baseURL) })
+}
+
+// https://www.jetbrains.com/help/youtrack/devportal/youtrack-rest-api.html
+type Client struct {
+	id string
+	// URL is the base URL of the REST API.
+	URL        *url.URL
+	token      string
+	HTTPClient *http.Client
+	// project is the short name of the project.
+	project string
+	// stateField is the name of the custom field holding the state.
+	stateField string
+	// secondaryField is the name of the custom field holding the secondary ID.
+	secondaryField string
+}
+
+// PageSize is the number of issues requested in one page.
+const PageSize = 100
+
+// DefaultStateField is the name of the custom field holding the state.
+const DefaultStateField = "State"
+
+// New returns a new YouTrack client.
+//
+// The permanent token is taken from the "token" query parameter, or the YOUTRACK_TOKEN
+// environment variable. The issues are created in (and listed from) the project
+// with the "project" short name, the state is the "state_field" custom field (default "State"),
+// the secondary ID is stored in the custom field named by "secondary_field".
+func New(baseURL string) (Client, error) {
+	URL, err := url.Parse(baseURL)
+	if err != nil {
+		return Client{}, err
+	}
+	q := URL.Query()
+	URL.RawQuery = ""
+	baseURL = URL.String()
+	token := q.Get("token")
+	if token == "" {
+		token = os.Getenv("YOUTRACK_TOKEN")
+	}
+	URL.Path = strings.TrimSuffix(URL.Path, "/") + "/api/"
+	return Client{
+		id: baseURL, URL: URL, token: token, HTTPClient: http.DefaultClient,
+		project:        q.Get("project"),
+		stateField:     firstNonEmpty(q.Get("state_field"), DefaultStateField),
+		secondaryField: q.Get("secondary_field"),
+	}, nil
+}
+
+func (c Client) ID() it.TrackerID {
+	return it.TrackerID(c.id)
+}
+
+const (
+	userFields  = "login,fullName,email"
+	issueFields = "id,idReadable,summary,description,created,updated," +
+		"project(id,shortName),reporter(" + userFields + "),tags(name)," +
+		"customFields($type,name,value($type,name,login,fullName,email,text,presentation))"
+)
+
+func issuePath(ID it.IssueID) string {
+	return "issues/" + url.PathEscape(string(ID))
+}
+
+// GetIssue returns the data for the issueID (the readable ID, like "PRJ-12").
+func (c Client) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	yi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return it.Issue{}, err
+	}
+	return c.readIssue(yi), nil
+}
+
+func (c Client) getIssue(ctx context.Context, ID it.IssueID) (apiIssue, error) {
+	var yi apiIssue
+	err := c.do(ctx, "GET", issuePath(ID)+"?fields="+url.QueryEscape(issueFields), nil, &yi)
+	return yi, err
+}
+
+// ListIssues lists all the issues (of the project, if set) created/changed since "since",
+// with the "updated: {since} .. Today" query.
+func (c Client) ListIssues(ctx context.Context, since time.Time) ([]it.Issue, error) {
+	var query []string
+	if c.project != "" {
+		query = append(query, "project: {"+c.project+"}")
+	}
+	if !since.IsZero() {
+		query = append(query, "updated: "+since.UTC().Format("2006-01-02T15:04:05")+" .. Today")
+	}
+	query = append(query, "sort by: updated asc")
+	q := url.Values{"query": {strings.Join(query, " ")}, "fields": {issueFields}, "$top": {strconv.Itoa(PageSize)}}
+	var issues []it.Issue
+	for skip := 0; ; skip += PageSize {
+		q.Set("$skip", strconv.Itoa(skip))
+		var page []apiIssue
+		if err := c.do(ctx, "GET", "issues?"+q.Encode(), nil, &page); err != nil {
+			return issues, err
+		}
+		for _, yi := range page {
+			issues = append(issues, c.readIssue(yi))
+		}
+		if len(page) < PageSize {
+			return issues, nil
+		}
+	}
+}
+
+// CreateIssue creates the issue in the project, returning the ID.
+//
+// The reporter cannot be set, so it is written into the description.
+// The state, priority and assignee are set after the creation,
+// when the types of the custom fields are known.
+func (c Client) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	var missing []string
+	if c.project == "" {
+		missing = append(missing, "project")
+	}
+	if issue.Summary == "" {
+		missing = append(missing, "summary")
+	}
+	if len(missing) != 0 {
+		return "", &it.ValidationError{Tracker: c.ID(), Missing: missing}
+	}
+	projectID, err := c.projectID(ctx)
+	if err != nil {
+		return "", err
+	}
+	author := issue.Reporter
+	if author == (it.User{}) {
+		author = issue.Author
+	}
+	description := issue.Description
+	if author != (it.User{}) {
+		description = it.Attribute(author, issue.CreatedAt, description)
+	}
+	var yi apiIssue
+	if err = c.do(ctx, "POST", "issues?fields=idReadable", map[string]interface{}{
+		"project":     map[string]string{"id": projectID},
+		"summary":     issue.Summary,
+		"description": description,
+	}, &yi); err != nil {
+		return "", err
+	}
+	ID := it.IssueID(yi.IDReadable)
+	upd := it.IssueUpdate{Issue: issue}
+	if issue.State != "" {
+		upd.Fields |= it.FieldState
+	}
+	if issue.Priority != "" {
+		upd.Fields |= it.FieldPriority
+	}
+	if issue.Assignee.ID != "" {
+		upd.Fields |= it.FieldAssignee
+	}
+	if len(issue.Labels) != 0 {
+		upd.Fields |= it.FieldLabels
+	}
+	if upd.Fields != 0 {
+		if err = c.UpdateIssue(ctx, ID, upd); err != nil {
+			return ID, err
+		}
+	}
+	return ID, nil
+}
+
+func (c Client) projectID(ctx context.Context) (string, error) {
+	var projects []struct {
+		ID        string `json:"id"`
+		ShortName string `json:"shortName"`
+	}
+	if err := c.do(ctx, "GET", "admin/projects?"+url.Values{
+		"fields": {"id,shortName"}, "query": {c.project},
+	}.Encode(), nil, &projects); err != nil {
+		return "", err
+	}
+	for _, p := range projects {
+		if strings.EqualFold(p.ShortName, c.project) {
+			return p.ID, nil
+		}
+	}
+	return "", fmt.Errorf("project %q: %w", c.project, it.ErrNotFound)
+}
+
+// UpdateIssueState updates the issue's state custom field.
+func (c Client) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	return c.UpdateIssue(ctx, ID, it.IssueUpdate{Issue: it.Issue{State: state}, Fields: it.FieldState})
+}
+
+// UpdateIssue updates the fields of the issue selected by the update's mask.
+//
+// The state, priority and assignee are the State (configurable), Priority and Assignee custom fields.
+// An assignee without ID (not a mapped YouTrack user) is left as is.
+// The labels are the tags, set by commands.
+func (c Client) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	yi, err := c.getIssue(ctx, ID)
+	if err != nil {
+		return err
+	}
+	req := make(map[string]interface{})
+	if upd.Fields.Has(it.FieldSummary) {
+		req["summary"] = upd.Summary
+	}
+	if upd.Fields.Has(it.FieldDescription) {
+		req["description"] = upd.Description
+	}
+	var fields []customField
+	setField := func(name string, value interface{}) error {
+		cf, ok := yi.field(name)
+		if !ok {
+			return fmt.Errorf("%q has no custom field %q: %w", ID, name, it.ErrNotFound)
+		}
+		b, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		fields = append(fields, customField{Type: cf.Type, Name: name, Value: b})
+		return nil
+	}
+	if upd.Fields.Has(it.FieldState) && upd.State != "" {
+		if err = setField(c.stateField, map[string]string{"name": string(upd.State)}); err != nil {
+			return err
+		}
+	}
+	if upd.Fields.Has(it.FieldPriority) && upd.Priority != "" {
+		if err = setField("Priority", map[string]string{"name": upd.Priority}); err != nil {
+			return err
+		}
+	}
+	if upd.Fields.Has(it.FieldAssignee) {
+		if upd.Assignee.ID != "" {
+			err = setField("Assignee", map[string]string{"login": string(upd.Assignee.ID)})
+		} else if upd.Assignee == (it.User{}) {
+			err = setField("Assignee", nil)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if len(fields) != 0 {
+		req["customFields"] = fields
+	}
+	if len(req) != 0 {
+		if err = c.do(ctx, "POST", issuePath(ID)+"?fields=id", req, nil); err != nil {
+			return fmt.Errorf("update %q: %w", ID, err)
+		}
+	}
+	if upd.Fields.Has(it.FieldLabels) {
+		return c.setTags(ctx, yi, upd.Labels)
+	}
+	return nil
+}
+
+func (c Client) setTags(ctx context.Context, yi apiIssue, labels []string) error {
+	want := make(map[string]bool, len(labels))
+	for _, l := range labels {
+		want[l] = true
+	}
+	var commands []string
+	for _, t := range yi.Tags {
+		if want[t.Name] {
+			delete(want, t.Name)
+			continue
+		}
+		commands = append(commands, "untag {"+t.Name+"}")
+	}
+	for _, l := range labels {
+		if want[l] {
+			commands = append(commands, "tag {"+l+"}")
+		}
+	}
+	for _, cmd := range commands {
+		if err := c.do(ctx, "POST", "commands", map[string]interface{}{
+			"query":  cmd,
+			"issues": []map[string]string{{"idReadable": yi.IDReadable}},
+		}, nil); err != nil {
+			return fmt.Errorf("%s on %q: %w", cmd, yi.IDReadable, err)
+		}
+	}
+	return nil
+}
+
+// SetSecondaryID updates the secondary ID to the issue.
+//
+// Returns ErrNotImplemented if no secondary_field is configured.
+func (c Client) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	if c.secondaryField == "" {
+		return it.ErrNotImplemented
+	}
+	yi, err := c.getIssue(ctx, primary)
+	if err != nil {
+		return err
+	}
+	cf, ok := yi.field(c.secondaryField)
+	if !ok {
+		return fmt.Errorf("%q has no custom field %q: %w", primary, c.secondaryField, it.ErrNotFound)
+	}
+	var value interface{} = string(secondary)
+	if cf.Type == "TextIssueCustomField" {
+		value = map[string]string{"text": string(secondary)}
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	if err = c.do(ctx, "POST", issuePath(primary)+"?fields=id", map[string][]customField{
+		"customFields": {{Type: cf.Type, Name: c.secondaryField, Value: b}},
+	}, nil); err != nil {
+		return fmt.Errorf("set %s of %q: %w", c.secondaryField, primary, err)
+	}
+	return nil
+}
+
+// ListStates lists the values of the state field in the project.
+//
+// Returns ErrNotImplemented if no project is configured.
+func (c Client) ListStates(ctx context.Context) ([]it.State, error) {
+	if c.project == "" {
+		return nil, it.ErrNotImplemented
+	}
+	projectID, err := c.projectID(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var fields []struct {
+		Field struct {
+			Name string `json:"name"`
+		} `json:"field"`
+		Bundle *struct {
+			Values []struct {
+				Name string `json:"name"`
+			} `json:"values"`
+		} `json:"bundle"`
+	}
+	if err = c.do(ctx, "GET", "admin/projects/"+url.PathEscape(projectID)+"/customFields?"+url.Values{
+		"fields": {"field(name),bundle(values(name))"}, "$top": {"-1"},
+	}.Encode(), nil, &fields); err != nil {
+		return nil, err
+	}
+	for _, f := range fields {
+		if f.Field.Name != c.stateField || f.Bundle == nil {
+			continue
+		}
+		states := make([]it.State, len(f.Bundle.Values))
+		for i, v := range f.Bundle.Values {
+			states[i] = it.State(v.Name)
+		}
+		return states, nil
+	}
+	return nil, fmt.Errorf("%s: field %q: %w", c.project, c.stateField, it.ErrNotFound)
+}
+
+// FindUser returns the user with the given email address.
+func (c Client) FindUser(ctx context.Context, email string) (it.User, error) {
+	var users []user
+	if err := c.do(ctx, "GET", "users?"+url.Values{"query": {email}, "fields": {userFields}}.Encode(), nil, &users); err != nil {
+		return it.User{}, err
+	}
+	for _, u := range users {
+		if strings.EqualFold(u.Email, email) {
+			return readUser(&u), nil
+		}
+	}
+	return it.User{}, fmt.Errorf("%q: %w", email, it.ErrNotFound)
+}
+
+// AddComment adds a comment to the issue.
+//
+// The author cannot be set, so it is written into the body.
+func (c Client) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	var yc struct {
+		ID string `json:"id"`
+	}
+	if err := c.do(ctx, "POST", issuePath(ID)+"/comments?fields=id", map[string]string{"text": comment.AttributedBody()}, &yc); err != nil {
+		return "", err
+	}
+	return it.CommentID(yc.ID), nil
+}
+
+// ListComments list the comments of the issue.
+func (c Client) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	var ycs []struct {
+		ID      string `json:"id"`
+		Text    string `json:"text"`
+		Created millis `json:"created"`
+		Author  *user  `json:"author"`
+	}
+	if err := c.do(ctx, "GET", issuePath(ID)+"/comments?"+url.Values{
+		"fields": {"id,text,created,author(" + userFields + ")"}, "$top": {"-1"},
+	}.Encode(), nil, &ycs); err != nil {
+		return nil, err
+	}
+	comments := make([]it.Comment, len(ycs))
+	for i, yc := range ycs {
+		comments[i] = it.Comment{
+			ID:        it.CommentID(yc.ID),
+			Author:    readUser(yc.Author),
+			CreatedAt: yc.Created.Time(),
+			Body:      yc.Text,
+		}
+	}
+	return comments, nil
+}
+
+// AddAttachment uploads the file to the issue.
+func (c Client) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	r, err := a.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	w, err := mw.CreateFormFile("file", a.Name)
+	if err != nil {
+		return "", err
+	}
+	if _, err = io.Copy(w, r); err != nil {
+		return "", err
+	}
+	if err = mw.Close(); err != nil {
+		return "", err
+	}
+	req, err := c.newRequest(ctx, "POST", issuePath(ID)+"/attachments?fields=id,name", &buf)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	var added []struct {
+		ID string `json:"id"`
+	}
+	if err = c.send(req, &added); err != nil {
+		return "", fmt.Errorf("upload %q: %w", a.Name, err)
+	}
+	if len(added) == 0 {
+		return "", fmt.Errorf("uploaded %q to %q, but got no ID: %w", a.Name, ID, it.ErrNotFound)
+	}
+	return it.AttachmentID(added[0].ID), nil
+}
+
+// ListAttachments lists the attachments of the issue.
+func (c Client) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	var yas []struct {
+		ID       string `json:"id"`
+		Name     string `json:"name"`
+		MimeType string `json:"mimeType"`
+		Created  millis `json:"created"`
+		Author   *user  `json:"author"`
+		URL      string `json:"url"`
+	}
+	if err := c.do(ctx, "GET", issuePath(ID)+"/attachments?"+url.Values{
+		"fields": {"id,name,mimeType,created,url,author(" + userFields + ")"}, "$top": {"-1"},
+	}.Encode(), nil, &yas); err != nil {
+		return nil, err
+	}
+	as := make([]it.Attachment, len(yas))
+	for i, ya := range yas {
+		// The url is relative to the server, with a signature, not to the API.
+		URL, err := c.URL.Parse(ya.URL)
+		if err != nil {
+			return nil, err
+		}
+		dl := URL.String()
+		as[i] = it.Attachment{
+			ID:        it.AttachmentID(ya.ID),
+			Name:      ya.Name,
+			MIMEType:  ya.MimeType,
+			Author:    readUser(ya.Author),
+			CreatedAt: ya.Created.Time(),
+			URL:       dl,
+			GetBody: func() (io.ReadCloser, error) {
+				req, err := c.newRequest(ctx, "GET", dl, nil)
+				if err != nil {
+					return nil, err
+				}
+				resp, err := c.HTTPClient.Do(req)
+				if err != nil {
+					return nil, err
+				}
+				if resp.StatusCode >= 300 {
+					resp.Body.Close()
+					return nil, fmt.Errorf("GET %s: %s", dl, resp.Status)
+				}
+				return resp.Body, nil
+			},
+		}
+	}
+	return as, nil
+}
+
+func (c Client) readIssue(yi apiIssue) it.Issue {
+	issue := it.Issue{
+		ID:          it.IssueID(yi.IDReadable),
+		Summary:     yi.Summary,
+		Description: yi.Description,
+		Author:      readUser(yi.Reporter),
+		Reporter:    readUser(yi.Reporter),
+		CreatedAt:   yi.Created.Time(),
+		UpdatedAt:   yi.Updated.Time(),
+	}
+	if yi.Project != nil {
+		issue.Project = yi.Project.ShortName
+	}
+	for _, t := range yi.Tags {
+		issue.Labels = append(issue.Labels, t.Name)
+	}
+	for _, cf := range yi.CustomFields {
+		switch cf.Name {
+		case c.stateField:
+			issue.State = it.State(cf.text())
+		case "Priority":
+			issue.Priority = cf.text()
+		case "Severity":
+			issue.Severity = cf.text()
+		case "Assignee":
+			var u user
+			if json.Unmarshal(cf.Value, &u) == nil {
+				issue.Assignee = readUser(&u)
+			}
+			continue
+		}
+		v := cf.text()
+		if v == "" {
+			continue
+		}
+		if c.secondaryField != "" && cf.Name == c.secondaryField {
+			issue.SecondaryID = it.IssueID(v)
+		}
+		if issue.Custom == nil {
+			issue.Custom = make(map[string]string, len(yi.CustomFields))
+		}
+		issue.Custom[cf.Name] = v
+	}
+	return issue
+}
+
+// do calls the API, encoding body and decoding the response into result, if not nil.
+func (c Client) do(ctx context.Context, method, path string, body, result interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.newRequest(ctx, method, path, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return c.send(req, result)
+}
+
+func (c Client) newRequest(ctx context.Context, method, path string, body io.Reader) (*http.Request, error) {
+	URL, err := c.URL.Parse(path)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(method, URL.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+func (c Client) send(req *http.Request, result interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		err = fmt.Errorf("%s %s: %s: %s", req.Method, req.URL.Path, resp.Status, b)
+		if resp.StatusCode == http.StatusNotFound {
+			err = fmt.Errorf("%w: %v", it.ErrNotFound, err)
+		}
+		return err
+	}
+	if result == nil {
+		return nil
+	}
+	if err = json.NewDecoder(resp.Body).Decode(result); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("%s %s: decode: %w", req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// millis is a timestamp in milliseconds since the epoch.
+type millis int64
+
+func (ms millis) Time() time.Time {
+	if ms == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(ms)*int64(time.Millisecond))
+}
+
+type user struct {
+	Login    string `json:"login"`
+	FullName string `json:"fullName"`
+	Email    string `json:"email"`
+}
+
+// readUser returns the it.User, identified by the login name.
+func readUser(u *user) it.User {
+	if u == nil || u.Login == "" {
+		return it.User{}
+	}
+	return it.User{ID: it.UserID(u.Login), RealName: u.FullName, Email: u.Email}
+}
+
+type customField struct {
+	Type  string          `json:"$type"`
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+}
+
+// text returns the string representation of the value:
+// strings as is, objects by their name, text or presentation.
+func (cf customField) text() string {
+	if len(cf.Value) == 0 || string(cf.Value) == "null" {
+		return ""
+	}
+	var s string
+	if json.Unmarshal(cf.Value, &s) == nil {
+		return s
+	}
+	var v struct {
+		Name         string `json:"name"`
+		Text         string `json:"text"`
+		Presentation string `json:"presentation"`
+		FullName     string `json:"fullName"`
+	}
+	if json.Unmarshal(cf.Value, &v) == nil {
+		return firstNonEmpty(v.Name, v.Text, v.Presentation, v.FullName)
+	}
+	return strings.Trim(string(cf.Value), `"`)
+}
+
+// apiIssue is an issue as returned by the API.
+type apiIssue struct {
+	ID          string `json:"id"`
+	IDReadable  string `json:"idReadable"`
+	Summary     string `json:"summary"`
+	Description string `json:"description"`
+	Created     millis `json:"created"`
+	Updated     millis `json:"updated"`
+	Project     *struct {
+		ID        string `json:"id"`
+		ShortName string `json:"shortName"`
+	} `json:"project"`
+	Reporter *user `json:"reporter"`
+	Tags     []struct {
+		Name string `json:"name"`
+	} `json:"tags"`
+	CustomFields []customField `json:"customFields"`
+}
+
+func (yi apiIssue) field(name string) (customField, bool) {
+	for _, cf := range yi.CustomFields {
+		if cf.Name == name {
+			return cf, true
+		}
+	}
+	return customField{}, false
+}
+
+func firstNonEmpty(ss ...string) string {
+	for _, s := range ss {
+		if s != "" {
+			return s
+		}
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package youtrack
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/ittest"
+	"github.com/UNO-SOFT/mantisync/it/youtrack/youtracktest"
+)
+
+const testParams = "?token=secret&project=TST&secondary_field=Secondary"
+
+func newTestClient(t *testing.T) (Client, *youtracktest.Server) {
+	t.Helper()
+	srv := youtracktest.NewServer("TST", "secret")
+	srv.Fields = append(srv.Fields, youtracktest.Field{Name: "Secondary", Type: "SimpleIssueCustomField"})
+	t.Cleanup(srv.Close)
+	c, err := New(srv.URL + testParams)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, srv
+}
+
+func TestConformance(t *testing.T) {
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, srv := newTestClient(t)
+		srv.AddUser(youtracktest.User{Login: "jdoe", FullName: "John Doe", Email: "jdoe@example.com"})
+		srv.AddUser(youtracktest.User{Login: "jdoe2", FullName: "Jane Doe", Email: "jdoe@example.com.au"})
+		return c
+	}, ittest.WithPageSize(PageSize),
+		ittest.WithUser(it.User{ID: "jdoe", Email: "jdoe@example.com"}))
+}
+
+// TestRecordedConformance replays the conformance tests from testdata/conformance.json, recorded with
+//
+//	YOUTRACK_TEST_URL='https://youtrack.example.com/?token=...&project=TST&secondary_field=Secondary' \
+//		go test -run RecordedConformance -record
+func TestRecordedConformance(t *testing.T) {
+	cas := ittest.NewCassette(t, "conformance")
+	URL := cas.EnvURL("YOUTRACK_TEST_URL")
+	ittest.RunConformance(t, func(t *testing.T) it.Tracker {
+		c, err := New(URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.HTTPClient = cas.Client()
+		return c
+	})
+}
+
+func TestUpdateIssue(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	srv.AddUser(youtracktest.User{Login: "jdoe", FullName: "John Doe", Email: "jdoe@example.com"})
+	ID, err := c.CreateIssue(ctx, it.Issue{
+		Summary: "update", State: "Open", Priority: "Major",
+		Assignee: it.User{ID: "jdoe"}, Labels: []string{"ui", "bug"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(state it.State, priority string, assignee it.UserID, labels ...string) {
+		t.Helper()
+		issue, err := c.GetIssue(ctx, ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if issue.State != state || issue.Priority != priority || issue.Assignee.ID != assignee {
+			t.Errorf("got state %q, priority %q, assignee %+v; wanted %q, %q and %q",
+				issue.State, issue.Priority, issue.Assignee, state, priority, assignee)
+		}
+		sort.Strings(issue.Labels)
+		if !reflect.DeepEqual(issue.Labels, labels) {
+			t.Errorf("labels: got %q, wanted %q", issue.Labels, labels)
+		}
+	}
+	check("Open", "Major", "jdoe", "bug", "ui")
+
+	if err = c.UpdateIssue(ctx, ID, it.IssueUpdate{
+		Issue:  it.Issue{State: "Fixed", Labels: []string{"bug", "backend"}},
+		Fields: it.FieldState | it.FieldAssignee | it.FieldLabels,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	check("Fixed", "Major", "", "backend", "bug")
+
+	// The values must be in the bundle.
+	if err = c.UpdateIssueState(ctx, ID, "Nonexistent"); err == nil {
+		t.Error("updating to a nonexistent state succeeded")
+	}
+}
+
+func TestListStates(t *testing.T) {
+	ctx := context.Background()
+	c, srv := newTestClient(t)
+	for i, f := range srv.Fields {
+		if f.Name == DefaultStateField {
+			srv.Fields[i].Values = []string{"Submitted", "Open", "Fixed"}
+		}
+	}
+	states, err := c.ListStates(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []it.State{"Submitted", "Open", "Fixed"}; !reflect.DeepEqual(states, want) {
+		t.Errorf("got %q, wanted %q", states, want)
+	}
+}
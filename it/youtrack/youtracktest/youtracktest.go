@@ -0,0 +1,777 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+// Package youtracktest provides an in-process YouTrack REST API server, for testing.
+//
+// It implements the endpoints used by the youtrack package under api/, for one project:
+// issue search (with the project, updated and sort by query terms, paginated by $skip and $top),
+// get, create and update (with custom fields), the tag and untag commands,
+// comments, attachments (downloaded from a signed URL), the project's custom fields and users.
+//
+// Only the fields requested by the fields parameter are returned, as YouTrack does.
+// The Authorization header must hold the Bearer Token, if it is not empty.
+package youtracktest
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is a YouTrack server, backed by an in-memory store.
+type Server struct {
+	*httptest.Server
+	// Token is the accepted permanent token.
+	Token string
+	// Project is the short name of the served project.
+	Project string
+	// Fields are the custom fields of the project.
+	Fields []Field
+	// Me is the owner of the token, the reporter of the created issues and the author of the comments.
+	Me User
+
+	mu          sync.Mutex
+	users       []User
+	issues      []*issue
+	comments    int
+	attachments []*attachment
+}
+
+// Field is a custom field of the project.
+type Field struct {
+	Name string
+	// Type is the $type of the issue's field: StateIssueCustomField, SingleEnumIssueCustomField,
+	// SingleUserIssueCustomField, SimpleIssueCustomField or TextIssueCustomField.
+	Type string
+	// Values are the values of the state and enum fields, the first is the default.
+	Values []string
+	// Required fields cannot be emptied.
+	Required bool
+}
+
+// User is a YouTrack account.
+type User struct {
+	Login    string
+	FullName string
+	Email    string
+}
+
+type comment struct {
+	ID      string
+	Text    string
+	Author  string
+	Created int64
+}
+
+type attachment struct {
+	ID       string
+	Name     string
+	MimeType string
+	Author   string
+	Created  int64
+	data     []byte
+}
+
+type issue struct {
+	Number               int
+	Summary, Description string
+	Reporter             string
+	Created, Updated     int64
+	Tags                 []string
+	// Fields holds the value of the custom fields: the name of the state and enum values,
+	// the login of the users and the text of the text fields.
+	Fields      map[string]string
+	Comments    []*comment
+	Attachments []*attachment
+}
+
+// DefaultFields are the custom fields of a new project.
+var DefaultFields = []Field{
+	{Name: "Priority", Type: "SingleEnumIssueCustomField", Values: []string{"Normal", "Show-stopper", "Critical", "Major", "Minor"}, Required: true},
+	{Name: "Type", Type: "SingleEnumIssueCustomField", Values: []string{"Bug", "Cosmetics", "Exception", "Feature", "Task"}, Required: true},
+	{Name: "State", Type: "StateIssueCustomField", Values: []string{
+		"Submitted", "Open", "In Progress", "To be discussed", "Reopened",
+		"Can't Reproduce", "Duplicate", "Fixed", "Won't fix", "Incomplete", "Obsolete", "Verified",
+	}, Required: true},
+	{Name: "Assignee", Type: "SingleUserIssueCustomField"},
+}
+
+// projectID is the database ID of the project.
+const projectID = "0-1"
+
+// NewServer starts and returns a new server for the project (short name), accepting the token.
+// The caller should call Close when finished, to shut it down.
+func NewServer(project, token string) *Server {
+	s := &Server{
+		Token: token, Project: project,
+		Fields: append([]Field(nil), DefaultFields...),
+		Me:     User{Login: "admin", FullName: "Administrator", Email: "admin@example.com"},
+	}
+	s.Server = httptest.NewServer(s)
+	return s
+}
+
+// AddUser adds a user account.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// apiError is the error response of the API.
+type apiError struct {
+	Code        int    `json:"-"`
+	Error       string `json:"error"`
+	Description string `json:"error_description"`
+}
+
+func errorf(code int, format string, args ...interface{}) *apiError {
+	e := &apiError{Code: code, Error: "bad_request", Description: fmt.Sprintf(format, args...)}
+	if code == http.StatusNotFound {
+		e.Error = "Not Found"
+	}
+	return e
+}
+
+// now returns the current time in milliseconds, the precision of the API.
+func now() int64 { return time.Now().UnixNano() / int64(time.Millisecond) }
+
+// ServeHTTP routes the request to the endpoint's handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p := strings.Trim(r.URL.Path, "/")
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if strings.HasPrefix(p, "api/files/") {
+		// The signed URL needs no token.
+		s.download(w, r, strings.TrimPrefix(p, "api/files/"))
+		return
+	}
+	if s.Token != "" && r.Header.Get("Authorization") != "Bearer "+s.Token {
+		writeJSON(w, 0, &apiError{Code: http.StatusUnauthorized, Error: "Unauthorized", Description: "You are not logged in."})
+		return
+	}
+	if !strings.HasPrefix(p, "api/") {
+		http.NotFound(w, r)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(p, "api/"), "/")
+	fields := parseFields(r.URL.Query().Get("fields"))
+
+	var result interface{}
+	err := errorf(http.StatusNotFound, "Unknown resource: %s", r.URL.Path)
+	switch {
+	case r.Method == "GET" && p == "api/admin/projects":
+		result, err = s.listProjects(), nil
+	case r.Method == "GET" && p == "api/admin/projects/"+projectID+"/customFields":
+		result, err = s.projectFields(), nil
+	case r.Method == "GET" && p == "api/users":
+		result, err = s.listUsers(r.URL.Query().Get("query")), nil
+	case r.Method == "POST" && p == "api/commands":
+		result, err = s.command(r)
+	case r.Method == "GET" && p == "api/issues":
+		result, err = s.search(r)
+	case r.Method == "POST" && p == "api/issues":
+		result, err = s.create(r)
+	case len(parts) >= 2 && parts[0] == "issues":
+		is := s.issue(parts[1])
+		if is == nil {
+			err = errorf(http.StatusNotFound, "Entity with id %s not found", parts[1])
+			break
+		}
+		switch endpoint := strings.Join(parts[2:], "/"); {
+		case r.Method == "GET" && endpoint == "":
+			result, err = s.render(is), nil
+		case r.Method == "POST" && endpoint == "":
+			result, err = s.update(is, r)
+		case r.Method == "GET" && endpoint == "comments":
+			result, err = s.listComments(is), nil
+		case r.Method == "POST" && endpoint == "comments":
+			result, err = s.addComment(is, r)
+		case r.Method == "GET" && endpoint == "attachments":
+			result, err = s.listAttachments(is), nil
+		case r.Method == "POST" && endpoint == "attachments":
+			result, err = s.addAttachments(is, r)
+		}
+	}
+	if err != nil {
+		writeJSON(w, err.Code, err)
+		return
+	}
+	writeJSON(w, 0, fields.filter(result))
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	if code == 0 {
+		code = http.StatusOK
+	}
+	w.Header().Set("Content-Type", "application/json;charset=UTF-8")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+// fieldTree is the parsed fields parameter, the requested fields with their sub-fields.
+type fieldTree map[string]fieldTree
+
+// parseFields parses the fields parameter, like "id,reporter(login,email)".
+// The empty parameter requests the id only.
+func parseFields(s string) fieldTree {
+	if s == "" {
+		return fieldTree{"id": nil}
+	}
+	t, _ := parseFieldList(s)
+	return t
+}
+
+func parseFieldList(s string) (fieldTree, string) {
+	t := make(fieldTree)
+	for s != "" {
+		i := strings.IndexAny(s, ",()")
+		if i < 0 {
+			t[s] = nil
+			return t, ""
+		}
+		name := s[:i]
+		switch s[i] {
+		case '(':
+			t[name], s = parseFieldList(s[i+1:])
+			continue
+		case ')':
+			if name != "" {
+				t[name] = nil
+			}
+			return t, s[i+1:]
+		}
+		if name != "" {
+			t[name] = nil
+		}
+		s = s[i+1:]
+	}
+	return t, ""
+}
+
+// filter returns the requested fields of the value, and the $type of the entities.
+func (t fieldTree) filter(v interface{}) interface{} {
+	switch x := v.(type) {
+	case []interface{}:
+		out := make([]interface{}, len(x))
+		for i, e := range x {
+			out[i] = t.filter(e)
+		}
+		return out
+	case map[string]interface{}:
+		out := map[string]interface{}{"$type": x["$type"]}
+		for k, sub := range t {
+			if v, ok := x[k]; ok {
+				out[k] = sub.filter(v)
+			}
+		}
+		return out
+	}
+	return v
+}
+
+// issue returns the issue by its readable or database ID, or nil. s.mu must be held.
+func (s *Server) issue(ID string) *issue {
+	var n int
+	if i := strings.LastIndexByte(ID, '-'); i >= 0 {
+		if ID[:i] != "2" && !strings.EqualFold(ID[:i], s.Project) {
+			return nil
+		}
+		n, _ = strconv.Atoi(ID[i+1:])
+	}
+	if n <= 0 || n > len(s.issues) {
+		return nil
+	}
+	return s.issues[n-1]
+}
+
+func (s *Server) user(login string) *User {
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if u.Login == login {
+			return &u
+		}
+	}
+	return nil
+}
+
+func (s *Server) field(name string) *Field {
+	for _, f := range s.Fields {
+		if f.Name == name {
+			return &f
+		}
+	}
+	return nil
+}
+
+func renderUser(u *User) interface{} {
+	if u == nil {
+		return nil
+	}
+	return map[string]interface{}{
+		"$type": "User", "id": "1-" + u.Login,
+		"login": u.Login, "fullName": u.FullName, "email": u.Email,
+	}
+}
+
+func (s *Server) renderProject() map[string]interface{} {
+	return map[string]interface{}{"$type": "Project", "id": projectID, "shortName": s.Project, "name": s.Project}
+}
+
+// renderValue returns the value of the custom field.
+func (s *Server) renderValue(f Field, v string) interface{} {
+	if v == "" {
+		return nil
+	}
+	switch f.Type {
+	case "StateIssueCustomField":
+		return map[string]interface{}{"$type": "StateBundleElement", "name": v, "presentation": v}
+	case "SingleEnumIssueCustomField":
+		return map[string]interface{}{"$type": "EnumBundleElement", "name": v, "presentation": v}
+	case "SingleUserIssueCustomField":
+		return renderUser(s.user(v))
+	case "TextIssueCustomField":
+		return map[string]interface{}{"$type": "TextFieldValue", "text": v}
+	}
+	return v
+}
+
+func (s *Server) render(is *issue) map[string]interface{} {
+	fields := make([]interface{}, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		fields = append(fields, map[string]interface{}{
+			"$type": f.Type, "id": "92-" + f.Name, "name": f.Name,
+			"value": s.renderValue(f, is.Fields[f.Name]),
+		})
+	}
+	tags := make([]interface{}, len(is.Tags))
+	for i, t := range is.Tags {
+		tags[i] = map[string]interface{}{"$type": "Tag", "id": "6-" + t, "name": t}
+	}
+	return map[string]interface{}{
+		"$type":        "Issue",
+		"id":           "2-" + strconv.Itoa(is.Number),
+		"idReadable":   s.Project + "-" + strconv.Itoa(is.Number),
+		"summary":      is.Summary,
+		"description":  is.Description,
+		"created":      is.Created,
+		"updated":      is.Updated,
+		"project":      s.renderProject(),
+		"reporter":     renderUser(s.user(is.Reporter)),
+		"tags":         tags,
+		"customFields": fields,
+	}
+}
+
+func (s *Server) listProjects() interface{} {
+	return []interface{}{s.renderProject()}
+}
+
+func (s *Server) projectFields() interface{} {
+	fields := make([]interface{}, 0, len(s.Fields))
+	for _, f := range s.Fields {
+		pf := map[string]interface{}{
+			"$type": strings.Replace(strings.TrimPrefix(f.Type, "Single"), "IssueCustomField", "ProjectCustomField", 1),
+			"field": map[string]interface{}{"$type": "CustomField", "name": f.Name},
+		}
+		var bundle map[string]interface{}
+		switch f.Type {
+		case "StateIssueCustomField":
+			bundle = map[string]interface{}{"$type": "StateBundle"}
+		case "SingleEnumIssueCustomField":
+			bundle = map[string]interface{}{"$type": "EnumBundle"}
+		case "SingleUserIssueCustomField":
+			pf["bundle"] = map[string]interface{}{"$type": "UserBundle"}
+		}
+		if bundle != nil {
+			values := make([]interface{}, len(f.Values))
+			for i, v := range f.Values {
+				values[i] = s.renderValue(f, v)
+			}
+			bundle["values"] = values
+			pf["bundle"] = bundle
+		}
+		fields = append(fields, pf)
+	}
+	return fields
+}
+
+func (s *Server) listUsers(query string) interface{} {
+	q := strings.ToLower(query)
+	users := []interface{}{}
+	for _, u := range append([]User{s.Me}, s.users...) {
+		if strings.Contains(strings.ToLower(u.Login), q) ||
+			strings.Contains(strings.ToLower(u.FullName), q) ||
+			strings.Contains(strings.ToLower(u.Email), q) {
+			users = append(users, renderUser(&u))
+		}
+	}
+	return users
+}
+
+var (
+	rProject = regexp.MustCompile(`project: *(?:\{([^}]*)\}|(\S+))`)
+	rUpdated = regexp.MustCompile(`updated: *(\S+) *\.\. *(\S+)`)
+	rSortBy  = regexp.MustCompile(`sort by: *updated *(asc|desc)?`)
+)
+
+// parseTime parses the time of a query range, "Today" is the end of the day.
+func parseTime(s string, end bool) (int64, error) {
+	if s == "Today" {
+		t := time.Now().UTC().Truncate(24 * time.Hour)
+		if end {
+			t = t.Add(24 * time.Hour)
+		}
+		return t.UnixNano() / int64(time.Millisecond), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02"} {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UnixNano() / int64(time.Millisecond), nil
+		}
+	}
+	return 0, fmt.Errorf("cannot parse %q as a date", s)
+}
+
+// search returns the issues matching the query, which may have only the project,
+// updated and sort by terms.
+func (s *Server) search(r *http.Request) (interface{}, *apiError) {
+	q := r.URL.Query()
+	query := q.Get("query")
+	project := s.Project
+	if m := rProject.FindStringSubmatch(query); m != nil {
+		project = m[1] + m[2]
+		query = strings.Replace(query, m[0], "", 1)
+	}
+	from, to := int64(0), int64(1<<62)
+	if m := rUpdated.FindStringSubmatch(query); m != nil {
+		var err error
+		if from, err = parseTime(m[1], false); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+		if to, err = parseTime(m[2], true); err != nil {
+			return nil, errorf(http.StatusBadRequest, "%v", err)
+		}
+		query = strings.Replace(query, m[0], "", 1)
+	}
+	var desc bool
+	if m := rSortBy.FindStringSubmatch(query); m != nil {
+		desc = m[1] == "desc"
+		query = strings.Replace(query, m[0], "", 1)
+	}
+	if strings.TrimSpace(query) != "" {
+		return nil, errorf(http.StatusBadRequest, "unsupported query: %q", query)
+	}
+	issues := []*issue{}
+	if strings.EqualFold(project, s.Project) {
+		for _, is := range s.issues {
+			if from <= is.Updated && is.Updated < to {
+				issues = append(issues, is)
+			}
+		}
+	}
+	sort.SliceStable(issues, func(i, j int) bool { return (issues[i].Updated < issues[j].Updated) != desc })
+
+	skip, _ := strconv.Atoi(q.Get("$skip"))
+	top := 42
+	if v := q.Get("$top"); v != "" {
+		top, _ = strconv.Atoi(v)
+	}
+	if skip > len(issues) {
+		skip = len(issues)
+	}
+	end := len(issues)
+	if top >= 0 && skip+top < end {
+		end = skip + top
+	}
+	result := make([]interface{}, 0, end-skip)
+	for _, is := range issues[skip:end] {
+		result = append(result, s.render(is))
+	}
+	return result, nil
+}
+
+func (s *Server) create(r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Project *struct {
+			ID string `json:"id"`
+		} `json:"project"`
+		Summary     string `json:"summary"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	switch {
+	case req.Project == nil || req.Project.ID != projectID:
+		return nil, errorf(http.StatusBadRequest, "Project is required")
+	case req.Summary == "":
+		return nil, errorf(http.StatusBadRequest, "Summary is required")
+	}
+	t := now()
+	is := &issue{
+		Number: len(s.issues) + 1, Summary: req.Summary, Description: req.Description,
+		Reporter: s.Me.Login, Created: t, Updated: t,
+		Fields: make(map[string]string, len(s.Fields)),
+	}
+	for _, f := range s.Fields {
+		if len(f.Values) != 0 {
+			is.Fields[f.Name] = f.Values[0]
+		}
+	}
+	s.issues = append(s.issues, is)
+	return s.render(is), nil
+}
+
+// setField sets the value of the custom field, checking its $type and value.
+func (s *Server) setField(is *issue, typ, name string, value json.RawMessage) *apiError {
+	f := s.field(name)
+	if f == nil {
+		return errorf(http.StatusBadRequest, "Unknown custom field %q", name)
+	}
+	if typ != f.Type {
+		return errorf(http.StatusBadRequest, "Incompatible field type: %s for %q of %s", typ, name, f.Type)
+	}
+	if len(value) == 0 || string(value) == "null" {
+		if f.Required {
+			return errorf(http.StatusBadRequest, "%s is required", name)
+		}
+		delete(is.Fields, name)
+		return nil
+	}
+	var v struct {
+		Name  string `json:"name"`
+		Login string `json:"login"`
+		Text  string `json:"text"`
+	}
+	var text string
+	var err error
+	switch f.Type {
+	case "SimpleIssueCustomField":
+		err = json.Unmarshal(value, &text)
+	default:
+		if err = json.Unmarshal(value, &v); err != nil {
+			break
+		}
+		switch f.Type {
+		case "StateIssueCustomField", "SingleEnumIssueCustomField":
+			text = v.Name
+			var ok bool
+			for _, x := range f.Values {
+				ok = ok || x == text
+			}
+			if !ok {
+				return errorf(http.StatusBadRequest, "No %s value named %q", name, text)
+			}
+		case "SingleUserIssueCustomField":
+			if text = v.Login; s.user(text) == nil {
+				return errorf(http.StatusBadRequest, "No user with login %q", text)
+			}
+		case "TextIssueCustomField":
+			text = v.Text
+		}
+	}
+	if err != nil {
+		return errorf(http.StatusBadRequest, "%s: %v", name, err)
+	}
+	is.Fields[name] = text
+	return nil
+}
+
+func (s *Server) update(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Summary      *string `json:"summary"`
+		Description  *string `json:"description"`
+		CustomFields []struct {
+			Type  string          `json:"$type"`
+			Name  string          `json:"name"`
+			Value json.RawMessage `json:"value"`
+		} `json:"customFields"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	upd := *is
+	upd.Fields = make(map[string]string, len(is.Fields))
+	for k, v := range is.Fields {
+		upd.Fields[k] = v
+	}
+	if req.Summary != nil {
+		if *req.Summary == "" {
+			return nil, errorf(http.StatusBadRequest, "Summary is required")
+		}
+		upd.Summary = *req.Summary
+	}
+	if req.Description != nil {
+		upd.Description = *req.Description
+	}
+	for _, cf := range req.CustomFields {
+		if err := s.setField(&upd, cf.Type, cf.Name, cf.Value); err != nil {
+			return nil, err
+		}
+	}
+	upd.Updated = now()
+	*is = upd
+	return s.render(is), nil
+}
+
+var rTag = regexp.MustCompile(`^(un)?tag +(?:\{([^}]*)\}|(\S+))$`)
+
+// command executes the tag and untag commands.
+func (s *Server) command(r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Query  string `json:"query"`
+		Issues []struct {
+			ID         string `json:"id"`
+			IDReadable string `json:"idReadable"`
+		} `json:"issues"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	m := rTag.FindStringSubmatch(strings.TrimSpace(req.Query))
+	if m == nil {
+		return nil, errorf(http.StatusBadRequest, "Unknown command: %s", req.Query)
+	}
+	untag, tag := m[1] != "", m[2]+m[3]
+	if len(req.Issues) == 0 {
+		return nil, errorf(http.StatusBadRequest, "No issues to apply the command to")
+	}
+	for _, x := range req.Issues {
+		is := s.issue(x.IDReadable + x.ID)
+		if is == nil {
+			return nil, errorf(http.StatusNotFound, "Entity with id %s not found", x.IDReadable+x.ID)
+		}
+		tags := is.Tags[:0:0]
+		for _, t := range is.Tags {
+			if t != tag {
+				tags = append(tags, t)
+			}
+		}
+		if !untag {
+			tags = append(tags, tag)
+		}
+		is.Tags = tags
+		is.Updated = now()
+	}
+	return map[string]interface{}{"$type": "CommandList", "query": req.Query}, nil
+}
+
+func (s *Server) renderComment(c *comment) map[string]interface{} {
+	return map[string]interface{}{
+		"$type": "IssueComment", "id": c.ID, "text": c.Text, "created": c.Created,
+		"author": renderUser(s.user(c.Author)),
+	}
+}
+
+func (s *Server) listComments(is *issue) interface{} {
+	comments := make([]interface{}, len(is.Comments))
+	for i, c := range is.Comments {
+		comments[i] = s.renderComment(c)
+	}
+	return comments
+}
+
+func (s *Server) addComment(is *issue, r *http.Request) (interface{}, *apiError) {
+	var req struct {
+		Text string `json:"text"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	if req.Text == "" {
+		return nil, errorf(http.StatusBadRequest, "Comment text is required")
+	}
+	s.comments++
+	c := &comment{ID: "4-" + strconv.Itoa(s.comments), Text: req.Text, Author: s.Me.Login, Created: now()}
+	is.Comments = append(is.Comments, c)
+	is.Updated = c.Created
+	return s.renderComment(c), nil
+}
+
+// sign returns the signature of the attachment's URL.
+func sign(a *attachment) string {
+	h := sha1.Sum([]byte(a.ID + "/" + a.Name))
+	return hex.EncodeToString(h[:])
+}
+
+func (s *Server) renderAttachment(a *attachment) map[string]interface{} {
+	return map[string]interface{}{
+		"$type": "IssueAttachment", "id": a.ID, "name": a.Name, "mimeType": a.MimeType,
+		"size": len(a.data), "created": a.Created, "author": renderUser(s.user(a.Author)),
+		// The URL is relative to the server, signed.
+		"url": "/api/files/" + a.ID + "?sign=" + sign(a) + "&updated=" + strconv.FormatInt(a.Created, 10),
+	}
+}
+
+func (s *Server) listAttachments(is *issue) interface{} {
+	attachments := make([]interface{}, len(is.Attachments))
+	for i, a := range is.Attachments {
+		attachments[i] = s.renderAttachment(a)
+	}
+	return attachments
+}
+
+// addAttachments adds all the files of the multipart form.
+func (s *Server) addAttachments(is *issue, r *http.Request) (interface{}, *apiError) {
+	if err := r.ParseMultipartForm(1 << 20); err != nil {
+		return nil, errorf(http.StatusBadRequest, "%v", err)
+	}
+	var added []interface{}
+	t := now()
+	for _, fhs := range r.MultipartForm.File {
+		for _, fh := range fhs {
+			f, err := fh.Open()
+			if err != nil {
+				return nil, errorf(http.StatusBadRequest, "%v", err)
+			}
+			data, err := ioutil.ReadAll(f)
+			f.Close()
+			if err != nil {
+				return nil, errorf(http.StatusBadRequest, "%v", err)
+			}
+			mimeType := fh.Header.Get("Content-Type")
+			if mimeType == "" || mimeType == "application/octet-stream" {
+				mimeType = http.DetectContentType(data)
+			}
+			a := &attachment{
+				ID: "8-" + strconv.Itoa(len(s.attachments)+1), Name: fh.Filename, MimeType: mimeType,
+				Author: s.Me.Login, Created: t, data: data,
+			}
+			s.attachments = append(s.attachments, a)
+			is.Attachments = append(is.Attachments, a)
+			added = append(added, s.renderAttachment(a))
+		}
+	}
+	if len(added) == 0 {
+		return nil, errorf(http.StatusBadRequest, "No files to attach")
+	}
+	is.Updated = t
+	return added, nil
+}
+
+func (s *Server) download(w http.ResponseWriter, r *http.Request, ID string) {
+	for _, a := range s.attachments {
+		if a.ID == ID {
+			if r.URL.Query().Get("sign") != sign(a) {
+				writeJSON(w, 0, &apiError{Code: http.StatusForbidden, Error: "Forbidden", Description: "Invalid signature"})
+				return
+			}
+			w.Header().Set("Content-Type", a.MimeType)
+			w.Write(a.data)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
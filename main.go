@@ -16,8 +16,17 @@ import (
 	"time"
 
 	"github.com/UNO-SOFT/mantisync/it"
+	_ "github.com/UNO-SOFT/mantisync/it/bugzilla"
+	_ "github.com/UNO-SOFT/mantisync/it/dir"
+	_ "github.com/UNO-SOFT/mantisync/it/gitea"
+	_ "github.com/UNO-SOFT/mantisync/it/github"
+	_ "github.com/UNO-SOFT/mantisync/it/gitlab"
 	_ "github.com/UNO-SOFT/mantisync/it/jira"
 	_ "github.com/UNO-SOFT/mantisync/it/mantisbt"
+	_ "github.com/UNO-SOFT/mantisync/it/mantisrest"
+	_ "github.com/UNO-SOFT/mantisync/it/memtracker"
+	_ "github.com/UNO-SOFT/mantisync/it/redmine"
+	_ "github.com/UNO-SOFT/mantisync/it/youtrack"
 
 	"github.com/peterbourgon/ff/v3/ffcli"
 	"github.com/tgulacsi/go/globalctx"
@@ -32,28 +41,122 @@ func main() {
 func Main() error {
 	fs := flag.NewFlagSet("mantisync", flag.ContinueOnError)
 	flagDB := fs.String("db", "sync.db.json", "DB to store sync info")
-	app := ffcli.Command{Name: "mantisync", FlagSet: fs,
-		ShortUsage: "jira:JIRABaseURL mantis:MantisURL",
+	var opts SyncOptions
+	fs.BoolVar(&opts.Full, "full", false, "force a full resync, ignoring the last sync time")
+	fs.DurationVar(&opts.Overlap, "overlap", 10*time.Minute, "overlap window before the last sync time, to cover clock skew")
+	flagDryRun := fs.Bool("dry-run", false, "only print the planned changes, do not modify the trackers or the DB")
+	flagPlanFormat := fs.String("plan-format", "text", "format of the dry-run plan: text or json")
+	flagConfig := fs.String("config", "", "JSON config file (state and user mapping)")
+	// openTrackers opens the trackers and sets the pair's configuration in opts.
+	openTrackers := func(ctx context.Context, args []string) (primary, secondary it.Tracker, err error) {
+		if len(args) != 2 {
+			return nil, nil, flag.ErrHelp
+		}
+		cfg, err := LoadConfig(*flagConfig)
+		if err != nil {
+			return nil, nil, err
+		}
+		if primary, err = it.New(args[0]); err != nil {
+			return nil, nil, fmt.Errorf("%q: %w", args[0], err)
+		}
+		if secondary, err = it.New(args[1]); err != nil {
+			return nil, nil, fmt.Errorf("%q: %w", args[1], err)
+		}
+		pair := cfg.Pair(primary.ID(), secondary.ID())
+		opts.States, opts.Priorities, opts.Users = pair.States, pair.Priorities, pair.Users
+		if err = opts.States.Validate(ctx, primary, secondary); err != nil {
+			return nil, nil, err
+		}
+		return primary, secondary, nil
+	}
+
+	watchFS := flag.NewFlagSet("watch", flag.ContinueOnError)
+	var watchOpts WatchOptions
+	watchFS.DurationVar(&watchOpts.Interval, "interval", 5*time.Minute, "time between two sync passes")
+	watchFS.DurationVar(&watchOpts.MaxBackoff, "max-backoff", time.Hour, "maximum wait after failed passes")
+	watchCmd := ffcli.Command{Name: "watch", FlagSet: watchFS,
+		ShortUsage: "watch [-interval=5m] jira:JIRABaseURL mantis:MantisURL",
+		ShortHelp:  "sync repeatedly, until interrupted",
 		Exec: func(ctx context.Context, args []string) error {
-			if len(args) != 2 {
-				return flag.ErrHelp
+			if *flagDryRun {
+				return errors.New("-dry-run is not supported in watch mode")
 			}
-			primary, err := it.New(args[0])
+			primary, secondary, err := openTrackers(ctx, args)
 			if err != nil {
-				return fmt.Errorf("%q: %w", args[0], err)
+				return err
 			}
-			secondary, err := it.New(args[1])
+			fdb, err := it.NewFileDB(*flagDB)
 			if err != nil {
-				return fmt.Errorf("%q: %w", args[1], err)
+				return err
 			}
+			defer fdb.Close()
+			return Watch(ctx, fdb, primary, secondary, opts, watchOpts)
+		},
+	}
 
-			db, err := it.NewFileDB(*flagDB)
+	rebuildFS := flag.NewFlagSet("rebuild-db", flag.ContinueOnError)
+	flagPrimaryMarker := rebuildFS.String("primary-marker", "jira", "marker of the primary's IDs in the secondary's issues, as in [jira:ABC-1]")
+	flagSecondaryMarker := rebuildFS.String("secondary-marker", "mantis", "marker of the secondary's IDs in the primary's issues, as in [mantis:123]")
+	rebuildCmd := ffcli.Command{Name: "rebuild-db", FlagSet: rebuildFS,
+		ShortUsage: "rebuild-db jira:JIRABaseURL mantis:MantisURL",
+		ShortHelp:  "rebuild the sync DB from the cross-references stored on the trackers",
+		Exec: func(ctx context.Context, args []string) error {
+			primary, secondary, err := openTrackers(ctx, args)
 			if err != nil {
 				return err
 			}
-			defer db.Close()
+			fdb, err := it.NewFileDB(*flagDB)
+			if err != nil {
+				return err
+			}
+			if !*flagDryRun {
+				defer fdb.Close()
+				stats, err := RebuildDB(ctx, fdb, primary, secondary, *flagPrimaryMarker, *flagSecondaryMarker)
+				log.Printf("restored %d issue, %d comment and %d attachment pairs", stats.Issues, stats.Comments, stats.Attachments)
+				return err
+			}
 
-			return Sync(ctx, db, primary, secondary)
+			var plan Plan
+			writePlan, err := plan.writer(*flagPlanFormat)
+			if err != nil {
+				return err
+			}
+			_, err = RebuildDB(ctx, plan.PairsDB(fdb), primary, secondary, *flagPrimaryMarker, *flagSecondaryMarker)
+			if wErr := writePlan(os.Stdout); wErr != nil && err == nil {
+				err = wErr
+			}
+			return err
+		},
+	}
+
+	app := ffcli.Command{Name: "mantisync", FlagSet: fs,
+		ShortUsage:  "jira:JIRABaseURL mantis:MantisURL",
+		Subcommands: []*ffcli.Command{&watchCmd, &rebuildCmd},
+		Exec: func(ctx context.Context, args []string) error {
+			primary, secondary, err := openTrackers(ctx, args)
+			if err != nil {
+				return err
+			}
+
+			fdb, err := it.NewFileDB(*flagDB)
+			if err != nil {
+				return err
+			}
+			if !*flagDryRun {
+				defer fdb.Close()
+				return Sync(ctx, fdb, primary, secondary, opts)
+			}
+
+			var plan Plan
+			writePlan, err := plan.writer(*flagPlanFormat)
+			if err != nil {
+				return err
+			}
+			err = Sync(ctx, plan.DB(fdb), plan.Tracker(primary), plan.Tracker(secondary), opts)
+			if wErr := writePlan(os.Stdout); wErr != nil && err == nil {
+				err = wErr
+			}
+			return err
 		},
 	}
 	ctx, cancel := globalctx.Wrap(context.Background())
@@ -61,68 +164,223 @@ func Main() error {
 	return app.ParseAndRun(ctx, os.Args[1:])
 }
 
-func Sync(ctx context.Context, db it.DB, primary, secondary it.Tracker) error {
+// SyncOptions modifies the behaviour of Sync.
+type SyncOptions struct {
+	// Full forces a complete resync, ignoring the stored last sync time.
+	Full bool
+	// Overlap is subtracted from the last sync time, to cover clock skew between the trackers.
+	Overlap time.Duration
+	// States translates the states between the trackers.
+	States StateMapping
+	// Priorities translates the priorities between the trackers.
+	Priorities PriorityMapping
+	// Users are the explicit user pairs, overriding the matching by email.
+	Users []UserPair
+}
+
+const lastListKey = "lastList"
+
+// Sync copies the issues changed since the last successful Sync from primary to secondary,
+// and then the other way around.
+//
+// The last sync time is stored in db, per (primary, secondary) pair, only after the whole pass succeeded.
+func Sync(ctx context.Context, db it.DB, primary, secondary it.Tracker, opts SyncOptions) error {
+	bucketL := string(primary.ID() + "\t" + secondary.ID() + "\tL")
 	var lastList time.Time
-	issues, err := primary.ListIssues(ctx, lastList)
-	if err != nil {
+	if !opts.Full {
+		s, err := db.Get(bucketL, lastListKey)
+		if err != nil && !errors.Is(err, it.ErrNotImplemented) {
+			return err
+		}
+		if s != "" {
+			if lastList, err = time.Parse(time.RFC3339Nano, s); err != nil {
+				return fmt.Errorf("parse %s %q: %w", lastListKey, s, err)
+			}
+			lastList = lastList.Add(-opts.Overlap)
+		}
+	}
+	// The start time is stored, not the end, so changes made during the pass are listed next time.
+	start := time.Now()
+	usersPS, usersSP := NewUserMappers(db, primary, secondary, opts.Users)
+	if err := syncIssues(ctx, db, primary, secondary, lastList, opts.States.Mapper(true), opts.Priorities.Mapper(true), usersPS, usersSP); err != nil {
+		return err
+	}
+	if err := syncIssues(ctx, db, secondary, primary, lastList, opts.States.Mapper(false), opts.Priorities.Mapper(false), usersSP, usersPS); err != nil {
 		return err
 	}
-	lastList = time.Now()
-	for _, issue := range issues {
+	return db.Put(bucketL, lastListKey, start.UTC().Format(time.RFC3339Nano))
+}
+
+// syncIssues copies the issues of a changed since "since" to b,
+// creating the missing ones and updating the already paired ones.
+//
+// mapState translates a's states to b's, mapPriority a's priorities to b's,
+// usersAB a's users to b's, usersBA the reverse.
+func syncIssues(ctx context.Context, db it.DB, a, b it.Tracker, since time.Time, mapState func(it.State) (it.State, error), mapPriority func(string) string, usersAB, usersBA *UserMapper) error {
+	issues, err := a.ListIssues(ctx, since)
+	if err != nil {
+		return fmt.Errorf("listIssues(%q): %w", a.ID(), err)
+	}
+	bucketAB := string(a.ID() + "\t" + b.ID() + "\tI")
+	bucketBA := string(b.ID() + "\t" + a.ID() + "\tI")
+	// The UpdatedAt of the issues as the last sync left them, to recognize the sync's own writes.
+	bucketSyncedA := string(a.ID() + "\t" + b.ID() + "\tS")
+	bucketSyncedB := string(b.ID() + "\t" + a.ID() + "\tS")
+	for _, listed := range issues {
 		if err := ctx.Err(); err != nil {
 			return err
 		}
-		bucket := string(primary.ID() + "\t" + secondary.ID() + "\tI")
-		bucketR := string(secondary.ID() + "\t" + primary.ID() + "\tI")
+		// ListIssues is only required to fill ID and SecondaryID.
+		issue, err := a.GetIssue(ctx, listed.ID)
+		if err != nil {
+			return fmt.Errorf("getIssue(%q): %w", listed.ID, err)
+		}
+		if issue.SecondaryID == "" {
+			issue.SecondaryID = listed.SecondaryID
+		}
 		secIDOk := issue.SecondaryID != ""
-		if !secIDOk {
-			if secondaryID, err := db.Get(bucket, string(issue.ID)); err != nil && !errors.Is(err, it.ErrNotImplemented) {
+		if secondaryID, err := db.Get(bucketAB, string(issue.ID)); err != nil && !errors.Is(err, it.ErrNotImplemented) {
+			return err
+		} else if !secIDOk {
+			issue.SecondaryID = it.IssueID(secondaryID)
+		} else if secondaryID != string(issue.SecondaryID) {
+			// The pair is stored on the tracker, but not in the DB (e.g. the DB is lost).
+			if err = db.PutN(
+				it.DBItem{Bucket: bucketAB, Key: string(issue.ID), Value: string(issue.SecondaryID)},
+				it.DBItem{Bucket: bucketBA, Key: string(issue.SecondaryID), Value: string(issue.ID)},
+			); err != nil {
 				return err
-			} else {
-				issue.SecondaryID = it.IssueID(secondaryID)
 			}
 		}
+		state, err := mapState(issue.State)
+		if err != nil && !errors.Is(err, errSkipState) {
+			return fmt.Errorf("map state of %q: %w", issue.ID, err)
+		}
+		issue.Priority = mapPriority(issue.Priority)
 		if issue.SecondaryID != "" {
-			if err := secondary.UpdateIssueState(ctx, issue.SecondaryID, issue.State); err != nil && !errors.Is(err, it.ErrNotImplemented) {
-				return fmt.Errorf("update %q: %w", issue.ID, err)
+			// An issue unchanged since the last sync has only been changed by the sync itself.
+			if unchanged, err := unchangedSinceSync(db, bucketSyncedA, issue); err != nil {
+				return err
+			} else if !unchanged {
+				if err := updateIssue(ctx, b, issue, state, usersAB); err != nil {
+					return fmt.Errorf("update %q: %w", issue.ID, err)
+				}
 			}
 		} else {
-			var err error
-			issue.SecondaryID, err = secondary.CreateIssue(ctx, issue)
+			issue.State = state
+			for _, u := range []*it.User{&issue.Author, &issue.Reporter, &issue.Assignee} {
+				if *u, err = usersAB.Map(ctx, *u); err != nil {
+					return fmt.Errorf("map users of %q: %w", issue.ID, err)
+				}
+			}
+			issue.SecondaryID, err = b.CreateIssue(ctx, issue)
 			if err != nil {
 				return fmt.Errorf("create %q: %w", issue.ID, err)
 			}
 			if err = db.PutN(
-				it.DBItem{bucket, string(issue.ID), string(issue.SecondaryID)},
-				it.DBItem{bucketR, string(issue.SecondaryID), string(issue.ID)},
+				it.DBItem{Bucket: bucketAB, Key: string(issue.ID), Value: string(issue.SecondaryID)},
+				it.DBItem{Bucket: bucketBA, Key: string(issue.SecondaryID), Value: string(issue.ID)},
 			); err != nil {
 				return err
 			}
 		}
 		if !secIDOk {
-			if err = primary.SetSecondaryID(ctx, issue.ID, issue.SecondaryID); err != nil && !errors.Is(err, it.ErrNotImplemented) {
+			if err = a.SetSecondaryID(ctx, issue.ID, issue.SecondaryID); err != nil && !errors.Is(err, it.ErrNotImplemented) {
 				return fmt.Errorf("update %q: %w", issue.ID, err)
 			}
 		}
 
-		if err := syncComments(ctx, db, primary, issue.ID, secondary, issue.SecondaryID); err != nil {
+		if err := syncComments(ctx, db, a, issue.ID, b, issue.SecondaryID, usersAB, usersBA); err != nil {
 			return fmt.Errorf("copy comments: %w", err)
 		}
 
-		if err := syncAttachments(ctx, db, primary, issue.ID, secondary, issue.SecondaryID); err != nil {
+		if err := syncAttachments(ctx, db, a, issue.ID, b, issue.SecondaryID); err != nil {
 			return fmt.Errorf("copy attachments: %w", err)
 		}
+
+		if err := markSynced(ctx, db, bucketSyncedA, a, issue.ID); err != nil {
+			return err
+		}
+		if err := markSynced(ctx, db, bucketSyncedB, b, issue.SecondaryID); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// markSynced stores the issue's UpdatedAt, as it is after the sync's changes.
+func markSynced(ctx context.Context, db it.DB, bucket string, t it.Tracker, ID it.IssueID) error {
+	issue, err := t.GetIssue(ctx, ID)
+	if err != nil {
+		return fmt.Errorf("getIssue(%q): %w", ID, err)
+	}
+	if issue.UpdatedAt.IsZero() {
+		return nil
+	}
+	return db.Put(bucket, string(ID), issue.UpdatedAt.UTC().Format(time.RFC3339Nano))
+}
+
+// unchangedSinceSync reports whether the issue has not been modified since markSynced.
+func unchangedSinceSync(db it.DB, bucket string, issue it.Issue) (bool, error) {
+	if issue.UpdatedAt.IsZero() {
+		return false, nil
+	}
+	s, err := db.Get(bucket, string(issue.ID))
+	if err != nil && !errors.Is(err, it.ErrNotImplemented) {
+		return false, err
+	}
+	return s != "" && s == issue.UpdatedAt.UTC().Format(time.RFC3339Nano), nil
+}
+
+// updateIssue updates the changed fields of the paired issue on b,
+// unless it has been modified later than issue.
+//
+// The state is not changed if empty.
+func updateIssue(ctx context.Context, b it.Tracker, issue it.Issue, state it.State, users *UserMapper) error {
+	target, err := b.GetIssue(ctx, issue.SecondaryID)
+	if err != nil {
+		return fmt.Errorf("getIssue(%q): %w", issue.SecondaryID, err)
+	}
+	if !issue.UpdatedAt.IsZero() && target.UpdatedAt.After(issue.UpdatedAt) {
+		return nil
+	}
+	want := issue
+	want.State = state
+	if want.Assignee, err = users.Map(ctx, issue.Assignee); err != nil {
+		return fmt.Errorf("map assignee: %w", err)
+	}
+	mask := it.Diff(want, target)
+	if state == "" {
+		mask &^= it.FieldState
+	}
+	if want.Priority == "" {
+		// An unmapped priority is not copied.
+		mask &^= it.FieldPriority
+	}
+	if want.Assignee.ID == "" && want.Assignee != (it.User{}) {
+		// An unmapped assignee cannot be set.
+		mask &^= it.FieldAssignee
+	}
+	if mask == 0 {
+		return nil
+	}
+	err = b.UpdateIssue(ctx, issue.SecondaryID, it.IssueUpdate{Issue: want, Fields: mask})
+	if errors.Is(err, it.ErrNotImplemented) && mask.Has(it.FieldState) {
+		err = b.UpdateIssueState(ctx, issue.SecondaryID, state)
+	}
+	if errors.Is(err, it.ErrNotImplemented) {
+		return nil
+	}
+	return err
+}
+
 // Ahhoz, hogy a szinkronizáció működjön, el kell tárolni a primary-secondary azonosító párokat!
 //
 // (T,T')_I: I -> I'
 // (T',T)_I: I' -> I
 // (T,T')_C: C -> C'
 // (T',T)_C: C' -> C
-func syncComments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b it.Tracker, bID it.IssueID) error {
+func syncComments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b it.Tracker, bID it.IssueID, usersAB, usersBA *UserMapper) error {
 	aComments, err := a.ListComments(ctx, aID)
 	if err != nil {
 		return fmt.Errorf("listComments(%q): %w", aID, err)
@@ -148,12 +406,15 @@ func syncComments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b
 			if yID, err := db.Get(bucketAB, string(x.ID)); err != nil {
 				return err
 			} else if yID == "" {
+				if x.Author, err = usersAB.Map(ctx, x.Author); err != nil {
+					return err
+				}
 				if yID, err := b.AddComment(ctx, bID, x); err != nil {
 					return err
 				} else {
 					if err = db.PutN(
-						it.DBItem{bucketAB, string(x.ID), string(yID)},
-						it.DBItem{bucketBA, string(yID), string(x.ID)},
+						it.DBItem{Bucket: bucketAB, Key: string(x.ID), Value: string(yID)},
+						it.DBItem{Bucket: bucketBA, Key: string(yID), Value: string(x.ID)},
 					); err != nil {
 						return err
 					}
@@ -166,12 +427,15 @@ func syncComments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b
 			if yID, err := db.Get(bucketBA, string(x.ID)); err != nil {
 				return err
 			} else if yID == "" {
+				if x.Author, err = usersBA.Map(ctx, x.Author); err != nil {
+					return err
+				}
 				if yID, err := a.AddComment(ctx, aID, x); err != nil {
 					return err
 				} else {
 					if err = db.PutN(
-						it.DBItem{bucketBA, string(x.ID), string(yID)},
-						it.DBItem{bucketAB, string(yID), string(x.ID)},
+						it.DBItem{Bucket: bucketBA, Key: string(x.ID), Value: string(yID)},
+						it.DBItem{Bucket: bucketAB, Key: string(yID), Value: string(x.ID)},
 					); err != nil {
 						return err
 					}
@@ -208,12 +472,12 @@ func syncAttachments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID
 			if yID, err := db.Get(bucketAB, string(x.ID)); err != nil {
 				return err
 			} else if yID == "" {
-				if yID, err := b.AddAttachment(ctx, aID, x); err != nil {
+				if yID, err := b.AddAttachment(ctx, bID, x); err != nil {
 					return err
 				} else {
 					if err = db.PutN(
-						it.DBItem{bucketAB, string(x.ID), string(yID)},
-						it.DBItem{bucketBA, string(yID), string(x.ID)},
+						it.DBItem{Bucket: bucketAB, Key: string(x.ID), Value: string(yID)},
+						it.DBItem{Bucket: bucketBA, Key: string(yID), Value: string(x.ID)},
 					); err != nil {
 						return err
 					}
@@ -226,12 +490,12 @@ func syncAttachments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID
 			if yID, err := db.Get(bucketBA, string(x.ID)); err != nil {
 				return err
 			} else if yID == "" {
-				if yID, err := a.AddAttachment(ctx, bID, x); err != nil {
+				if yID, err := a.AddAttachment(ctx, aID, x); err != nil {
 					return err
 				} else {
 					if err = db.PutN(
-						it.DBItem{bucketBA, string(x.ID), string(yID)},
-						it.DBItem{bucketAB, string(yID), string(x.ID)},
+						it.DBItem{Bucket: bucketBA, Key: string(x.ID), Value: string(yID)},
+						it.DBItem{Bucket: bucketAB, Key: string(yID), Value: string(x.ID)},
 					); err != nil {
 						return err
 					}
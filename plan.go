@@ -0,0 +1,263 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// Plan collects the changes a dry run would have made.
+type Plan struct {
+	mu      sync.Mutex
+	Actions []Action
+	seq     int
+}
+
+// Action is one planned change on a tracker.
+type Action struct {
+	Op      Op           `json:"op"`
+	Tracker it.TrackerID `json:"tracker"`
+	// Issue is the ID of the changed issue on Tracker
+	// (of the comment or attachment for OpStorePair).
+	Issue it.IssueID `json:"issue"`
+	// Source is the ID of the issue, comment or attachment the change is copied from.
+	Source string `json:"source,omitempty"`
+	// Value is the summary, state, updated fields, secondary ID, file name
+	// or the partner's tracker, depending on Op.
+	Value string `json:"value,omitempty"`
+}
+
+// Op is the kind of the planned change.
+type Op string
+
+const (
+	OpCreateIssue    = Op("create issue")
+	OpUpdateState    = Op("update state")
+	OpUpdateIssue    = Op("update issue")
+	OpSetSecondaryID = Op("set secondary ID")
+	OpAddComment     = Op("add comment")
+	OpAddAttachment  = Op("upload attachment")
+	// OpStorePair stores a pair into the DB; Source is the partner's ID on the Value tracker.
+	OpStorePair = Op("store pair")
+	// OpUpdateStateFallback follows an OpUpdateIssue changing the state:
+	// the sync sets the state alone if the tracker cannot update the issues.
+	OpUpdateStateFallback = Op("update state if update issue is not implemented")
+)
+
+func (a Action) String() string {
+	switch a.Op {
+	case OpCreateIssue:
+		return fmt.Sprintf("%s: create issue %s from %q: %q", a.Tracker, a.Issue, a.Source, a.Value)
+	case OpUpdateState:
+		return fmt.Sprintf("%s: set state of %q to %q", a.Tracker, a.Issue, a.Value)
+	case OpUpdateIssue:
+		return fmt.Sprintf("%s: update %s of %q", a.Tracker, a.Value, a.Issue)
+	case OpUpdateStateFallback:
+		return fmt.Sprintf("%s: or if it cannot update issues, set state of %q to %q", a.Tracker, a.Issue, a.Value)
+	case OpSetSecondaryID:
+		return fmt.Sprintf("%s: set secondary ID of %q to %q", a.Tracker, a.Issue, a.Value)
+	case OpAddComment:
+		return fmt.Sprintf("%s: add comment %q to %q", a.Tracker, a.Source, a.Issue)
+	case OpAddAttachment:
+		return fmt.Sprintf("%s: upload attachment %q (%s) to %q", a.Tracker, a.Value, a.Source, a.Issue)
+	case OpStorePair:
+		return fmt.Sprintf("%s: pair %q with %q of %s", a.Tracker, a.Issue, a.Source, a.Value)
+	}
+	return fmt.Sprintf("%s: %s %q %q %q", a.Tracker, a.Op, a.Issue, a.Source, a.Value)
+}
+
+func (p *Plan) add(a Action) {
+	p.mu.Lock()
+	p.Actions = append(p.Actions, a)
+	p.mu.Unlock()
+}
+
+// newID returns a placeholder ID for an object that would have been created.
+func (p *Plan) newID() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.seq++
+	return plannedPrefix + strconv.Itoa(p.seq)
+}
+
+const plannedPrefix = "planned-"
+
+func isPlanned(ID it.IssueID) bool { return strings.HasPrefix(string(ID), plannedPrefix) }
+
+// WriteText writes the planned actions in human-readable form, one per line.
+func (p *Plan) WriteText(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if len(p.Actions) == 0 {
+		_, err := io.WriteString(w, "Nothing to do.\n")
+		return err
+	}
+	for _, a := range p.Actions {
+		if _, err := fmt.Fprintln(w, a.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writer returns the Write method for the format: text or json.
+func (p *Plan) writer(format string) (func(io.Writer) error, error) {
+	switch format {
+	case "text":
+		return p.WriteText, nil
+	case "json":
+		return p.WriteJSON, nil
+	}
+	return nil, fmt.Errorf("unknown plan format %q", format)
+}
+
+// WriteJSON writes the planned actions as a JSON array.
+func (p *Plan) WriteJSON(w io.Writer) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	actions := p.Actions
+	if actions == nil {
+		actions = []Action{}
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(actions)
+}
+
+// Tracker returns a Tracker that records the changes into the Plan,
+// instead of executing them.
+func (p *Plan) Tracker(t it.Tracker) it.Tracker { return dryRunTracker{Tracker: t, plan: p} }
+
+// DB returns a DB that keeps the writes in memory, without modifying db.
+func (p *Plan) DB(db it.DB) it.DB { return &dryRunDB{DB: db} }
+
+// PairsDB is like DB, but also records the pairs written as OpStorePair actions.
+//
+// Every PutN must store one pair, the first item being the pair's forward half.
+func (p *Plan) PairsDB(db it.DB) it.DB { return &dryRunDB{DB: db, plan: p} }
+
+var _ = it.Tracker(dryRunTracker{})
+
+type dryRunTracker struct {
+	it.Tracker
+	plan *Plan
+}
+
+func (t dryRunTracker) GetIssue(ctx context.Context, ID it.IssueID) (it.Issue, error) {
+	if isPlanned(ID) {
+		return it.Issue{ID: ID}, nil
+	}
+	return t.Tracker.GetIssue(ctx, ID)
+}
+func (t dryRunTracker) CreateIssue(ctx context.Context, issue it.Issue) (it.IssueID, error) {
+	ID := it.IssueID(t.plan.newID())
+	t.plan.add(Action{Op: OpCreateIssue, Tracker: t.ID(), Issue: ID, Source: string(issue.ID), Value: issue.Summary})
+	return ID, nil
+}
+func (t dryRunTracker) UpdateIssueState(ctx context.Context, ID it.IssueID, state it.State) error {
+	t.plan.add(Action{Op: OpUpdateState, Tracker: t.ID(), Issue: ID, Value: string(state)})
+	return nil
+}
+func (t dryRunTracker) UpdateIssue(ctx context.Context, ID it.IssueID, upd it.IssueUpdate) error {
+	t.plan.add(Action{Op: OpUpdateIssue, Tracker: t.ID(), Issue: ID, Value: upd.Fields.String()})
+	// Whether the tracker implements UpdateIssue cannot be known without calling it,
+	// so the fallback of the sync is recorded, too.
+	if upd.Fields.Has(it.FieldState) {
+		t.plan.add(Action{Op: OpUpdateStateFallback, Tracker: t.ID(), Issue: ID, Value: string(upd.State)})
+	}
+	return nil
+}
+func (t dryRunTracker) SetSecondaryID(ctx context.Context, primary, secondary it.IssueID) error {
+	t.plan.add(Action{Op: OpSetSecondaryID, Tracker: t.ID(), Issue: primary, Value: string(secondary)})
+	return nil
+}
+func (t dryRunTracker) AddComment(ctx context.Context, ID it.IssueID, comment it.Comment) (it.CommentID, error) {
+	t.plan.add(Action{Op: OpAddComment, Tracker: t.ID(), Issue: ID, Source: string(comment.ID)})
+	return it.CommentID(t.plan.newID()), nil
+}
+func (t dryRunTracker) ListComments(ctx context.Context, ID it.IssueID) ([]it.Comment, error) {
+	if isPlanned(ID) {
+		return nil, nil
+	}
+	return t.Tracker.ListComments(ctx, ID)
+}
+func (t dryRunTracker) AddAttachment(ctx context.Context, ID it.IssueID, a it.Attachment) (it.AttachmentID, error) {
+	t.plan.add(Action{Op: OpAddAttachment, Tracker: t.ID(), Issue: ID, Source: string(a.ID), Value: a.Name})
+	return it.AttachmentID(t.plan.newID()), nil
+}
+func (t dryRunTracker) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	if isPlanned(ID) {
+		return nil, nil
+	}
+	return t.Tracker.ListAttachments(ctx, ID)
+}
+
+var _ = it.DB((*dryRunDB)(nil))
+
+// dryRunDB reads through to the underlying DB, but keeps the writes in memory.
+type dryRunDB struct {
+	it.DB
+	plan    *Plan
+	mu      sync.RWMutex
+	buckets map[string]map[string]string
+}
+
+func (db *dryRunDB) Get(bucket, key string) (string, error) {
+	db.mu.RLock()
+	v, ok := db.buckets[bucket][key]
+	db.mu.RUnlock()
+	if ok {
+		return v, nil
+	}
+	return db.DB.Get(bucket, key)
+}
+func (db *dryRunDB) Put(bucket, key, value string) error {
+	return db.PutN(it.DBItem{Bucket: bucket, Key: key, Value: value})
+}
+func (db *dryRunDB) PutN(items ...it.DBItem) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.buckets == nil {
+		db.buckets = make(map[string]map[string]string)
+	}
+	if db.plan != nil && len(items) != 0 {
+		db.plan.add(pairAction(items[0]))
+	}
+	for _, x := range items {
+		b := db.buckets[x.Bucket]
+		if b == nil {
+			b = make(map[string]string)
+			db.buckets[x.Bucket] = b
+		}
+		b[x.Key] = x.Value
+	}
+	return nil
+}
+func (db *dryRunDB) Close() error { return nil }
+
+// pairAction describes the pair stored by item.
+//
+// The issue pairs are stored in the "T\tU\tI" buckets as T's ID -> U's ID,
+// the comments and attachments in the "U\tT\tC" buckets as T's ID -> U's ID.
+func pairAction(item it.DBItem) Action {
+	parts := strings.Split(item.Bucket, "\t")
+	if len(parts) != 3 {
+		return Action{Op: OpStorePair, Issue: it.IssueID(item.Key), Source: item.Value, Value: item.Bucket}
+	}
+	t, u := parts[0], parts[1]
+	if parts[2] == "C" {
+		t, u = u, t
+	}
+	return Action{Op: OpStorePair, Tracker: it.TrackerID(t), Issue: it.IssueID(item.Key), Source: item.Value, Value: u}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import "fmt"
+
+// PriorityMapping translates the priorities between the primary and the secondary tracker.
+//
+// An empty PriorityMapping copies the priorities verbatim, as the states.
+// When a direction is mapped, the trackers have different priority vocabularies,
+// so the unmapped priorities are not copied: the created issues get the tracker's
+// default priority, and the updates leave the priority as is.
+type PriorityMapping struct {
+	// Forward maps the primary's priorities to the secondary's.
+	Forward map[string]string `json:"forward,omitempty"`
+	// Backward maps the secondary's priorities to the primary's.
+	// If empty, the inverse of Forward is used.
+	Backward map[string]string `json:"backward,omitempty"`
+}
+
+func (m *PriorityMapping) init() error {
+	if len(m.Backward) != 0 || len(m.Forward) == 0 {
+		return nil
+	}
+	m.Backward = make(map[string]string, len(m.Forward))
+	for k, v := range m.Forward {
+		if prev, ok := m.Backward[v]; ok {
+			return fmt.Errorf("cannot invert forward priority mapping: both %q and %q map to %q, specify backward", prev, k, v)
+		}
+		m.Backward[v] = k
+	}
+	return nil
+}
+
+// Mapper returns the function that maps the priorities in the given direction,
+// returning "" for the unmapped ones, or the priority itself if the direction has no mapping.
+func (m PriorityMapping) Mapper(forward bool) func(string) string {
+	pm := m.Backward
+	if forward {
+		pm = m.Forward
+	}
+	if len(pm) == 0 {
+		return func(p string) string { return p }
+	}
+	return func(p string) string { return pm[p] }
+}
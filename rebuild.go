@@ -0,0 +1,269 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// RebuildStats counts the pairs restored by RebuildDB.
+type RebuildStats struct {
+	Issues, Comments, Attachments int
+}
+
+// RebuildDB regenerates the issue, comment and attachment pairs in db
+// from the cross-references stored on the trackers.
+//
+// The partner of an issue is its SecondaryID (as stored by SetSecondaryID),
+// or a "[marker:ID]" in its summary or description,
+// where marker is primaryMarker on the secondary's issues and secondaryMarker on the primary's.
+//
+// Remote links are not scanned: the Tracker interface has no notion of them,
+// and each tracker's GetIssue returns the partner stored by its SetSecondaryID
+// (be it a custom field or a link) as SecondaryID.
+//
+// Comments are paired by their body (without the attribution prefix),
+// the closest creation time breaking ties; attachments by name and content.
+// The attachments whose content cannot be downloaded are left unpaired.
+func RebuildDB(ctx context.Context, db it.DB, primary, secondary it.Tracker, primaryMarker, secondaryMarker string) (RebuildStats, error) {
+	var stats RebuildStats
+	pairs := make(map[it.IssueID]it.IssueID)
+	seen := make(map[it.IssueID]it.IssueID)
+	add := func(pID, sID it.IssueID) {
+		if prev, ok := pairs[pID]; ok && prev != sID {
+			log.Printf("%s: %q is paired with both %q and %q, keeping the first", primary.ID(), pID, prev, sID)
+			return
+		}
+		if prev, ok := seen[sID]; ok && prev != pID {
+			log.Printf("%s: %q is paired with both %q and %q, keeping the first", secondary.ID(), sID, prev, pID)
+			return
+		}
+		pairs[pID], seen[sID] = sID, pID
+	}
+	if err := scanPartners(ctx, primary, secondaryMarker, add); err != nil {
+		return stats, err
+	}
+	if err := scanPartners(ctx, secondary, primaryMarker, func(sID, pID it.IssueID) { add(pID, sID) }); err != nil {
+		return stats, err
+	}
+
+	bucketPS := string(primary.ID() + "\t" + secondary.ID() + "\tI")
+	bucketSP := string(secondary.ID() + "\t" + primary.ID() + "\tI")
+	for pID, sID := range pairs {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		if err := db.PutN(
+			it.DBItem{Bucket: bucketPS, Key: string(pID), Value: string(sID)},
+			it.DBItem{Bucket: bucketSP, Key: string(sID), Value: string(pID)},
+		); err != nil {
+			return stats, err
+		}
+		stats.Issues++
+
+		n, err := rebuildComments(ctx, db, primary, pID, secondary, sID)
+		if err != nil {
+			return stats, err
+		}
+		stats.Comments += n
+
+		if n, err = rebuildAttachments(ctx, db, primary, pID, secondary, sID); err != nil {
+			return stats, err
+		}
+		stats.Attachments += n
+	}
+	return stats, nil
+}
+
+// scanPartners calls found with the ID of each issue of t and the ID of its partner, if any.
+func scanPartners(ctx context.Context, t it.Tracker, marker string, found func(ID, partner it.IssueID)) error {
+	issues, err := t.ListIssues(ctx, time.Time{})
+	if err != nil {
+		return fmt.Errorf("listIssues(%q): %w", t.ID(), err)
+	}
+	var rMarker *regexp.Regexp
+	if marker != "" {
+		rMarker = regexp.MustCompile(`\[` + regexp.QuoteMeta(marker) + `:([^\]\s]+)\]`)
+	}
+	for _, listed := range issues {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		partner := listed.SecondaryID
+		if partner == "" {
+			issue, err := t.GetIssue(ctx, listed.ID)
+			if err != nil {
+				return fmt.Errorf("getIssue(%q): %w", listed.ID, err)
+			}
+			partner = issue.SecondaryID
+			if partner == "" && rMarker != nil {
+				if m := rMarker.FindStringSubmatch(issue.Summary + "\n" + issue.Description); m != nil {
+					partner = it.IssueID(m[1])
+				}
+			}
+		}
+		if partner != "" {
+			found(listed.ID, partner)
+		}
+	}
+	return nil
+}
+
+// rebuildComments pairs the comments with the same body.
+//
+// The buckets are the same as syncComments uses.
+func rebuildComments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b it.Tracker, bID it.IssueID) (int, error) {
+	aComments, err := a.ListComments(ctx, aID)
+	if err != nil {
+		return 0, fmt.Errorf("listComments(%q): %w", aID, err)
+	}
+	bComments, err := b.ListComments(ctx, bID)
+	if err != nil {
+		return 0, fmt.Errorf("listComments(%q): %w", bID, err)
+	}
+	byHash := make(map[string][]it.Comment, len(bComments))
+	for _, c := range bComments {
+		h := commentHash(c)
+		byHash[h] = append(byHash[h], c)
+	}
+
+	bucketAB := string(b.ID() + "\t" + a.ID() + "\tC")
+	bucketBA := string(a.ID() + "\t" + b.ID() + "\tC")
+	var n int
+	for _, x := range aComments {
+		h := commentHash(x)
+		cands := byHash[h]
+		if len(cands) == 0 {
+			continue
+		}
+		best := 0
+		for i, c := range cands {
+			if absDuration(c.CreatedAt.Sub(x.CreatedAt)) < absDuration(cands[best].CreatedAt.Sub(x.CreatedAt)) {
+				best = i
+			}
+		}
+		y := cands[best]
+		byHash[h] = append(cands[:best], cands[best+1:]...)
+		if err := db.PutN(
+			it.DBItem{Bucket: bucketAB, Key: string(x.ID), Value: string(y.ID)},
+			it.DBItem{Bucket: bucketBA, Key: string(y.ID), Value: string(x.ID)},
+		); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+func commentHash(c it.Comment) string {
+	body := strings.TrimSpace(strings.ReplaceAll(it.StripAttribution(c.Body), "\r\n", "\n"))
+	hsh := sha256.Sum256([]byte(body))
+	return hex.EncodeToString(hsh[:])
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
+
+// rebuildAttachments pairs the attachments with the same name and content.
+//
+// The buckets are the same as syncAttachments uses.
+func rebuildAttachments(ctx context.Context, db it.DB, a it.Tracker, aID it.IssueID, b it.Tracker, bID it.IssueID) (int, error) {
+	aAttachments, err := a.ListAttachments(ctx, aID)
+	if err != nil {
+		return 0, fmt.Errorf("listAttachments(%q): %w", aID, err)
+	}
+	bAttachments, err := b.ListAttachments(ctx, bID)
+	if err != nil {
+		return 0, fmt.Errorf("listAttachments(%q): %w", bID, err)
+	}
+	byName := make(map[string][]it.Attachment, len(bAttachments))
+	for _, x := range bAttachments {
+		byName[x.Name] = append(byName[x.Name], x)
+	}
+	// Only the attachments with matching names are downloaded, and only once.
+	hashes := make(map[it.AttachmentID]string)
+	hashOf := func(x it.Attachment) (string, error) {
+		if h, ok := hashes[x.ID]; ok {
+			return h, nil
+		}
+		h, err := attachmentHash(x)
+		hashes[x.ID] = h
+		return h, err
+	}
+
+	bucketAB := string(b.ID() + "\t" + a.ID() + "\tC")
+	bucketBA := string(a.ID() + "\t" + b.ID() + "\tC")
+	var n int
+	for _, x := range aAttachments {
+		cands := byName[x.Name]
+		if len(cands) == 0 {
+			continue
+		}
+		xh, err := hashOf(x)
+		if errors.Is(err, errNoContent) {
+			log.Printf("%s: attachment %q of %q has no content, leaving it unpaired", a.ID(), x.Name, aID)
+			continue
+		} else if err != nil {
+			return n, fmt.Errorf("read attachment %q of %q: %w", x.Name, aID, err)
+		}
+		for i, y := range cands {
+			yh, err := hashOf(y)
+			if errors.Is(err, errNoContent) {
+				continue
+			} else if err != nil {
+				return n, fmt.Errorf("read attachment %q of %q: %w", y.Name, bID, err)
+			}
+			if yh != xh {
+				continue
+			}
+			byName[x.Name] = append(cands[:i], cands[i+1:]...)
+			if err := db.PutN(
+				it.DBItem{Bucket: bucketAB, Key: string(x.ID), Value: string(y.ID)},
+				it.DBItem{Bucket: bucketBA, Key: string(y.ID), Value: string(x.ID)},
+			); err != nil {
+				return n, err
+			}
+			n++
+			break
+		}
+	}
+	return n, nil
+}
+
+// errNoContent is returned by attachmentHash when the attachment cannot be downloaded:
+// the same name alone does not mean the same content.
+var errNoContent = errors.New("no content")
+
+func attachmentHash(x it.Attachment) (string, error) {
+	if x.GetBody == nil {
+		return "", errNoContent
+	}
+	r, err := x.GetBody()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	hsh := sha256.New()
+	if _, err = io.Copy(hsh, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hsh.Sum(nil)), nil
+}
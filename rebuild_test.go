@@ -0,0 +1,118 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+func TestRebuildDBDryRun(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bID, err := b.CreateIssue(ctx, it.Issue{Summary: "first [mem:" + string(aID) + "]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	aCID, err := a.AddComment(ctx, aID, it.Comment{Body: "comment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bCID, err := b.AddComment(ctx, bID, it.Comment{Body: "Originally by someone\n\ncomment"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var plan Plan
+	stats, err := RebuildDB(ctx, plan.PairsDB(db), a, b, "mem", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Issues != 1 || stats.Comments != 1 {
+		t.Errorf("got %+v, wanted 1 issue and 1 comment", stats)
+	}
+	var buf strings.Builder
+	if err = plan.WriteText(&buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `mem:a: pair "` + string(aID) + `" with "` + string(bID) + `" of mem:b
+mem:a: pair "` + string(aCID) + `" with "` + string(bCID) + `" of mem:b
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwanted\n%s", got, want)
+	}
+	if s, _ := db.Get("mem:a\tmem:b\tI", string(aID)); s != "" {
+		t.Errorf("the dry run stored %q", s)
+	}
+}
+
+// noContent lists the attachments without their content.
+type noContent struct{ it.Tracker }
+
+func (t noContent) ListAttachments(ctx context.Context, ID it.IssueID) ([]it.Attachment, error) {
+	attachments, err := t.Tracker.ListAttachments(ctx, ID)
+	for i := range attachments {
+		attachments[i].GetBody = nil
+	}
+	return attachments, err
+}
+
+func TestRebuildDBAttachments(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "first"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bID, err := b.CreateIssue(ctx, it.Issue{Summary: "first [mem:" + string(aID) + "]"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, x := range []struct {
+		Tracker       it.Tracker
+		ID            it.IssueID
+		Name, Content string
+	}{
+		{a, aID, "same.txt", "same"}, {b, bID, "same.txt", "same"},
+		{a, aID, "other.txt", "a"}, {b, bID, "other.txt", "b"},
+	} {
+		content := x.Content
+		if _, err = x.Tracker.AddAttachment(ctx, x.ID, it.Attachment{
+			Name: x.Name, GetBody: func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(content)), nil },
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, tc := range []struct {
+		Name        string
+		B           it.Tracker
+		Attachments int
+	}{
+		{"content", b, 1},
+		{"noContent", noContent{b}, 0},
+	} {
+		t.Run(tc.Name, func(t *testing.T) {
+			var plan Plan
+			stats, err := RebuildDB(ctx, plan.PairsDB(db), a, tc.B, "mem", "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.Issues != 1 || stats.Attachments != tc.Attachments {
+				t.Errorf("got %+v, wanted 1 issue and %d attachments", stats, tc.Attachments)
+			}
+		})
+	}
+}
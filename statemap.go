@@ -0,0 +1,157 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// StateMapping translates the states between the primary and the secondary tracker.
+//
+// An empty StateMapping copies the states verbatim.
+type StateMapping struct {
+	// Forward maps the primary's states to the secondary's.
+	Forward StateMap `json:"forward"`
+	// Backward maps the secondary's states to the primary's.
+	// If empty, the inverse of Forward is used.
+	Backward StateMap `json:"backward"`
+	// Unmapped is what to do with a state that has no mapping and no default.
+	Unmapped UnmappedPolicy `json:"unmapped,omitempty"`
+}
+
+// StateMap maps the states in one direction.
+type StateMap struct {
+	Map map[it.State]it.State `json:"map,omitempty"`
+	// Default is used for the states missing from Map, if not empty.
+	Default it.State `json:"default,omitempty"`
+}
+
+// UnmappedPolicy is the policy for unmapped states.
+type UnmappedPolicy string
+
+const (
+	// UnmappedCopy copies the state verbatim. This is the default.
+	UnmappedCopy = UnmappedPolicy("copy")
+	// UnmappedSkip leaves the state of the other issue as is.
+	UnmappedSkip = UnmappedPolicy("skip")
+	// UnmappedError fails the sync.
+	UnmappedError = UnmappedPolicy("error")
+)
+
+// ErrUnmappedState is returned for unmapped states under the UnmappedError policy.
+var ErrUnmappedState = errors.New("unmapped state")
+
+// errSkipState signals that the state must not be changed.
+var errSkipState = errors.New("skip state")
+
+func (m *StateMapping) init() error {
+	switch m.Unmapped {
+	case "":
+		m.Unmapped = UnmappedCopy
+	case UnmappedCopy, UnmappedSkip, UnmappedError:
+	default:
+		return fmt.Errorf("unknown unmapped state policy %q", m.Unmapped)
+	}
+	if len(m.Backward.Map) != 0 || len(m.Forward.Map) == 0 {
+		return nil
+	}
+	m.Backward.Map = make(map[it.State]it.State, len(m.Forward.Map))
+	for k, v := range m.Forward.Map {
+		if prev, ok := m.Backward.Map[v]; ok {
+			return fmt.Errorf("cannot invert forward state mapping: both %q and %q map to %q, specify backward", prev, k, v)
+		}
+		m.Backward.Map[v] = k
+	}
+	return nil
+}
+
+// Mapper returns the function that maps the states in the given direction.
+//
+// The returned function returns errSkipState if the state must be left as is.
+func (m StateMapping) Mapper(forward bool) func(it.State) (it.State, error) {
+	sm := m.Backward
+	if forward {
+		sm = m.Forward
+	}
+	return func(s it.State) (it.State, error) {
+		if t, ok := sm.Map[s]; ok {
+			return t, nil
+		}
+		if sm.Default != "" {
+			return sm.Default, nil
+		}
+		switch m.Unmapped {
+		case UnmappedSkip:
+			return "", errSkipState
+		case UnmappedError:
+			return "", fmt.Errorf("%q: %w", s, ErrUnmappedState)
+		}
+		return s, nil
+	}
+}
+
+// Validate checks that the mapping only refers to states the trackers offer.
+//
+// Trackers that cannot list their states are not checked.
+func (m StateMapping) Validate(ctx context.Context, primary, secondary it.Tracker) error {
+	listStates := func(t it.Tracker) (map[it.State]struct{}, error) {
+		states, err := t.ListStates(ctx)
+		if err != nil {
+			if errors.Is(err, it.ErrNotImplemented) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("listStates(%q): %w", t.ID(), err)
+		}
+		set := make(map[it.State]struct{}, len(states))
+		for _, s := range states {
+			set[s] = struct{}{}
+		}
+		return set, nil
+	}
+	pStates, err := listStates(primary)
+	if err != nil {
+		return err
+	}
+	sStates, err := listStates(secondary)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	check := func(t it.Tracker, set map[it.State]struct{}, s it.State) {
+		if set == nil || s == "" {
+			return
+		}
+		if _, ok := set[s]; !ok {
+			unknown = append(unknown, fmt.Sprintf("%q on %s", s, t.ID()))
+		}
+	}
+	for _, x := range []struct {
+		StateMap
+		from, to             it.Tracker
+		fromStates, toStates map[it.State]struct{}
+	}{
+		{m.Forward, primary, secondary, pStates, sStates},
+		{m.Backward, secondary, primary, sStates, pStates},
+	} {
+		for k, v := range x.Map {
+			check(x.from, x.fromStates, k)
+			check(x.to, x.toStates, v)
+		}
+		check(x.to, x.toStates, x.Default)
+	}
+	if len(unknown) != 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("state mapping refers to unknown states: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
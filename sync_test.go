@@ -0,0 +1,414 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+	"github.com/UNO-SOFT/mantisync/it/memtracker"
+)
+
+// newSyncPair returns two empty in-memory trackers and a DB.
+func newSyncPair(t *testing.T) (a, b memtracker.Client, db it.DB) {
+	t.Helper()
+	var err error
+	if a, err = memtracker.New("a"); err != nil {
+		t.Fatal(err)
+	}
+	if b, err = memtracker.New("b"); err != nil {
+		t.Fatal(err)
+	}
+	if db, err = it.NewFileDB(filepath.Join(t.TempDir(), "sync.db.json")); err != nil {
+		t.Fatal(err)
+	}
+	return a, b, db
+}
+
+func TestSyncCreate(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	b.AddUser(it.User{ID: "bob", Email: "bob@example.com"})
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "first", Description: "desc",
+		Author: it.User{ID: "b1", Email: "bob@example.com"}, State: "new", Labels: []string{"x"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.AddComment(ctx, aID, it.Comment{Body: "comment"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.AddAttachment(ctx, aID, it.Attachment{Name: "a.txt", GetBody: body("data")}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	issues, err := b.ListIssues(ctx, zeroTime)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(issues) != 1 {
+		t.Fatalf("got %d issues, wanted 1", len(issues))
+	}
+	got := issues[0]
+	if got.Summary != "first" || got.Description != "desc" || got.State != "new" || got.Author.ID != "bob" {
+		t.Errorf("got %+v", got)
+	}
+	if issue, _ := a.GetIssue(ctx, aID); issue.SecondaryID != got.ID {
+		t.Errorf("SecondaryID: got %q, wanted %q", issue.SecondaryID, got.ID)
+	}
+	if comments, _ := b.ListComments(ctx, got.ID); len(comments) != 1 || comments[0].Body != "comment" {
+		t.Errorf("comments: got %+v", comments)
+	}
+	if attachments, _ := b.ListAttachments(ctx, got.ID); len(attachments) != 1 || attachments[0].Name != "a.txt" {
+		t.Errorf("attachments: got %+v", attachments)
+	}
+
+	// The comment added on the secondary is copied back.
+	if _, err = b.AddComment(ctx, got.ID, it.Comment{Body: "answer"}); err != nil {
+		t.Fatal(err)
+	}
+	a.ResetCalls()
+	b.ResetCalls()
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if comments, _ := a.ListComments(ctx, aID); len(comments) != 2 || comments[1].Body != "answer" {
+		t.Errorf("comments: got %+v", comments)
+	}
+	for _, c := range []memtracker.Client{a, b} {
+		for _, m := range []string{"CreateIssue", "UpdateIssue", "AddAttachment"} {
+			if n := c.Count(m); n != 0 {
+				t.Errorf("%s: %d calls of %s on the second sync: %v", c.ID(), n, m, c.Calls())
+			}
+		}
+	}
+	if n := b.Count("AddComment"); n != 0 {
+		t.Errorf("comment copied again: %v", b.Calls())
+	}
+}
+
+func TestSyncUpdate(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "first", State: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	issue, _ := a.GetIssue(ctx, aID)
+	bID := issue.SecondaryID
+
+	if err = a.UpdateIssue(ctx, aID, it.IssueUpdate{
+		Issue:  it.Issue{Summary: "changed", State: "closed"},
+		Fields: it.FieldSummary | it.FieldState,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, bID); got.Summary != "changed" || got.State != "closed" {
+		t.Errorf("got %+v", got)
+	}
+
+	// Trackers without UpdateIssue get the state by UpdateIssueState.
+	b.NotImplemented("UpdateIssue")
+	if err = a.UpdateIssueState(ctx, aID, "reopened"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, bID); got.State != "reopened" {
+		t.Errorf("state: got %q, wanted reopened", got.State)
+	}
+	if n := b.Count("UpdateIssueState"); n != 1 {
+		t.Errorf("UpdateIssueState called %d times: %v", n, b.Calls())
+	}
+}
+
+func TestSyncStateMapping(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	if _, err := a.CreateIssue(ctx, it.Issue{Summary: "first", State: "new"}); err != nil {
+		t.Fatal(err)
+	}
+	opts := SyncOptions{States: StateMapping{Forward: StateMap{Map: map[it.State]it.State{"new": "open"}}}}
+	if err := Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.State != "open" {
+		t.Errorf("state: got %q, wanted open", got.State)
+	}
+}
+
+func TestSyncPriorityMapping(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	highID, err := a.CreateIssue(ctx, it.Issue{Summary: "high", Priority: "High"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = a.CreateIssue(ctx, it.Issue{Summary: "medium", Priority: "Medium"}); err != nil {
+		t.Fatal(err)
+	}
+	opts := SyncOptions{Priorities: PriorityMapping{Forward: map[string]string{"High": "urgent"}}}
+	if err = opts.Priorities.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	// The unmapped priority is left to the tracker's default.
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Priority != "urgent" {
+		t.Errorf("priority: got %q, wanted urgent", got.Priority)
+	}
+	if got, _ := b.GetIssue(ctx, "b-2"); got.Priority != "" {
+		t.Errorf("priority: got %q, wanted none", got.Priority)
+	}
+
+	// An unmapped priority is not copied by the updates.
+	if err = a.UpdateIssue(ctx, highID, it.IssueUpdate{
+		Issue:  it.Issue{Summary: "changed", Priority: "Low"},
+		Fields: it.FieldSummary | it.FieldPriority,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Summary != "changed" || got.Priority != "urgent" {
+		t.Errorf("got %q with priority %q, wanted changed with urgent", got.Summary, got.Priority)
+	}
+	if got, _ := a.GetIssue(ctx, highID); got.Priority != "Low" {
+		t.Errorf("priority of the primary: got %q, wanted Low", got.Priority)
+	}
+}
+
+// TestSyncPriorityNoMapping checks that without a mapping the priorities are copied verbatim.
+func TestSyncPriorityNoMapping(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "high", Priority: "High"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var opts SyncOptions
+	if err = opts.Priorities.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Priority != "High" {
+		t.Errorf("priority: got %q, wanted High", got.Priority)
+	}
+
+	if err = a.UpdateIssue(ctx, aID, it.IssueUpdate{Issue: it.Issue{Priority: "Low"}, Fields: it.FieldPriority}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Priority != "Low" {
+		t.Errorf("updated priority: got %q, wanted Low", got.Priority)
+	}
+}
+
+// TestSyncNoEcho checks that the second pass does not copy back the first pass' write.
+func TestSyncNoEcho(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "x", State: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := SyncOptions{States: StateMapping{Forward: StateMap{
+		Map:     map[it.State]it.State{"new": "open", "closed": "done"},
+		Default: "open",
+	}}}
+	if err = opts.States.init(); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// "in review" maps to the default "open", which maps back to "new".
+	if err = a.UpdateIssue(ctx, aID, it.IssueUpdate{
+		Issue:  it.Issue{Summary: "y", State: "in review"},
+		Fields: it.FieldSummary | it.FieldState,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	a.ResetCalls()
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.GetIssue(ctx, aID); got.Summary != "y" || got.State != "in review" {
+		t.Errorf("primary: got %q in %q, wanted y in \"in review\"", got.Summary, got.State)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Summary != "y" || got.State != "open" {
+		t.Errorf("secondary: got %q in %q, wanted y in open", got.Summary, got.State)
+	}
+	for _, m := range []string{"UpdateIssue", "UpdateIssueState"} {
+		if n := a.Count(m); n != 0 {
+			t.Errorf("%d calls of %s on the primary: %v", n, m, a.Calls())
+		}
+	}
+
+	// A real change on the secondary is still copied back.
+	if err = b.UpdateIssueState(ctx, "b-1", "done"); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, opts); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := a.GetIssue(ctx, aID); got.State != "closed" {
+		t.Errorf("primary: got %q, wanted closed", got.State)
+	}
+}
+
+// TestSyncBuckets checks that the sync markers and the user cache are kept apart.
+func TestSyncBuckets(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	b.AddUser(it.User{ID: "bob", Email: "bob@example.com"})
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "x", Author: it.User{ID: "b1", Email: "bob@example.com"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	const bucketU, bucketS = "mem:a\tmem:b\tU", "mem:a\tmem:b\tS"
+	if s, _ := db.Get(bucketU, "email:bob@example.com"); !strings.Contains(s, `"bob"`) {
+		t.Errorf("user cache: got %q, wanted bob", s)
+	}
+	if s, _ := db.Get(bucketU, string(aID)); s != "" {
+		t.Errorf("sync marker in the user cache: %q", s)
+	}
+	if s, _ := db.Get(bucketS, string(aID)); s == "" {
+		t.Errorf("no sync marker for %q", aID)
+	}
+
+	// Both are used by the next pass: the cached user is kept, the issue is not echoed.
+	a.ResetCalls()
+	if err = a.UpdateIssue(ctx, aID, it.IssueUpdate{Issue: it.Issue{Assignee: it.User{ID: "b1", Email: "bob@example.com"}}, Fields: it.FieldAssignee}); err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := b.GetIssue(ctx, "b-1"); got.Assignee.ID != "bob" {
+		t.Errorf("secondary assignee: got %+v, wanted bob", got.Assignee)
+	}
+	if n := a.Count("UpdateIssue"); n != 1 {
+		t.Errorf("%d calls of UpdateIssue on the primary, wanted only the test's: %v", n, a.Calls())
+	}
+}
+
+// TestSyncDryRunUpdate checks that the plan shows the state change of a tracker
+// which may not implement UpdateIssue.
+func TestSyncDryRunUpdate(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	aID, err := a.CreateIssue(ctx, it.Issue{Summary: "x", State: "new"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err = a.UpdateIssueState(ctx, aID, "closed"); err != nil {
+		t.Fatal(err)
+	}
+	b.NotImplemented("UpdateIssue")
+
+	var plan Plan
+	if err = Sync(ctx, plan.DB(db), plan.Tracker(a), plan.Tracker(b), SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, a := range plan.Actions {
+		if a.Op != OpStorePair {
+			got = append(got, a.String())
+		}
+	}
+	want := []string{
+		`mem:b: update state of "b-1"`,
+		`mem:b: or if it cannot update issues, set state of "b-1" to "closed"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %q, wanted %q", got, want)
+	}
+	if issue, _ := b.GetIssue(ctx, "b-1"); issue.State != "new" {
+		t.Errorf("the dry run changed the state to %q", issue.State)
+	}
+
+	// The real run sets the state alone.
+	if err = Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if issue, _ := b.GetIssue(ctx, "b-1"); issue.State != "closed" {
+		t.Errorf("got state %q, wanted closed", issue.State)
+	}
+}
+
+func TestSyncFailure(t *testing.T) {
+	ctx := context.Background()
+	a, b, db := newSyncPair(t)
+	for _, s := range []string{"first", "second"} {
+		if _, err := a.CreateIssue(ctx, it.Issue{Summary: s}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errBoom := errors.New("boom")
+	b.Inject(memtracker.Fault{Method: "CreateIssue", Nth: 2, Err: errBoom})
+	if err := Sync(ctx, db, a, b, SyncOptions{}); !errors.Is(err, errBoom) {
+		t.Fatalf("got %+v, wanted %v", err, errBoom)
+	}
+	if s, _ := db.Get("mem:a\tmem:b\tL", lastListKey); s != "" {
+		t.Errorf("last sync time is stored after a failed pass: %q", s)
+	}
+
+	// The next pass creates only the missing issue.
+	if err := Sync(ctx, db, a, b, SyncOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	issues, _ := b.ListIssues(ctx, zeroTime)
+	var summaries []string
+	for _, issue := range issues {
+		summaries = append(summaries, issue.Summary)
+	}
+	if got := strings.Join(summaries, ","); got != "first,second" {
+		t.Errorf("got %q, wanted first,second", got)
+	}
+
+	// A failing tracker fails the pass.
+	b.Inject(memtracker.Fault{Method: "ListIssues", Err: context.Canceled})
+	if err := Sync(ctx, db, a, b, SyncOptions{Full: true}); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %+v, wanted Canceled", err)
+	}
+}
+
+var zeroTime time.Time
+
+func body(s string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) { return ioutil.NopCloser(strings.NewReader(s)), nil }
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// UserPair is an explicit pairing of a primary and a secondary user,
+// matched by ID or (case insensitive) email.
+type UserPair struct {
+	Primary   it.User `json:"primary"`
+	Secondary it.User `json:"secondary"`
+}
+
+// UserMapper maps the users of one tracker to the users of the other.
+//
+// The explicit overrides are checked first, then the cache (stored in the DB),
+// and last the target tracker is asked for a user with the same email.
+// The unmappable users are returned without ID.
+type UserMapper struct {
+	db        it.DB
+	from, to  it.Tracker
+	bucket    string
+	overrides map[string]it.User
+
+	mu   sync.Mutex
+	memo map[string]it.User
+}
+
+// NewUserMappers returns the mappers for both directions, from primary to secondary and back.
+func NewUserMappers(db it.DB, primary, secondary it.Tracker, pairs []UserPair) (forward, backward *UserMapper) {
+	forward = newUserMapper(db, primary, secondary)
+	backward = newUserMapper(db, secondary, primary)
+	for _, p := range pairs {
+		forward.override(p.Primary, p.Secondary)
+		backward.override(p.Secondary, p.Primary)
+	}
+	return forward, backward
+}
+
+func newUserMapper(db it.DB, from, to it.Tracker) *UserMapper {
+	return &UserMapper{
+		db: db, from: from, to: to,
+		bucket:    string(from.ID() + "\t" + to.ID() + "\tU"),
+		overrides: make(map[string]it.User),
+		memo:      make(map[string]it.User),
+	}
+}
+
+func (m *UserMapper) override(from, to it.User) {
+	for _, k := range userKeys(from) {
+		m.overrides[k] = to
+	}
+}
+
+func userKeys(u it.User) []string {
+	keys := make([]string, 0, 2)
+	if u.ID != "" {
+		keys = append(keys, "id:"+string(u.ID))
+	}
+	if u.Email != "" {
+		keys = append(keys, "email:"+strings.ToLower(u.Email))
+	}
+	return keys
+}
+
+// Map returns the user of the target tracker for u.
+//
+// A nil UserMapper, or a user that cannot be mapped returns u without its ID,
+// as that ID is meaningless on the target tracker.
+func (m *UserMapper) Map(ctx context.Context, u it.User) (it.User, error) {
+	unmapped := it.User{RealName: u.RealName, Email: u.Email}
+	keys := userKeys(u)
+	if m == nil || len(keys) == 0 {
+		return unmapped, nil
+	}
+	for _, k := range keys {
+		if v, ok := m.overrides[k]; ok {
+			return v, nil
+		}
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, k := range keys {
+		if v, ok := m.memo[k]; ok {
+			return v, nil
+		}
+	}
+	for _, k := range keys {
+		s, err := m.db.Get(m.bucket, k)
+		if err != nil && !errors.Is(err, it.ErrNotImplemented) {
+			return unmapped, err
+		}
+		if s == "" {
+			continue
+		}
+		var v it.User
+		if err := json.Unmarshal([]byte(s), &v); err != nil {
+			return unmapped, fmt.Errorf("parse cached user %q: %w", s, err)
+		}
+		m.remember(keys, v)
+		return v, nil
+	}
+
+	if u.Email == "" {
+		m.remember(keys, unmapped)
+		return unmapped, nil
+	}
+	v, err := m.to.FindUser(ctx, u.Email)
+	if err != nil {
+		if errors.Is(err, it.ErrNotFound) || errors.Is(err, it.ErrNotImplemented) {
+			m.remember(keys, unmapped)
+			return unmapped, nil
+		}
+		return unmapped, fmt.Errorf("findUser(%q): %w", u.Email, err)
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return unmapped, err
+	}
+	items := make([]it.DBItem, len(keys))
+	for i, k := range keys {
+		items[i] = it.DBItem{Bucket: m.bucket, Key: k, Value: string(b)}
+	}
+	if err = m.db.PutN(items...); err != nil {
+		return unmapped, err
+	}
+	m.remember(keys, v)
+	return v, nil
+}
+
+// remember caches the result for this run only, so misses are retried on the next run.
+func (m *UserMapper) remember(keys []string, u it.User) {
+	for _, k := range keys {
+		m.memo[k] = u
+	}
+}
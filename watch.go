@@ -0,0 +1,72 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it"
+)
+
+// WatchOptions modifies the behaviour of Watch.
+type WatchOptions struct {
+	// Interval is the time between the start of two successful passes.
+	Interval time.Duration
+	// MaxBackoff caps the exponentially growing wait after failed passes.
+	MaxBackoff time.Duration
+}
+
+// Watch calls Sync every opts.Interval, until ctx is canceled.
+//
+// The first retry after a failed pass waits opts.Interval, each further one twice the previous,
+// up to opts.MaxBackoff; the wait is reset after the next successful pass.
+// Cancelation is not an error: Sync stops between issues, and Watch returns nil.
+func Watch(ctx context.Context, db it.DB, primary, secondary it.Tracker, syncOpts SyncOptions, opts WatchOptions) error {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Minute
+	}
+	if opts.MaxBackoff < opts.Interval {
+		opts.MaxBackoff = opts.Interval
+	}
+	backoff := opts.Interval
+	for {
+		start := time.Now()
+		err := Sync(ctx, db, primary, secondary, syncOpts)
+		if ctx.Err() != nil {
+			return nil
+		}
+		wait := opts.Interval - time.Since(start)
+		if err != nil {
+			log.Printf("sync %s <-> %s: %+v", primary.ID(), secondary.ID(), err)
+			wait = backoff
+			log.Printf("retrying in %s", wait)
+			if backoff *= 2; backoff > opts.MaxBackoff {
+				backoff = opts.MaxBackoff
+			}
+		} else {
+			// A forced full resync is needed only once.
+			syncOpts.Full = false
+			backoff = opts.Interval
+		}
+		if !watchSleep(ctx, wait) {
+			return nil
+		}
+	}
+}
+
+// watchSleep waits d, and reports false if ctx is canceled meanwhile.
+var watchSleep = func(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return false
+	case <-timer.C:
+		return true
+	}
+}
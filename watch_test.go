@@ -0,0 +1,48 @@
+// Copyright 2020 Tamás Gulácsi. All rights reserved.
+//
+//
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/UNO-SOFT/mantisync/it/memtracker"
+)
+
+func TestWatchBackoff(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a, b, db := newSyncPair(t)
+	a.Inject(memtracker.Fault{Method: "ListIssues", Err: errors.New("down")})
+
+	var waits []time.Duration
+	oldSleep := watchSleep
+	defer func() { watchSleep = oldSleep }()
+	watchSleep = func(ctx context.Context, d time.Duration) bool {
+		if waits = append(waits, d); len(waits) == 5 {
+			a.ClearFaults()
+		} else if len(waits) == 6 {
+			cancel()
+			return false
+		}
+		return true
+	}
+
+	if err := Watch(ctx, db, a, b, SyncOptions{}, WatchOptions{Interval: time.Minute, MaxBackoff: 5 * time.Minute}); err != nil {
+		t.Fatal(err)
+	}
+	// The first retry waits the interval; after a successful pass the wait is
+	// the rest of the interval.
+	if got, want := waits[:5], []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute, 5 * time.Minute, 5 * time.Minute}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, wanted %v", got, want)
+	}
+	if len(waits) != 6 || waits[5] > time.Minute {
+		t.Errorf("got %v, wanted at most a minute after the success", waits)
+	}
+}